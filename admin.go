@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Clients connecting to this database talk to pgspanner itself rather
+// than to a backend cluster
+const (
+	ADMIN_DATABASE_NAME = "pgspanner"
+)
+
+// The result of an admin command. It is sent to the client as a set of
+// text columns
+type adminResult struct {
+	Columns []string
+	Rows    [][]string
+	Tag     string
+}
+
+type adminCommand func(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error)
+
+func getAdminCommands() map[string]adminCommand {
+	return map[string]adminCommand{
+		"SHOW HEALTH":            adminShowHealth,
+		"RELOAD":                 adminReload,
+		"CHECK REFERENCE TABLES": adminCheckReferenceTables,
+		"SHOW SCHEMA DRIFT":      adminShowSchemaDrift,
+		"MOVE KEYRANGE":          adminMoveKeyRange,
+		"SHOW MOVES":             adminShowMoves,
+		"CANCEL MOVE":            adminCancelMove,
+		"SHOW SHARD MAP":         adminShowShardMap,
+		"BACKFILL LOOKUP":        adminBackfillLookup,
+		"SHOW SHADOW":            adminShowShadow,
+		"SHOW SHADOW MISMATCHES": adminShowShadowMismatches,
+	}
+}
+
+// Split a command into the registered command name and its arguments.
+// Longer command names take priority over shorter ones
+func parseAdminCommand(query string) (adminCommand, []string, bool) {
+	query = strings.TrimSpace(query)
+	query = strings.TrimSuffix(query, ";")
+	words := strings.Fields(query)
+	commands := getAdminCommands()
+	for i := len(words); i > 0; i-- {
+		name := strings.ToUpper(strings.Join(words[:i], " "))
+		if command, ok := commands[name]; ok {
+			return command, words[i:], true
+		}
+	}
+	return nil, nil, false
+}
+
+func buildAdminError(code string, message string) *protocol.ErrorResponsePgMessage {
+	return protocol.BuildErrorResponsePgMessage(map[string]string{
+		protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "ERROR",
+		protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "ERROR",
+		protocol.NOTICE_KIND_CODE:                  code,
+		protocol.NOTICE_KIND_MESSAGE:               message,
+	})
+}
+
+func (r *adminResult) Pack() []byte {
+	out := make([]byte, 0, 1024)
+	if len(r.Columns) > 0 {
+		out = append(out, protocol.BuildTextRowDescriptionPgMessage(r.Columns).Pack()...)
+		for _, row := range r.Rows {
+			values := make([][]byte, len(row))
+			for i, value := range row {
+				values[i] = []byte(value)
+			}
+			out = append(out, protocol.BuildDataRowPgMessage(values).Pack()...)
+		}
+	}
+	out = append(out, protocol.BuildCommandCompletePgMessage(r.Tag).Pack()...)
+	out = append(out, protocol.BuildReadyForQueryPgMessage(byte(TRANSACTION_STATUS_IDLE)).Pack()...)
+	return out
+}
+
+func handleAdminQuery(
+	query string,
+	client *ClientConnection,
+	config *SpannerConfig,
+	requester *ConnectionRequester,
+) {
+	command, args, ok := parseAdminCommand(query)
+	if !ok {
+		slog.Warn("Unknown admin command", "query", query)
+		client.Write(buildErrorResponsePacket(buildAdminError("42601", fmt.Sprintf("Unknown admin command: %s", query))))
+		return
+	}
+
+	result, err := command(args, config, requester)
+	if err != nil {
+		slog.Error("Error running admin command", "query", query, "error", err)
+		errMsg, ok := err.(*protocol.ErrorResponsePgMessage)
+		if !ok {
+			errMsg = buildAdminError("XX000", err.Error())
+		}
+		client.Write(buildErrorResponsePacket(errMsg))
+		return
+	}
+	client.Write(result.Pack())
+}
+
+func AdminConnectionLoop(
+	client *ClientConnection,
+	requester *ConnectionRequester,
+) {
+	slog.Info("Admin console session started", "clientPid", client.Ctx.ClientPid)
+	client.Write(configPacketShim(client.Ctx))
+	for {
+		rawMessage, err := protocol.GetRawPgMessage(client.Conn)
+		if err != nil {
+			slog.Error("Error reading message from admin client", "error", err)
+			return
+		}
+		if !client.StartRequest() {
+			return
+		}
+
+		switch rawMessage.Kind {
+		case protocol.FMESSAGE_QUERY:
+			queryPgMessage := &protocol.QueryPgMessage{}
+			queryPgMessage, err := queryPgMessage.Unpack(rawMessage)
+			if err != nil {
+				slog.Error("Error unpacking admin query", "error", err)
+				return
+			}
+			slog.Info("Recieved Admin Command", "query", queryPgMessage.Query)
+			handleAdminQuery(queryPgMessage.Query, client, requester.GetConfig(), requester)
+		case protocol.FMESSAGE_TERMINATE:
+			slog.Info("Terminating admin connection", "clientPid", client.Ctx.ClientPid)
+			return
+		default:
+			slog.Warn("Unsupported message kind in admin console", "kind", fmt.Sprint(rawMessage.Kind))
+		}
+		if !client.FinishRequest() {
+			return
+		}
+	}
+}
+
+func formatAdminTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func adminShowHealth(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	response := requester.RequestClusterHealth()
+	if response.Result != RESULT_SUCCESS {
+		return nil, response.Detail
+	}
+	result := &adminResult{
+		Columns: []string{"database", "cluster", "role", "state", "in_recovery", "failures", "replication_lag", "last_check", "next_check", "last_error"},
+		Rows:    make([][]string, 0, len(response.Health)),
+	}
+	for _, health := range response.Health {
+		role := "primary"
+		if health.IsReplica {
+			role = "replica"
+		}
+		result.Rows = append(result.Rows, []string{
+			health.DatabaseName,
+			health.ClusterAddr,
+			role,
+			health.State,
+			fmt.Sprint(health.InRecovery),
+			fmt.Sprint(health.ConsecutiveFailures),
+			fmt.Sprintf("%.3f", health.ReplicationLag),
+			formatAdminTime(health.LastCheck),
+			formatAdminTime(health.NextCheck),
+			health.LastError,
+		})
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
+
+func adminReload(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	changes, err := ReloadConfig(requester)
+	if err != nil {
+		return nil, buildAdminError("F0000", err.Error())
+	}
+	result := &adminResult{
+		Columns: []string{"action", "database", "cluster", "detail"},
+		Rows:    make([][]string, 0, len(changes)),
+		Tag:     "RELOAD",
+	}
+	for _, change := range changes {
+		result.Rows = append(result.Rows, []string{change.Action, change.Database, change.Cluster, change.Detail})
+	}
+	return result, nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/livinlefevreloca/pgspanner/protocol"
 )
@@ -11,10 +15,18 @@ type ClientConnectionContext struct {
 	DatabaseName string
 	User         string
 	Options      map[string]string
-	Database     *DatabaseConfig
+	Database     *DatabaseConfig `json:"-"`
 	SSL          bool
+	// Address of the client. When it connects through a load balancer
+	// this is the address from the PROXY protocol header
+	ClientAddr   string
 	ClientPid    int
 	ClientSecret int
+	// The tenant the session runs as and the search_path it set. Both
+	// are kept by the proxy so they survive returning connections to
+	// the pool
+	Tenant     string `json:",omitempty"`
+	SearchPath string `json:",omitempty"`
 }
 
 func NewClientConnectionContext(
@@ -30,6 +42,7 @@ func NewClientConnectionContext(
 		SSL:          false,
 		ClientPid:    clientPid,
 		ClientSecret: clientPid,
+		Tenant:       getStartupTenant(message.Options),
 	}
 	return connCtx
 }
@@ -37,6 +50,198 @@ func NewClientConnectionContext(
 type ClientConnection struct {
 	Conn net.Conn
 	Ctx  *ClientConnectionContext
+	// Server connections held by the client while it has a transaction
+	// open, keyed by the address of the cluster's primary
+	pinned map[string]*ServerConnection
+	// A BEGIN statement that has not been sent to a server yet
+	pendingBegin string
+	// Guards busy and closed so the shutdown coordinator can safely
+	// disconnect the client from another goroutine
+	mu     sync.Mutex
+	busy   bool
+	closed bool
+	// The error to disconnect the client with once its request is done
+	terminating *protocol.ErrorResponsePgMessage
+	// Bytes read of the message currently being received
+	received int
+}
+
+// Mark the client as running a request. Returns false if the client has
+// already been disconnected
+func (c *ClientConnection) StartRequest() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.busy = true
+	return true
+}
+
+// Mark the client's request as done. A client terminated while running
+// it is disconnected now. Returns false if the client was disconnected
+func (c *ClientConnection) FinishRequest() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = false
+	if c.terminating != nil && !c.closed {
+		c.Conn.Write(c.terminating.Pack())
+		c.closed = true
+		c.Conn.Close()
+	}
+	return !c.closed
+}
+
+// Mark the client as gone so it is no longer touched by the shutdown
+// coordinator while its connections are released
+func (c *ClientConnection) MarkClosed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// Whether the client holds an open transaction. Only safe to call from
+// the connection loop or while holding mu with the client idle
+func (c *ClientConnection) InTransaction() bool {
+	return len(c.pinned) > 0 || c.pendingBegin != ""
+}
+
+// The transaction status to tell the client. The transaction has failed
+// as soon as it failed on one of its shards
+func (c *ClientConnection) TransactionStatus() byte {
+	if !c.InTransaction() {
+		return TRANSACTION_STATUS_IDLE
+	}
+	statuses := []byte{TRANSACTION_STATUS_ACTIVE}
+	for _, server := range c.pinned {
+		statuses = append(statuses, server.GetTransactionStatus())
+	}
+	return combineTransactionStatus(statuses)
+}
+
+// Send the client a fatal error and close its connection. Unless forced
+// a client that is running a request or is inside a transaction is left
+// alone. A forced client running a request is sent the error once the
+// response it is getting is complete, see FinishRequest. Returns whether
+// the client was or will be disconnected
+func (c *ClientConnection) Terminate(errMsg *protocol.ErrorResponsePgMessage, force bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if !force && (c.busy || c.InTransaction()) {
+		return false
+	}
+	// Never interleave the error with a response that is being relayed
+	if c.busy {
+		c.terminating = errMsg
+		return true
+	}
+	c.Conn.Write(errMsg.Pack())
+	c.closed = true
+	c.Conn.Close()
+	return true
+}
+
+// Whether the client was terminated while running a request it has not
+// finished yet
+func (c *ClientConnection) IsTerminating() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.terminating != nil && !c.closed
+}
+
+// Close the client's connection without a word, for clients that did
+// not finish their request in time after being terminated. Returns
+// whether the connection was still open
+func (c *ClientConnection) Abort() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	c.Conn.Close()
+	return true
+}
+
+// Whether the client's transaction spans more than one shard
+func (c *ClientConnection) InMultiShardTransaction() bool {
+	return len(c.pinned) > 1
+}
+
+func (c *ClientConnection) GetPinnedConnection(clusterAddr string) (*ServerConnection, bool) {
+	server, ok := c.pinned[clusterAddr]
+	return server, ok
+}
+
+func (c *ClientConnection) PinConnection(clusterAddr string, server *ServerConnection) {
+	if c.pinned == nil {
+		c.pinned = make(map[string]*ServerConnection)
+	}
+	c.pinned[clusterAddr] = server
+}
+
+func (c *ClientConnection) UnpinConnection(clusterAddr string) {
+	delete(c.pinned, clusterAddr)
+}
+
+// Whether the client's socket can be passed to another process
+func (c *ClientConnection) CanHandOff() bool {
+	return !c.Ctx.SSL && c.Ctx.DatabaseName != ADMIN_DATABASE_NAME
+}
+
+// Wake up the client's goroutine if it is waiting for the next message
+// from an idle client
+func (c *ClientConnection) Interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.busy || c.InTransaction() {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// Pass the client's socket to a new process. Returns false without an
+// error if the client is busy and has to be handed off later
+func (c *ClientConnection) HandOff(handoff *handoffConn) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.busy || c.InTransaction() {
+		return false, nil
+	}
+	conn, ok := c.Conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return false, errors.New("client connection has no file descriptor")
+	}
+	file, err := conn.File()
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if err := handoff.send(handoffMessage{Kind: HANDOFF_MESSAGE_CLIENT, Client: c.Ctx}, file); err != nil {
+		return false, err
+	}
+	c.closed = true
+	c.Conn.Close()
+	return true, nil
+}
+
+// Return any server connections still held by the client to the pool.
+// Called when the client goes away, possibly mid transaction
+func (c *ClientConnection) ReleaseConnections(requester *ConnectionRequester) {
+	for shardAddr, server := range c.pinned {
+		serverAddr := server.GetClusterConfig().GetAddr()
+		slog.Info(
+			"Releasing pinned connection",
+			"Cluster", serverAddr,
+			"BackendPid", server.GetBackendPid(),
+			"ClientPid", c.Ctx.ClientPid,
+		)
+		requester.ReturnConnection(server, c.Ctx.DatabaseName, serverAddr, c.Ctx.ClientPid)
+		delete(c.pinned, shardAddr)
+	}
 }
 
 // Implement Writer interface for ClientConnection
@@ -49,12 +254,24 @@ func (c *ClientConnection) Write(data []byte) (int, error) {
 	}
 }
 
-// Implement Reader interface for ClientConnection
+// Implement Reader interface for ClientConnection. An interrupt only
+// stops the wait for the next message, a message that has started to
+// arrive is read to its end so the client is let go between messages
 func (c *ClientConnection) Read(data []byte) (int, error) {
-	if n, err := c.Conn.Read(data); err != nil {
-		slog.Error("Error reading from client connection: ", "error", err)
-		return n, err
-	} else {
+	n, err := c.Conn.Read(data)
+	c.received += n
+	if errors.Is(err, os.ErrDeadlineExceeded) && c.received > 0 {
+		c.Conn.SetReadDeadline(time.Time{})
+		if n == 0 {
+			return c.Read(data)
+		}
 		return n, nil
 	}
+	if err != nil {
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.Error("Error reading from client connection: ", "error", err)
+		}
+		return n, err
+	}
+	return n, nil
 }
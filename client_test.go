@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+func TestInterruptBetweenMessages(t *testing.T) {
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	client := &ClientConnection{Conn: proxyEnd, Ctx: &ClientConnectionContext{}}
+
+	// A client waiting for its next message is woken up
+	client.Interrupt()
+	if _, err := protocol.GetRawPgMessage(client); !errors.Is(err, os.ErrDeadlineExceeded) || client.received != 0 {
+		t.Fatalf("Expected an idle client to be interrupted, got %v", err)
+	}
+	proxyEnd.SetReadDeadline(time.Time{})
+
+	// A message that has started to arrive is read whole
+	query := protocol.BuildQueryMessage("SELECT 1").Pack()
+	go func() {
+		clientEnd.Write(query[:3])
+		client.Interrupt()
+		clientEnd.Write(query[3:])
+	}()
+	rm, err := protocol.GetRawPgMessage(client)
+	if err != nil {
+		t.Fatalf("Expected the message to be read despite the interrupt, got %v", err)
+	}
+	if rm.Kind != protocol.FMESSAGE_QUERY || client.received != len(query) {
+		t.Fatalf("Expected the whole query, got %c after %d bytes", rm.Kind, client.received)
+	}
+}
@@ -1,6 +1,23 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"time"
+)
+
+// A read only replica of a cluster. Replicas share the name
+// and credentials of their primary
+type ReplicaConfig struct {
+	Host string
+	Port int
+}
+
+func (r *ReplicaConfig) GetAddr() string {
+	return fmt.Sprintf("%s:%d", r.Host, r.Port)
+}
 
 type ClusterConfig struct {
 	Name        string
@@ -8,34 +25,371 @@ type ClusterConfig struct {
 	Port        int
 	User        string
 	PasswordEnv string
+	Replicas    []ReplicaConfig
+	// Range of keyspace ids stored on the cluster when the database is
+	// sharded. Empty means the whole keyspace and "none" no keyspace ids
+	// at all
+	KeyRange string
 }
 
 func (c *ClusterConfig) display() string {
-	return "Cluster: " + c.Name + " Host: " + c.Host + " Port: " + fmt.Sprint(c.Port) + " User: " + c.User + " PasswordEnv: " + c.PasswordEnv
+	confStr := "Cluster: " + c.Name + " Host: " + c.Host + " Port: " + fmt.Sprint(c.Port) + " User: " + c.User + " PasswordEnv: " + c.PasswordEnv
+	for _, r := range c.Replicas {
+		confStr += " Replica: " + r.GetAddr()
+	}
+	if c.KeyRange != "" {
+		confStr += " KeyRange: " + c.KeyRange
+	}
+	return confStr
+}
+
+func (c *ClusterConfig) GetKeyRange() (KeyRange, error) {
+	return ParseKeyRange(c.KeyRange)
 }
 
 func (c *ClusterConfig) GetAddr() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
 
+// A host starting with a slash is the directory of the cluster's unix
+// socket, like the host parameter of libpq
+func (c *ClusterConfig) IsUnixSocket() bool {
+	return filepath.IsAbs(c.Host)
+}
+
+// Get the network and address to dial to reach the cluster
+func (c *ClusterConfig) GetNetworkAddr() (string, string) {
+	if c.IsUnixSocket() {
+		return "unix", unixSocketPath(c.Host, c.Port)
+	}
+	return "tcp", c.GetAddr()
+}
+
+// Get a cluster config for each of the cluster's replicas so they
+// can be connected to like any other cluster
+func (c *ClusterConfig) GetReplicaConfigs() []ClusterConfig {
+	replicas := make([]ClusterConfig, 0, len(c.Replicas))
+	for _, r := range c.Replicas {
+		replica := *c
+		replica.Host = r.Host
+		replica.Port = r.Port
+		replica.Replicas = nil
+		replicas = append(replicas, replica)
+	}
+	return replicas
+}
+
+const (
+	DEFAULT_RESET_QUERY            = "DISCARD ALL"
+	DEFAULT_HEALTH_CHECK_IDLE_TIME = 30
+)
+
 type PoolConfig struct {
 	MaxOpenConns     int
 	MaxIdleConns     int
 	MaxConnLifetime  int
 	IdleConnLifetime int
+	// Query run against a connection before it is returned to the pool
+	ResetQuery string
+	// Seconds a connection may sit idle in the pool before it is
+	// checked for liveness when handed out
+	HealthCheckIdleTime int
+}
+
+func (p *PoolConfig) GetResetQuery() string {
+	if p.ResetQuery == "" {
+		return DEFAULT_RESET_QUERY
+	}
+	return p.ResetQuery
+}
+
+func (p *PoolConfig) GetHealthCheckIdleTime() int {
+	if p.HealthCheckIdleTime <= 0 {
+		return DEFAULT_HEALTH_CHECK_IDLE_TIME
+	}
+	return p.HealthCheckIdleTime
 }
 
 func (p *PoolConfig) display() string {
-	return "MaxOpenConns: " + fmt.Sprint(p.MaxOpenConns) + " MaxIdleConns: " + fmt.Sprint(p.MaxIdleConns) + " MaxConnLifetime: " + fmt.Sprint(p.MaxConnLifetime) + " IdleConnLifetime: " + fmt.Sprint(p.IdleConnLifetime)
+	return "MaxOpenConns: " + fmt.Sprint(p.MaxOpenConns) + " MaxIdleConns: " + fmt.Sprint(p.MaxIdleConns) + " MaxConnLifetime: " + fmt.Sprint(p.MaxConnLifetime) + " IdleConnLifetime: " + fmt.Sprint(p.IdleConnLifetime) + " ResetQuery: " + p.GetResetQuery() + " HealthCheckIdleTime: " + fmt.Sprint(p.GetHealthCheckIdleTime())
 }
 
+// How read only queries are distributed across replicas
+const (
+	READ_ROUTING_PRIMARY           = "primary"
+	READ_ROUTING_ROUND_ROBIN       = "round_robin"
+	READ_ROUTING_LEAST_CONNECTIONS = "least_connections"
+)
+
+// A table whose rows are spread across the clusters of a database by
+// the value of its shard key column
+type TableConfig struct {
+	Name     string
+	ShardKey string
+	// The type of the shard key column, one of SHARD_KEY_TYPE_*. Defaults
+	// to text
+	ShardKeyType string
+	// Column filled in with an id generated by the proxy when an INSERT
+	// does not set it
+	IdColumn string
+	// A reference table has a full copy on every cluster instead of being
+	// spread across them. It has no shard key
+	Reference bool
+	// Columns with a lookup table mapping their values to shard keys
+	Lookups []LookupConfig
+}
+
+// Types of shard key columns. A shard key is hashed in the text
+// postgres prints for it, which the type decides
+const (
+	SHARD_KEY_TYPE_TEXT    = "text"
+	SHARD_KEY_TYPE_INTEGER = "integer"
+	SHARD_KEY_TYPE_UUID    = "uuid"
+)
+
+func (t *TableConfig) GetShardKeyType() string {
+	if t.ShardKeyType == "" {
+		return SHARD_KEY_TYPE_TEXT
+	}
+	return t.ShardKeyType
+}
+
+// Columns of a lookup table. The table is sharded by its value column
+const (
+	LOOKUP_VALUE_COLUMN = "value"
+	LOOKUP_KEY_COLUMN   = "key"
+)
+
+// A secondary index of a sharded table. The proxy keeps a table mapping
+// every value of the column to the shard keys of the rows holding it so
+// queries on the column can be sent to a single cluster
+type LookupConfig struct {
+	Column string
+	// Defaults to <table>_<column>_lookup
+	Table string
+}
+
+func (l *LookupConfig) GetTable(table *TableConfig) string {
+	if l.Table == "" {
+		return table.Name + "_" + l.Column + "_lookup"
+	}
+	return l.Table
+}
+
+func (t *TableConfig) GetLookup(column string) (*LookupConfig, bool) {
+	for i := range t.Lookups {
+		if t.Lookups[i].Column == column {
+			return &t.Lookups[i], true
+		}
+	}
+	return nil, false
+}
+
+// Sessions of a tenant all run on the cluster the tenant lives on. The
+// tenant is given with the pgspanner.tenant startup option or SET
+// pgspanner.tenant, or taken from the first schema of search_path
+type TenantConfig struct {
+	Enabled bool
+	// Table on the first cluster mapping tenants to the address of their
+	// cluster. Tenants it does not list live on the cluster owning the
+	// keyspace id of their name
+	DirectoryTable string
+	// Take the tenant from search_path when the session sets none
+	FromSearchPath bool
+}
+
+// Columns of the tenant directory table
+const (
+	TENANT_DIRECTORY_TENANT_COLUMN  = "tenant"
+	TENANT_DIRECTORY_CLUSTER_COLUMN = "cluster"
+)
+
+// A cluster that is not serving yet, like new hardware, getting a copy
+// of a sample of the reads of another cluster to compare with
+type ShadowConfig struct {
+	Cluster ClusterConfig
+	// host:port of the cluster whose reads are mirrored. Defaults to the
+	// first cluster
+	Source string
+	// Percent of the reads mirrored
+	SampleRate float64
+	// Connections to the shadow cluster
+	MaxConns int
+	// Mirrored reads waiting for a connection beyond which more are
+	// dropped
+	QueueSize int
+	// How many times slower than the source a mirrored read may be
+	// before it counts as a mismatch
+	MaxLatencyRatio float64
+}
+
+const (
+	DEFAULT_SHADOW_MAX_CONNS         = 2
+	DEFAULT_SHADOW_QUEUE_SIZE        = 100
+	DEFAULT_SHADOW_MAX_LATENCY_RATIO = 2
+)
+
+func (s *ShadowConfig) Enabled() bool {
+	return s.Cluster.Host != "" && s.SampleRate > 0
+}
+
+func (s *ShadowConfig) GetSource(database *DatabaseConfig) string {
+	if s.Source == "" && len(database.Clusters) > 0 {
+		return database.Clusters[0].GetAddr()
+	}
+	return s.Source
+}
+
+func (s *ShadowConfig) GetMaxConns() int {
+	if s.MaxConns == 0 {
+		return DEFAULT_SHADOW_MAX_CONNS
+	}
+	return s.MaxConns
+}
+
+func (s *ShadowConfig) GetQueueSize() int {
+	if s.QueueSize == 0 {
+		return DEFAULT_SHADOW_QUEUE_SIZE
+	}
+	return s.QueueSize
+}
+
+func (s *ShadowConfig) GetMaxLatencyRatio() float64 {
+	if s.MaxLatencyRatio == 0 {
+		return DEFAULT_SHADOW_MAX_LATENCY_RATIO
+	}
+	return s.MaxLatencyRatio
+}
+
+func (s *ShadowConfig) display(database *DatabaseConfig) string {
+	return "Shadow: " + s.Cluster.display() + " Source: " + s.GetSource(database) +
+		" SampleRate: " + fmt.Sprint(s.SampleRate) + " MaxConns: " + fmt.Sprint(s.GetMaxConns()) +
+		" QueueSize: " + fmt.Sprint(s.GetQueueSize()) + " MaxLatencyRatio: " + fmt.Sprint(s.GetMaxLatencyRatio())
+}
+
+const DEFAULT_MAX_HASH_JOIN_MEMORY = 64
+
 type DatabaseConfig struct {
 	Name         string
 	Clusters     []ClusterConfig
+	Tables       []TableConfig
+	Tenants      TenantConfig
+	Shadow       ShadowConfig
 	AuthMethod   string
 	SSL          bool
 	ShouldPool   bool
 	PoolSettings PoolConfig
+	ReadRouting  string
+	// Seconds a replica may lag behind its primary before reads
+	// stop being routed to it. Zero disables the check
+	MaxReplicationLag int
+	// Megabytes of rows a join run by the proxy may hold in memory
+	MaxHashJoinMemory int
+}
+
+func (d *DatabaseConfig) GetMaxHashJoinMemory() int {
+	if d.MaxHashJoinMemory == 0 {
+		return DEFAULT_MAX_HASH_JOIN_MEMORY
+	}
+	return d.MaxHashJoinMemory
+}
+
+func (d *DatabaseConfig) GetReadRouting() string {
+	if d.ReadRouting == "" {
+		return READ_ROUTING_PRIMARY
+	}
+	return d.ReadRouting
+}
+
+// Whether the database spreads tables across its clusters
+func (d *DatabaseConfig) IsSharded() bool {
+	for _, t := range d.Tables {
+		if !t.Reference {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the tables spread across the clusters, including the lookup
+// tables which are sharded by their value
+func (d *DatabaseConfig) GetShardedTables() []TableConfig {
+	tables := make([]TableConfig, 0, len(d.Tables))
+	for _, t := range d.Tables {
+		if t.Reference {
+			continue
+		}
+		tables = append(tables, t)
+		for _, lookup := range t.Lookups {
+			tables = append(tables, TableConfig{Name: lookup.GetTable(&t), ShardKey: LOOKUP_VALUE_COLUMN})
+		}
+	}
+	return tables
+}
+
+// Get the tables copied to every cluster
+func (d *DatabaseConfig) GetReferenceTables() []TableConfig {
+	tables := make([]TableConfig, 0)
+	for _, t := range d.Tables {
+		if t.Reference {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+func (d *DatabaseConfig) GetTableConfig(name string) (*TableConfig, bool) {
+	for _, t := range d.Tables {
+		if t.Name == name {
+			return &t, true
+		}
+	}
+	return nil, false
+}
+
+// Get the config of a table referenced in a query, possibly with its
+// schema. Tables are matched with and without the schema
+func (d *DatabaseConfig) GetRelationTableConfig(schema string, table string) (*TableConfig, bool) {
+	if schema != "" {
+		if tableConfig, ok := d.GetTableConfig(schema + "." + table); ok {
+			return tableConfig, true
+		}
+	}
+	return d.GetTableConfig(table)
+}
+
+// Get the cluster owning the keyspace id
+func (d *DatabaseConfig) GetClusterForKeyspaceId(id uint64) (*ClusterConfig, bool) {
+	for i := range d.Clusters {
+		keyRange, err := d.Clusters[i].GetKeyRange()
+		if err == nil && keyRange.Contains(id) {
+			return &d.Clusters[i], true
+		}
+	}
+	return nil, false
+}
+
+// Whether read only queries may be sent to replicas
+func (d *DatabaseConfig) UsesReplicas() bool {
+	if d.GetReadRouting() == READ_ROUTING_PRIMARY {
+		return false
+	}
+	for _, c := range d.Clusters {
+		if len(c.Replicas) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the configs for every host of the database, primaries and replicas
+func (d *DatabaseConfig) GetAllClusterConfigs() []ClusterConfig {
+	clusters := make([]ClusterConfig, 0, len(d.Clusters))
+	for _, c := range d.Clusters {
+		clusters = append(clusters, c)
+		clusters = append(clusters, c.GetReplicaConfigs()...)
+	}
+	return clusters
 }
 
 func (d *DatabaseConfig) display() string {
@@ -48,13 +402,26 @@ func (d *DatabaseConfig) display() string {
 	confStr += "AuthMethod: " + d.AuthMethod + "\n"
 	confStr += "SSL: " + fmt.Sprint(d.SSL) + "\n"
 	confStr += "ShouldPool: " + fmt.Sprint(d.ShouldPool) + "\n"
+	confStr += "ReadRouting: " + d.GetReadRouting() + "\n"
+	confStr += "MaxReplicationLag: " + fmt.Sprint(d.MaxReplicationLag) + "\n"
+	confStr += "MaxHashJoinMemory: " + fmt.Sprint(d.GetMaxHashJoinMemory()) + "\n"
+	for _, t := range d.Tables {
+		confStr += "Table: " + t.Name + " ShardKey: " + t.ShardKey + " IdColumn: " + t.IdColumn + " Reference: " + fmt.Sprint(t.Reference) + "\n"
+		for _, l := range t.Lookups {
+			confStr += "  Lookup: " + l.Column + " Table: " + l.GetTable(&t) + "\n"
+		}
+	}
+	confStr += "Tenants: Enabled: " + fmt.Sprint(d.Tenants.Enabled) + " DirectoryTable: " + d.Tenants.DirectoryTable + " FromSearchPath: " + fmt.Sprint(d.Tenants.FromSearchPath) + "\n"
+	if d.Shadow.Enabled() {
+		confStr += d.Shadow.display(d) + "\n"
+	}
 	confStr += "[[ PoolSettings ]]\n"
 	confStr += d.PoolSettings.display() + "\n"
 	return confStr
 }
 
 func (d *DatabaseConfig) GetClusterConfigByHostPort(addr string) (*ClusterConfig, bool) {
-	for _, c := range d.Clusters {
+	for _, c := range d.GetAllClusterConfigs() {
 		if c.GetAddr() == addr {
 			return &c, true
 		}
@@ -72,18 +439,152 @@ func (l *LoggingConfig) display() string {
 	return "LogLevel: " + l.LogLevel + " LogFile: " + l.LogFile + " Json: " + fmt.Sprint(l.Json)
 }
 
+const UNIX_SOCKET_PREFIX = ".s.PGSQL."
+
+// Path of the unix socket for the port in the directory, named the way
+// postgres names its sockets
+func unixSocketPath(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", UNIX_SOCKET_PREFIX, port))
+}
+
+// An address clients connect to. Either a TCP address or a directory
+// the unix socket is created in
+type ListenerConfig struct {
+	Addr      string
+	Port      int
+	SocketDir string
+	// Expect a PROXY protocol header from load balancers in front of the
+	// proxy. The header is only read from connections coming from one of
+	// the TrustedProxies CIDRs, or from any address when none are listed
+	ProxyProtocol  bool
+	TrustedProxies []string
+	// Failing to listen is not fatal. Used for the IPv6 side of localhost
+	optional bool
+}
+
+func (l *ListenerConfig) IsUnixSocket() bool {
+	return l.SocketDir != ""
+}
+
+// Get the network and address to listen on
+func (l *ListenerConfig) GetNetworkAddr() (string, string) {
+	if l.IsUnixSocket() {
+		return "unix", unixSocketPath(l.SocketDir, l.Port)
+	}
+	return "tcp", net.JoinHostPort(l.Addr, fmt.Sprint(l.Port))
+}
+
+// Whether a connection from addr starts with a PROXY protocol header.
+// Connections over a unix socket always come from the local machine
+func (l *ListenerConfig) ExpectsProxyHeader(addr net.Addr) bool {
+	if !l.ProxyProtocol {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || len(l.TrustedProxies) == 0 {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, cidr := range l.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ListenerConfig) display() string {
+	network, addr := l.GetNetworkAddr()
+	return network + " " + addr
+}
+
 type SpannerConfig struct {
 	// Logging Config
 	Logging LoggingConfig
 
 	PidFile string
 
+	// Id of the proxy among the proxies in front of the same databases.
+	// It is part of every id the proxy generates so each proxy needs its
+	// own
+	NodeId int
+
+	// Seconds to wait for clients to finish their transactions on shutdown
+	ShutdownTimeout int
+
+	// Unix socket a new process connects to during an upgrade to take
+	// over the listener and idle clients. Empty disables upgrades
+	UpgradeSocket string
+
+	// File the shard map is kept in once key ranges have been moved
+	// between clusters. Key ranges in the file take priority over the
+	// ones in the config. Empty disables key range moves
+	ShardMetadataPath string
+	// Postgres cluster keeping the shard map instead of a file, so it
+	// can be shared by several proxies
+	ShardMetadataCluster ClusterConfig
+
 	// Frontend Config
 	ListenPort int
 	ListenAddr string
+	// Addresses to accept clients on. ListenAddr and ListenPort are used
+	// when no listeners are configured
+	Listeners []ListenerConfig
 
 	// Backend Config
 	Databases []DatabaseConfig
+
+	// File the config was read from
+	path string
+	// Version of the shard map from the metadata store applied to the
+	// config
+	shardMapVersion int64
+}
+
+// Get every address clients are accepted on. Listeners without a port
+// use ListenPort and localhost listens on both IPv4 and IPv6
+func (c *SpannerConfig) GetListenerConfigs() []ListenerConfig {
+	configured := c.Listeners
+	if len(configured) == 0 {
+		configured = []ListenerConfig{{Addr: c.ListenAddr, Port: c.ListenPort}}
+	}
+	listeners := make([]ListenerConfig, 0, len(configured))
+	for _, listener := range configured {
+		if listener.Port == 0 {
+			listener.Port = c.ListenPort
+		}
+		if listener.IsUnixSocket() {
+			listeners = append(listeners, listener)
+			continue
+		}
+		if listener.Addr == "localhost" || listener.Addr == "" {
+			ipv6 := listener
+			listener.Addr = "127.0.0.1"
+			ipv6.Addr = "::1"
+			ipv6.optional = true
+			listeners = append(listeners, listener, ipv6)
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+func (c *SpannerConfig) GetShutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return DEFAULT_SHUTDOWN_TIMEOUT * time.Second
+	}
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+// Whether the shard map is kept in a metadata store
+func (c *SpannerConfig) HasShardMetadata() bool {
+	return c.ShardMetadataPath != "" || c.ShardMetadataCluster.Host != ""
 }
 
 func (c *SpannerConfig) GetDatabaseConfigByName(name string) (*DatabaseConfig, bool) {
@@ -98,8 +599,16 @@ func (c *SpannerConfig) GetDatabaseConfigByName(name string) (*DatabaseConfig, b
 func (s *SpannerConfig) Display() string {
 	confStr := ""
 	confStr += s.Logging.display() + "\n"
-	confStr += "ListenAddr: " + s.ListenAddr + "\n"
-	confStr += "ListenPort: " + fmt.Sprint(s.ListenPort) + "\n"
+	confStr += "NodeId: " + fmt.Sprint(s.NodeId) + "\n"
+	confStr += "ShutdownTimeout: " + fmt.Sprint(s.GetShutdownTimeout()) + "\n"
+	confStr += "UpgradeSocket: " + s.UpgradeSocket + "\n"
+	confStr += "ShardMetadataPath: " + s.ShardMetadataPath + "\n"
+	if s.ShardMetadataCluster.Host != "" {
+		confStr += "ShardMetadataCluster: " + s.ShardMetadataCluster.display() + "\n"
+	}
+	for _, l := range s.GetListenerConfigs() {
+		confStr += "Listener: " + l.display() + "\n"
+	}
 	confStr += "[[ Databases ]]\n\n"
 	for _, d := range s.Databases {
 		confStr += d.display() + "\n"
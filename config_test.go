@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestGetListenerConfigs(t *testing.T) {
+	config := &SpannerConfig{ListenAddr: "localhost", ListenPort: 6432}
+	addrs := func() []string {
+		addrs := make([]string, 0)
+		for _, listener := range config.GetListenerConfigs() {
+			addrs = append(addrs, listener.display())
+		}
+		return addrs
+	}
+
+	// localhost listens on both IPv4 and IPv6
+	if expected := []string{"tcp 127.0.0.1:6432", "tcp [::1]:6432"}; !slices.Equal(addrs(), expected) {
+		t.Fatalf("Expected %q, got %q", expected, addrs())
+	}
+	if listeners := config.GetListenerConfigs(); listeners[0].optional || !listeners[1].optional {
+		t.Fatal("Expected only the IPv6 side of localhost to be optional")
+	}
+
+	// Listeners without a port use ListenPort
+	config.Listeners = []ListenerConfig{{Addr: "10.0.0.1"}, {Addr: "::", Port: 5433}, {SocketDir: "/tmp"}}
+	if expected := []string{"tcp 10.0.0.1:6432", "tcp [::]:5433", "unix /tmp/.s.PGSQL.6432"}; !slices.Equal(addrs(), expected) {
+		t.Fatalf("Expected %q, got %q", expected, addrs())
+	}
+}
+
+func TestClusterNetworkAddr(t *testing.T) {
+	for _, c := range []struct {
+		cluster ClusterConfig
+		network string
+		addr    string
+	}{
+		{ClusterConfig{Host: "db", Port: 5432}, "tcp", "db:5432"},
+		{ClusterConfig{Host: "/var/run/postgresql", Port: 5433}, "unix", "/var/run/postgresql/.s.PGSQL.5433"},
+	} {
+		if network, addr := c.cluster.GetNetworkAddr(); network != c.network || addr != c.addr {
+			t.Fatalf("Expected %s %s for host %q, got %s %s", c.network, c.addr, c.cluster.Host, network, addr)
+		}
+	}
+}
+
+func TestExpectsProxyHeader(t *testing.T) {
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	unix := &net.UnixAddr{Name: "/tmp/.s.PGSQL.6432", Net: "unix"}
+	cases := []struct {
+		listener ListenerConfig
+		addr     net.Addr
+		expected bool
+	}{
+		{ListenerConfig{}, tcp("10.0.0.1"), false},
+		{ListenerConfig{ProxyProtocol: true}, tcp("10.0.0.1"), true},
+		{ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}}, tcp("10.1.2.3"), true},
+		{ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}}, tcp("192.168.0.1"), false},
+		// IPv4 clients of a dual stack listener arrive as mapped addresses
+		{ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}}, tcp("::ffff:10.1.2.3"), true},
+		{ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"not a cidr"}}, tcp("10.1.2.3"), false},
+		{ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}}, unix, true},
+	}
+	for _, c := range cases {
+		if expects := c.listener.ExpectsProxyHeader(c.addr); expects != c.expected {
+			t.Fatalf("Expected a header from %s to be expected %t with %+v", c.addr, c.expected, c.listener)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	CONFIG_PROBLEM_ERROR   = "ERROR"
+	CONFIG_PROBLEM_WARNING = "WARNING"
+)
+
+type ConfigProblem struct {
+	Severity string
+	Message  string
+}
+
+func (p ConfigProblem) String() string {
+	return p.Severity + ": " + p.Message
+}
+
+func configError(format string, args ...any) ConfigProblem {
+	return ConfigProblem{CONFIG_PROBLEM_ERROR, fmt.Sprintf(format, args...)}
+}
+
+func configWarning(format string, args ...any) ConfigProblem {
+	return ConfigProblem{CONFIG_PROBLEM_WARNING, fmt.Sprintf(format, args...)}
+}
+
+// Check the config for settings the proxy cannot run with. Every
+// problem found is reported, not just the first
+func ValidateConfig(config *SpannerConfig) error {
+	problems := make([]error, 0)
+	for _, problem := range checkConfig(config) {
+		if problem.Severity == CONFIG_PROBLEM_ERROR {
+			problems = append(problems, errors.New(problem.Message))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Settings in the file that do not map to any config field. These are
+// usually typos that would otherwise be silently ignored
+func checkUndecodedKeys(metadata toml.MetaData) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	for _, key := range metadata.Undecoded() {
+		problems = append(problems, configError("unknown setting %q", key.String()))
+	}
+	return problems
+}
+
+func checkConfig(config *SpannerConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	switch config.Logging.LogLevel {
+	case "", "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		problems = append(problems, configError("invalid log level %q", config.Logging.LogLevel))
+	}
+	if config.NodeId < 0 || config.NodeId > ID_MAX_NODE_ID {
+		problems = append(problems, configError("nodeId must be between 0 and %d", ID_MAX_NODE_ID))
+	}
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, configError("shutdownTimeout is negative"))
+	}
+	if config.ShardMetadataPath != "" && config.ShardMetadataCluster.Host != "" {
+		problems = append(problems, configError("only one of shardMetadataPath and shardMetadataCluster can be set"))
+	}
+	if config.ShardMetadataCluster.Host != "" && (config.ShardMetadataCluster.Name == "" || config.ShardMetadataCluster.Port == 0) {
+		problems = append(problems, configError("shardMetadataCluster needs a name and a port"))
+	}
+	problems = append(problems, checkListeners(config)...)
+
+	databaseNames := make(map[string]bool)
+	for _, database := range config.Databases {
+		if database.Name == "" {
+			problems = append(problems, configError("database with no name"))
+		} else if database.Name == ADMIN_DATABASE_NAME {
+			problems = append(problems, configError("database name %q is reserved for the admin console", database.Name))
+		} else if databaseNames[database.Name] {
+			problems = append(problems, configError("duplicate database %q", database.Name))
+		}
+		databaseNames[database.Name] = true
+
+		if len(database.Clusters) == 0 {
+			problems = append(problems, configError("database %q has no clusters", database.Name))
+		}
+		switch database.GetReadRouting() {
+		case READ_ROUTING_PRIMARY, READ_ROUTING_ROUND_ROBIN, READ_ROUTING_LEAST_CONNECTIONS:
+		default:
+			problems = append(problems, configError("database %q has invalid readRouting %q", database.Name, database.ReadRouting))
+		}
+		if database.MaxReplicationLag < 0 {
+			problems = append(problems, configError("database %q has negative maxReplicationLag", database.Name))
+		}
+		if database.MaxHashJoinMemory < 0 {
+			problems = append(problems, configError("database %q has negative maxHashJoinMemory", database.Name))
+		}
+
+		addrs := make(map[string]bool)
+		for _, cluster := range database.GetAllClusterConfigs() {
+			if cluster.Host == "" || cluster.Port == 0 {
+				problems = append(problems, configError("database %q has a cluster with no host or port", database.Name))
+				continue
+			}
+			if addrs[cluster.GetAddr()] {
+				problems = append(problems, configError("database %q lists cluster %s more than once", database.Name, cluster.GetAddr()))
+			}
+			addrs[cluster.GetAddr()] = true
+		}
+
+		problems = append(problems, checkPoolSettings(&database)...)
+		problems = append(problems, checkShardMap(&database)...)
+		problems = append(problems, checkTenants(&database)...)
+		problems = append(problems, checkShadow(&database)...)
+	}
+	return problems
+}
+
+func checkListeners(config *SpannerConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	for _, listener := range config.Listeners {
+		if listener.Addr != "" && listener.SocketDir != "" {
+			problems = append(problems, configError("listener has both an addr and a socketDir"))
+		}
+		if listener.SocketDir != "" && !filepath.IsAbs(listener.SocketDir) {
+			problems = append(problems, configError("listener socketDir %q is not an absolute path", listener.SocketDir))
+		}
+		for _, cidr := range listener.TrustedProxies {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				problems = append(problems, configError("listener trustedProxies entry %q is not a valid CIDR", cidr))
+			}
+		}
+		if len(listener.TrustedProxies) > 0 && !listener.ProxyProtocol {
+			problems = append(problems, configWarning("listener has trustedProxies but proxyProtocol is disabled"))
+		}
+		if listener.ProxyProtocol && len(listener.TrustedProxies) == 0 && !listener.IsUnixSocket() {
+			problems = append(problems, configWarning("listener accepts PROXY protocol headers from any address"))
+		}
+	}
+	seen := make(map[string]bool)
+	for _, listener := range config.GetListenerConfigs() {
+		if listener.Port <= 0 || listener.Port > 65535 {
+			problems = append(problems, configError("listener %s has an invalid port", listener.display()))
+		}
+		if seen[listener.display()] {
+			problems = append(problems, configError("listener %s is configured more than once", listener.display()))
+		}
+		seen[listener.display()] = true
+	}
+	return problems
+}
+
+func checkPoolSettings(database *DatabaseConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	settings := database.PoolSettings
+	if settings.MaxOpenConns < 0 || settings.MaxIdleConns < 0 || settings.MaxConnLifetime < 0 ||
+		settings.IdleConnLifetime < 0 || settings.HealthCheckIdleTime < 0 {
+		problems = append(problems, configError("database %q has negative pool settings", database.Name))
+	}
+	if settings.MaxOpenConns == 0 {
+		problems = append(problems, configWarning("database %q has maxOpenConns 0 so no connection is ever reused", database.Name))
+	}
+	if settings.MaxIdleConns > settings.MaxOpenConns {
+		problems = append(problems, configWarning(
+			"database %q allows more idle connections (%d) than open connections (%d)",
+			database.Name, settings.MaxIdleConns, settings.MaxOpenConns,
+		))
+	}
+	if settings.MaxConnLifetime == 0 {
+		problems = append(problems, configWarning("database %q has maxConnLifetime 0 so connections are closed instead of reused", database.Name))
+	}
+	if settings.IdleConnLifetime > settings.MaxConnLifetime {
+		problems = append(problems, configWarning(
+			"database %q has idleConnLifetime (%d) longer than maxConnLifetime (%d)",
+			database.Name, settings.IdleConnLifetime, settings.MaxConnLifetime,
+		))
+	}
+	return problems
+}
+
+func checkShardMap(database *DatabaseConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	tableNames := make(map[string]bool)
+	for _, table := range database.Tables {
+		if table.Name == "" {
+			problems = append(problems, configError("database %q has a table with no name", database.Name))
+		} else if tableNames[table.Name] {
+			problems = append(problems, configError("database %q lists table %q more than once", database.Name, table.Name))
+		}
+		tableNames[table.Name] = true
+		if table.Reference && table.ShardKey != "" {
+			problems = append(problems, configError("reference table %q of database %q has a shardKey", table.Name, database.Name))
+		} else if !table.Reference && table.ShardKey == "" {
+			problems = append(problems, configError("table %q of database %q has no shardKey", table.Name, database.Name))
+		}
+		switch table.GetShardKeyType() {
+		case SHARD_KEY_TYPE_TEXT, SHARD_KEY_TYPE_INTEGER, SHARD_KEY_TYPE_UUID:
+		default:
+			problems = append(problems, configError(
+				"table %q of database %q has shardKeyType %q, expected %s, %s or %s",
+				table.Name, database.Name, table.ShardKeyType, SHARD_KEY_TYPE_TEXT, SHARD_KEY_TYPE_INTEGER, SHARD_KEY_TYPE_UUID,
+			))
+		}
+		if table.IdColumn != "" && !table.Reference && table.IdColumn != table.ShardKey {
+			problems = append(problems, configWarning(
+				"table %q of database %q generates ids for %s which is not its shardKey",
+				table.Name, database.Name, table.IdColumn,
+			))
+		}
+		for _, lookup := range table.Lookups {
+			switch {
+			case table.Reference:
+				problems = append(problems, configError("reference table %q of database %q cannot have lookups", table.Name, database.Name))
+			case lookup.Column == "":
+				problems = append(problems, configError("a lookup of table %q of database %q has no column", table.Name, database.Name))
+			case lookup.Column == table.ShardKey:
+				problems = append(problems, configWarning(
+					"lookup of table %q of database %q is on its shardKey %s which needs no lookup",
+					table.Name, database.Name, lookup.Column,
+				))
+			}
+		}
+	}
+	for _, table := range database.Tables {
+		for _, lookup := range table.Lookups {
+			name := lookup.GetTable(&table)
+			if tableNames[name] {
+				problems = append(problems, configError("lookup table %q of database %q is already used by another table", name, database.Name))
+			}
+			tableNames[name] = true
+		}
+	}
+
+	ranges := make([]KeyRange, 0, len(database.Clusters))
+	for _, cluster := range database.Clusters {
+		keyRange, err := cluster.GetKeyRange()
+		if err != nil {
+			problems = append(problems, configError("cluster %s of database %q: %s", cluster.GetAddr(), database.Name, err))
+			continue
+		}
+		if cluster.KeyRange != "" && !database.IsSharded() && !database.Tenants.Enabled {
+			problems = append(problems, configWarning(
+				"cluster %s of database %q has a keyRange but the database has no sharded tables",
+				cluster.GetAddr(), database.Name,
+			))
+		}
+		ranges = append(ranges, keyRange)
+	}
+
+	if !database.IsSharded() {
+		if len(database.Clusters) > 1 && !database.Tenants.Enabled {
+			problems = append(problems, configWarning(
+				"database %q has %d clusters but no sharded tables. Only the first cluster is used",
+				database.Name, len(database.Clusters),
+			))
+		}
+		return problems
+	}
+	if len(ranges) == len(database.Clusters) {
+		if err := checkKeyRangeCoverage(ranges); err != nil {
+			problems = append(problems, configError("shard map of database %q is invalid: %s", database.Name, err))
+		}
+	}
+	return problems
+}
+
+func checkTenants(database *DatabaseConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	tenants := database.Tenants
+	if !tenants.Enabled {
+		if tenants.DirectoryTable != "" || tenants.FromSearchPath {
+			problems = append(problems, configWarning("database %q has tenant settings but tenant routing is not enabled", database.Name))
+		}
+		return problems
+	}
+	if len(database.Clusters) < 2 {
+		problems = append(problems, configWarning("database %q routes tenants but has a single cluster", database.Name))
+	}
+	if _, ok := database.GetTableConfig(tenants.DirectoryTable); ok {
+		problems = append(problems, configError(
+			"tenant directory table %q of database %q is also listed as a table", tenants.DirectoryTable, database.Name,
+		))
+	}
+	for _, cluster := range database.Clusters {
+		if cluster.KeyRange == "" && len(database.Clusters) > 1 {
+			problems = append(problems, configWarning(
+				"cluster %s of database %q has no keyRange so tenants missing from the directory all live on the first cluster",
+				cluster.GetAddr(), database.Name,
+			))
+			break
+		}
+	}
+	return problems
+}
+
+func checkShadow(database *DatabaseConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	shadow := database.Shadow
+	if shadow.Cluster.Host == "" {
+		if shadow.SampleRate != 0 || shadow.Source != "" {
+			problems = append(problems, configWarning("database %q has shadow settings but no shadow cluster", database.Name))
+		}
+		return problems
+	}
+	if shadow.Cluster.Name == "" || shadow.Cluster.Port == 0 {
+		problems = append(problems, configError("shadow cluster of database %q needs a name and a port", database.Name))
+	}
+	if shadow.SampleRate < 0 || shadow.SampleRate > 100 {
+		problems = append(problems, configError("database %q has shadow sampleRate %v outside of 0 to 100", database.Name, shadow.SampleRate))
+	}
+	if shadow.MaxConns < 0 || shadow.QueueSize < 0 || shadow.MaxLatencyRatio < 0 {
+		problems = append(problems, configError("database %q has negative shadow settings", database.Name))
+	}
+	if _, ok := database.GetClusterConfigByHostPort(shadow.Cluster.GetAddr()); ok {
+		problems = append(problems, configError(
+			"shadow cluster %s of database %q is one of its clusters", shadow.Cluster.GetAddr(), database.Name,
+		))
+	}
+	source := shadow.GetSource(database)
+	if !slices.ContainsFunc(database.Clusters, func(cluster ClusterConfig) bool { return cluster.GetAddr() == source }) {
+		problems = append(problems, configError(
+			"shadow source %s of database %q is not one of its clusters", source, database.Name,
+		))
+	}
+	return problems
+}
+
+// Password environment variables that are not set in the environment
+// the check runs in
+func checkEnvironment(config *SpannerConfig) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	if cluster := config.ShardMetadataCluster; cluster.Host != "" && cluster.PasswordEnv != "" {
+		if _, ok := os.LookupEnv(cluster.PasswordEnv); !ok {
+			problems = append(problems, configError(
+				"password environment variable %s for shard metadata cluster %s is not set",
+				cluster.PasswordEnv, cluster.GetAddr(),
+			))
+		}
+	}
+	for _, database := range config.Databases {
+		clusters := database.Clusters
+		if database.Shadow.Cluster.Host != "" {
+			clusters = append(slices.Clone(clusters), database.Shadow.Cluster)
+		}
+		for _, cluster := range clusters {
+			if cluster.PasswordEnv == "" {
+				continue
+			}
+			if _, ok := os.LookupEnv(cluster.PasswordEnv); !ok {
+				problems = append(problems, configError(
+					"password environment variable %s for cluster %s of database %q is not set",
+					cluster.PasswordEnv, cluster.GetAddr(), database.Name,
+				))
+			}
+		}
+	}
+	return problems
+}
+
+// Run every check against the config file
+func CheckConfigFile(path string) ([]ConfigProblem, error) {
+	var config SpannerConfig
+	metadata, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		return nil, err
+	}
+	problems := checkUndecodedKeys(metadata)
+	// Check the shard map the proxy would run with
+	if withMetadata, err := applyShardMetadata(&config); err != nil {
+		problems = append(problems, configError("%s", err))
+	} else {
+		config = *withMetadata
+	}
+	problems = append(problems, checkConfig(&config)...)
+	problems = append(problems, checkEnvironment(&config)...)
+	return problems, nil
+}
+
+// Entry point of the check-config subcommand. Returns the exit code
+func RunCheckConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := flags.String("config", "config.toml", "Path to the config file")
+	flags.Parse(args)
+
+	problems, err := CheckConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: cannot read %s: %s\n", *configPath, err)
+		return 1
+	}
+
+	errorCount := 0
+	for _, problem := range problems {
+		if problem.Severity == CONFIG_PROBLEM_ERROR {
+			errorCount++
+		}
+		fmt.Println(problem)
+	}
+	fmt.Printf("%s: %d errors, %d warnings\n", *configPath, errorCount, len(problems)-errorCount)
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+const CHECK_CONFIG_TEST_TOML = `
+ListenPort = 8000
+
+[logging]
+logLevel = "VERBOSE"
+
+[[databases]]
+name = "test"
+[[databases.tables]]
+name = "users"
+shardKey = "id"
+shardKeyType = "bigint"
+[[databases.tables]]
+name = "users"
+[[databases.tables]]
+name = "countries"
+reference = true
+shardKey = "code"
+[[databases.clusters]]
+host = "postgres1"
+port = 5432
+keyRange = "-80"
+[[databases.clusters]]
+host = "postgres1"
+port = 5432
+keyRange = "c0-"
+passwrdEnv = "PG_PASSWORD"
+[databases.poolSettings]
+maxOpenConns = 10
+maxIdleConns = 20
+maxConnLifetime = 900
+
+[[databases]]
+name = "test"
+[[databases.clusters]]
+host = "postgres3"
+port = 5432
+[databases.poolSettings]
+maxOpenConns = 10
+maxConnLifetime = 900
+`
+
+func TestCheckConfig(t *testing.T) {
+	var config SpannerConfig
+	metadata, err := toml.Decode(CHECK_CONFIG_TEST_TOML, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := checkUndecodedKeys(metadata)
+	problems = append(problems, checkConfig(&config)...)
+
+	expected := []string{
+		`ERROR: unknown setting "databases.clusters.passwrdEnv"`,
+		`ERROR: invalid log level "VERBOSE"`,
+		`ERROR: database "test" lists cluster postgres1:5432 more than once`,
+		`WARNING: database "test" allows more idle connections (20) than open connections (10)`,
+		`ERROR: table "users" of database "test" has shardKeyType "bigint", expected text, integer or uuid`,
+		`ERROR: database "test" lists table "users" more than once`,
+		`ERROR: table "users" of database "test" has no shardKey`,
+		`ERROR: reference table "countries" of database "test" has a shardKey`,
+		`ERROR: shard map of database "test" is invalid: keyspace ids between -80 and c0- are not covered`,
+		`ERROR: duplicate database "test"`,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem.String(), expected[i]) {
+			t.Fatalf("Problem %d: expected %q, got %q", i, expected[i], problem.String())
+		}
+	}
+
+	if err := ValidateConfig(&config); err == nil || strings.Contains(err.Error(), "idle connections") {
+		t.Fatalf("Expected only errors to fail validation, got %v", err)
+	}
+}
+
+func TestCheckEnvironment(t *testing.T) {
+	t.Setenv("PG_PASSWORD_SET", "secret")
+	config := &SpannerConfig{
+		ShardMetadataCluster: ClusterConfig{Host: "meta", Port: 5432, PasswordEnv: "PG_PASSWORD_META_UNSET"},
+		Databases: []DatabaseConfig{{
+			Name: "test",
+			Clusters: []ClusterConfig{
+				{Host: "a", Port: 5432, PasswordEnv: "PG_PASSWORD_SET"},
+				{Host: "b", Port: 5432, PasswordEnv: "PG_PASSWORD_B_UNSET"},
+			},
+			Shadow: ShadowConfig{Cluster: ClusterConfig{Host: "c", Port: 5432, PasswordEnv: "PG_PASSWORD_C_UNSET"}},
+		}},
+	}
+	expected := []string{
+		"ERROR: password environment variable PG_PASSWORD_META_UNSET for shard metadata cluster meta:5432 is not set",
+		`ERROR: password environment variable PG_PASSWORD_B_UNSET for cluster b:5432 of database "test" is not set`,
+		`ERROR: password environment variable PG_PASSWORD_C_UNSET for cluster c:5432 of database "test" is not set`,
+	}
+	problems := checkEnvironment(config)
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, problem := range problems {
+		if problem.String() != expected[i] {
+			t.Fatalf("Problem %d: expected %q, got %q", i, expected[i], problem.String())
+		}
+	}
+}
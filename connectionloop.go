@@ -7,10 +7,12 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/livinlefevreloca/pgspanner/protocol"
 	"github.com/livinlefevreloca/pgspanner/protocol/parsing"
+	"github.com/livinlefevreloca/pgspanner/query"
 )
 
 func staticServerConfiguration(ctx *ClientConnectionContext) *map[string]string {
@@ -57,6 +59,25 @@ func buildErrorResponsePacket(errMsg *protocol.ErrorResponsePgMessage) []byte {
 	return packet
 }
 
+func buildLostConnectionError(clusterAddr string, databaseName string, err error) *protocol.ErrorResponsePgMessage {
+	return protocol.BuildErrorResponsePgMessage(map[string]string{
+		protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "ERROR",
+		protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "ERROR",
+		protocol.NOTICE_KIND_CODE:                  "08006",
+		protocol.NOTICE_KIND_MESSAGE:               fmt.Sprintf("Lost connection to cluster %s for database %s", clusterAddr, databaseName),
+		protocol.NOTICE_KIND_DETAIL:                err.Error(),
+	})
+}
+
+func buildQueryError(code string, message string) *protocol.ErrorResponsePgMessage {
+	return protocol.BuildErrorResponsePgMessage(map[string]string{
+		protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "ERROR",
+		protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "ERROR",
+		protocol.NOTICE_KIND_CODE:                  code,
+		protocol.NOTICE_KIND_MESSAGE:               message,
+	})
+}
+
 func handleCancelRequest(
 	cancelMessage *protocol.CancelRequestPgMessage,
 	config *SpannerConfig,
@@ -120,20 +141,36 @@ func getServerConnection(
 	database *DatabaseConfig,
 	clusterAddr string,
 	clientPid int,
+	readOnly bool,
 ) (*ServerConnection, error) {
 	slog.Info(
 		"Requesting Connection",
 		"Cluster", clusterAddr,
 		"Database", database.Name,
 		"ClientPid", clientPid,
+		"ReadOnly", readOnly,
 	)
-	response := requester.RequestConnection(database.Name, clusterAddr, clientPid)
+	var response ConnectionResponse
+	if readOnly {
+		response = requester.RequestReadConnection(database.Name, clusterAddr, clientPid)
+	} else {
+		response = requester.RequestConnection(database.Name, clusterAddr, clientPid)
+	}
 
 	switch response.Result {
 	case RESULT_SUCCESS:
 		break
 	case RESULT_ERROR:
 		slog.Error("Error Requesting Connection", "error", response.Detail.Error())
+		if downErr, ok := response.Detail.(ClusterDownError); ok {
+			return nil, protocol.BuildErrorResponsePgMessage(map[string]string{
+				protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "ERROR",
+				protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "ERROR",
+				protocol.NOTICE_KIND_CODE:                  "08006",
+				protocol.NOTICE_KIND_MESSAGE:               fmt.Sprintf("Cluster %s for database %s is unavailable", clusterAddr, database.Name),
+				protocol.NOTICE_KIND_DETAIL:                downErr.Error(),
+			})
+		}
 		params := map[string]string{
 			protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "ERROR",
 			protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "ERROR",
@@ -148,7 +185,7 @@ func getServerConnection(
 
 	slog.Info(
 		"Recieved Connection",
-		"Cluster", clusterAddr,
+		"Cluster", response.Conn.GetClusterConfig().GetAddr(),
 		"Database", database.Name,
 		"ConnectionPid", response.Conn.GetBackendPid(),
 	)
@@ -174,55 +211,282 @@ func getSeverConnectionMapping(
 	return response.ConnMapping, nil
 }
 
+// Whether the query is a lone BEGIN that does not say if the transaction
+// is read only. We hold these back until we see the next statement so the
+// transaction can be sent to a replica if it turns out to be read only
+func isDeferrableBegin(statements []*query.Statement) bool {
+	return len(statements) == 1 &&
+		statements[0].Kind == query.KIND_BEGIN &&
+		!statements[0].ReadOnlyTransaction
+}
+
+// Respond to the client as if the server had run the statement
+func writeSyntheticCompletion(client *ClientConnection, tag string, transactionStatus byte) {
+	packet := protocol.BuildCommandCompletePgMessage(tag).Pack()
+	packet = append(packet, protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...)
+	client.Write(packet)
+}
+
+// Respond to the client with an error raised by the proxy. No server saw
+// the statement so the client's transaction carries on
+func writeSyntheticError(client *ClientConnection, errMsg *protocol.ErrorResponsePgMessage) {
+	packet := errMsg.Pack()
+	packet = append(packet, protocol.BuildReadyForQueryPgMessage(client.TransactionStatus()).Pack()...)
+	client.Write(packet)
+}
+
+// The error postgres answers every statement but ROLLBACK with once the
+// transaction failed
+func buildFailedTransactionError() *protocol.ErrorResponsePgMessage {
+	return buildQueryError("25P02", "current transaction is aborted, commands ignored until end of transaction block")
+}
+
 func handleQuery(
-	query string,
+	queryText string,
 	client *ClientConnection,
 	requester *ConnectionRequester,
 	database *DatabaseConfig,
 ) {
-	// Get a connection from the pool
-	cluster := database.Clusters[0]
-	server, err := getServerConnection(requester, database, cluster.GetAddr(), client.Ctx.ClientPid)
+	// A hint in front of the query picks the clusters it runs on
+	hint, queryText, err := query.ParseHint(queryText)
 	if err != nil {
-		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
-			client.Write(buildErrorResponsePacket(errMsg))
+		writeSyntheticError(client, buildQueryError("42601", err.Error()))
+		return
+	}
+	statements, err := query.Parse(queryText)
+	if err != nil {
+		slog.Warn("Unable to parse query. Routing to primary", "error", err)
+		statements = nil
+	}
+
+	// pgspanner.next_id and the id columns of sharded tables are filled
+	// in by the proxy
+	if handleNextIdSelect(statements, client) {
+		return
+	}
+	if handleSessionSetting(statements, client, database) {
+		return
+	}
+	if rewritten, errMsg := rewriteGeneratedIds(queryText, statements, database); errMsg != nil {
+		writeSyntheticError(client, errMsg)
+		return
+	} else if rewritten != queryText {
+		queryText = rewritten
+		statements, _ = query.Parse(queryText)
+	}
+
+	// A transaction that reached several shards ends on all of them
+	if len(statements) == 1 && client.InMultiShardTransaction() &&
+		(statements[0].Kind == query.KIND_COMMIT || statements[0].Kind == query.KIND_ROLLBACK) {
+		handleMultiShardTransactionEnd(queryText, statements[0], client, requester, database)
+		return
+	}
+
+	if hint != nil {
+		routeByHint(queryText, statements, hint, client, requester, database)
+		return
+	}
+
+	// A session running as a tenant stays on the tenant's cluster
+	tenant := getSessionTenant(client, database)
+
+	// COPY FROM STDIN into a sharded table has its rows spread over the
+	// shards and COPY TO STDOUT gathers them from every shard
+	if tenant == "" && len(statements) == 1 && statements[0].Kind == query.KIND_COPY {
+		copyStatement, err := query.ParseCopy(statements[0])
+		if err == nil && copyStatement.From && copyStatement.Stdio {
+			if table, ok := getCopyTableConfig(database, copyStatement); ok {
+				handleShardedCopyIn(queryText, copyStatement, table, client, requester, database)
+				return
+			}
+		} else if err == nil && copyStatement.Stdio && copyReadsShardedTable(database, statements[0], copyStatement) {
+			handleShardedCopyOut(queryText, copyStatement, client, requester, database)
 			return
-		} else {
-			slog.Error("Error getting server connection", "error", err)
 		}
+	}
+
+	if tenant == "" && routeDDL(queryText, statements, client, requester, database) {
+		return
+	}
+	if tenant == "" && routeJoins(statements, client, requester, database) {
+		return
+	}
+	if tenant == "" && routeLookupWrites(queryText, statements, client, requester, database) {
+		return
+	}
+	if routeReferenceTables(queryText, statements, client, requester, database) {
 		return
 	}
 
-	// ensure we return the connection to the pool
-	defer requester.ReturnConnection(server, database.Name, cluster.GetAddr(), client.Ctx.ClientPid)
+	// Queries pinning a shard key go to the cluster owning it and those
+	// using no sharded table to the first cluster
+	var write *routedWrite
+	if database.IsSharded() && !query.IsReadOnly(statements) {
+		write = shardRouting.BeginWrite(database.Name)
+		defer write.Finish(client)
+	}
+	var cluster *ClusterConfig
+	if tenant != "" {
+		cluster, err = routeByTenant(client, write, requester, database)
+	} else {
+		cluster, err = routeByShardKey(statements, write, client.Ctx.ClientPid, requester, database)
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error routing query", "error", err)
+			writeSyntheticError(client, buildQueryError("58000", err.Error()))
+		}
+		return
+	}
+	// Statements on sharded tables that bind no single cluster run on
+	// every cluster that may own their rows
+	if cluster == nil && tenant == "" && routeUnpinned(queryText, statements, write, client, requester, database) {
+		return
+	}
+	if cluster == nil {
+		cluster = &database.Clusters[0]
+	}
+	runOnCluster(queryText, statements, cluster, client, requester, database)
+}
 
-	server.IssueQuery(query)
+// Run a query on a single cluster. The connection the client is holding
+// for an open transaction is reused, otherwise one comes from the pool
+func runOnCluster(
+	queryText string,
+	statements []*query.Statement,
+	cluster *ClusterConfig,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	shardAddr := cluster.GetAddr()
+	var err error
+	server, ok := client.GetPinnedConnection(shardAddr)
+	if !ok {
+		var readOnly bool
+		if client.pendingBegin != "" {
+			// The transaction ended before it did anything
+			if len(statements) == 1 && (statements[0].Kind == query.KIND_COMMIT || statements[0].Kind == query.KIND_ROLLBACK) {
+				client.pendingBegin = ""
+				writeSyntheticCompletion(client, string(statements[0].Kind), TRANSACTION_STATUS_IDLE)
+				return
+			}
+			readOnly = len(statements) > 0 && statements[0].ReadOnlyTransaction
+		} else if database.UsesReplicas() && isDeferrableBegin(statements) {
+			client.pendingBegin = queryText
+			writeSyntheticCompletion(client, string(query.KIND_BEGIN), TRANSACTION_STATUS_ACTIVE)
+			return
+		} else if !client.InTransaction() {
+			readOnly = query.IsReadOnly(statements) ||
+				(len(statements) == 1 && statements[0].ReadOnlyTransaction && statements[0].Kind == query.KIND_BEGIN)
+		}
 
-	for {
-		rm, err := protocol.GetRawPgMessage(server.Conn)
+		server, err = getServerConnection(requester, database, shardAddr, client.Ctx.ClientPid, readOnly && database.UsesReplicas())
 		if err != nil {
-			slog.Error("Error reading raw message in query handler", "error", err)
+			client.pendingBegin = ""
+			if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+				client.Write(buildErrorResponsePacket(errMsg))
+				return
+			} else {
+				slog.Error("Error getting server connection", "error", err)
+			}
 			return
 		}
-		switch rm.Kind {
-		case protocol.BMESSAGE_READY_FOR_QUERY:
-			client.Write(rm.Pack())
+
+		if err = applySessionSettings(client, server); err != nil {
+			client.pendingBegin = ""
+			slog.Error("Error applying session settings", "error", err)
+			requester.ReturnConnection(server, database.Name, server.GetClusterConfig().GetAddr(), client.Ctx.ClientPid)
+			if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+				writeSyntheticError(client, errMsg)
+			} else {
+				client.Write(buildErrorResponsePacket(buildLostConnectionError(shardAddr, database.Name, err)))
+			}
 			return
-		default:
-			client.Write(rm.Pack())
 		}
+
+		// A transaction the client holds on another shard carries on here
+		begin := client.pendingBegin
+		if begin == "" && client.InTransaction() {
+			begin = "BEGIN"
+		}
+		if begin != "" {
+			err = server.Exec(begin)
+			client.pendingBegin = ""
+			if err != nil {
+				slog.Error("Error starting deferred transaction", "error", err)
+				requester.ReturnConnection(server, database.Name, server.GetClusterConfig().GetAddr(), client.Ctx.ClientPid)
+				if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+					client.Write(buildErrorResponsePacket(errMsg))
+				} else {
+					client.Write(buildErrorResponsePacket(buildLostConnectionError(shardAddr, database.Name, err)))
+				}
+				return
+			}
+		}
+	}
+	serverAddr := server.GetClusterConfig().GetAddr()
+
+	// Reads picked for the shadow cluster are queued once the client has
+	// its answer
+	mirror := sampleShadowRead(statements, cluster, server, database)
+	start := time.Now()
+	server.IssueQuery(queryText)
+
+	relay := newResultRelay(client)
+	transactionStatus, err := relay.ForwardUntilReady(server)
+	relay.Release()
+	// Time spent waiting on the client is not the cluster's doing
+	latency := time.Since(start) - relay.output.blocked
+	if mirror != nil && err == nil {
+		mirror.enqueue(shadowRead{
+			query:      queryText,
+			searchPath: client.Ctx.SearchPath,
+			rows:       relay.rows,
+			failed:     relay.failed,
+			latency:    latency,
+		})
+	}
+	if err != nil {
+		slog.Error("Error relaying result in query handler", "error", err)
+		client.UnpinConnection(shardAddr)
+		requester.ReturnConnection(server, database.Name, serverAddr, client.Ctx.ClientPid)
+		client.Write(buildErrorResponsePacket(buildLostConnectionError(serverAddr, database.Name, err)))
+		return
+	}
+	server.SetTransactionStatus(transactionStatus)
+	// Hold on to the connection until the transaction is finished
+	if server.InTransaction() {
+		client.PinConnection(shardAddr, server)
+	} else {
+		client.UnpinConnection(shardAddr)
+		requester.ReturnConnection(server, database.Name, serverAddr, client.Ctx.ClientPid)
 	}
 }
 
-func ConnectionLoop(conn net.Conn, config *SpannerConfig, connectionRequester *ConnectionRequester, clientPid int) {
+func ConnectionLoop(
+	conn net.Conn,
+	listener ListenerConfig,
+	connectionRequester *ConnectionRequester,
+	shutdown *ShutdownCoordinator,
+	clientPid int,
+) {
 	defer conn.Close()
+	config := connectionRequester.GetConfig()
 	clientConnection := &ClientConnection{Conn: conn}
 
-	rawMessage, err := protocol.GetRawStartupPgMessage(conn)
+	rawMessage, proxyHeader, err := protocol.GetRawStartupPgMessage(conn, listener.ExpectsProxyHeader(conn.RemoteAddr()))
 	if err != nil {
-		slog.Error("Error getting raw startup message", "error", err)
+		slog.Error("Error getting raw startup message", "error", err, "remoteAddr", conn.RemoteAddr().String())
 		return
 	}
+	clientAddr := conn.RemoteAddr().String()
+	if proxyHeader != nil && !proxyHeader.Local {
+		clientAddr = proxyHeader.SourceAddr.String()
+	}
+	slog.Info("Received client startup", "clientPid", clientPid, "clientAddr", clientAddr)
 
 	switch rawMessage.Kind {
 	case protocol.FMESSAGE_CANCEL:
@@ -251,9 +515,19 @@ func ConnectionLoop(conn net.Conn, config *SpannerConfig, connectionRequester *C
 		slog.Error("Error Unpacking startup message", "error", err)
 		return
 	}
+	if startPgMessage.Database == ADMIN_DATABASE_NAME {
+		clientConnection.Ctx = NewClientConnectionContext(startPgMessage, nil, clientPid)
+		clientConnection.Ctx.ClientAddr = clientAddr
+		shutdown.RegisterClient(clientConnection)
+		defer shutdown.UnregisterClient(clientConnection)
+		defer clientConnection.MarkClosed()
+		AdminConnectionLoop(clientConnection, connectionRequester)
+		return
+	}
+
 	database, ok := config.GetDatabaseConfigByName(startPgMessage.Database)
 	if !ok {
-		slog.Error("Database not found", "database", startPgMessage.Database)
+		slog.Error("Database not found", "database", startPgMessage.Database, "clientAddr", clientAddr)
 		errMsg := protocol.BuildErrorResponsePgMessage(map[string]string{
 			protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "FATAL",
 			protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "FATAL",
@@ -266,13 +540,78 @@ func ConnectionLoop(conn net.Conn, config *SpannerConfig, connectionRequester *C
 	}
 
 	ctx := NewClientConnectionContext(startPgMessage, database, clientPid)
+	ctx.ClientAddr = clientAddr
 	clientConnection.Ctx = ctx
 	conn.Write(configPacketShim(ctx))
+	runClientSession(clientConnection, connectionRequester, shutdown)
+}
+
+// Pick up a client handed over by the previous process during an
+// upgrade. The client already completed its startup with that process
+func ResumeConnectionLoop(
+	conn net.Conn,
+	ctx *ClientConnectionContext,
+	connectionRequester *ConnectionRequester,
+	shutdown *ShutdownCoordinator,
+) {
+	defer conn.Close()
+	database, ok := connectionRequester.GetConfig().GetDatabaseConfigByName(ctx.DatabaseName)
+	if !ok {
+		slog.Error("Database of handed off client not found", "database", ctx.DatabaseName)
+		errMsg := protocol.BuildErrorResponsePgMessage(map[string]string{
+			protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "FATAL",
+			protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "FATAL",
+			protocol.NOTICE_KIND_CODE:                  "08000",
+			protocol.NOTICE_KIND_MESSAGE:               fmt.Sprintf("Database %s not found", ctx.DatabaseName),
+			protocol.NOTICE_KIND_DETAIL:                "",
+		})
+		conn.Write(errMsg.Pack())
+		return
+	}
+	ctx.Database = database
+	slog.Info("Resuming client handed off by previous process", "clientPid", ctx.ClientPid)
+	runClientSession(&ClientConnection{Conn: conn, Ctx: ctx}, connectionRequester, shutdown)
+}
+
+// The current config of the client's database. It is looked up for
+// every query so reloads and key range moves reach connected clients
+func getSessionDatabase(client *ClientConnection, requester *ConnectionRequester) (*DatabaseConfig, *protocol.ErrorResponsePgMessage) {
+	database, ok := requester.GetConfig().GetDatabaseConfigByName(client.Ctx.DatabaseName)
+	if !ok {
+		return nil, buildQueryError("3D000", fmt.Sprintf("database %s was removed from the configuration", client.Ctx.DatabaseName))
+	}
+	client.Ctx.Database = database
+	return database, nil
+}
+
+// Serve the client's queries until it disconnects
+func runClientSession(
+	clientConnection *ClientConnection,
+	connectionRequester *ConnectionRequester,
+	shutdown *ShutdownCoordinator,
+) {
+	clientPid := clientConnection.Ctx.ClientPid
+	shutdown.RegisterClient(clientConnection)
+	defer shutdown.UnregisterClient(clientConnection)
+	defer clientConnection.ReleaseConnections(connectionRequester)
+	defer shardRouting.EndTransaction(clientConnection)
+	defer clientConnection.MarkClosed()
 
 	for {
-		rawMessage, err := protocol.GetRawPgMessage(conn)
-		if err != nil {
-			slog.Error("Error: ", err)
+		clientConnection.received = 0
+		rawMessage, err := protocol.GetRawPgMessage(clientConnection)
+		if errors.Is(err, os.ErrDeadlineExceeded) && clientConnection.received == 0 {
+			// Woken up to hand the client to a new process
+			if shutdown.ReleaseClient(clientConnection) {
+				return
+			}
+			clientConnection.Conn.SetReadDeadline(time.Time{})
+			continue
+		} else if err != nil {
+			slog.Error("Error reading message from client", "error", err)
+			break
+		}
+		if !clientConnection.StartRequest() {
 			break
 		}
 
@@ -281,10 +620,14 @@ func ConnectionLoop(conn net.Conn, config *SpannerConfig, connectionRequester *C
 			queryPgMessage := &protocol.QueryPgMessage{}
 			queryPgMessage, err := queryPgMessage.Unpack(rawMessage)
 			if err != nil {
-				slog.Error("Error: ", err)
+				slog.Error("Error unpacking query message", "error", err)
 			}
 			slog.Info("Recieved Query: ", "query", queryPgMessage.Query)
-			handleQuery(queryPgMessage.Query, clientConnection, connectionRequester, database)
+			if database, errMsg := getSessionDatabase(clientConnection, connectionRequester); errMsg != nil {
+				writeSyntheticError(clientConnection, errMsg)
+			} else {
+				handleQuery(queryPgMessage.Query, clientConnection, connectionRequester, database)
+			}
 		case protocol.FMESSAGE_CANCEL:
 			slog.Info("Recieved Cancel Request with no query running. Ignoring")
 		case protocol.FMESSAGE_TERMINATE:
@@ -307,6 +650,108 @@ func ConnectionLoop(conn net.Conn, config *SpannerConfig, connectionRequester *C
 		default:
 			slog.Warn("Unknown message kind: ", "kind", fmt.Sprint(rawMessage.Kind))
 		}
+		if !clientConnection.FinishRequest() {
+			return
+		}
+		if !clientConnection.InTransaction() {
+			shardRouting.EndTransaction(clientConnection)
+		}
+
+		// Once the proxy is shutting down disconnect the client as soon
+		// as it is no longer inside a transaction
+		if shutdown.IsDraining() && shutdown.ReleaseClient(clientConnection) {
+			return
+		}
+	}
+}
+
+// Open a listener for clients. Unix sockets are made accessible to every
+// local user like the ones postgres creates
+func openListener(listenerConfig ListenerConfig) (net.Listener, error) {
+	network, addr := listenerConfig.GetNetworkAddr()
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	// Remove the socket left behind by a process that did not shut down
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.ListenUnix(network, &net.UnixAddr{Name: addr, Net: network})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed on shutdown but has to survive the old
+	// process closing it during an upgrade
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(addr, 0777); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func openListeners(config *SpannerConfig) []net.Listener {
+	listeners := make([]net.Listener, 0)
+	for _, listenerConfig := range config.GetListenerConfigs() {
+		listener, err := openListener(listenerConfig)
+		if err != nil && listenerConfig.optional {
+			slog.Warn("Could not listen on optional address", "listener", listenerConfig.display(), "error", err)
+			continue
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// A client accepted on one of the listeners
+type acceptedClient struct {
+	conn      net.Conn
+	listener  ListenerConfig
+	clientPid int
+}
+
+// Find the config of a listener. Listeners inherited during an upgrade
+// are matched to the current config by their address
+func findListenerConfig(config *SpannerConfig, listener net.Listener) ListenerConfig {
+	for _, listenerConfig := range config.GetListenerConfigs() {
+		network, addr := listenerConfig.GetNetworkAddr()
+		if network == listener.Addr().Network() && addr == listener.Addr().String() {
+			return listenerConfig
+		}
+	}
+	return ListenerConfig{}
+}
+
+// Accept clients on the listener until it is closed
+func acceptClients(
+	listener net.Listener,
+	listenerConfig ListenerConfig,
+	accepted chan<- acceptedClient,
+	shutdown *ShutdownCoordinator,
+) {
+	for {
+		// Accepting is paused while the listeners are handed to a new
+		// process. The pid is assigned before the pause can start so
+		// the new process knows the next free one
+		shutdown.acceptMu.RLock()
+		conn, err := listener.Accept()
+		if shutdown.IsDraining() {
+			shutdown.acceptMu.RUnlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			shutdown.acceptMu.RUnlock()
+			continue
+		} else if err != nil {
+			log.Fatal(err)
+			return
+		}
+		accepted <- acceptedClient{conn, listenerConfig, shutdown.AssignClientPid()}
+		shutdown.acceptMu.RUnlock()
 	}
 }
 
@@ -314,41 +759,52 @@ func clientConnectionHandler(
 	config *SpannerConfig,
 	keepAlive *KeepAlive,
 	connectionReqester *ConnectionRequester,
+	shutdown *ShutdownCoordinator,
 ) {
-	// Start the client pid counter
-	clientPid := 0
+	if shutdown.IsDraining() {
+		return
+	}
 	slog.Info("Client connection handler started")
-	if config.ListenAddr == "localhost" || config.ListenAddr == "" {
-		config.ListenAddr = "127.0.0.1"
+
+	listeners := shutdown.TakeInheritedListeners()
+	if len(listeners) == 0 {
+		listeners = openListeners(config)
 	}
-	addr := net.TCPAddr{
-		IP:   net.ParseIP(config.ListenAddr),
-		Port: config.ListenPort,
-		Zone: "",
+	if !shutdown.SetListeners(listeners) {
+		return
 	}
 
-	l, err := net.ListenTCP("tcp", &addr)
-	if err != nil {
-		log.Fatal(err)
+	accepted := make(chan acceptedClient)
+	var accepting sync.WaitGroup
+	for _, listener := range listeners {
+		listenerConfig := findListenerConfig(config, listener)
+		slog.Info("Listening for clients", "addr", listener.Addr().String(), "proxyProtocol", listenerConfig.ProxyProtocol)
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			acceptClients(listener, listenerConfig, accepted, shutdown)
+		}(listener)
 	}
-
-	slog.Info("Listening on port 8000")
-	defer l.Close()
+	stopped := make(chan struct{})
+	go func() {
+		accepting.Wait()
+		close(stopped)
+	}()
+
+	ticker := time.NewTicker(TIMEOUT)
+	defer ticker.Stop()
 	for {
-		l.SetDeadline(time.Now().Add(TIMEOUT))
-		conn, err := l.Accept()
-		if errors.Is(err, os.ErrDeadlineExceeded) {
+		select {
+		case client := <-accepted:
+			slog.Info("Client connected. Starting connection loop...")
+			go ConnectionLoop(client.conn, client.listener, connectionReqester, shutdown, client.clientPid)
 			keepAlive.Notify()
-			slog.Debug("Client connection handler loop timeout")
-			continue
-		} else if err != nil {
-			log.Fatal(err)
+		case <-stopped:
+			slog.Info("Client connection handler stopped accepting connections")
 			return
+		case <-ticker.C:
+			keepAlive.Notify()
+			slog.Debug("Client connection handler loop timeout")
 		}
-		slog.Info("Client connected. Starting connection loop...")
-		go ConnectionLoop(conn, config, connectionReqester, clientPid)
-		clientPid++
-		keepAlive.Notify()
-		slog.Debug("Client connection handler loop")
 	}
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Start a session for a client connected to database and return the
+// client's end of it
+func startQuerySession(t *testing.T, requester *ConnectionRequester, database string) net.Conn {
+	proxyEnd, clientEnd := net.Pipe()
+	client := &ClientConnection{Conn: proxyEnd, Ctx: &ClientConnectionContext{DatabaseName: database, ClientPid: 1}}
+	go runClientSession(client, requester, NewShutdownCoordinator(""))
+	t.Cleanup(func() { clientEnd.Close() })
+	return clientEnd
+}
+
+// Send a query and read the answer. Returns the code of the error the
+// client got, "" when there is none
+func sendSessionQuery(t *testing.T, conn net.Conn, sql string) string {
+	t.Helper()
+	if _, err := conn.Write(protocol.BuildQueryMessage(sql).Pack()); err != nil {
+		t.Fatal(err)
+	}
+	code := ""
+	for {
+		rm, err := protocol.GetRawPgMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch rm.Kind {
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			code = getErrorCode(rm.Pack())
+		case protocol.BMESSAGE_READY_FOR_QUERY:
+			return code
+		}
+	}
+}
+
+// Answer the config reloads sent to the pool manager the way it does.
+// Every other request goes to the channel returned
+func serveConfigReloads(requester *ConnectionRequester, requests <-chan *ConnectionRequest) <-chan *ConnectionRequest {
+	others := make(chan *ConnectionRequest, 16)
+	go func() {
+		for request := range requests {
+			if request.Event != ACTION_RELOAD_CONFIG {
+				others <- request
+				continue
+			}
+			requester.setConfig(request.Config)
+			request.responder <- ConnectionResponse{Event: ACTION_RELOAD_CONFIG, Result: RESULT_SUCCESS}
+		}
+	}()
+	return others
+}
+
+func newSessionServer(database *DatabaseConfig, cluster *ClusterConfig, messages ...[]byte) (*ServerConnection, *scriptedConn) {
+	server, conn := newScriptedServer(cluster, messages...)
+	server.Context.Database = database
+	server.MarkUsed()
+	return server, conn
+}
+
+func TestSessionFollowsKeyRangeMove(t *testing.T) {
+	database := lookupTestDatabase()
+	database.Tables[0].Lookups = nil
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	moved, _ := ParseKeyRange("40-80")
+	id := 1
+	for !moved.Contains(KeyspaceId([]byte(fmt.Sprint(id)))) {
+		id++
+	}
+
+	before, beforeConn := newSessionServer(database, &ClusterConfig{Host: "a", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+	after, afterConn := newSessionServer(database, &ClusterConfig{Host: "b", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+	write, writeConn := newSessionServer(database, &ClusterConfig{Host: "b", Port: 5432}, buildCompletion("UPDATE 1", TRANSACTION_STATUS_IDLE))
+	returned := serveConfigReloads(requester, serveScriptedPool(requester, map[string][]*ServerConnection{
+		"a:5432": {before},
+		"b:5432": {after, write},
+	}))
+	conn := startQuerySession(t, requester, "test")
+
+	read := fmt.Sprintf("SELECT * FROM users WHERE id = %d", id)
+	update := fmt.Sprintf("UPDATE users SET name = 'x' WHERE id = %d", id)
+	if code := sendSessionQuery(t, conn, read); code != "" {
+		t.Fatalf("Expected the read to succeed, got %q", code)
+	}
+
+	// The range moves to the other cluster while the session is open
+	metadata := newShardMetadata()
+	metadata.Version = 1
+	metadata.KeyRanges["test"] = map[string]string{"a:5432": "-40", "b:5432": "40-"}
+	if err := applyShardMap(requester, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if code := sendSessionQuery(t, conn, read); code != "" {
+		t.Fatalf("Expected the read to succeed, got %q", code)
+	}
+	if code := sendSessionQuery(t, conn, update); code != "" {
+		t.Fatalf("Expected the write to succeed, got %q", code)
+	}
+	for i := 0; i < 3; i++ {
+		<-returned
+	}
+	for _, c := range []struct {
+		conn     *scriptedConn
+		expected string
+	}{{beforeConn, read}, {afterConn, read}, {writeConn, update}} {
+		if !slices.Contains(c.conn.queries(), c.expected) {
+			t.Fatalf("Expected %q on the cluster owning the key, got %q", c.expected, c.conn.queries())
+		}
+	}
+}
+
+func TestSessionFollowsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgspanner.toml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`
+ListenPort = 6432
+
+[[databases]]
+name = "test"
+
+[[databases.clusters]]
+host = "a"
+port = 5432
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, _ := config.GetDatabaseConfigByName("test")
+	requester := NewConnectionRequester(config)
+	defer close(requester.channel)
+
+	// The table is sharded across a new cluster by the reload
+	writeConfig(`
+ListenPort = 6432
+
+[[databases]]
+name = "test"
+
+[[databases.tables]]
+name = "users"
+shardKey = "id"
+
+[[databases.clusters]]
+host = "a"
+port = 5432
+keyRange = "-80"
+
+[[databases.clusters]]
+host = "b"
+port = 5432
+keyRange = "80-"
+`)
+	id := 1
+	for KeyspaceId([]byte(fmt.Sprint(id))) < 1<<63 {
+		id++
+	}
+	read := fmt.Sprintf("SELECT * FROM users WHERE id = %d", id)
+	before, beforeConn := newSessionServer(database, &ClusterConfig{Host: "a", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+	after, afterConn := newSessionServer(database, &ClusterConfig{Host: "b", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+	returned := serveConfigReloads(requester, serveScriptedPool(requester, map[string][]*ServerConnection{
+		"a:5432": {before},
+		"b:5432": {after},
+	}))
+	conn := startQuerySession(t, requester, "test")
+
+	if code := sendSessionQuery(t, conn, read); code != "" {
+		t.Fatalf("Expected the read to succeed, got %q", code)
+	}
+	if _, err := ReloadConfig(requester); err != nil {
+		t.Fatal(err)
+	}
+	if code := sendSessionQuery(t, conn, read); code != "" {
+		t.Fatalf("Expected the read to succeed, got %q", code)
+	}
+	<-returned
+	<-returned
+	if !slices.Contains(beforeConn.queries(), read) || !slices.Contains(afterConn.queries(), read) {
+		t.Fatal("Expected the session to route by the reloaded config")
+	}
+
+	// A database dropped from the config fails the session's queries
+	writeConfig(`
+ListenPort = 6432
+
+[[databases]]
+name = "other"
+
+[[databases.clusters]]
+host = "a"
+port = 5432
+`)
+	if _, err := ReloadConfig(requester); err != nil {
+		t.Fatal(err)
+	}
+	if code := sendSessionQuery(t, conn, read); code != "3D000" {
+		t.Fatalf("Expected queries on a removed database to fail, got %q", code)
+	}
+}
+
+func TestDeferredReadOnlyBegin(t *testing.T) {
+	database := &DatabaseConfig{
+		Name:        "test",
+		ReadRouting: READ_ROUTING_ROUND_ROBIN,
+		Clusters:    []ClusterConfig{{Host: "a", Port: 5432, Replicas: []ReplicaConfig{{Host: "b", Port: 5432}}}},
+	}
+	replica := &database.Clusters[0].GetReplicaConfigs()[0]
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	servers := make(chan *ServerConnection, 2)
+	events := make(chan string, 2)
+	returned := make(chan *ConnectionRequest, 2)
+	go func() {
+		for request := range requester.ReceiveConnectionRequest() {
+			switch request.Event {
+			case ACTION_GET_CONNECTION, ACTION_GET_READ_CONNECTION:
+				events <- request.Event
+				request.responder <- ConnectionResponse{Result: RESULT_SUCCESS, Conn: <-servers}
+			default:
+				returned <- request
+			}
+		}
+	}()
+	conn := startQuerySession(t, requester, "test")
+
+	// The BEGIN waits for the first statement, which makes the
+	// transaction read only so it runs on a replica
+	server, serverConn := newSessionServer(database, replica,
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("SET", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE),
+	)
+	servers <- server
+	for _, sql := range []string{"BEGIN", "SET TRANSACTION READ ONLY", "COMMIT"} {
+		if code := sendSessionQuery(t, conn, sql); code != "" {
+			t.Fatalf("Expected %q to succeed, got %q", sql, code)
+		}
+	}
+	<-returned
+	if event := <-events; event != ACTION_GET_READ_CONNECTION {
+		t.Fatalf("Expected a read connection, got %s", event)
+	}
+	expected := []string{"BEGIN", "SET TRANSACTION READ ONLY", "COMMIT"}
+	if queries := serverConn.queries(); len(queries) < len(expected) || !slices.Equal(queries[:len(expected)], expected) {
+		t.Fatalf("Expected queries %q, got %q", expected, queries)
+	}
+
+	// A connection lost while starting the transaction is reported
+	server, _ = newSessionServer(database, replica)
+	servers <- server
+	if code := sendSessionQuery(t, conn, "BEGIN"); code != "" {
+		t.Fatalf("Expected BEGIN to succeed, got %q", code)
+	}
+	if code := sendSessionQuery(t, conn, "SET TRANSACTION READ ONLY"); code != "08006" {
+		t.Fatalf("Expected the lost connection to be reported, got %q", code)
+	}
+	<-returned
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+// Rows headed for the same shard are batched into CopyData messages of
+// about this size
+const COPY_CHUNK_SIZE = 64 * 1024
+
+// The COPY running on one shard of a sharded table. Rows are written to
+// the server by their own goroutine so every shard is loaded in parallel
+type shardCopyStream struct {
+	shardAddr string
+	keyRange  KeyRange
+	server    *ServerConnection
+	pending   []byte
+	chunks    chan []byte
+	done      chan error
+	// What the server answered once the copy ended
+	result shardResult
+}
+
+func (s *shardCopyStream) start() {
+	s.chunks = make(chan []byte, 16)
+	s.done = make(chan error, 1)
+	go func() {
+		var err error
+		for chunk := range s.chunks {
+			// Keep draining after a failed write so the router never blocks
+			if err == nil {
+				_, err = s.server.Write(protocol.BuildCopyDataPgMessage(chunk).Pack())
+			}
+		}
+		s.done <- err
+	}()
+}
+
+func (s *shardCopyStream) add(row []byte) {
+	s.pending = append(s.pending, row...)
+	if len(s.pending) >= COPY_CHUNK_SIZE {
+		s.chunks <- s.pending
+		s.pending = make([]byte, 0, COPY_CHUNK_SIZE)
+	}
+}
+
+// Send the remaining rows and end the copy on the server. A non empty
+// failure aborts it instead. Returns once the server has answered
+func (s *shardCopyStream) finish(failure string) {
+	if len(s.pending) > 0 {
+		s.chunks <- s.pending
+		s.pending = nil
+	}
+	close(s.chunks)
+	if err := <-s.done; err != nil {
+		failure = err.Error()
+	}
+	if failure != "" {
+		s.server.Write(protocol.BuildCopyFailPgMessage(failure).Pack())
+	} else {
+		s.server.Write(protocol.BuildCopyDonePgMessage().Pack())
+	}
+	s.result = readShardResult(s.server)
+}
+
+// Wait for the server to start the copy. Returns the CopyInResponse or
+// CopyOutResponse or nil if the server refused the copy
+func (s *shardCopyStream) awaitCopyResponse(kind int) *protocol.RawPgMessage {
+	for {
+		rm, err := protocol.GetRawPgMessage(s.server)
+		if err != nil {
+			s.result = shardResult{shardAddr: s.shardAddr, err: err}
+			return nil
+		}
+		switch rm.Kind {
+		case kind:
+			return rm
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			errMsg := &protocol.ErrorResponsePgMessage{}
+			errMsg, _ = errMsg.Unpack(rm)
+			s.result = readShardResult(s.server)
+			s.result.errMsg = errMsg
+			return nil
+		case protocol.BMESSAGE_READY_FOR_QUERY:
+			s.result = shardResult{shardAddr: s.shardAddr, err: fmt.Errorf("server did not start the copy")}
+			return nil
+		}
+	}
+}
+
+// The row count of a "COPY n" command tag
+func parseCopyCount(tag string) int {
+	tag = strings.TrimRight(tag, "\x00")
+	count, _ := strconv.Atoi(strings.TrimPrefix(tag, "COPY "))
+	return count
+}
+
+// Quote a string as a SQL literal
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Find the sharded or reference table a COPY targets. Tables are matched
+// with and without their schema
+func getCopyTableConfig(database *DatabaseConfig, copyStatement *query.CopyStatement) (*TableConfig, bool) {
+	if copyStatement.Query {
+		return nil, false
+	}
+	return database.GetRelationTableConfig(copyStatement.Schema, copyStatement.Table)
+}
+
+// Whether a COPY reads from a sharded table, either directly or through
+// the query it copies the result of
+func copyReadsShardedTable(database *DatabaseConfig, statement *query.Statement, copyStatement *query.CopyStatement) bool {
+	if !copyStatement.Query {
+		table, ok := getCopyTableConfig(database, copyStatement)
+		return ok && !table.Reference
+	}
+	for _, ref := range query.Tables(statement) {
+		if table, ok := database.GetRelationTableConfig(ref.Schema, ref.Table); ok && !table.Reference {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up the key ranges of the shards a copy writes to after the shard
+// map changed
+func refreshCopyKeyRanges(streams []*shardCopyStream, config *SpannerConfig, databaseName string) {
+	database, ok := config.GetDatabaseConfigByName(databaseName)
+	for _, stream := range streams {
+		stream.keyRange = EMPTY_KEY_RANGE
+		if !ok {
+			continue
+		}
+		if cluster, ok := database.GetClusterConfigByHostPort(stream.shardAddr); ok {
+			stream.keyRange, _ = cluster.GetKeyRange()
+		}
+	}
+}
+
+// Find the position of the shard key among the columns being copied. The
+// table's own column order is looked up when the COPY lists no columns
+func getShardKeyColumn(server *ServerConnection, copyStatement *query.CopyStatement, table *TableConfig) (int, error) {
+	columns := copyStatement.Columns
+	if len(columns) == 0 {
+		rows, err := server.QueryRows(fmt.Sprintf(
+			"SELECT attname FROM pg_attribute WHERE attrelid = %s::regclass AND attnum > 0 AND NOT attisdropped ORDER BY attnum",
+			quoteLiteral(copyStatement.Relation),
+		))
+		if err != nil {
+			return 0, err
+		}
+		for _, row := range rows {
+			columns = append(columns, string(row.Values[0]))
+		}
+	}
+	index := slices.Index(columns, table.ShardKey)
+	if index == -1 {
+		return 0, buildQueryError("42703", fmt.Sprintf("COPY into sharded table %s must include its shard key column %s", copyStatement.Table, table.ShardKey))
+	}
+	return index, nil
+}
+
+// Run a COPY FROM STDIN into a sharded table. The same COPY is started on
+// every shard, the client's rows are split on their shard key and each
+// shard receives its own rows. The client sees a single copy with the
+// combined row count. Every shard receives all rows of a reference table
+// and outside of a transaction the copy is prepared on every shard
+// before it is committed on any
+func handleShardedCopyIn(
+	queryText string,
+	copyStatement *query.CopyStatement,
+	table *TableConfig,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	if copyStatement.Format == query.COPY_FORMAT_BINARY {
+		writeSyntheticError(client, buildQueryError("0A000", fmt.Sprintf("binary COPY into sharded table %s is not supported", copyStatement.Table)))
+		return
+	}
+
+	coordinated := table.Reference && !client.InTransaction()
+	servers, err := getShardConnections(client, requester, database)
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for COPY", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+	defer releaseShardConnections(client, requester, database, servers)
+
+	keyColumn := 0
+	if coordinated {
+		err = beginCoordinatedTransaction(servers)
+	} else if !table.Reference {
+		keyColumn, err = getShardKeyColumn(servers[0], copyStatement, table)
+	}
+	if err != nil {
+		errMsg, ok := err.(*protocol.ErrorResponsePgMessage)
+		if !ok {
+			errMsg = buildLostConnectionError(servers[0].GetClusterConfig().GetAddr(), database.Name, err)
+		}
+		writeSyntheticError(client, errMsg)
+		return
+	}
+
+	// A key range being moved can hold back rows routed to it. The key
+	// ranges come from the database config since pooled connections can
+	// predate the last change to the shard map
+	write := shardRouting.BeginWrite(database.Name)
+	defer write.Finish(client)
+	streams := make([]*shardCopyStream, len(servers))
+	for i, server := range servers {
+		streams[i] = &shardCopyStream{
+			shardAddr: server.GetClusterConfig().GetAddr(),
+			server:    server,
+			pending:   make([]byte, 0, COPY_CHUNK_SIZE),
+		}
+		server.IssueQuery(queryText)
+	}
+	refreshCopyKeyRanges(streams, requester.GetConfig(), database.Name)
+
+	// Every shard has to accept the copy before the client is asked for data
+	var copyInResponse *protocol.RawPgMessage
+	refused := false
+	for _, stream := range streams {
+		if response := stream.awaitCopyResponse(protocol.BMESSAGE_COPY_IN_RESPONSE); response != nil {
+			copyInResponse = response
+		} else {
+			refused = true
+		}
+	}
+	if refused {
+		results := make([]shardResult, 0, len(streams))
+		for _, stream := range streams {
+			if stream.result.shardAddr == "" {
+				stream.start()
+				stream.finish("COPY could not be started on every shard")
+			}
+			results = append(results, stream.result)
+		}
+		if coordinated {
+			endPreparedTransaction(servers, results, newPreparedTransactionId("copy", client.Ctx.ClientPid), database.Name)
+		}
+		writeShardResults(client, database.Name, results, "", nil)
+		return
+	}
+
+	client.Write(copyInResponse.Pack())
+	for _, stream := range streams {
+		stream.start()
+	}
+
+	splitter := newCopyRowSplitter(copyStatement)
+	headerPending := copyStatement.Header
+	var routeErr *protocol.ErrorResponsePgMessage
+	route := func(row []byte) error {
+		if headerPending {
+			// Every shard skips its own copy of the header
+			headerPending = false
+			for _, stream := range streams {
+				stream.add(row)
+			}
+			return nil
+		}
+		if isCopyEndMarker(row) {
+			return nil
+		}
+		if table.Reference {
+			for _, stream := range streams {
+				stream.add(row)
+			}
+			return nil
+		}
+		value, null, err := copyField(copyStatement, row, keyColumn)
+		if err != nil {
+			return buildQueryError("22P04", fmt.Sprintf("invalid COPY data for %s: %s", copyStatement.Table, err))
+		}
+		if null {
+			return buildQueryError("23502", fmt.Sprintf("null value in shard key column %s of %s", table.ShardKey, copyStatement.Table))
+		}
+		key, err := shardKeyText(query.Constant{Value: string(value)}, table.GetShardKeyType())
+		if err != nil {
+			return buildQueryError("22P02", fmt.Sprintf("invalid COPY data for %s: %s", copyStatement.Table, err))
+		}
+		id := KeyspaceId([]byte(key))
+		if write.Route(id) {
+			refreshCopyKeyRanges(streams, requester.GetConfig(), database.Name)
+		}
+		for _, stream := range streams {
+			if stream.keyRange.Contains(id) {
+				stream.add(row)
+				return nil
+			}
+		}
+		return buildQueryError("XX000", fmt.Sprintf("no shard of %s owns keyspace id %016x", database.Name, id))
+	}
+
+	// Read the client's data until it ends the copy. After a routing
+	// error the rest of the data is read and dropped
+	failure := ""
+	clientLost := false
+	for done := false; !done; {
+		rm, err := protocol.GetRawPgMessage(client)
+		if err != nil {
+			slog.Error("Error reading COPY data from client", "error", err)
+			failure = "client connection lost during COPY"
+			clientLost = true
+			break
+		}
+		switch rm.Kind {
+		case protocol.MESSAGE_COPY_DATA:
+			if routeErr == nil {
+				if err := splitter.Split(rm.Data, route); err != nil {
+					routeErr = err.(*protocol.ErrorResponsePgMessage)
+				}
+			}
+		case protocol.MESSAGE_COPY_DONE:
+			if routeErr == nil {
+				if err := splitter.Finish(route); err != nil {
+					routeErr = err.(*protocol.ErrorResponsePgMessage)
+				}
+			}
+			done = true
+		case protocol.FMESSAGE_COPY_FAIL:
+			copyFail := &protocol.CopyFailPgMessage{}
+			copyFail, _ = copyFail.Unpack(rm)
+			failure = copyFail.Message
+			done = true
+		}
+	}
+	if routeErr != nil {
+		failure = routeErr.GetErrorResponseField(protocol.NOTICE_KIND_MESSAGE)
+	}
+
+	results := make([]shardResult, 0, len(streams))
+	copied := 0
+	for _, stream := range streams {
+		stream.finish(failure)
+		results = append(results, stream.result)
+		copied += parseCopyCount(stream.result.tag)
+	}
+	if table.Reference {
+		// Every shard holds the same rows
+		copied = parseCopyCount(results[0].tag)
+	}
+	if coordinated {
+		endPreparedTransaction(servers, results, newPreparedTransactionId("copy", client.Ctx.ClientPid), database.Name)
+	}
+	if clientLost {
+		return
+	}
+	slog.Info("Copied rows into shards", "table", copyStatement.Table, "rows", copied, "shards", len(streams))
+	writeShardResults(client, database.Name, results, fmt.Sprintf("COPY %d", copied), routeErr)
+}
+
+// Run a COPY TO STDOUT that reads from a sharded table. The COPY runs on
+// every shard and the rows of the shards are sent to the client one
+// shard after the other as a single copy
+func handleShardedCopyOut(
+	queryText string,
+	copyStatement *query.CopyStatement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	if copyStatement.Format == query.COPY_FORMAT_BINARY {
+		writeSyntheticError(client, buildQueryError("0A000", "binary COPY from a sharded table is not supported"))
+		return
+	}
+	if errMsg := checkShardedCopyQuery(copyStatement, database); errMsg != nil {
+		writeSyntheticError(client, errMsg)
+		return
+	}
+
+	servers, err := getShardConnections(client, requester, database)
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for COPY", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+	defer releaseShardConnections(client, requester, database, servers)
+
+	// The shards all start producing rows right away and wait for them to
+	// be read one shard at a time
+	streams := make([]*shardCopyStream, len(servers))
+	for i, server := range servers {
+		streams[i] = &shardCopyStream{shardAddr: server.GetClusterConfig().GetAddr(), server: server}
+		server.IssueQuery(queryText)
+	}
+	results, copied := relayShardedCopyOut(client, streams, copyStatement.Header)
+	writeShardResults(client, database.Name, results, fmt.Sprintf("COPY %d", copied), nil)
+}
+
+// Check that the query of a COPY (SELECT ...) gives the same rows when
+// run on every shard. Rows are only put one after the other, so clauses
+// working on all rows at once and joins that are not co-located are
+// rejected
+func checkShardedCopyQuery(copyStatement *query.CopyStatement, database *DatabaseConfig) *protocol.ErrorResponsePgMessage {
+	if !copyStatement.Query {
+		return nil
+	}
+	statements, err := query.Parse(copyStatement.QueryText)
+	if err != nil || len(statements) != 1 || statements[0].Kind != query.KIND_SELECT {
+		return buildQueryError("0A000", "COPY of a query on sharded tables must copy a single SELECT")
+	}
+	if clause := query.MergingClause(statements[0]); clause != "" {
+		errMsg := buildQueryError("0A000", fmt.Sprintf("COPY of a query using %s on sharded tables is not supported", clause))
+		errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{
+			Type: 'D', Value: "The query runs on every shard and the rows of the shards are sent one after the other.",
+		}
+		return errMsg
+	}
+	if refs := findShardedTables(statements[0], database); len(refs) > 1 {
+		return checkColocated(statements[0], refs)
+	}
+	return nil
+}
+
+// Send the client the rows of every shard one after the other as a
+// single copy. A CSV header is only sent once. Returns the result of
+// each shard and the number of rows copied
+func relayShardedCopyOut(client io.ReadWriter, streams []*shardCopyStream, header bool) ([]shardResult, int) {
+	var copyOutResponse *protocol.RawPgMessage
+	refused := false
+	for _, stream := range streams {
+		if response := stream.awaitCopyResponse(protocol.BMESSAGE_COPY_OUT_RESPONSE); response != nil {
+			copyOutResponse = response
+		} else {
+			refused = true
+		}
+	}
+
+	relay := newResultRelay(client)
+	defer relay.Release()
+	if !refused {
+		relay.writer.Write(copyOutResponse.Pack())
+	}
+	results := make([]shardResult, 0, len(streams))
+	copied := 0
+	failed := refused
+	for i, stream := range streams {
+		if stream.result.shardAddr != "" {
+			// Refused the copy and already answered
+			results = append(results, stream.result)
+			continue
+		}
+		if failed {
+			// Nothing more goes to the client once a shard failed. The
+			// rest of the shards are read so their connections stay usable
+			stream.result = readShardResult(stream.server)
+		} else {
+			stream.result = relay.ForwardCopyOut(stream.server, header && i > 0)
+		}
+		failed = failed || stream.result.err != nil || stream.result.errMsg != nil
+		copied += parseCopyCount(stream.result.tag)
+		results = append(results, stream.result)
+	}
+	if !failed {
+		relay.writer.Write(protocol.BuildCopyDonePgMessage().Pack())
+		slog.Info("Copied rows out of shards", "rows", copied, "shards", len(streams))
+	}
+	relay.writer.Flush()
+	return results, copied
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestCopyReadsShardedTable(t *testing.T) {
+	database := &DatabaseConfig{Tables: []TableConfig{{Name: "users", ShardKey: "id"}}}
+	cases := map[string]bool{
+		"COPY users TO STDOUT":                                            true,
+		"COPY public.users TO STDOUT (FORMAT csv)":                        true,
+		"COPY (SELECT u.id FROM orders o JOIN users u ON true) TO STDOUT": true,
+		"COPY (SELECT * FROM orders) TO STDOUT":                           false,
+		"COPY orders TO STDOUT":                                           false,
+	}
+	for sql, expected := range cases {
+		statements, err := query.Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyStatement, err := query.ParseCopy(statements[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copyReadsShardedTable(database, statements[0], copyStatement) != expected {
+			t.Fatalf("%s: expected reads sharded table to be %v", sql, expected)
+		}
+	}
+}
+
+func TestCheckShardedCopyQuery(t *testing.T) {
+	database := &DatabaseConfig{Tables: []TableConfig{
+		{Name: "users", ShardKey: "id"},
+		{Name: "orders", ShardKey: "user_id"},
+	}}
+	cases := map[string]bool{
+		"COPY users TO STDOUT": true,
+		"COPY (SELECT id, name FROM users WHERE id > 10) TO STDOUT":                       true,
+		"COPY (SELECT * FROM users u JOIN orders o ON o.user_id = u.id) TO STDOUT":        true,
+		"COPY (SELECT count(*) FROM users) TO STDOUT":                                     false,
+		"COPY (SELECT * FROM users ORDER BY id LIMIT 10) TO STDOUT":                       false,
+		"COPY (SELECT DISTINCT name FROM users) TO STDOUT (FORMAT csv)":                   false,
+		"COPY (SELECT * FROM users u JOIN orders o ON o.id = u.id) TO STDOUT":             false,
+		"COPY (SELECT name FROM users GROUP BY name) TO STDOUT WITH (FORMAT csv, HEADER)": false,
+	}
+	for sql, allowed := range cases {
+		statements, _ := query.Parse(sql)
+		copyStatement, err := query.ParseCopy(statements[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errMsg := checkShardedCopyQuery(copyStatement, database); (errMsg == nil) != allowed {
+			t.Fatalf("%s: expected allowed to be %v, got %v", sql, allowed, errMsg)
+		}
+	}
+}
+
+// The messages of a shard copying out a CSV with a header
+func buildCopyOut(rows ...string) [][]byte {
+	messages := [][]byte{
+		protocol.BuildCopyOutResponsePgMessage(0, []int{0, 0}).Pack(),
+		protocol.BuildCopyDataPgMessage([]byte("id,name\n")).Pack(),
+	}
+	for _, row := range rows {
+		messages = append(messages, protocol.BuildCopyDataPgMessage([]byte(row+"\n")).Pack())
+	}
+	return append(messages,
+		protocol.BuildCopyDonePgMessage().Pack(),
+		protocol.BuildCommandCompletePgMessage(fmt.Sprintf("COPY %d", len(rows))).Pack(),
+		protocol.BuildReadyForQueryPgMessage(TRANSACTION_STATUS_IDLE).Pack(),
+	)
+}
+
+func TestRelayShardedCopyOut(t *testing.T) {
+	first, _ := newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildCopyOut("1,ann", "2,bob")...)
+	second, _ := newScriptedServer(&ClusterConfig{Host: "b", Port: 5432}, buildCopyOut("3,cid")...)
+	streams := []*shardCopyStream{{shardAddr: "a:5432", server: first}, {shardAddr: "b:5432", server: second}}
+
+	var client bytes.Buffer
+	results, copied := relayShardedCopyOut(&readWriter{&bytes.Buffer{}, &client}, streams, true)
+	if copied != 3 || len(results) != 2 {
+		t.Fatalf("Expected 3 rows from 2 shards, got %d from %d", copied, len(results))
+	}
+	var kinds []byte
+	var data string
+	for {
+		rm, err := protocol.GetRawPgMessage(&client)
+		if err != nil {
+			break
+		}
+		kinds = append(kinds, byte(rm.Kind))
+		if rm.Kind == protocol.MESSAGE_COPY_DATA {
+			data += string(rm.Data)
+		}
+	}
+	if string(kinds) != "Hddddc" {
+		t.Fatalf("Expected one copy with 4 rows, got messages %q", kinds)
+	}
+	if data != "id,name\n1,ann\n2,bob\n3,cid\n" {
+		t.Fatalf("Expected the header once followed by every row, got %q", data)
+	}
+
+	// A shard failing mid copy ends the copy without CopyDone
+	failing := buildCopyOut("3,cid")
+	errMsg := buildQueryError("57014", "canceling statement due to user request")
+	failing = append(failing[:3], errMsg.Pack(), protocol.BuildReadyForQueryPgMessage(TRANSACTION_STATUS_IDLE).Pack())
+	first, _ = newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildCopyOut("1,ann")...)
+	second, _ = newScriptedServer(&ClusterConfig{Host: "b", Port: 5432}, failing...)
+	streams = []*shardCopyStream{{shardAddr: "a:5432", server: first}, {shardAddr: "b:5432", server: second}}
+	client.Reset()
+	results, _ = relayShardedCopyOut(&readWriter{&bytes.Buffer{}, &client}, streams, true)
+	if results[1].errMsg == nil {
+		t.Fatal("Expected the error of the second shard")
+	}
+	if bytes.Contains(client.Bytes(), protocol.BuildCopyDonePgMessage().Pack()) {
+		t.Fatal("A failed copy should not be completed")
+	}
+}
+
+func TestShardedCopyInErrors(t *testing.T) {
+	database := lookupTestDatabase()
+	table, _ := database.GetTableConfig("users")
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	parseCopy := func(sql string) *query.CopyStatement {
+		statements, _ := query.Parse(sql)
+		copyStatement, err := query.ParseCopy(statements[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return copyStatement
+	}
+
+	// Errors inside a client transaction keep the client in it
+	sql := "COPY users FROM STDIN (FORMAT binary)"
+	client, clientConn := newReferenceClient(1)
+	client.pendingBegin = "BEGIN"
+	handleShardedCopyIn(sql, parseCopy(sql), table, client, requester, database)
+	if code := sentErrorCode(clientConn); code != "0A000" {
+		t.Fatalf("Expected binary COPY to be rejected with 0A000, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected the client to be told it is in a transaction, got %q", status)
+	}
+
+	// A cluster closing the connection on BEGIN fails the copy before it
+	// starts
+	server, _ := newSessionServer(database, &database.Clusters[0])
+	returned := serveScriptedPool(requester, map[string][]*ServerConnection{database.Clusters[0].GetAddr(): {server}})
+	sql = "COPY users FROM STDIN"
+	client, clientConn = newReferenceClient(1)
+	client.pendingBegin = "BEGIN"
+	handleShardedCopyIn(sql, parseCopy(sql), table, client, requester, database)
+	<-returned
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the copy to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected the client to be told it is in a transaction, got %q", status)
+	}
+}
+
+func TestShardedCopyOutErrors(t *testing.T) {
+	database := lookupTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+
+	// Errors inside a client transaction keep the client in it
+	sql := "COPY users TO STDOUT (FORMAT binary)"
+	statements, _ := query.Parse(sql)
+	copyStatement, _ := query.ParseCopy(statements[0])
+	client, clientConn := newReferenceClient(1)
+	client.pendingBegin = "BEGIN"
+	handleShardedCopyOut(sql, copyStatement, client, requester, database)
+	if code := sentErrorCode(clientConn); code != "0A000" {
+		t.Fatalf("Expected binary COPY to be rejected with 0A000, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected the client to be told it is in a transaction, got %q", status)
+	}
+
+	// A cluster closing the connection on BEGIN fails the copy before it
+	// starts
+	server, _ := newSessionServer(database, &database.Clusters[0])
+	returned := serveScriptedPool(requester, map[string][]*ServerConnection{database.Clusters[0].GetAddr(): {server}})
+	sql = "COPY users TO STDOUT"
+	statements, _ = query.Parse(sql)
+	copyStatement, _ = query.ParseCopy(statements[0])
+	client, clientConn = newReferenceClient(1)
+	client.pendingBegin = "BEGIN"
+	handleShardedCopyOut(sql, copyStatement, client, requester, database)
+	<-returned
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the copy to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected the client to be told it is in a transaction, got %q", status)
+	}
+}
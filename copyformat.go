@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+// Splits the data of a text or csv COPY into rows. The data arrives in
+// chunks that do not line up with rows so the split state is carried
+// from one chunk to the next
+type copyRowSplitter struct {
+	format *query.CopyStatement
+	// The start of a row that continues in the next chunk
+	partial  []byte
+	escaped  bool
+	inQuotes bool
+}
+
+func newCopyRowSplitter(format *query.CopyStatement) *copyRowSplitter {
+	return &copyRowSplitter{format: format}
+}
+
+// Call emit with every row completed by the chunk. Rows include their
+// line ending and are only valid until emit returns
+func (s *copyRowSplitter) Split(chunk []byte, emit func(row []byte) error) error {
+	csv := s.format.Format == query.COPY_FORMAT_CSV
+	start := 0
+	for i, c := range chunk {
+		if s.escaped {
+			s.escaped = false
+			continue
+		}
+		switch {
+		case !csv && c == '\\':
+			s.escaped = true
+		case csv && s.inQuotes && c == s.format.Escape && s.format.Escape != s.format.Quote:
+			s.escaped = true
+		case csv && c == s.format.Quote:
+			s.inQuotes = !s.inQuotes
+		case c == '\n' && !s.inQuotes:
+			row := chunk[start : i+1]
+			if len(s.partial) > 0 {
+				s.partial = append(s.partial, row...)
+				row = s.partial
+			}
+			if err := emit(row); err != nil {
+				return err
+			}
+			s.partial = s.partial[:0]
+			start = i + 1
+		}
+	}
+	s.partial = append(s.partial, chunk[start:]...)
+	return nil
+}
+
+// Emit the last row if the data did not end with a line ending
+func (s *copyRowSplitter) Finish(emit func(row []byte) error) error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	row := append(s.partial, '\n')
+	s.partial = nil
+	return emit(row)
+}
+
+// Whether the row is the \. line that may mark the end of the data
+func isCopyEndMarker(row []byte) bool {
+	return string(bytes.TrimRight(row, "\r\n")) == `\.`
+}
+
+// Extract the value of the column at index from a row. Returns nil
+// and true for NULL values
+func copyField(format *query.CopyStatement, row []byte, index int) ([]byte, bool, error) {
+	row = bytes.TrimSuffix(row, []byte("\n"))
+	row = bytes.TrimSuffix(row, []byte("\r"))
+	if format.Format == query.COPY_FORMAT_CSV {
+		return csvField(format, row, index)
+	}
+	return textField(format, row, index)
+}
+
+func textField(format *query.CopyStatement, row []byte, index int) ([]byte, bool, error) {
+	column := 0
+	start := 0
+	for i := 0; i <= len(row); i++ {
+		if i < len(row) && row[i] == '\\' {
+			i++
+			continue
+		}
+		if i < len(row) && row[i] != format.Delimiter {
+			continue
+		}
+		if column == index {
+			raw := row[start:min(i, len(row))]
+			if string(raw) == format.Null {
+				return nil, true, nil
+			}
+			return unescapeTextField(raw), false, nil
+		}
+		column++
+		start = i + 1
+	}
+	return nil, false, fmt.Errorf("row has %d columns, expected at least %d", column, index+1)
+}
+
+// Undo the backslash escapes of the text format
+func unescapeTextField(raw []byte) []byte {
+	if bytes.IndexByte(raw, '\\') == -1 {
+		return raw
+	}
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' || i+1 == len(raw) {
+			out = append(out, raw[i])
+			continue
+		}
+		i++
+		switch c := raw[i]; c {
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case 'x':
+			end := i + 1
+			for end < len(raw) && end < i+3 && isHexDigit(raw[end]) {
+				end++
+			}
+			if end == i+1 {
+				out = append(out, c)
+				continue
+			}
+			value, _ := strconv.ParseUint(string(raw[i+1:end]), 16, 8)
+			out = append(out, byte(value))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i
+			for end < len(raw) && end < i+3 && raw[end] >= '0' && raw[end] <= '7' {
+				end++
+			}
+			value, _ := strconv.ParseUint(string(raw[i:end]), 8, 16)
+			out = append(out, byte(value))
+			i = end - 1
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func csvField(format *query.CopyStatement, row []byte, index int) ([]byte, bool, error) {
+	column := 0
+	i := 0
+	for {
+		var value []byte
+		quoted := i < len(row) && row[i] == format.Quote
+		if quoted {
+			value = make([]byte, 0)
+			i++
+			for {
+				if i >= len(row) {
+					return nil, false, fmt.Errorf("unterminated quoted field in column %d", column+1)
+				}
+				c := row[i]
+				if c == format.Escape && i+1 < len(row) && (row[i+1] == format.Quote || row[i+1] == format.Escape) {
+					value = append(value, row[i+1])
+					i += 2
+					continue
+				}
+				if c == format.Quote {
+					i++
+					break
+				}
+				value = append(value, c)
+				i++
+			}
+			// Anything up to the next delimiter is part of the value
+			end := i
+			for end < len(row) && row[end] != format.Delimiter {
+				end++
+			}
+			value = append(value, row[i:end]...)
+			i = end
+		} else {
+			end := i
+			for end < len(row) && row[end] != format.Delimiter {
+				end++
+			}
+			value = row[i:end]
+			i = end
+		}
+		if column == index {
+			// Only unquoted values can be NULL
+			if !quoted && string(value) == format.Null {
+				return nil, true, nil
+			}
+			return value, false, nil
+		}
+		if i >= len(row) {
+			return nil, false, fmt.Errorf("row has %d columns, expected at least %d", column+1, index+1)
+		}
+		column++
+		i++
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func parseCopyStatement(t *testing.T, sql string) *query.CopyStatement {
+	statements, err := query.Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyStatement, err := query.ParseCopy(statements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return copyStatement
+}
+
+func TestCopyRowSplitter(t *testing.T) {
+	cases := map[string][]string{
+		"COPY t FROM STDIN":                   {"1\ta\\\nb\n", "2\tc\n", "\\.\n", "3\tno newline\n"},
+		"COPY t FROM STDIN WITH (FORMAT csv)": {"1,\"a\nb\"\n", "2,\"say \"\"hi\"\"\"\r\n", "3,last\n"},
+	}
+	for sql, expected := range cases {
+		copyStatement := parseCopyStatement(t, sql)
+		data := ""
+		for _, row := range expected {
+			data += row
+		}
+		// The last row is sent without its newline
+		data = data[:len(data)-1]
+
+		// Split the data in every possible place across two chunks
+		for cut := 0; cut <= len(data); cut++ {
+			splitter := newCopyRowSplitter(copyStatement)
+			rows := make([]string, 0)
+			emit := func(row []byte) error {
+				rows = append(rows, string(row))
+				return nil
+			}
+			splitter.Split([]byte(data[:cut]), emit)
+			splitter.Split([]byte(data[cut:]), emit)
+			splitter.Finish(emit)
+			if len(rows) != len(expected) {
+				t.Fatalf("%s cut at %d: expected rows %q, got %q", sql, cut, expected, rows)
+			}
+			for i := range rows {
+				if rows[i] != expected[i] {
+					t.Fatalf("%s cut at %d: expected rows %q, got %q", sql, cut, expected, rows)
+				}
+			}
+		}
+	}
+}
+
+func TestCopyField(t *testing.T) {
+	type fieldCase struct {
+		sql   string
+		row   string
+		index int
+		value string
+		null  bool
+	}
+	cases := []fieldCase{
+		{"COPY t FROM STDIN", "1\tname\\twith tab\t\\N\n", 1, "name\twith tab", false},
+		{"COPY t FROM STDIN", "1\tname\t\\N\n", 2, "", true},
+		{"COPY t FROM STDIN", "a\\\tb\t\\x41\\101\r\n", 1, "AA", false},
+		{"COPY t FROM STDIN (DELIMITER '|')", "1|two|3\n", 1, "two", false},
+		{"COPY t FROM STDIN CSV", "1,\"a,b\",c\n", 1, "a,b", false},
+		{"COPY t FROM STDIN CSV", "1,\"say \"\"hi\"\"\",c\n", 1, `say "hi"`, false},
+		{"COPY t FROM STDIN CSV", "1,,c\n", 1, "", true},
+		{"COPY t FROM STDIN CSV", "1,\"\",c\n", 1, "", false},
+		{"COPY t FROM STDIN CSV ESCAPE '\\'", "1,\"a\\\"b\",c\n", 1, `a"b`, false},
+	}
+	for _, c := range cases {
+		value, null, err := copyField(parseCopyStatement(t, c.sql), []byte(c.row), c.index)
+		if err != nil {
+			t.Fatalf("%s: error extracting field %d of %q: %s", c.sql, c.index, c.row, err)
+		}
+		if string(value) != c.value || null != c.null {
+			t.Fatalf("%s: field %d of %q: expected %q null=%v, got %q null=%v", c.sql, c.index, c.row, c.value, c.null, value, null)
+		}
+	}
+
+	if _, _, err := copyField(parseCopyStatement(t, "COPY t FROM STDIN"), []byte("1\t2\n"), 2); err == nil {
+		t.Fatal("Expected an error for a missing column")
+	}
+}
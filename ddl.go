@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Schema changes to a database spread over several clusters run on every cluster, in a two
+/// phase commit when they can run in a transaction and one cluster after the other otherwise
+
+const (
+	DDL_PROGRESS_INTERVAL = 5 * time.Second
+	DDL_PROGRESS_QUERY    = "SELECT phase, blocks_done, blocks_total, tuples_done, tuples_total FROM pg_stat_progress_create_index WHERE pid = %d"
+)
+
+func buildNoticePacket(message string) []byte {
+	return protocol.BuildNoticeResponsePgMessage(map[string]string{
+		protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "NOTICE",
+		protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "NOTICE",
+		protocol.NOTICE_KIND_CODE:                  "00000",
+		protocol.NOTICE_KIND_MESSAGE:               message,
+	}).Pack()
+}
+
+// Run DDL on every cluster of a database that spans several of them.
+// Returns whether the query was handled
+func routeDDL(
+	queryText string,
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	if len(database.Clusters) < 2 {
+		return false
+	}
+	ddl := 0
+	var outsideTransaction *query.Statement
+	for _, statement := range statements {
+		if statement.Kind == query.KIND_DDL {
+			ddl++
+		}
+		if !statement.CanRunInTransaction() {
+			outsideTransaction = statement
+		}
+	}
+	if ddl == 0 {
+		return false
+	}
+	if ddl < len(statements) {
+		writeSyntheticError(client, buildQueryError("0A000", "DDL must be sent on its own or together with other DDL"))
+		return true
+	}
+
+	if outsideTransaction != nil {
+		if len(statements) > 1 || client.InTransaction() {
+			writeSyntheticError(client, buildQueryError(
+				"25001",
+				fmt.Sprintf("%s cannot run inside a transaction block", ddlCommandName(outsideTransaction)),
+			))
+			return true
+		}
+		handleSequentialDDL(queryText, outsideTransaction, client, requester, database)
+		return true
+	}
+	handleDistributedDDL(queryText, statements, client, requester, database)
+	return true
+}
+
+// The command of a DDL statement for messages, e.g. CREATE INDEX
+func ddlCommandName(statement *query.Statement) string {
+	words := make([]string, 0, 3)
+	for _, token := range statement.Tokens {
+		if token.Kind != query.TOKEN_IDENT || len(words) == 3 {
+			break
+		}
+		words = append(words, strings.ToUpper(token.Value))
+	}
+	return strings.Join(words, " ")
+}
+
+// Run transactional DDL on every cluster. It is prepared on every
+// cluster before it is committed on any, right away outside of a client
+// transaction and when the client commits inside of one
+func handleDistributedDDL(
+	queryText string,
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	coordinated := !client.InTransaction()
+	servers, err := getShardConnections(client, requester, database)
+	if err == nil && coordinated {
+		if err = beginCoordinatedTransaction(servers); err != nil {
+			releaseShardConnections(client, requester, database, servers)
+		}
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for DDL", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+
+	for _, server := range servers {
+		server.IssueQuery(queryText)
+	}
+	results := make([]shardResult, 0, len(servers))
+	for _, server := range servers {
+		results = append(results, readShardResult(server))
+	}
+	if coordinated {
+		endPreparedTransaction(servers, results, newPreparedTransactionId("ddl", client.Ctx.ClientPid), database.Name)
+	}
+	releaseShardConnections(client, requester, database, servers)
+
+	slog.Info("Ran DDL on every shard", "statements", len(statements), "shards", len(servers), "coordinated", coordinated)
+	writeShardResults(client, database.Name, results, results[0].tag, nil)
+}
+
+// Run DDL that cannot be part of a transaction on one cluster after the
+// other. The client is told which cluster the DDL is running on and how
+// far an index build has got. The first failure stops the DDL so it is
+// not run on the clusters after it
+func handleSequentialDDL(
+	queryText string,
+	statement *query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	command := ddlCommandName(statement)
+	results := make([]shardResult, 0, len(database.Clusters))
+	var errMsg *protocol.ErrorResponsePgMessage
+	for i := range database.Clusters {
+		cluster := &database.Clusters[i]
+		shardAddr := cluster.GetAddr()
+		client.Write(buildNoticePacket(fmt.Sprintf("%s running on shard %s (%d of %d)", command, shardAddr, i+1, len(database.Clusters))))
+
+		server, err := getServerConnection(requester, database, shardAddr, client.Ctx.ClientPid, false)
+		if err != nil {
+			result := shardResult{shardAddr: shardAddr, transactionStatus: TRANSACTION_STATUS_IDLE}
+			if connErr, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+				result.errMsg = connErr
+			} else {
+				result.err = err
+			}
+			results = append(results, result)
+			break
+		}
+		server.IssueQuery(queryText)
+		stopProgress := reportDDLProgress(client, database, cluster, server.GetBackendPid(), command)
+		result := readShardResult(server)
+		stopProgress()
+		requester.ReturnConnection(server, database.Name, shardAddr, client.Ctx.ClientPid)
+		results = append(results, result)
+		if result.err != nil || result.errMsg != nil {
+			break
+		}
+		client.Write(buildNoticePacket(fmt.Sprintf("%s finished on shard %s", command, shardAddr)))
+	}
+
+	if len(results) < len(database.Clusters) {
+		failed := results[len(results)-1]
+		errMsg = failed.errMsg
+		if errMsg == nil {
+			errMsg = buildLostConnectionError(failed.shardAddr, database.Name, failed.err)
+		}
+		skipped := make([]string, 0)
+		for _, cluster := range database.Clusters[len(results):] {
+			skipped = append(skipped, cluster.GetAddr())
+		}
+		detail := errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL)
+		detail = strings.TrimSpace(detail + " Not run on shards " + strings.Join(skipped, ", ") + ".")
+		errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: detail}
+	}
+	slog.Info("Ran DDL on shards one at a time", "command", command, "shards", len(results), "failed", errMsg != nil)
+	writeShardResults(client, database.Name, results, results[0].tag, errMsg)
+}
+
+// Send the client a notice with the progress of an index build every
+// DDL_PROGRESS_INTERVAL until the returned function is called. Progress
+// is read from another connection to the cluster
+func reportDDLProgress(
+	client *ClientConnection,
+	database *DatabaseConfig,
+	cluster *ClusterConfig,
+	backendPid int,
+	command string,
+) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(DDL_PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		var monitor *ServerConnection
+		defer func() {
+			if monitor != nil {
+				monitor.Terminate()
+			}
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if monitor == nil {
+				var err error
+				if monitor, err = CreateServerConnection(database, cluster); err != nil {
+					slog.Warn("Cannot connect to report DDL progress", "cluster", cluster.GetAddr(), "error", err)
+					monitor = nil
+					continue
+				}
+			}
+			rows, err := monitor.QueryRows(fmt.Sprintf(DDL_PROGRESS_QUERY, backendPid))
+			if err != nil {
+				slog.Warn("Error reading DDL progress", "cluster", cluster.GetAddr(), "error", err)
+				monitor.Terminate()
+				monitor = nil
+				continue
+			}
+			if len(rows) != 1 || len(rows[0].Values) != 5 {
+				continue
+			}
+			select {
+			case <-done:
+				return
+			default:
+				client.Write(buildNoticePacket(fmt.Sprintf("%s on shard %s: %s", command, cluster.GetAddr(), formatIndexProgress(rows[0].Values))))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Describe a row of pg_stat_progress_create_index. The share of blocks
+// or tuples done is given when the phase reports them
+func formatIndexProgress(values [][]byte) string {
+	phase := string(values[0])
+	blocksDone, _ := strconv.ParseFloat(string(values[1]), 64)
+	blocksTotal, _ := strconv.ParseFloat(string(values[2]), 64)
+	tuplesDone, _ := strconv.ParseFloat(string(values[3]), 64)
+	tuplesTotal, _ := strconv.ParseFloat(string(values[4]), 64)
+	switch {
+	case blocksTotal > 0:
+		return fmt.Sprintf("%s (%.0f%% of blocks)", phase, 100*blocksDone/blocksTotal)
+	case tuplesTotal > 0:
+		return fmt.Sprintf("%s (%.0f%% of tuples)", phase, 100*tuplesDone/tuplesTotal)
+	default:
+		return phase
+	}
+}
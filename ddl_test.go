@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+// A database sharded over two clusters
+func ddlTestDatabase() *DatabaseConfig {
+	return &DatabaseConfig{
+		Name:   "test",
+		Tables: []TableConfig{{Name: "users", ShardKey: "id"}},
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-80"},
+			{Host: "b", Port: 5432, KeyRange: "80-"},
+		},
+	}
+}
+
+// The code of the error the proxy sent the client, "" when there is none
+func sentErrorCode(conn *scriptedConn) string {
+	return getErrorCode(conn.sent.Bytes())
+}
+
+func getErrorCode(data []byte) string {
+	sent := bytes.NewReader(data)
+	for {
+		rm, err := protocol.GetRawPgMessage(sent)
+		if err != nil {
+			return ""
+		}
+		if rm.Kind == protocol.BMESSAGE_ERROR_RESPONSE {
+			errMsg, _ := (&protocol.ErrorResponsePgMessage{}).Unpack(rm)
+			return errMsg.GetErrorResponseField(protocol.NOTICE_KIND_CODE)
+		}
+	}
+}
+
+func TestRouteDDL(t *testing.T) {
+	cases := []struct {
+		sql           string
+		inTransaction bool
+		handled       bool
+		code          string
+	}{
+		{"SELECT 1", false, false, ""},
+		{"CREATE TABLE a (id int); SELECT 1", false, true, "0A000"},
+		{"CREATE INDEX CONCURRENTLY i ON users (id)", true, true, "25001"},
+		{"CREATE INDEX CONCURRENTLY i ON users (id); CREATE TABLE a (id int)", false, true, "25001"},
+	}
+	for _, c := range cases {
+		statements, err := query.Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &scriptedConn{}
+		client := &ClientConnection{Conn: conn}
+		if c.inTransaction {
+			client.pendingBegin = "BEGIN"
+		}
+		if handled := routeDDL(c.sql, statements, client, nil, ddlTestDatabase()); handled != c.handled {
+			t.Fatalf("Expected %q handled to be %t", c.sql, c.handled)
+		}
+		if code := sentErrorCode(conn); code != c.code {
+			t.Fatalf("Expected %q to be answered with %q, got %q", c.sql, c.code, code)
+		}
+	}
+
+	// Databases on a single cluster run DDL like any other statement
+	database := ddlTestDatabase()
+	database.Clusters = database.Clusters[:1]
+	statements, _ := query.Parse("CREATE TABLE a (id int)")
+	if routeDDL("CREATE TABLE a (id int)", statements, &ClientConnection{}, nil, database) {
+		t.Fatal("Expected DDL on a single cluster not to be handled")
+	}
+
+	// Databases on several clusters need no tables listed, like those
+	// of tenants, to have their DDL run on every cluster
+	database = ddlTestDatabase()
+	database.Tables = nil
+	statements, _ = query.Parse("CREATE TABLE a (id int); SELECT 1")
+	conn := &scriptedConn{}
+	if !routeDDL("CREATE TABLE a (id int); SELECT 1", statements, &ClientConnection{Conn: conn}, nil, database) || sentErrorCode(conn) != "0A000" {
+		t.Fatal("Expected DDL on several clusters to be handled without tables")
+	}
+}
+
+func TestDDLCommandName(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"create index concurrently i on users (id)": "CREATE INDEX CONCURRENTLY",
+		"DROP INDEX CONCURRENTLY i":                 "DROP INDEX CONCURRENTLY",
+		"VACUUM":                                    "VACUUM",
+		"REINDEX TABLE users":                       "REINDEX TABLE USERS",
+	} {
+		statements, _ := query.Parse(sql)
+		if name := ddlCommandName(statements[0]); name != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, sql, name)
+		}
+	}
+}
+
+func TestFormatIndexProgress(t *testing.T) {
+	row := func(values ...string) [][]byte {
+		row := make([][]byte, 0, len(values))
+		for _, value := range values {
+			row = append(row, []byte(value))
+		}
+		return row
+	}
+	cases := []struct {
+		values   [][]byte
+		expected string
+	}{
+		{row("building index", "25", "100", "0", "0"), "building index (25% of blocks)"},
+		{row("loading tuples in tree", "0", "0", "3", "4"), "loading tuples in tree (75% of tuples)"},
+		{row("initializing", "0", "0", "0", "0"), "initializing"},
+	}
+	for _, c := range cases {
+		if progress := formatIndexProgress(c.values); progress != c.expected {
+			t.Fatalf("Expected %q, got %q", c.expected, progress)
+		}
+	}
+}
+
+// The server's answer to a statement completing with tag
+func buildCompletion(tag string, transactionStatus byte) []byte {
+	return append(
+		protocol.BuildCommandCompletePgMessage(tag).Pack(),
+		protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...,
+	)
+}
+
+func buildFailure(code string, transactionStatus byte) []byte {
+	return append(
+		buildQueryError(code, "failed").Pack(),
+		protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...,
+	)
+}
+
+func TestEndPreparedTransaction(t *testing.T) {
+	gid := "pgspanner_ddl_1_2_3"
+	prepare := "PREPARE TRANSACTION '" + gid + "'"
+	decision := gid + PREPARED_TRANSACTION_DECISION_SUFFIX
+	newServers := func(answers ...[][]byte) ([]*ServerConnection, []*scriptedConn, []shardResult) {
+		servers := make([]*ServerConnection, 0, len(answers))
+		conns := make([]*scriptedConn, 0, len(answers))
+		results := make([]shardResult, 0, len(answers))
+		for i, answer := range answers {
+			server, conn := newScriptedServer(&ClusterConfig{Host: string(rune('a' + i)), Port: 5432}, answer...)
+			servers = append(servers, server)
+			conns = append(conns, conn)
+			results = append(results, shardResult{shardAddr: server.GetClusterConfig().GetAddr(), tag: "CREATE TABLE"})
+		}
+		return servers, conns, results
+	}
+	expectQueries := func(conn *scriptedConn, expected ...string) {
+		t.Helper()
+		if queries := conn.queries(); !slices.Equal(queries, expected) {
+			t.Fatalf("Expected queries %q, got %q", expected, queries)
+		}
+	}
+
+	// Every cluster prepares before any commits
+	servers, conns, results := newServers(
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE)},
+	)
+	endPreparedTransaction(servers, results, gid, "test")
+	expectQueries(conns[0], prepare, "COMMIT PREPARED '"+gid+"'")
+	expectQueries(conns[1], "PREPARE TRANSACTION '"+decision+"'", "COMMIT PREPARED '"+decision+"'")
+	for i := range conns {
+		if results[i].errMsg != nil || results[i].rolledBack || results[i].transactionStatus != TRANSACTION_STATUS_IDLE {
+			t.Fatalf("Expected the transaction to commit on %s, got %+v", results[i].shardAddr, results[i])
+		}
+	}
+
+	// A cluster failing to prepare rolls back the clusters that prepared
+	// and the ones still to prepare
+	servers, conns, results = newServers(
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildCompletion("ROLLBACK PREPARED", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildFailure("55000", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE)},
+	)
+	endPreparedTransaction(servers, results, gid, "test")
+	expectQueries(conns[0], prepare, "ROLLBACK PREPARED '"+gid+"'")
+	expectQueries(conns[1], prepare)
+	expectQueries(conns[2], "ROLLBACK")
+	if !results[0].rolledBack || results[1].errMsg == nil || !results[2].rolledBack {
+		t.Fatalf("Expected the failed prepare to roll back every cluster, got %+v", results)
+	}
+
+	// A statement failing on one cluster rolls back the others without
+	// preparing
+	servers, conns, results = newServers(
+		[][]byte{buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE)},
+	)
+	results[1].errMsg = buildQueryError("42P07", "relation already exists")
+	endPreparedTransaction(servers, results, gid, "test")
+	expectQueries(conns[0], "ROLLBACK")
+	expectQueries(conns[1], "ROLLBACK")
+	if !results[0].rolledBack || results[1].rolledBack {
+		t.Fatalf("Expected only the clusters that succeeded to be rolled back, got %+v", results)
+	}
+
+	// A cluster failing to commit keeps the transaction prepared and
+	// says so
+	servers, _, results = newServers(
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildFailure("08006", TRANSACTION_STATUS_IDLE)},
+	)
+	endPreparedTransaction(servers, results, gid, "test")
+	if results[0].errMsg != nil || results[1].errMsg == nil {
+		t.Fatalf("Expected the commit to fail on the second cluster only, got %+v", results)
+	}
+	if detail := results[1].errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL); !strings.Contains(detail, gid) {
+		t.Fatalf("Expected the detail to name the prepared transaction, got %q", detail)
+	}
+
+	// The decision stays prepared on the last cluster when another one
+	// fails to commit so the recovery commits both
+	servers, conns, results = newServers(
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE), buildFailure("08006", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE)},
+	)
+	endPreparedTransaction(servers, results, gid, "test")
+	expectQueries(conns[1], "PREPARE TRANSACTION '"+decision+"'")
+	if results[0].errMsg == nil {
+		t.Fatal("Expected the commit to fail on the first cluster")
+	}
+
+	// Losing the last cluster while it prepares the decision leaves
+	// the others prepared since the decision may have been prepared
+	servers, conns, results = newServers(
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE)},
+		[][]byte{},
+	)
+	endPreparedTransaction(servers, results, gid, "test")
+	expectQueries(conns[0], prepare)
+	expectQueries(conns[1], prepare)
+	expectQueries(conns[2], "PREPARE TRANSACTION '"+decision+"'")
+	if results[0].rolledBack || results[1].rolledBack || results[2].errMsg == nil {
+		t.Fatalf("Expected the lost decision to keep every cluster prepared, got %+v", results)
+	}
+	if detail := results[2].errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL); !strings.Contains(detail, gid) {
+		t.Fatalf("Expected the detail to name the prepared transaction, got %q", detail)
+	}
+
+	// Clusters that do not allow prepared transactions commit one after
+	// the other
+	servers, conns, results = newServers(
+		[][]byte{buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE)},
+		[][]byte{buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE)},
+	)
+	servers[1].noPreparedTransactions = true
+	endPreparedTransaction(servers, results, gid, "test")
+	for i, conn := range conns {
+		expectQueries(conn, "COMMIT")
+		if results[i].errMsg != nil {
+			t.Fatalf("Expected the transaction to commit on %s, got %+v", results[i].shardAddr, results[i])
+		}
+	}
+}
+
+func TestDistributedDDLConnectionError(t *testing.T) {
+	database := ddlTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	sql := "CREATE TABLE a (id int)"
+	statements, _ := query.Parse(sql)
+
+	// A cluster closing the connection on BEGIN rolls back the others
+	// before the DDL runs anywhere
+	first, firstConn := newSessionServer(database, &database.Clusters[0],
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE),
+	)
+	second, _ := newSessionServer(database, &database.Clusters[1])
+	servers := map[string][]*ServerConnection{
+		database.Clusters[0].GetAddr(): {first},
+		database.Clusters[1].GetAddr(): {second},
+	}
+	returned := serveScriptedPool(requester, servers)
+	clientConn := &scriptedConn{}
+	client := &ClientConnection{Conn: clientConn, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: 1}}
+	handleDistributedDDL(sql, statements, client, requester, database)
+	<-returned
+	<-returned
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the DDL to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_IDLE {
+		t.Fatalf("Expected the client to be told it is idle, got %q", status)
+	}
+	if queries := firstConn.queries(); len(queries) < 2 || !slices.Equal(queries[:2], []string{"BEGIN", "ROLLBACK"}) || slices.Contains(queries, sql) {
+		t.Fatalf("Expected the DDL not to run, got %q", queries)
+	}
+
+	// Inside a client transaction the client is told it still is in one
+	first, _ = newSessionServer(database, &database.Clusters[0])
+	servers[database.Clusters[0].GetAddr()] = []*ServerConnection{first}
+	clientConn = &scriptedConn{}
+	client = &ClientConnection{Conn: clientConn, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: 1}}
+	client.pendingBegin = "BEGIN"
+	handleDistributedDDL(sql, statements, client, requester, database)
+	<-returned
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the DDL to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected the client to be told it is in a transaction, got %q", status)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// How long after the primary went down clients wait for a replica to
+	// be promoted before giving up
+	FAILOVER_WAIT_TIMEOUT = 30 * time.Second
+)
+
+type queuedConnectionRequest struct {
+	request  ConnectionRequest
+	deadline time.Time
+}
+
+// The hosts serving a shard. The primary changes when one of the
+// replicas is promoted during a failover
+type shardTopology struct {
+	primary  *Pooler
+	replicas []*Pooler
+	// Requests waiting for the shard to have a usable primary again
+	queued []queuedConnectionRequest
+	// When the primary was last reported down
+	primaryDown time.Time
+}
+
+func newShardTopology(primary *Pooler) *shardTopology {
+	return &shardTopology{
+		primary:  primary,
+		replicas: make([]*Pooler, 0),
+		queued:   make([]queuedConnectionRequest, 0),
+	}
+}
+
+func (s *shardTopology) queue(request ConnectionRequest) {
+	slog.Warn(
+		"Primary is down. Queueing connection request until failover completes",
+		"cluster", s.primary.GetAddr(),
+		"database", request.database,
+		"ClientPid", request.FrontendPid,
+	)
+	s.queued = append(s.queued, queuedConnectionRequest{
+		request:  request,
+		deadline: s.primaryDown.Add(FAILOVER_WAIT_TIMEOUT),
+	})
+}
+
+// Whether a replica may still be promoted in place of a primary that is
+// down. That is until FAILOVER_WAIT_TIMEOUT after it went down and only
+// while one of the replicas is up to take over
+func (s *shardTopology) failoverPending(now time.Time) bool {
+	if !s.primary.health.IsDown() || now.Sub(s.primaryDown) >= FAILOVER_WAIT_TIMEOUT {
+		return false
+	}
+	for _, replica := range s.replicas {
+		if !replica.health.IsDown() {
+			return true
+		}
+	}
+	return false
+}
+
+// Swap the primary with one of the replicas
+func (s *shardTopology) promote(pooler *Pooler) *Pooler {
+	demoted := s.primary
+	for i, replica := range s.replicas {
+		if replica == pooler {
+			s.replicas[i] = demoted
+			break
+		}
+	}
+	s.primary = pooler
+	pooler.health.IsReplica = false
+	demoted.health.IsReplica = true
+	return demoted
+}
+
+// Promote the host to primary of its shard if it reports that it is no
+// longer in recovery while the current primary is gone or has itself
+// been demoted to a standby
+func (pm *PoolerManager) checkFailover(shard *shardTopology, pooler *Pooler) {
+	if shard.primary != pooler && !pooler.health.InRecovery && pooler.health.State == CLUSTER_STATE_HEALTHY {
+		current := shard.primary
+		if !current.health.IsDown() && !current.health.InRecovery {
+			slog.Error(
+				"Multiple hosts report being primary. Keeping the current primary",
+				"database", pooler.databaseConfig.Name,
+				"primary", current.GetAddr(),
+				"candidate", pooler.GetAddr(),
+			)
+			return
+		}
+		slog.Warn(
+			"Primary failover detected. Promoting new primary",
+			"database", pooler.databaseConfig.Name,
+			"shard", pooler.shardAddr,
+			"oldPrimary", current.GetAddr(),
+			"newPrimary", pooler.GetAddr(),
+		)
+		demoted := shard.promote(pooler)
+		demoted.drain()
+	}
+
+	if shard.primary.health.State == CLUSTER_STATE_HEALTHY && !shard.primary.health.InRecovery {
+		pm.retryQueuedRequests(shard)
+	}
+}
+
+func (pm *PoolerManager) retryQueuedRequests(shard *shardTopology) {
+	if len(shard.queued) == 0 {
+		return
+	}
+	slog.Info(
+		"Retrying queued connection requests",
+		"cluster", shard.primary.GetAddr(),
+		"count", len(shard.queued),
+	)
+	queued := shard.queued
+	shard.queued = make([]queuedConnectionRequest, 0)
+	for _, q := range queued {
+		pm.sendPoolerConnection(q.request, shard.primary)
+	}
+}
+
+// Fail any queued requests that have waited too long for a failover or
+// for which no replica is left to take over
+func (pm *PoolerManager) ExpireQueuedRequests() {
+	now := time.Now()
+	for _, databaseShards := range pm.shards {
+		for _, shard := range databaseShards {
+			remaining := make([]queuedConnectionRequest, 0, len(shard.queued))
+			pending := shard.failoverPending(now)
+			for _, q := range shard.queued {
+				if pending && now.Before(q.deadline) {
+					remaining = append(remaining, q)
+					continue
+				}
+				slog.Error(
+					"Timed out waiting for failover",
+					"cluster", shard.primary.GetAddr(),
+					"database", q.request.database,
+					"ClientPid", q.request.FrontendPid,
+				)
+				q.request.responder <- ConnectionResponse{
+					Event:  ACTION_GET_CONNECTION,
+					Result: RESULT_ERROR,
+					Detail: ClusterDownError{
+						DatabaseName: q.request.database,
+						ClusterAddr:  shard.primary.GetAddr(),
+						LastError:    shard.primary.health.LastError,
+						NextCheck:    shard.primary.health.NextCheck,
+					},
+				}
+			}
+			shard.queued = remaining
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Put a connection to the pooler's host in its pool
+func addIdleConnection(pooler *Pooler, backendPid int) (*ServerConnection, *scriptedConn) {
+	server, conn := newScriptedServer(pooler.clusterConfig)
+	server.Context.Database = pooler.databaseConfig
+	server.Context.ServerIdentity.BackendPid = backendPid
+	server.createTime = time.Now().Unix()
+	server.MarkUsed()
+	pooler.connections = append(pooler.connections, server)
+	return server, conn
+}
+
+func reportHealth(pm *PoolerManager, clusterAddr string, state string, inRecovery bool) {
+	pm.UpdateClusterHealth(ConnectionRequest{
+		Event:       ACTION_REPORT_CLUSTER_HEALTH,
+		database:    "test",
+		clusterAddr: clusterAddr,
+		Health:      ClusterHealth{DatabaseName: "test", ClusterAddr: clusterAddr, State: state, InRecovery: inRecovery},
+	})
+}
+
+func requestConnection(pm *PoolerManager) chan ConnectionResponse {
+	response := make(chan ConnectionResponse, 1)
+	pm.SendConnection(ConnectionRequest{
+		Event:       ACTION_GET_CONNECTION,
+		database:    "test",
+		clusterAddr: "a:5432",
+		responder:   response,
+		FrontendPid: 1,
+	})
+	return response
+}
+
+func TestFailover(t *testing.T) {
+	config := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:         "test",
+		PoolSettings: PoolConfig{MaxOpenConns: 5, MaxConnLifetime: 3600},
+		Clusters:     []ClusterConfig{{Host: "a", Port: 5432, Replicas: []ReplicaConfig{{Host: "b", Port: 5432}}}},
+	}}}
+	pm := NewPoolerManager(config, nil)
+	shard := pm.shards["test"]["a:5432"]
+	primary, replica := pm.poolers["test"]["a:5432"], pm.poolers["test"]["b:5432"]
+	inUse, _ := addIdleConnection(primary, 1)
+	primary.connections = nil
+	primary.checkOut(inUse)
+	promoted, _ := addIdleConnection(replica, 2)
+
+	// The primary going down drops its pool and holds new requests back
+	// while a replica may take over
+	reportHealth(pm, "a:5432", CLUSTER_STATE_DOWN, false)
+	if !inUse.IsPoisoned() {
+		t.Fatal("Expected connections handed out by a host that went down to be poisoned")
+	}
+	response := requestConnection(pm)
+	if len(shard.queued) != 1 {
+		t.Fatalf("Expected the request to wait for a failover, got %d queued", len(shard.queued))
+	}
+
+	// A replica still in recovery is not promoted
+	reportHealth(pm, "b:5432", CLUSTER_STATE_HEALTHY, true)
+	if shard.primary != primary || len(shard.queued) != 1 {
+		t.Fatal("Expected a standby not to be promoted")
+	}
+
+	// The replica leaving recovery becomes the primary and gets the
+	// requests that waited
+	reportHealth(pm, "b:5432", CLUSTER_STATE_HEALTHY, false)
+	if shard.primary != replica || shard.replicas[0] != primary || !primary.health.IsReplica || replica.health.IsReplica {
+		t.Fatal("Expected the replica to be promoted")
+	}
+	if answer := <-response; answer.Result != RESULT_SUCCESS || answer.Conn != promoted {
+		t.Fatalf("Expected the queued request to get a connection to the new primary, got %s", answer.Result)
+	}
+
+	// The old primary coming back as a primary does not take over again
+	reportHealth(pm, "a:5432", CLUSTER_STATE_HEALTHY, false)
+	if shard.primary != replica {
+		t.Fatal("Expected the current primary to be kept")
+	}
+
+	// Requests waiting too long for a failover fail
+	reportHealth(pm, "b:5432", CLUSTER_STATE_DOWN, false)
+	response = requestConnection(pm)
+	shard.queued[0].deadline = time.Now().Add(-time.Second)
+	pm.ExpireQueuedRequests()
+	answer := <-response
+	if _, ok := answer.Detail.(ClusterDownError); answer.Result != RESULT_ERROR || !ok || len(shard.queued) != 0 {
+		t.Fatalf("Expected the queued request to fail, got %s", answer.Result)
+	}
+}
+
+func TestFailoverFailsFast(t *testing.T) {
+	config := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:         "test",
+		PoolSettings: PoolConfig{MaxOpenConns: 5, MaxConnLifetime: 3600},
+		Clusters:     []ClusterConfig{{Host: "a", Port: 5432, Replicas: []ReplicaConfig{{Host: "b", Port: 5432}}}},
+	}}}
+	pm := NewPoolerManager(config, nil)
+	shard := pm.shards["test"]["a:5432"]
+	expectDown := func(response chan ConnectionResponse) {
+		t.Helper()
+		answer := <-response
+		if _, ok := answer.Detail.(ClusterDownError); answer.Result != RESULT_ERROR || !ok || len(shard.queued) != 0 {
+			t.Fatalf("Expected the request to fail right away, got %s", answer.Result)
+		}
+	}
+
+	// No replica is up to take over
+	reportHealth(pm, "b:5432", CLUSTER_STATE_DOWN, true)
+	reportHealth(pm, "a:5432", CLUSTER_STATE_DOWN, false)
+	expectDown(requestConnection(pm))
+
+	// Requests waiting for a failover fail once the last replica goes down
+	reportHealth(pm, "b:5432", CLUSTER_STATE_HEALTHY, true)
+	response := requestConnection(pm)
+	if len(shard.queued) != 1 {
+		t.Fatalf("Expected the request to wait for a failover, got %d queued", len(shard.queued))
+	}
+	reportHealth(pm, "b:5432", CLUSTER_STATE_DOWN, true)
+	pm.ExpireQueuedRequests()
+	expectDown(response)
+
+	// No replica was promoted in time after the primary went down
+	reportHealth(pm, "b:5432", CLUSTER_STATE_HEALTHY, true)
+	shard.primaryDown = time.Now().Add(-FAILOVER_WAIT_TIMEOUT)
+	expectDown(requestConnection(pm))
+}
+
+func TestPoolerDrain(t *testing.T) {
+	pooler := newPooler(DatabaseConfig{Name: "test", PoolSettings: PoolConfig{MaxOpenConns: 5}}, ClusterConfig{Host: "a", Port: 5432})
+	_, idle := addIdleConnection(pooler, 1)
+	inUse, _ := addIdleConnection(pooler, 2)
+	pooler.connections = pooler.connections[:1]
+	pooler.checkOut(inUse)
+
+	done := pooler.drain()
+	if len(pooler.connections) != 0 || !inUse.IsPoisoned() {
+		t.Fatal("Expected the pool to be emptied and connections in use poisoned")
+	}
+	<-done
+	if !idle.closed || !bytes.Equal(idle.sent.Bytes(), protocol.BuildTerminateMessage().Pack()) {
+		t.Fatal("Expected idle connections to be terminated")
+	}
+}
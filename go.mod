@@ -2,4 +2,4 @@ module github.com/livinlefevreloca/pgspanner
 
 go 1.21.5
 
-require github.com/BurntSushi/toml v1.4.0 // indirect
+require github.com/BurntSushi/toml v1.4.0
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Joins of sharded tables that are not co-located are run by the proxy when they are a SELECT
+/// of two tables joined on equal columns
+
+// Bytes a row costs in memory besides its values
+const HASH_JOIN_ROW_OVERHEAD = 64
+
+// One table of a join run by the proxy
+type hashJoinSide struct {
+	servers []*ServerConnection
+	results []shardResult
+	// Index of the server being read
+	current     int
+	description *protocol.RowDescriptionPgMessage
+	// Rows read before the smaller table was known
+	rows []*protocol.DataRowPgMessage
+}
+
+// Read the next row of the table. Servers are read one after the other.
+// Returns nil once every server has answered
+func (s *hashJoinSide) next() *protocol.DataRowPgMessage {
+	for s.current < len(s.servers) {
+		server := s.servers[s.current]
+		result := &s.results[s.current]
+		rm, err := protocol.GetRawPgMessage(server)
+		if err != nil {
+			result.err = err
+			server.Poison()
+			s.current++
+			continue
+		}
+		switch rm.Kind {
+		case protocol.BMESSAGE_ROW_DESCRIPTION:
+			description := &protocol.RowDescriptionPgMessage{}
+			if description, err = description.Unpack(rm); err == nil && s.description == nil {
+				s.description = description
+			}
+		case protocol.BMESSAGE_DATA_ROW:
+			row := &protocol.DataRowPgMessage{}
+			if row, err = row.Unpack(rm); err == nil {
+				return row
+			}
+			result.err = err
+		case protocol.BMESSAGE_COMMAND_COMPLETE:
+			complete := &protocol.CommandCompletePgMessage{}
+			complete, _ = complete.Unpack(rm)
+			result.tag = strings.TrimRight(complete.Command, "\x00")
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			errMsg := &protocol.ErrorResponsePgMessage{}
+			if errMsg, err = errMsg.Unpack(rm); err == nil {
+				result.errMsg = errMsg
+			}
+		case protocol.BMESSAGE_READY_FOR_QUERY:
+			readyForQuery := &protocol.ReadyForQueryPgMessage{}
+			if readyForQuery, err = readyForQuery.Unpack(rm); err == nil {
+				result.transactionStatus = readyForQuery.TransactionStatus
+				server.SetTransactionStatus(result.transactionStatus)
+			}
+			s.current++
+		}
+	}
+	return nil
+}
+
+func (s *hashJoinSide) failed() bool {
+	for _, result := range s.results {
+		if result.err != nil || result.errMsg != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Give the connections back. Connections still sending rows are
+// discarded by the pool instead of being read to the end
+func (s *hashJoinSide) release(requester *ConnectionRequester, database *DatabaseConfig, clientPid int) {
+	for i, server := range s.servers {
+		if i >= s.current {
+			server.Poison()
+		}
+		requester.ReturnConnection(server, database.Name, server.GetClusterConfig().GetAddr(), clientPid)
+	}
+}
+
+// The query reading one table of the join. The join columns come first
+// followed by the select list items using the table
+func buildHashJoinSideQuery(join *query.JoinSelect, side int) string {
+	name := quoteIdentifier(join.TableName(side))
+	columns := make([]string, 0, len(join.Keys[side])+len(join.Items))
+	for _, key := range join.Keys[side] {
+		columns = append(columns, name+"."+quoteIdentifier(key))
+	}
+	for _, item := range join.Items {
+		if item.Table == side {
+			columns = append(columns, item.Text)
+		}
+	}
+
+	ref := join.Tables[side]
+	table := quoteIdentifier(ref.Table)
+	if ref.Schema != "" {
+		table = quoteIdentifier(ref.Schema) + "." + table
+	}
+	if ref.Alias != "" {
+		table += " " + quoteIdentifier(ref.Alias)
+	}
+	sql := "SELECT " + strings.Join(columns, ", ") + " FROM " + table
+	if len(join.Filters[side]) > 0 {
+		sql += " WHERE (" + strings.Join(join.Filters[side], ") AND (") + ")"
+	}
+	return sql
+}
+
+// The fields of the two tables' rows the client gets, in the order of
+// the select list. Each entry is a table and a field of its rows
+func getHashJoinOutput(join *query.JoinSelect, descriptions [2]*protocol.RowDescriptionPgMessage) [][2]int {
+	output := make([][2]int, 0, len(join.Items))
+	var next [2]int
+	var starWidth [2]int
+	for side := range descriptions {
+		next[side] = len(join.Keys[side])
+		starWidth[side] = len(descriptions[side].Fields) - len(join.Keys[side])
+		for _, item := range join.Items {
+			if item.Table == side && !item.Star {
+				starWidth[side]--
+			}
+		}
+	}
+	for _, item := range join.Items {
+		width := 1
+		if item.Star {
+			width = starWidth[item.Table]
+		}
+		for i := 0; i < width; i++ {
+			output = append(output, [2]int{item.Table, next[item.Table]})
+			next[item.Table]++
+		}
+	}
+	return output
+}
+
+// The hash table key of a row. Returns false when a join column is NULL
+func getHashJoinKey(row *protocol.DataRowPgMessage, keys int) (string, bool) {
+	var key []byte
+	for _, value := range row.Values[:keys] {
+		if value == nil {
+			return "", false
+		}
+		key = binary.BigEndian.AppendUint32(key, uint32(len(value)))
+		key = append(key, value...)
+	}
+	return string(key), true
+}
+
+func getRowMemory(row *protocol.DataRowPgMessage) int {
+	size := HASH_JOIN_ROW_OVERHEAD
+	for _, value := range row.Values {
+		size += len(value) + 24
+	}
+	return size
+}
+
+// Run a join of two sharded tables in the proxy. Each table is read
+// from every cluster with the conditions using only that table. Both
+// are read at the same pace until one ends, and the rows of that smaller
+// one go into a hash table the rows of the other are streamed through.
+// The rows held may not take more than maxHashJoinMemory megabytes. Join
+// columns are compared in their text form and NULLs never match
+func handleHashJoin(
+	join *query.JoinSelect,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	clientPid := client.Ctx.ClientPid
+	var sides [2]*hashJoinSide
+	var err error
+	for side := range sides {
+		sides[side] = &hashJoinSide{}
+		sql := buildHashJoinSideQuery(join, side)
+		for _, cluster := range database.Clusters {
+			if keyRange, _ := cluster.GetKeyRange(); keyRange.IsEmpty() {
+				continue
+			}
+			var server *ServerConnection
+			server, err = getServerConnection(requester, database, cluster.GetAddr(), clientPid, database.UsesReplicas())
+			if err != nil {
+				break
+			}
+			if err = applySessionSettings(client, server); err != nil {
+				requester.ReturnConnection(server, database.Name, cluster.GetAddr(), clientPid)
+				break
+			}
+			server.IssueQuery(sql)
+			sides[side].servers = append(sides[side].servers, server)
+			sides[side].results = append(sides[side].results, shardResult{shardAddr: cluster.GetAddr()})
+		}
+		if err != nil {
+			break
+		}
+	}
+	defer func() {
+		for _, side := range sides {
+			if side != nil {
+				side.release(requester, database, clientPid)
+			}
+		}
+	}()
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for join", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+
+	// Read both tables until one of them ends
+	limit := database.GetMaxHashJoinMemory() << 20
+	memory := 0
+	build := -1
+	for build == -1 && memory <= limit {
+		for side := range sides {
+			row := sides[side].next()
+			if row == nil {
+				build = side
+				break
+			}
+			sides[side].rows = append(sides[side].rows, row)
+			memory += getRowMemory(row)
+		}
+	}
+	if memory > limit {
+		slog.Warn("Join ran out of memory", "clientPid", clientPid, "limit", database.GetMaxHashJoinMemory())
+		errMsg := buildQueryError("53200", fmt.Sprintf(
+			"join of %s and %s needs more than %d MB of memory", join.Tables[0].Table, join.Tables[1].Table, database.GetMaxHashJoinMemory(),
+		))
+		errMsg.Fields[protocol.NOTICE_KIND_HINT] = protocol.ErrorField{
+			Type: 'H', Value: "Add conditions so fewer rows are read or raise maxHashJoinMemory of the database.",
+		}
+		writeSyntheticError(client, errMsg)
+		return
+	}
+
+	probe := 1 - build
+	keys := len(join.Keys[0])
+	table := make(map[string][]*protocol.DataRowPgMessage)
+	for _, row := range sides[build].rows {
+		if key, ok := getHashJoinKey(row, keys); ok {
+			table[key] = append(table[key], row)
+		}
+	}
+	sides[build].rows = nil
+
+	// Stream the other table through the hash table
+	relay := newResultRelay(client)
+	var output [][2]int
+	joined := 0
+	buffered := sides[probe].rows
+	sides[probe].rows = nil
+	for !sides[build].failed() {
+		var row *protocol.DataRowPgMessage
+		if len(buffered) > 0 {
+			row, buffered = buffered[0], buffered[1:]
+		} else if row = sides[probe].next(); row == nil {
+			break
+		}
+		key, ok := getHashJoinKey(row, keys)
+		if !ok {
+			continue
+		}
+		for _, match := range table[key] {
+			var rows [2]*protocol.DataRowPgMessage
+			rows[build], rows[probe] = match, row
+			if output == nil {
+				descriptions := [2]*protocol.RowDescriptionPgMessage{sides[0].description, sides[1].description}
+				output = getHashJoinOutput(join, descriptions)
+				relay.writer.Write(buildHashJoinDescription(descriptions, output).Pack())
+			}
+			values := make([][]byte, 0, len(output))
+			for _, field := range output {
+				values = append(values, rows[field[0]].Values[field[1]])
+			}
+			relay.writer.Write(protocol.BuildDataRowPgMessage(values).Pack())
+			joined++
+		}
+	}
+	if output == nil && !sides[0].failed() && !sides[1].failed() && sides[0].description != nil && sides[1].description != nil {
+		descriptions := [2]*protocol.RowDescriptionPgMessage{sides[0].description, sides[1].description}
+		relay.writer.Write(buildHashJoinDescription(descriptions, getHashJoinOutput(join, descriptions)).Pack())
+	}
+	relay.Release()
+
+	slog.Debug("Joined tables in the proxy", "tables", join.Tables[0].Table+","+join.Tables[1].Table, "rows", joined, "memory", memory)
+	results := append(sides[0].results, sides[1].results...)
+	writeShardResults(client, database.Name, results, fmt.Sprintf("SELECT %d", joined), nil)
+}
+
+func buildHashJoinDescription(descriptions [2]*protocol.RowDescriptionPgMessage, output [][2]int) *protocol.RowDescriptionPgMessage {
+	fields := make([]protocol.FieldDescription, 0, len(output))
+	for _, field := range output {
+		fields = append(fields, descriptions[field[0]].Fields[field[1]])
+	}
+	return &protocol.RowDescriptionPgMessage{Fields: fields}
+}
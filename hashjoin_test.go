@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestHashJoinSides(t *testing.T) {
+	statements, _ := query.Parse("SELECT c.body, p.*, c.id AS comment FROM posts p JOIN comments c ON c.post_id = p.id WHERE c.score > 2")
+	join, err := query.ParseJoinSelect(statements[0])
+	if err != nil {
+		t.Fatalf("Expected a join, got %s", err)
+	}
+	sides := []string{
+		"SELECT p.id, p.* FROM posts p",
+		"SELECT c.post_id, c.body, c.id AS comment FROM comments c WHERE (c.score > 2)",
+	}
+	for side, expected := range sides {
+		if sql := buildHashJoinSideQuery(join, side); sql != expected {
+			t.Fatalf("Expected %s, got %s", expected, sql)
+		}
+	}
+
+	// posts has the columns id, user_id and title
+	descriptions := [2]*protocol.RowDescriptionPgMessage{
+		{Fields: make([]protocol.FieldDescription, 4)},
+		{Fields: make([]protocol.FieldDescription, 3)},
+	}
+	output := getHashJoinOutput(join, descriptions)
+	expected := [][2]int{{1, 1}, {0, 1}, {0, 2}, {0, 3}, {1, 2}}
+	if len(output) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, output)
+	}
+	for i := range expected {
+		if output[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, output)
+		}
+	}
+}
+
+func TestGetHashJoinKey(t *testing.T) {
+	first, _ := getHashJoinKey(&protocol.DataRowPgMessage{Values: [][]byte{[]byte("ab"), []byte("c")}}, 2)
+	second, _ := getHashJoinKey(&protocol.DataRowPgMessage{Values: [][]byte{[]byte("a"), []byte("bc")}}, 2)
+	if first == second {
+		t.Fatalf("Expected different keys for different values")
+	}
+	if _, ok := getHashJoinKey(&protocol.DataRowPgMessage{Values: [][]byte{nil, []byte("c")}}, 1); ok {
+		t.Fatalf("Expected rows with NULL join columns to have no key")
+	}
+}
+
+// Hand out the scripted connections of each cluster in order like the
+// pool manager would. A nil connection is refused as if the cluster were
+// down. Connections given back are sent on the channel
+func serveScriptedPool(requester *ConnectionRequester, servers map[string][]*ServerConnection) <-chan *ConnectionRequest {
+	returned := make(chan *ConnectionRequest, 16)
+	go func() {
+		for request := range requester.ReceiveConnectionRequest() {
+			switch request.Event {
+			case ACTION_GET_CONNECTION, ACTION_GET_READ_CONNECTION:
+				server := servers[request.clusterAddr][0]
+				servers[request.clusterAddr] = servers[request.clusterAddr][1:]
+				if server == nil {
+					request.responder <- ConnectionResponse{Result: RESULT_ERROR, Detail: ClusterDownError{ClusterAddr: request.clusterAddr}}
+					continue
+				}
+				request.responder <- ConnectionResponse{Result: RESULT_SUCCESS, Conn: server}
+			default:
+				returned <- request
+			}
+		}
+	}()
+	return returned
+}
+
+// A shard's answer to a hash join side query. Each row is a join column
+// followed by a value. Connections read to the end are reset when given
+// back
+func buildJoinSide(rows ...[2]string) []byte {
+	var result bytes.Buffer
+	result.Write(protocol.BuildTextRowDescriptionPgMessage([]string{"key", "value"}).Pack())
+	for _, row := range rows {
+		result.Write(protocol.BuildDataRowPgMessage([][]byte{[]byte(row[0]), []byte(row[1])}).Pack())
+	}
+	result.Write(buildCompletion(fmt.Sprintf("SELECT %d", len(rows)), TRANSACTION_STATUS_IDLE))
+	result.Write(buildCompletion("DISCARD ALL", TRANSACTION_STATUS_IDLE))
+	return result.Bytes()
+}
+
+func TestHandleHashJoin(t *testing.T) {
+	database := &DatabaseConfig{
+		Name:     "test",
+		Clusters: []ClusterConfig{{Host: "a", Port: 5432, KeyRange: "-80"}, {Host: "b", Port: 5432, KeyRange: "80-"}},
+	}
+	statements, _ := query.Parse("SELECT p.title, c.body FROM posts p JOIN comments c ON c.post_id = p.id")
+	join, err := query.ParseJoinSelect(statements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(answers map[string][2][]byte) ([]*ServerConnection, *scriptedConn, []*ConnectionRequest) {
+		t.Helper()
+		servers := make(map[string][]*ServerConnection)
+		all := make([]*ServerConnection, 0, 4)
+		for i := range database.Clusters {
+			cluster := &database.Clusters[i]
+			for _, answer := range answers[cluster.GetAddr()] {
+				server, _ := newScriptedServer(cluster, answer)
+				server.Context.Database = database
+				server.MarkUsed()
+				servers[cluster.GetAddr()] = append(servers[cluster.GetAddr()], server)
+				all = append(all, server)
+			}
+		}
+		requester := NewConnectionRequester(nil)
+		defer close(requester.channel)
+		returned := serveScriptedPool(requester, servers)
+
+		conn := &scriptedConn{}
+		handleHashJoin(join, &ClientConnection{Conn: conn, Ctx: &ClientConnectionContext{}}, requester, database)
+		requests := make([]*ConnectionRequest, 0, len(all))
+		for range all {
+			requests = append(requests, <-returned)
+		}
+		return all, conn, requests
+	}
+	sentRows := func(conn *scriptedConn) []string {
+		rows := make([]string, 0)
+		sent := bytes.NewReader(conn.sent.Bytes())
+		for {
+			rm, err := protocol.GetRawPgMessage(sent)
+			if err != nil {
+				return rows
+			}
+			if rm.Kind == protocol.BMESSAGE_DATA_ROW {
+				row, _ := (&protocol.DataRowPgMessage{}).Unpack(rm)
+				rows = append(rows, string(row.Values[0])+"/"+string(row.Values[1]))
+			}
+		}
+	}
+
+	// comments ends first so its rows are hashed and the posts are
+	// streamed through them in their order
+	_, conn, returned := run(map[string][2][]byte{
+		"a:5432": {
+			buildJoinSide([2]string{"1", "a"}, [2]string{"2", "b"}),
+			buildJoinSide([2]string{"1", "first"}, [2]string{"1", "second"}),
+		},
+		"b:5432": {
+			buildJoinSide([2]string{"1", "c"}, [2]string{"1", "d"}),
+			buildJoinSide(),
+		},
+	})
+	expected := []string{"a/first", "a/second", "c/first", "c/second", "d/first", "d/second"}
+	if rows := sentRows(conn); !slices.Equal(rows, expected) {
+		t.Fatalf("Expected rows %q, got %q", expected, rows)
+	}
+	for _, request := range returned {
+		if request.Event != ACTION_RETURN_CONNECTION {
+			t.Fatalf("Expected connections read to the end to go back to the pool, got %s", request.Event)
+		}
+	}
+
+	// Running out of memory before either table ends fails the join and
+	// discards the connections still sending rows
+	database.MaxHashJoinMemory = 1
+	large := strings.Repeat("x", 300<<10)
+	rows := make([][2]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		rows = append(rows, [2]string{fmt.Sprint(i), large})
+	}
+	servers, conn, returned := run(map[string][2][]byte{
+		"a:5432": {buildJoinSide(rows...), buildJoinSide(rows...)},
+		"b:5432": {buildJoinSide(), buildJoinSide()},
+	})
+	if code := sentErrorCode(conn); code != "53200" {
+		t.Fatalf("Expected an out of memory error, got %q", code)
+	}
+	for _, server := range servers {
+		if !server.IsPoisoned() {
+			t.Fatalf("Expected unread connection to %s to be poisoned", server.GetClusterConfig().GetAddr())
+		}
+	}
+	for _, request := range returned {
+		if request.Event != ACTION_CLOSE_CONNECTION {
+			t.Fatalf("Expected unread connections to be closed, got %s", request.Event)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	HEALTH_CHECK_INTERVAL       = 5 * time.Second
+	HEALTH_CHECK_MAX_BACKOFF    = 60 * time.Second
+	HEALTH_CHECK_DOWN_THRESHOLD = 3
+)
+
+const (
+	CLUSTER_STATE_HEALTHY  = "healthy"
+	CLUSTER_STATE_DEGRADED = "degraded"
+	CLUSTER_STATE_DOWN     = "down"
+)
+
+// The health of a single cluster as seen by the health checker
+type ClusterHealth struct {
+	DatabaseName        string
+	ClusterAddr         string
+	IsReplica           bool
+	State               string
+	ConsecutiveFailures int
+	LastCheck           time.Time
+	NextCheck           time.Time
+	LastError           string
+	// Whether the host reported being a standby on its last check
+	InRecovery bool
+	// Seconds the replica is behind its primary. Always zero for primaries
+	ReplicationLag float64
+}
+
+func newClusterHealth(databaseName string, clusterAddr string) *ClusterHealth {
+	return &ClusterHealth{
+		DatabaseName: databaseName,
+		ClusterAddr:  clusterAddr,
+		State:        CLUSTER_STATE_HEALTHY,
+	}
+}
+
+func (h *ClusterHealth) IsDown() bool {
+	return h.State == CLUSTER_STATE_DOWN
+}
+
+// Whether reads can be sent to the cluster given the lag it is allowed
+func (h *ClusterHealth) CanServeReads(maxReplicationLag int) bool {
+	if h.State != CLUSTER_STATE_HEALTHY {
+		return false
+	}
+	return maxReplicationLag <= 0 || h.ReplicationLag <= float64(maxReplicationLag)
+}
+
+// Record the result of a probe and schedule the next one. Failing
+// clusters are probed with exponential backoff so a dead host is
+// not hammered with connection attempts
+func (h *ClusterHealth) record(result healthProbeResult, now time.Time) {
+	err := result.err
+	h.LastCheck = now
+	if err == nil {
+		h.InRecovery = result.inRecovery
+		h.ReplicationLag = result.replicationLag
+		h.State = CLUSTER_STATE_HEALTHY
+		h.ConsecutiveFailures = 0
+		h.LastError = ""
+		h.NextCheck = now.Add(HEALTH_CHECK_INTERVAL)
+		return
+	}
+
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	if h.ConsecutiveFailures >= HEALTH_CHECK_DOWN_THRESHOLD {
+		h.State = CLUSTER_STATE_DOWN
+	} else {
+		h.State = CLUSTER_STATE_DEGRADED
+	}
+	h.NextCheck = now.Add(healthCheckBackoff(h.ConsecutiveFailures))
+}
+
+func healthCheckBackoff(failures int) time.Duration {
+	backoff := HEALTH_CHECK_INTERVAL
+	for i := 1; i < failures && backoff < HEALTH_CHECK_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	return min(backoff, HEALTH_CHECK_MAX_BACKOFF)
+}
+
+// Error returned to requesters when a connection is requested for a
+// cluster that the health checker has marked as down
+type ClusterDownError struct {
+	DatabaseName string
+	ClusterAddr  string
+	LastError    string
+	NextCheck    time.Time
+}
+
+func (e ClusterDownError) Error() string {
+	return fmt.Sprintf(
+		"Cluster %s for database %s is down (last error: %s). Next check at %s",
+		e.ClusterAddr,
+		e.DatabaseName,
+		e.LastError,
+		e.NextCheck.Format(time.RFC3339),
+	)
+}
+
+const (
+	// Replicas that have replayed everything they have received are not
+	// lagging even if the primary has been idle for a while
+	REPLICATION_LAG_QUERY = "SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+		"ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END"
+	RECOVERY_STATUS_QUERY = "SELECT pg_is_in_recovery()"
+)
+
+// Open a fresh connection to the cluster and run a trivial query on it.
+// Every host reports whether it is a standby so failovers can be
+// detected, and standbys report how far behind their primary they are
+func probeCluster(database *DatabaseConfig, cluster *ClusterConfig) healthProbeResult {
+	result := healthProbeResult{databaseName: database.Name, clusterAddr: cluster.GetAddr()}
+	server, err := CreateServerConnection(database, cluster)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer server.Terminate()
+
+	if !server.CheckLiveness() {
+		result.err = fmt.Errorf("Liveness check failed on %s", cluster.GetAddr())
+		return result
+	}
+	result.inRecovery, result.err = queryRecoveryStatus(server)
+	if result.err == nil && result.inRecovery {
+		result.replicationLag, result.err = queryReplicationLag(server)
+	}
+	return result
+}
+
+func queryRecoveryStatus(server *ServerConnection) (bool, error) {
+	server.Conn.SetDeadline(time.Now().Add(HEALTH_CHECK_TIMEOUT))
+	defer server.Conn.SetDeadline(time.Time{})
+
+	rows, err := server.QueryRows(RECOVERY_STATUS_QUERY)
+	if err != nil {
+		return false, err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 1 {
+		return false, fmt.Errorf("Unexpected result checking recovery status on %s", server.GetClusterConfig().GetAddr())
+	}
+	return string(rows[0].Values[0]) == "t", nil
+}
+
+func queryReplicationLag(server *ServerConnection) (float64, error) {
+	server.Conn.SetDeadline(time.Now().Add(HEALTH_CHECK_TIMEOUT))
+	defer server.Conn.SetDeadline(time.Time{})
+
+	rows, err := server.QueryRows(REPLICATION_LAG_QUERY)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 1 {
+		return 0, fmt.Errorf("Unexpected result checking replication lag on %s", server.GetClusterConfig().GetAddr())
+	}
+	return strconv.ParseFloat(string(rows[0].Values[0]), 64)
+}
+
+type healthProbeResult struct {
+	databaseName   string
+	clusterAddr    string
+	inRecovery     bool
+	replicationLag float64
+	err            error
+}
+
+type healthCheckTarget struct {
+	database  DatabaseConfig
+	cluster   ClusterConfig
+	isReplica bool
+}
+
+func getHealthCheckTargets(config *SpannerConfig) []healthCheckTarget {
+	targets := make([]healthCheckTarget, 0)
+	for _, database := range config.Databases {
+		for _, cluster := range database.Clusters {
+			targets = append(targets, healthCheckTarget{database, cluster, false})
+			for _, replica := range cluster.GetReplicaConfigs() {
+				targets = append(targets, healthCheckTarget{database, replica, true})
+			}
+		}
+	}
+	return targets
+}
+
+// Build the table of health state for the targets, carrying over the
+// state of targets that were already being checked
+func buildHealthTable(
+	targets []healthCheckTarget,
+	previous map[string]map[string]*ClusterHealth,
+) map[string]map[string]*ClusterHealth {
+	healthTable := make(map[string]map[string]*ClusterHealth)
+	for _, target := range targets {
+		if healthTable[target.database.Name] == nil {
+			healthTable[target.database.Name] = make(map[string]*ClusterHealth)
+		}
+		health, ok := previous[target.database.Name][target.cluster.GetAddr()]
+		if !ok {
+			health = newClusterHealth(target.database.Name, target.cluster.GetAddr())
+			health.IsReplica = target.isReplica
+		}
+		healthTable[target.database.Name][target.cluster.GetAddr()] = health
+	}
+	return healthTable
+}
+
+func RunHealthChecker(config *SpannerConfig, keepAlive *KeepAlive, connectionRequester *ConnectionRequester) {
+	slog.Info("Health checker started")
+
+	config = connectionRequester.GetConfig()
+	targets := getHealthCheckTargets(config)
+	healthTable := buildHealthTable(targets, nil)
+
+	results := make(chan healthProbeResult, 64)
+	inFlight := make(map[string]bool)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case result := <-results:
+			delete(inFlight, result.databaseName+"/"+result.clusterAddr)
+			health, ok := healthTable[result.databaseName][result.clusterAddr]
+			if !ok {
+				// The cluster was removed while it was being probed
+				continue
+			}
+			previousState := health.State
+			health.record(result, time.Now())
+			if health.State != previousState {
+				logHealthTransition(health, previousState)
+			}
+			connectionRequester.ReportClusterHealth(*health)
+		case now := <-ticker.C:
+			keepAlive.Notify()
+			if current := connectionRequester.GetConfig(); current != config {
+				config = current
+				targets = getHealthCheckTargets(config)
+				healthTable = buildHealthTable(targets, healthTable)
+			}
+			for _, target := range targets {
+				health := healthTable[target.database.Name][target.cluster.GetAddr()]
+				key := target.database.Name + "/" + target.cluster.GetAddr()
+				if inFlight[key] || now.Before(health.NextCheck) {
+					continue
+				}
+				inFlight[key] = true
+				go func(target healthCheckTarget) {
+					results <- probeCluster(&target.database, &target.cluster)
+				}(target)
+			}
+		}
+	}
+}
+
+func logHealthTransition(health *ClusterHealth, previousState string) {
+	switch health.State {
+	case CLUSTER_STATE_HEALTHY:
+		slog.Info(
+			"Cluster recovered",
+			"Database", health.DatabaseName,
+			"Cluster", health.ClusterAddr,
+			"PreviousState", previousState,
+		)
+	default:
+		slog.Warn(
+			"Cluster health changed",
+			"Database", health.DatabaseName,
+			"Cluster", health.ClusterAddr,
+			"State", health.State,
+			"PreviousState", previousState,
+			"Failures", health.ConsecutiveFailures,
+			"Error", health.LastError,
+			"NextCheck", health.NextCheck,
+		)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClusterHealthTransitions(t *testing.T) {
+	health := newClusterHealth("test", "a:5432")
+	now := time.Now()
+	failure := healthProbeResult{err: errors.New("connection refused")}
+
+	// A cluster is degraded by its first failures and down once they
+	// reach the threshold, backing off further with each one
+	for failures := 1; failures <= HEALTH_CHECK_DOWN_THRESHOLD+1; failures++ {
+		health.record(failure, now)
+		expected := CLUSTER_STATE_DEGRADED
+		if failures >= HEALTH_CHECK_DOWN_THRESHOLD {
+			expected = CLUSTER_STATE_DOWN
+		}
+		if health.State != expected || health.ConsecutiveFailures != failures {
+			t.Fatalf("Expected %s after %d failures, got %s after %d", expected, failures, health.State, health.ConsecutiveFailures)
+		}
+		if next := now.Add(healthCheckBackoff(failures)); !health.NextCheck.Equal(next) {
+			t.Fatalf("Expected the next check at %s after %d failures, got %s", next, failures, health.NextCheck)
+		}
+	}
+	if !health.IsDown() || health.CanServeReads(0) || health.LastError != "connection refused" {
+		t.Fatalf("Expected a down cluster to serve nothing, got %+v", health)
+	}
+
+	// A single successful probe brings it back
+	health.record(healthProbeResult{inRecovery: true, replicationLag: 3}, now)
+	if health.State != CLUSTER_STATE_HEALTHY || health.ConsecutiveFailures != 0 || health.LastError != "" {
+		t.Fatalf("Expected the cluster to recover, got %+v", health)
+	}
+	if !health.NextCheck.Equal(now.Add(HEALTH_CHECK_INTERVAL)) || !health.InRecovery {
+		t.Fatalf("Expected the probe result to be recorded, got %+v", health)
+	}
+	if !health.CanServeReads(0) || !health.CanServeReads(3) || health.CanServeReads(2) {
+		t.Fatal("Expected reads to be served only within the allowed replication lag")
+	}
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:  HEALTH_CHECK_INTERVAL,
+		2:  2 * HEALTH_CHECK_INTERVAL,
+		3:  4 * HEALTH_CHECK_INTERVAL,
+		10: HEALTH_CHECK_MAX_BACKOFF,
+	} {
+		if backoff := healthCheckBackoff(failures); backoff != expected {
+			t.Fatalf("Expected a backoff of %s after %d failures, got %s", expected, failures, backoff)
+		}
+	}
+}
+
+func TestBuildHealthTable(t *testing.T) {
+	config := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:     "test",
+		Clusters: []ClusterConfig{{Host: "a", Port: 5432, Replicas: []ReplicaConfig{{Host: "b", Port: 5432}}}},
+	}}}
+	healthTable := buildHealthTable(getHealthCheckTargets(config), nil)
+	if healthTable["test"]["a:5432"].IsReplica || !healthTable["test"]["b:5432"].IsReplica {
+		t.Fatal("Expected replicas to be told apart from primaries")
+	}
+
+	// A reload keeps the state of clusters still configured and drops
+	// the removed ones
+	down := healthTable["test"]["a:5432"]
+	down.State = CLUSTER_STATE_DOWN
+	config.Databases[0].Clusters[0].Replicas = nil
+	healthTable = buildHealthTable(getHealthCheckTargets(config), healthTable)
+	if healthTable["test"]["a:5432"] != down || len(healthTable["test"]) != 1 {
+		t.Fatalf("Expected the health of kept clusters to carry over, got %v", healthTable["test"])
+	}
+}
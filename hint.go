@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// A comment in front of a query, like /* pgspanner: shard=2 */, picks the clusters it runs on
+/// in place of the routing by shard key, tenant, lookup or reference table. It is removed before sending
+
+// Run a query on the clusters its hint picks. shard=2 is the second
+// cluster of the database in the order of the configuration, cluster=
+// the cluster with that address and all every cluster, those waiting
+// for a key range included. The hint also takes the place of the
+// handling of DDL, COPY and joins
+func routeByHint(
+	queryText string,
+	statements []*query.Statement,
+	hint *query.Hint,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	// Writes wait for any key range being moved to leave its cutover
+	if database.IsSharded() && !query.IsReadOnly(statements) {
+		write := shardRouting.BeginWrite(database.Name)
+		defer write.Finish(client)
+		write.RouteAll()
+		if current, ok := requester.GetConfig().GetDatabaseConfigByName(database.Name); ok {
+			database = current
+		}
+	}
+
+	if hint.All {
+		handleHintedQuery(queryText, statements, client, requester, database)
+		return
+	}
+	cluster, errMsg := getHintCluster(hint, database)
+	if errMsg != nil {
+		writeSyntheticError(client, errMsg)
+		return
+	}
+	slog.Info("Routed query by hint", "clientPid", client.Ctx.ClientPid, "shard", cluster.GetAddr())
+	runOnCluster(queryText, statements, cluster, client, requester, database)
+}
+
+// Find the cluster a hint for a single cluster names
+func getHintCluster(hint *query.Hint, database *DatabaseConfig) (*ClusterConfig, *protocol.ErrorResponsePgMessage) {
+	if hint.Shard > 0 {
+		if hint.Shard > len(database.Clusters) {
+			return nil, buildQueryError("22023", fmt.Sprintf(
+				"hint names shard %d but database %q has %d", hint.Shard, database.Name, len(database.Clusters),
+			))
+		}
+		return &database.Clusters[hint.Shard-1], nil
+	}
+	for i := range database.Clusters {
+		if database.Clusters[i].GetAddr() == hint.Cluster {
+			return &database.Clusters[i], nil
+		}
+	}
+	return nil, buildQueryError("22023", fmt.Sprintf("hint names %s which is not a cluster of database %q", hint.Cluster, database.Name))
+}
+
+// Run a query on every cluster and send the client the rows of all of
+// them one after the other. A write outside of a transaction is prepared
+// on each cluster before any commits it. Statements that cannot run in a
+// transaction, like CREATE INDEX CONCURRENTLY, and queries ending or
+// starting a transaction themselves are sent to each cluster as they
+// are, so they can end up applied on some clusters only
+func handleHintedQuery(
+	queryText string,
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	coordinated := !query.IsReadOnly(statements) && !client.InTransaction()
+	for _, statement := range statements {
+		if !statement.CanRunInTransaction() || statement.Kind == query.KIND_BEGIN ||
+			statement.Kind == query.KIND_COMMIT || statement.Kind == query.KIND_ROLLBACK {
+			coordinated = false
+		}
+	}
+	servers, err := getShardConnections(client, requester, database)
+	if err == nil && coordinated {
+		if err = beginCoordinatedTransaction(servers); err != nil {
+			releaseShardConnections(client, requester, database, servers)
+		}
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for hinted query", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+
+	for _, server := range servers {
+		server.IssueQuery(queryText)
+	}
+	results := relayShardRows(client, servers)
+	if coordinated {
+		endPreparedTransaction(servers, results, newPreparedTransactionId("hint", client.Ctx.ClientPid), database.Name)
+	}
+	releaseShardConnections(client, requester, database, servers)
+
+	slog.Info("Ran hinted query on every shard", "clientPid", client.Ctx.ClientPid, "shards", len(servers), "coordinated", coordinated)
+	writeShardResults(client, database.Name, results, sumCommandTags(results), nil)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestGetHintCluster(t *testing.T) {
+	database := joinTestDatabase()
+	cluster, errMsg := getHintCluster(&query.Hint{Shard: 2}, database)
+	if errMsg != nil || cluster.GetAddr() != "b:5432" {
+		t.Fatalf("Expected shard 2 to be b:5432, got %v", cluster)
+	}
+	cluster, errMsg = getHintCluster(&query.Hint{Cluster: "a:5432"}, database)
+	if errMsg != nil || cluster != &database.Clusters[0] {
+		t.Fatalf("Expected the cluster a:5432, got %v", cluster)
+	}
+	if _, errMsg = getHintCluster(&query.Hint{Shard: 3}, database); errMsg == nil {
+		t.Fatalf("Expected an error for a shard the database does not have")
+	}
+	if _, errMsg = getHintCluster(&query.Hint{Cluster: "c:5432"}, database); errMsg == nil {
+		t.Fatalf("Expected an error for a cluster the database does not have")
+	}
+}
+
+func TestRouteByHint(t *testing.T) {
+	database := joinTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+
+	read := "SELECT * FROM users WHERE id > 10"
+	update := "UPDATE users SET name = 'x'"
+	write := func(cluster *ClusterConfig) (*ServerConnection, *scriptedConn) {
+		return newSessionServer(database, cluster,
+			buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+			buildCompletion("UPDATE 2", TRANSACTION_STATUS_ACTIVE),
+			buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE),
+			buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE),
+		)
+	}
+	shardTwo, shardTwoConn := newSessionServer(database, &database.Clusters[1], buildResult(1, TRANSACTION_STATUS_IDLE))
+	clusterA, clusterAConn := newSessionServer(database, &database.Clusters[0], buildResult(1, TRANSACTION_STATUS_IDLE))
+	allA, allAConn := newSessionServer(database, &database.Clusters[0], buildResult(1, TRANSACTION_STATUS_IDLE))
+	allB, allBConn := newSessionServer(database, &database.Clusters[1], buildResult(1, TRANSACTION_STATUS_IDLE))
+	writeA, writeAConn := write(&database.Clusters[0])
+	writeB, writeBConn := write(&database.Clusters[1])
+	returned := serveScriptedPool(requester, map[string][]*ServerConnection{
+		"a:5432": {clusterA, allA, writeA},
+		"b:5432": {shardTwo, allB, writeB},
+	})
+	conn := startQuerySession(t, requester, "test")
+
+	for _, sql := range []string{
+		"/* pgspanner: shard=2 */ " + read,
+		"/* pgspanner: cluster=a:5432 */ " + read,
+		"/* pgspanner: all */ " + read,
+		"/* pgspanner: all */ " + update,
+	} {
+		if code := sendSessionQuery(t, conn, sql); code != "" {
+			t.Fatalf("Expected %q to succeed, got %q", sql, code)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		<-returned
+	}
+
+	// Each query runs without its hint on the clusters the hint picks
+	for _, c := range []struct {
+		conn     *scriptedConn
+		expected string
+	}{{shardTwoConn, read}, {clusterAConn, read}, {allAConn, read}, {allBConn, read}} {
+		if queries := c.conn.queries(); len(queries) == 0 || strings.TrimSpace(queries[0]) != c.expected {
+			t.Fatalf("Expected %q, got %q", c.expected, queries)
+		}
+	}
+
+	// A write to every cluster outside of a transaction is prepared on
+	// every cluster before it is committed on any
+	for _, c := range []*scriptedConn{writeAConn, writeBConn} {
+		queries := c.queries()
+		if len(queries) < 4 || queries[0] != "BEGIN" || strings.TrimSpace(queries[1]) != update ||
+			!strings.HasPrefix(queries[2], "PREPARE TRANSACTION 'pgspanner_hint_") ||
+			queries[3] != "COMMIT PREPARED "+strings.TrimPrefix(queries[2], "PREPARE TRANSACTION ") {
+			t.Fatalf("Expected the write to be prepared and committed, got %q", queries)
+		}
+	}
+	if !strings.HasSuffix(writeBConn.queries()[2], PREPARED_TRANSACTION_DECISION_SUFFIX+"'") {
+		t.Fatalf("Expected the last cluster to prepare the decision, got %q", writeBConn.queries()[2])
+	}
+}
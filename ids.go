@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Ids for sharded tables are generated by the proxy since sequences on each shard hand out the
+/// same values
+
+const (
+	ID_EPOCH_MS       = 1704067200000 // 2024-01-01T00:00:00Z
+	ID_NODE_BITS      = 10
+	ID_SEQUENCE_BITS  = 11
+	ID_MAX_NODE_ID    = 1<<ID_NODE_BITS - 1
+	ID_MAX_SEQUENCE   = 1<<ID_SEQUENCE_BITS - 1
+	ID_FUNCTION_NAME  = "next_id"
+	ID_FUNCTION_OWNER = "pgspanner"
+	INT8_TYPE_OID     = 20
+)
+
+// Generates Snowflake style 63 bit ids made of the milliseconds since
+// ID_EPOCH_MS, the node id of the proxy and a sequence number:
+//
+//	| 41 bits timestamp | 10 bits node id | 11 bits sequence | 1 bit generation |
+type IdGenerator struct {
+	mu         sync.Mutex
+	nodeId     int64
+	generation int64
+	lastMs     int64
+	sequence   int64
+	now        func() int64
+}
+
+func NewIdGenerator(nodeId int) *IdGenerator {
+	return &IdGenerator{
+		nodeId: int64(nodeId),
+		now:    func() int64 { return time.Now().UnixMilli() },
+	}
+}
+
+// The generator used by every client of the process
+var idGenerator = NewIdGenerator(0)
+
+// Get a new id. When the clock goes backwards or the sequence of the
+// current millisecond runs out the next millisecond is used early so
+// ids never repeat and keep increasing
+func (g *IdGenerator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if now > g.lastMs {
+		g.lastMs = now
+		g.sequence = 0
+	} else if g.sequence < ID_MAX_SEQUENCE {
+		g.sequence++
+	} else {
+		g.lastMs++
+		g.sequence = 0
+	}
+	return (g.lastMs-ID_EPOCH_MS)<<(ID_NODE_BITS+ID_SEQUENCE_BITS+1) |
+		g.nodeId<<(ID_SEQUENCE_BITS+1) |
+		g.sequence<<1 |
+		g.generation
+}
+
+func (g *IdGenerator) GetGeneration() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int(g.generation)
+}
+
+// Use the other generation than the process we took over from, so both
+// can hand out ids while the old process finishes its transactions
+func (g *IdGenerator) FollowGeneration(previous int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.generation = int64(previous&1) ^ 1
+}
+
+// Answer a query that only asks for a new id without going to a server.
+// Returns whether the query was answered
+func handleNextIdSelect(statements []*query.Statement, client *ClientConnection) bool {
+	if len(statements) != 1 || statements[0].Kind != query.KIND_SELECT {
+		return false
+	}
+	statement := statements[0]
+	calls, err := query.FindFunctionCalls(statement, ID_FUNCTION_OWNER, ID_FUNCTION_NAME)
+	if err != nil || len(calls) != 1 || len(statement.Tokens) < 2 || calls[0].Start != statement.Tokens[1].Start {
+		return false
+	}
+	// SELECT pgspanner.next_id('name') [[AS] alias]
+	column := ID_FUNCTION_NAME
+	rest := make([]query.Token, 0, 2)
+	for _, token := range statement.Tokens {
+		if token.Start >= calls[0].End {
+			rest = append(rest, token)
+		}
+	}
+	if len(rest) > 0 && rest[0].IsKeyword("AS") {
+		rest = rest[1:]
+	}
+	if len(rest) > 1 || (len(rest) == 1 && rest[0].Kind != query.TOKEN_IDENT && rest[0].Kind != query.TOKEN_QUOTED_IDENT) {
+		return false
+	}
+	if len(rest) == 1 {
+		column = rest[0].Name()
+	}
+
+	if errMsg := checkNextIdCall(calls[0]); errMsg != nil {
+		writeSyntheticError(client, errMsg)
+		return true
+	}
+	transactionStatus := client.TransactionStatus()
+	if transactionStatus == TRANSACTION_STATUS_FAILED {
+		writeSyntheticError(client, buildFailedTransactionError())
+		return true
+	}
+	id := strconv.FormatInt(idGenerator.Next(), 10)
+	packet := protocol.BuildRowDescriptionPgMessage(map[string][]int{column: {0, 0, INT8_TYPE_OID, 8, -1, 0}}).Pack()
+	packet = append(packet, protocol.BuildDataRowPgMessage([][]byte{[]byte(id)}).Pack()...)
+	packet = append(packet, protocol.BuildCommandCompletePgMessage("SELECT 1").Pack()...)
+	packet = append(packet, protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...)
+	client.Write(packet)
+	return true
+}
+
+// pgspanner.next_id takes the name of the sequence as a string. Every
+// name shares the same ids
+func checkNextIdCall(call query.FunctionCall) *protocol.ErrorResponsePgMessage {
+	if len(call.Args) != 1 || len(call.Args[0]) != 1 || call.Args[0][0].Kind != query.TOKEN_STRING {
+		return buildQueryError("42883", "pgspanner.next_id takes a single string constant naming the sequence")
+	}
+	return nil
+}
+
+// A replacement of part of a query
+type queryEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// Fill in the ids generated by the proxy. Calls to pgspanner.next_id are
+// replaced by a new id and INSERTs into tables with an idColumn that do
+// not list it get the column added with a new id for every row.
+// pgspanner.next_id is evaluated once per call in the text so it is only
+// allowed where the call produces a single value
+func rewriteGeneratedIds(
+	queryText string,
+	statements []*query.Statement,
+	database *DatabaseConfig,
+) (string, *protocol.ErrorResponsePgMessage) {
+	edits := make([]queryEdit, 0)
+	for _, statement := range statements {
+		calls, err := query.FindFunctionCalls(statement, ID_FUNCTION_OWNER, ID_FUNCTION_NAME)
+		if err != nil {
+			continue
+		}
+
+		var insert *query.InsertStatement
+		if statement.Kind == query.KIND_INSERT {
+			insert, _ = query.ParseInsert(statement)
+		}
+		if len(calls) > 0 && !allowsNextId(statement, insert) {
+			return "", buildQueryError(
+				"0A000",
+				"pgspanner.next_id can only be called in the VALUES of an INSERT or in a SELECT without a FROM",
+			)
+		}
+		for _, call := range calls {
+			if errMsg := checkNextIdCall(call); errMsg != nil {
+				return "", errMsg
+			}
+			edits = append(edits, queryEdit{call.Start, call.End, strconv.FormatInt(idGenerator.Next(), 10)})
+		}
+
+		if insert == nil {
+			continue
+		}
+		table, ok := database.GetRelationTableConfig(insert.Schema, insert.Table)
+		if !ok || table.IdColumn == "" || insert.HasColumn(table.IdColumn) {
+			continue
+		}
+		if insert.ColumnsStart < 0 {
+			errMsg := buildQueryError("0A000", fmt.Sprintf("INSERT into %s must name its columns so the proxy can fill in %s", table.Name, table.IdColumn))
+			errMsg.Fields[protocol.NOTICE_KIND_HINT] = protocol.ErrorField{
+				Type: 'H', Value: fmt.Sprintf("List the columns after the table name, leaving out %s to have it generated.", table.IdColumn),
+			}
+			return "", errMsg
+		}
+		if len(insert.Rows) == 0 {
+			return "", buildQueryError("0A000", fmt.Sprintf(
+				"INSERT into %s that leaves out %s must give its rows in VALUES so the proxy can fill it in", table.Name, table.IdColumn,
+			))
+		}
+		edits = append(edits, queryEdit{insert.ColumnsStart, insert.ColumnsStart, quoteIdentifier(table.IdColumn) + ", "})
+		for _, row := range insert.Rows {
+			edits = append(edits, queryEdit{row, row, fmt.Sprintf("%d, ", idGenerator.Next())})
+		}
+		slog.Debug("Generated ids for insert", "table", table.Name, "column", table.IdColumn, "rows", len(insert.Rows))
+	}
+	if len(edits) == 0 {
+		return queryText, nil
+	}
+
+	// Apply edits from the end of the query so earlier offsets stay valid.
+	// A call replaced at the start of a row goes before the id inserted
+	// there
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start > edits[j].start
+		}
+		return edits[i].end > edits[j].end
+	})
+	for _, edit := range edits {
+		queryText = queryText[:edit.start] + edit.text + queryText[edit.end:]
+	}
+	return queryText, nil
+}
+
+// Whether every call to pgspanner.next_id in the statement yields one
+// value. That is the case for the rows of a VALUES list and for a SELECT
+// that does not read from a table
+func allowsNextId(statement *query.Statement, insert *query.InsertStatement) bool {
+	for _, token := range statement.Tokens {
+		if token.IsKeyword("FROM") || (insert != nil && token.IsKeyword("SELECT")) {
+			return false
+		}
+	}
+	return statement.Kind == query.KIND_SELECT || (insert != nil && len(insert.Rows) > 0)
+}
+
+// Quote a table name that may be qualified with its schema
+func quoteTableName(name string) string {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return quoteIdentifier(schema) + "." + quoteIdentifier(table)
+	}
+	return quoteIdentifier(name)
+}
+
+// Quote an identifier if postgres would not read it back as written
+func quoteIdentifier(name string) string {
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9')) {
+			return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		}
+	}
+	return name
+}
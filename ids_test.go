@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestIdGenerator(t *testing.T) {
+	now := int64(ID_EPOCH_MS + 1000)
+	generator := NewIdGenerator(5)
+	generator.now = func() int64 { return now }
+
+	first := generator.Next()
+	if first>>(ID_NODE_BITS+ID_SEQUENCE_BITS+1) != 1000 || (first>>(ID_SEQUENCE_BITS+1))&ID_MAX_NODE_ID != 5 {
+		t.Fatalf("Unexpected id layout %b", first)
+	}
+
+	// Running out of sequence numbers and the clock going backwards both
+	// keep the ids increasing
+	previous := first
+	for i := 0; i < 3*ID_MAX_SEQUENCE; i++ {
+		if i == ID_MAX_SEQUENCE {
+			now -= 10
+		}
+		id := generator.Next()
+		if id <= previous {
+			t.Fatalf("Id %d is not greater than %d", id, previous)
+		}
+		previous = id
+	}
+
+	// A process taking over during an upgrade never repeats an id of the
+	// previous one
+	next := NewIdGenerator(5)
+	next.now = generator.now
+	next.FollowGeneration(generator.GetGeneration())
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		seen[generator.Next()] = true
+	}
+	for i := 0; i < 100; i++ {
+		if seen[next.Next()] {
+			t.Fatal("Ids of the next generation collide")
+		}
+	}
+}
+
+func TestRewriteGeneratedIds(t *testing.T) {
+	previous := idGenerator
+	defer func() { idGenerator = previous }()
+
+	database := &DatabaseConfig{Tables: []TableConfig{{Name: "users", ShardKey: "id", IdColumn: "id"}}}
+	rewrite := func(sql string) string {
+		statements, err := query.Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewritten, errMsg := rewriteGeneratedIds(sql, statements, database)
+		if errMsg != nil {
+			t.Fatalf("Error rewriting %q: %s", sql, errMsg.Error())
+		}
+		return rewritten
+	}
+	expect := func(sql string, expected string) {
+		t.Helper()
+		// Ids generated in the first millisecond are twice the sequence
+		idGenerator = NewIdGenerator(0)
+		idGenerator.now = func() int64 { return ID_EPOCH_MS }
+		if rewritten := rewrite(sql); rewritten != expected {
+			t.Fatalf("Expected %q, got %q", expected, rewritten)
+		}
+	}
+
+	expect(
+		"INSERT INTO users (name) VALUES ('a'), ('b') RETURNING id",
+		"INSERT INTO users (id, name) VALUES (0, 'a'), (2, 'b') RETURNING id",
+	)
+	expect("INSERT INTO users (id, name) VALUES (7, 'a')", "INSERT INTO users (id, name) VALUES (7, 'a')")
+	expect("INSERT INTO posts (title) VALUES ('a')", "INSERT INTO posts (title) VALUES ('a')")
+	expect(
+		"INSERT INTO posts (id, user_id) VALUES (pgspanner.next_id('posts'), 1); SELECT pgspanner.next_id('x')",
+		"INSERT INTO posts (id, user_id) VALUES (0, 1); SELECT 2",
+	)
+	expect(
+		"INSERT INTO public.users (name, ref) VALUES (pgspanner.next_id('users'), 1)",
+		"INSERT INTO public.users (id, name, ref) VALUES (2, 0, 1)",
+	)
+
+	for _, sql := range []string{
+		"SELECT pgspanner.next_id('users') FROM generate_series(1, 10)",
+		"INSERT INTO posts (id) SELECT pgspanner.next_id('posts')",
+		"UPDATE posts SET id = pgspanner.next_id('posts')",
+		"SELECT pgspanner.next_id(1)",
+		"INSERT INTO users VALUES ('a')",
+		"INSERT INTO users (name) SELECT name FROM staging",
+	} {
+		statements, _ := query.Parse(sql)
+		if _, errMsg := rewriteGeneratedIds(sql, statements, database); errMsg == nil {
+			t.Fatalf("Expected %q to be rejected", sql)
+		}
+	}
+
+	if quoteIdentifier("user_id") != "user_id" || quoteIdentifier("UserId") != `"UserId"` || !strings.HasPrefix(quoteIdentifier("1a"), `"`) {
+		t.Fatal("Unexpected identifier quoting")
+	}
+}
+
+func TestSyntheticErrorTransactionStatus(t *testing.T) {
+	conn := &scriptedConn{}
+	server := &ServerConnection{}
+	client := &ClientConnection{Conn: conn}
+	client.PinConnection("shard", server)
+
+	expect := func(expected byte) {
+		t.Helper()
+		conn.sent.Reset()
+		writeSyntheticError(client, buildQueryError("0A000", "rejected"))
+		packet := conn.sent.Bytes()
+		if packet[len(packet)-1] != expected {
+			t.Fatalf("Expected transaction status %c, got %c", expected, packet[len(packet)-1])
+		}
+	}
+	server.SetTransactionStatus(TRANSACTION_STATUS_ACTIVE)
+	expect(TRANSACTION_STATUS_ACTIVE)
+	server.SetTransactionStatus(TRANSACTION_STATUS_FAILED)
+	expect(TRANSACTION_STATUS_FAILED)
+	client.UnpinConnection("shard")
+	expect(TRANSACTION_STATUS_IDLE)
+
+	if buildFailedTransactionError().Fields[protocol.NOTICE_KIND_CODE].Value != "25P02" {
+		t.Fatal("Expected a failed transaction error")
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
 const (
 	ACTION_GET_CONNECTION         = "GET_CONNECTION"
+	ACTION_GET_READ_CONNECTION    = "GET_READ_CONNECTION"
 	ACTION_RETURN_CONNECTION      = "RETURN_CONNECTION"
 	ACTION_CLOSE_CONNECTION       = "CLOSE_CONNECTION"
 	ACTION_GET_CONNECTION_MAPPING = "GET_CONNECTION_MAPPING"
+	ACTION_REPORT_CLUSTER_HEALTH  = "REPORT_CLUSTER_HEALTH"
+	ACTION_GET_CLUSTER_HEALTH     = "GET_CLUSTER_HEALTH"
+	ACTION_SHUTDOWN               = "SHUTDOWN"
+	ACTION_RELOAD_CONFIG          = "RELOAD_CONFIG"
 )
 
 const (
@@ -18,6 +28,8 @@ type ConnectionRequest struct {
 	clusterAddr string
 	FrontendPid int
 	Connection  *ServerConnection
+	Health      ClusterHealth
+	Config      *SpannerConfig
 	responder   chan ConnectionResponse
 }
 
@@ -27,15 +39,30 @@ type ConnectionResponse struct {
 	Detail      error
 	ConnMapping []ServerProcessIdentity
 	Conn        *ServerConnection
+	Health      []ClusterHealth
+	Changes     []ConfigChange
 }
 
 type ConnectionRequester struct {
 	channel chan *ConnectionRequest
+	// The running config. Only replaced by the pool manager once it has
+	// applied a reloaded config
+	config atomic.Pointer[SpannerConfig]
 }
 
-func NewConnectionRequester() *ConnectionRequester {
+func NewConnectionRequester(config *SpannerConfig) *ConnectionRequester {
 	// Use a buffered channel to avoid blocking the requester
-	return &ConnectionRequester{channel: make(chan *ConnectionRequest, 1024)}
+	requester := &ConnectionRequester{channel: make(chan *ConnectionRequest, 1024)}
+	requester.config.Store(config)
+	return requester
+}
+
+func (cr *ConnectionRequester) GetConfig() *SpannerConfig {
+	return cr.config.Load()
+}
+
+func (cr *ConnectionRequester) setConfig(config *SpannerConfig) {
+	cr.config.Store(config)
 }
 
 func (cr *ConnectionRequester) ReceiveConnectionRequest() chan *ConnectionRequest {
@@ -43,19 +70,54 @@ func (cr *ConnectionRequester) ReceiveConnectionRequest() chan *ConnectionReques
 }
 
 func (cr *ConnectionRequester) RequestConnection(database string, clusterAddr string, clientPid int) ConnectionResponse {
-	response := make(chan ConnectionResponse)
-	request := ConnectionRequest{
-		Event:       ACTION_GET_CONNECTION,
-		database:    database,
-		clusterAddr: clusterAddr,
-		responder:   response,
-		FrontendPid: clientPid,
+	return cr.requestLiveConnection(ACTION_GET_CONNECTION, database, clusterAddr, clientPid)
+}
+
+// Request a connection for read only queries. The pool manager may
+// hand out a connection to one of the cluster's replicas
+func (cr *ConnectionRequester) RequestReadConnection(database string, clusterAddr string, clientPid int) ConnectionResponse {
+	return cr.requestLiveConnection(ACTION_GET_READ_CONNECTION, database, clusterAddr, clientPid)
+}
+
+// Request a connection and check it is still alive if it sat idle in
+// the pool for a while. The check runs on the client's goroutine so a
+// server that does not answer does not stall the pool manager. A
+// connection failing the check is closed and another one requested
+func (cr *ConnectionRequester) requestLiveConnection(event string, database string, clusterAddr string, clientPid int) ConnectionResponse {
+	for {
+		response := make(chan ConnectionResponse)
+		request := ConnectionRequest{
+			Event:       event,
+			database:    database,
+			clusterAddr: clusterAddr,
+			responder:   response,
+			FrontendPid: clientPid,
+		}
+		cr.channel <- &request
+		result := <-response
+		if result.Result != RESULT_SUCCESS {
+			return result
+		}
+		conn := result.Conn
+		healthCheckIdleTime := conn.GetDatabaseConfig().PoolSettings.GetHealthCheckIdleTime()
+		if conn.GetIdleTime() <= int64(healthCheckIdleTime) || conn.CheckLiveness() {
+			return result
+		}
+		slog.Info(
+			"Closing connection. Connection failed liveness check",
+			"Cluster", conn.GetClusterConfig().GetAddr(),
+			"BackendPid", conn.GetBackendPid(),
+		)
+		cr.ReturnConnection(conn, database, conn.GetClusterConfig().GetAddr(), clientPid)
 	}
-	cr.channel <- &request
-	return <-response
 }
 
 func (cr *ConnectionRequester) ReturnConnection(conn *ServerConnection, database string, clusterAddr string, clientPid int) {
+	// Clear any state left behind by the client before the connection
+	// goes back to the pool. This runs on the client's goroutine so a
+	// slow reset does not stall the pool manager
+	conn.Reset()
+
 	var request ConnectionRequest
 	if conn.IsPoisoned() {
 		request = ConnectionRequest{
@@ -83,3 +145,37 @@ func (cr *ConnectionRequester) RequestConnectionMapping(clientPid int) Connectio
 	cr.channel <- &request
 	return <-response
 }
+
+func (cr *ConnectionRequester) ReportClusterHealth(health ClusterHealth) {
+	request := ConnectionRequest{
+		Event:       ACTION_REPORT_CLUSTER_HEALTH,
+		database:    health.DatabaseName,
+		clusterAddr: health.ClusterAddr,
+		Health:      health,
+	}
+	cr.channel <- &request
+}
+
+func (cr *ConnectionRequester) RequestClusterHealth() ConnectionResponse {
+	response := make(chan ConnectionResponse)
+	request := ConnectionRequest{Event: ACTION_GET_CLUSTER_HEALTH, responder: response}
+	cr.channel <- &request
+	return <-response
+}
+
+// Ask the pool manager to close every pooled connection and wait for it
+func (cr *ConnectionRequester) RequestShutdown() ConnectionResponse {
+	response := make(chan ConnectionResponse)
+	request := ConnectionRequest{Event: ACTION_SHUTDOWN, responder: response}
+	cr.channel <- &request
+	return <-response
+}
+
+// Hand a validated config to the pool manager to apply and wait for the
+// changes it made
+func (cr *ConnectionRequester) RequestConfigReload(config *SpannerConfig) ConnectionResponse {
+	response := make(chan ConnectionResponse)
+	request := ConnectionRequest{Event: ACTION_RELOAD_CONFIG, Config: config, responder: response}
+	cr.channel <- &request
+	return <-response
+}
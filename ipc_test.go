@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestLiveConnection(t *testing.T) {
+	database := &DatabaseConfig{Name: "test"}
+	cluster := &ClusterConfig{Host: "a", Port: 5432}
+	// The server behind the first connection went away while it sat idle
+	dead, _ := newScriptedServer(cluster)
+	live, liveConn := newScriptedServer(cluster, buildCompletion("SELECT 1", TRANSACTION_STATUS_IDLE))
+	fresh, freshConn := newScriptedServer(cluster)
+	fresh.Context.Database = database
+	fresh.MarkUsed()
+	for _, server := range []*ServerConnection{dead, live} {
+		server.Context.Database = database
+		server.lastUsed = time.Now().Unix() - int64(database.PoolSettings.GetHealthCheckIdleTime()) - 1
+	}
+
+	requester := NewConnectionRequester(nil)
+	defer close(requester.channel)
+	returned := serveScriptedPool(requester, map[string][]*ServerConnection{"a:5432": {dead, live, fresh}})
+	response := requester.RequestConnection("test", "a:5432", 1)
+	if response.Conn != live {
+		t.Fatal("Expected the connection that passed the liveness check")
+	}
+	if queries := liveConn.queries(); len(queries) != 1 || queries[0] != HEALTH_CHECK_QUERY {
+		t.Fatalf("Expected the idle connection to be checked, got %q", queries)
+	}
+	if request := <-returned; request.Connection != dead || request.Event != ACTION_CLOSE_CONNECTION {
+		t.Fatalf("Expected the dead connection to be closed, got %s", request.Event)
+	}
+
+	// Connections used recently are handed out as they are
+	if response := requester.RequestReadConnection("test", "a:5432", 1); response.Conn != fresh || len(freshConn.queries()) != 0 {
+		t.Fatal("Expected a recently used connection without a liveness check")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// A join of sharded tables only finds all of its rows on each cluster when it equates their
+/// shard keys, since rows with equal keys live on the same cluster
+
+// A sharded table used by a statement
+type shardedRef struct {
+	table *TableConfig
+	ref   query.TableRef
+}
+
+// The name the statement refers to the table by
+func (s shardedRef) name() string {
+	if s.ref.Alias != "" {
+		return s.ref.Alias
+	}
+	return s.ref.Table
+}
+
+// Find every use of a sharded table in a statement, subqueries included
+func findShardedTables(statement *query.Statement, database *DatabaseConfig) []shardedRef {
+	refs := make([]shardedRef, 0, 2)
+	for _, ref := range query.Tables(statement) {
+		table, ok := database.GetRelationTableConfig(ref.Schema, ref.Table)
+		if ok && !table.Reference {
+			refs = append(refs, shardedRef{table, ref})
+		}
+	}
+	return refs
+}
+
+// Check that the sharded tables of a statement are linked to each other
+// through conditions equating their shard keys. Such co-located joins
+// are routed like queries on a single table. Returns an error naming two
+// tables that are not
+func checkColocated(statement *query.Statement, refs []shardedRef) *protocol.ErrorResponsePgMessage {
+	groups := make([]int, len(refs))
+	for i := range groups {
+		groups[i] = i
+	}
+	find := func(i int) int {
+		for groups[i] != i {
+			i = groups[i]
+		}
+		return i
+	}
+	resolve := func(column query.ColumnRef) int {
+		for i, ref := range refs {
+			if ref.name() == column.Qualifier && ref.table.ShardKey == column.Column {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, equality := range query.JoinEqualities(statement) {
+		left, right := resolve(equality.Left), resolve(equality.Right)
+		if left >= 0 && right >= 0 {
+			groups[find(left)] = find(right)
+		}
+	}
+
+	for i := range refs[1:] {
+		if find(i+1) == find(0) {
+			continue
+		}
+		first, other := refs[0], refs[i+1]
+		errMsg := buildQueryError("0A000", fmt.Sprintf(
+			"join of sharded tables %s and %s is not co-located", first.table.Name, other.table.Name,
+		))
+		errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: fmt.Sprintf(
+			"Rows of %s and %s that join may live on different clusters. Only joins equating the shard keys of the tables, like %s.%s = %s.%s, run on the clusters.",
+			first.table.Name, other.table.Name, first.name(), first.table.ShardKey, other.name(), other.table.ShardKey,
+		)}
+		errMsg.Fields[protocol.NOTICE_KIND_HINT] = protocol.ErrorField{
+			Type: 'H', Value: "Add the condition on the shard keys to the join or make one of the tables a reference table.",
+		}
+		return errMsg
+	}
+	return nil
+}
+
+// Run joins of sharded tables that are not co-located in the proxy when
+// it can, see hashjoin.go, and reject the others, since they would miss
+// the rows living on other clusters, along with co-located joins sent with
+// other statements, which cannot be run on every cluster on their own.
+// Returns whether the query was handled
+func routeJoins(
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	for _, statement := range statements {
+		refs := findShardedTables(statement, database)
+		if len(refs) < 2 {
+			continue
+		}
+		if errMsg := checkColocated(statement, refs); errMsg != nil {
+			reason := "joins the proxy runs itself must be sent as a query of their own outside of a transaction"
+			if len(statements) == 1 && !client.InTransaction() {
+				join, err := query.ParseJoinSelect(statement)
+				if err == nil {
+					handleHashJoin(join, client, requester, database)
+					return true
+				}
+				reason = err.Error()
+			}
+			detail := errMsg.Fields[protocol.NOTICE_KIND_DETAIL]
+			detail.Value += " The proxy cannot run the join itself either: " + reason + "."
+			errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = detail
+			slog.Warn("Rejected join that is not co-located", "clientPid", client.Ctx.ClientPid, "error", errMsg.Error())
+			writeSyntheticError(client, errMsg)
+			return true
+		}
+		if len(statements) > 1 {
+			writeSyntheticError(client, buildQueryError(
+				"0A000",
+				fmt.Sprintf("joins of sharded table %s must be sent as a query of their own", refs[0].table.Name),
+			))
+			return true
+		}
+	}
+	return false
+}
+
+// Add up the row counts of command tags like SELECT 3 or UPDATE 2
+func sumCommandTags(results []shardResult) string {
+	tag := results[0].tag
+	total := 0
+	for _, result := range results {
+		fields := strings.Fields(result.tag)
+		if len(fields) < 2 {
+			return tag
+		}
+		count, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return tag
+		}
+		total += count
+	}
+	fields := strings.Fields(tag)
+	fields[len(fields)-1] = strconv.Itoa(total)
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func joinTestDatabase() *DatabaseConfig {
+	return &DatabaseConfig{
+		Name: "test",
+		Tables: []TableConfig{
+			{Name: "users", ShardKey: "id"},
+			{Name: "posts", ShardKey: "user_id"},
+			{Name: "comments", ShardKey: "user_id"},
+			{Name: "countries", Reference: true},
+		},
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-80"},
+			{Host: "b", Port: 5432, KeyRange: "80-"},
+		},
+	}
+}
+
+func TestCheckColocated(t *testing.T) {
+	database := joinTestDatabase()
+	colocated := []string{
+		"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id",
+		"SELECT * FROM users u JOIN posts p ON p.user_id = u.id JOIN comments c ON c.user_id = p.user_id",
+		"SELECT * FROM posts JOIN comments USING (user_id)",
+		"SELECT * FROM posts p, comments c, countries WHERE p.user_id = c.user_id",
+		"SELECT * FROM posts p WHERE NOT EXISTS (SELECT 1 FROM comments c WHERE c.user_id = p.user_id)",
+	}
+	for _, sql := range colocated {
+		statements, _ := query.Parse(sql)
+		if errMsg := checkColocated(statements[0], findShardedTables(statements[0], database)); errMsg != nil {
+			t.Fatalf("Expected %q to be co-located, got %s", sql, errMsg.Error())
+		}
+	}
+
+	notColocated := []string{
+		"SELECT * FROM posts p JOIN comments c ON c.post_id = p.id",
+		"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id OR c.post_id = p.id",
+		"SELECT * FROM users u JOIN posts p ON p.user_id = u.id JOIN comments c ON c.post_id = p.id",
+		"SELECT * FROM posts WHERE id IN (SELECT post_id FROM comments)",
+	}
+	for _, sql := range notColocated {
+		statements, _ := query.Parse(sql)
+		if errMsg := checkColocated(statements[0], findShardedTables(statements[0], database)); errMsg == nil {
+			t.Fatalf("Expected %q not to be co-located", sql)
+		}
+	}
+}
+
+func TestRouteColocatedJoin(t *testing.T) {
+	database := joinTestDatabase()
+	owner, _ := database.GetClusterForKeyspaceId(KeyspaceId([]byte("3")))
+	cases := []struct {
+		sql      string
+		expected string
+	}{
+		{"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id WHERE c.user_id = 3", owner.GetAddr()},
+		{"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id WHERE p.user_id = 3", owner.GetAddr()},
+		{"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id", ""},
+		{"SELECT * FROM posts p JOIN comments c ON c.post_id = p.id WHERE p.user_id = 3", ""},
+	}
+	for _, c := range cases {
+		statements, _ := query.Parse(c.sql)
+		cluster, err := routeByShardKey(statements, nil, 0, nil, database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ""
+		if cluster != nil {
+			addr = cluster.GetAddr()
+		}
+		if addr != c.expected {
+			t.Fatalf("Expected %q to route to %q, got %q", c.sql, c.expected, addr)
+		}
+	}
+}
+
+func TestSumCommandTags(t *testing.T) {
+	results := []shardResult{{tag: "SELECT 2"}, {tag: "SELECT 0"}, {tag: "SELECT 5"}}
+	if tag := sumCommandTags(results); tag != "SELECT 7" {
+		t.Fatalf("Expected SELECT 7, got %s", tag)
+	}
+	results = []shardResult{{tag: "INSERT 0 1"}, {tag: "INSERT 0 2"}}
+	if tag := sumCommandTags(results); tag != "INSERT 0 3" {
+		t.Fatalf("Expected INSERT 0 3, got %s", tag)
+	}
+}
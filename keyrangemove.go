@@ -0,0 +1,1015 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/// Moves a key range to another cluster of its database with logical replication, without
+/// stopping writes to it
+
+const (
+	MOVE_STATE_COPYING     = "copying"
+	MOVE_STATE_CATCHING_UP = "catching_up"
+	MOVE_STATE_CLEANING_UP = "cleaning_up"
+	MOVE_STATE_DONE        = "done"
+	MOVE_STATE_CANCELLING  = "cancelling"
+	MOVE_STATE_CANCELLED   = "cancelled"
+)
+
+const (
+	MOVE_POLL_INTERVAL  = time.Second
+	MOVE_RETRY_INTERVAL = 10 * time.Second
+	// Bytes of WAL the target may be behind the source before writes
+	// are held back for the cutover
+	MOVE_CUTOVER_LAG = 1024 * 1024
+	// Longest writes to the moving range are held back. A cutover that
+	// takes longer is abandoned and tried again later
+	MOVE_FREEZE_TIMEOUT  = 5 * time.Second
+	MOVE_FREEZE_INTERVAL = 20 * time.Millisecond
+	// How often the shard metadata is read while waiting for the other
+	// proxies to hold back their writes
+	MOVE_FREEZE_CONFIRM_INTERVAL = 100 * time.Millisecond
+	// Longest the other proxies hold back writes for a cutover. They let
+	// them through again after this even if the proxy running the move
+	// went away in the middle of it
+	MOVE_REMOTE_FREEZE_TIMEOUT = 3 * MOVE_FREEZE_TIMEOUT
+)
+
+// A move of a key range from one cluster to another. The target
+// subscribes to the rows of the range on the source, then writes to the
+// range are held back on every proxy while the shard map is switched
+// over and the rows are deleted from the source. Every step is recorded
+// in the shard metadata so a move picks up where it stopped
+type KeyRangeMove struct {
+	Id       int    `json:"id"`
+	Database string `json:"database"`
+	KeyRange string `json:"keyRange"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	// Key ranges of the source and the target once the move is done
+	SourceKeyRange string    `json:"sourceKeyRange"`
+	TargetKeyRange string    `json:"targetKeyRange"`
+	State          string    `json:"state"`
+	Started        time.Time `json:"started"`
+	Updated        time.Time `json:"updated"`
+	LastError      string    `json:"lastError"`
+	// The instance id of the proxy running the move
+	Owner string `json:"owner"`
+	// Set during the cutover. Every proxy holds back its writes to the
+	// key range until then
+	FrozenUntil time.Time `json:"frozenUntil"`
+}
+
+// Whether the other proxies have to hold back writes to the key range
+func (m *KeyRangeMove) IsFrozen() bool {
+	return time.Now().Before(m.FrozenUntil)
+}
+
+func (m *KeyRangeMove) IsFinished() bool {
+	return m.State == MOVE_STATE_DONE || m.State == MOVE_STATE_CANCELLED
+}
+
+// Name of the publication, subscription and replication slot of the move
+func (m *KeyRangeMove) replicationName() string {
+	return fmt.Sprintf("pgspanner_move_%d", m.Id)
+}
+
+func (m *KeyRangeMove) row() []string {
+	return []string{
+		fmt.Sprint(m.Id),
+		m.Database,
+		m.KeyRange,
+		m.Source,
+		m.Target,
+		m.State,
+		formatAdminTime(m.Started),
+		formatAdminTime(m.Updated),
+		m.LastError,
+		m.Owner,
+	}
+}
+
+func (s *ShardMetadata) getMove(id int) *KeyRangeMove {
+	for i := range s.Moves {
+		if s.Moves[i].Id == id {
+			return &s.Moves[i]
+		}
+	}
+	return nil
+}
+
+// Writes routed by their shard key pass through the gate so a move can
+// hold back the writes to its key range during the cutover
+type routingGate struct {
+	mu      sync.Mutex
+	freezes map[string]*keyRangeFreeze
+	writers map[*routedWrite]bool
+	// Keyspace ids written by transactions that are still open, by client
+	transactions map[*ClientConnection]*routedWrite
+	// Counts the freezes so writers can tell which ones started before them
+	freezeCount int64
+	// Changes every time the shard map changes
+	version atomic.Int64
+}
+
+type keyRangeFreeze struct {
+	keyRange KeyRange
+	seq      int64
+	thawed   chan struct{}
+}
+
+// A write that routes rows by their shard key, like a COPY into a
+// sharded table
+type routedWrite struct {
+	gate     *routingGate
+	database string
+	// The freeze count when the write started
+	started int64
+	version int64
+	// Keyspace ids the write was routed to
+	ids []uint64
+	all bool
+}
+
+var shardRouting = &routingGate{
+	freezes:      make(map[string]*keyRangeFreeze),
+	writers:      make(map[*routedWrite]bool),
+	transactions: make(map[*ClientConnection]*routedWrite),
+}
+
+func (g *routingGate) BeginWrite(databaseName string) *routedWrite {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	write := &routedWrite{gate: g, database: databaseName, started: g.freezeCount, version: g.version.Load()}
+	g.writers[write] = true
+	return write
+}
+
+// Wait until rows with the keyspace id may be written. A freeze waits
+// for the writes that started before it so those are let through.
+// Returns whether the shard map changed since the last call, in which
+// case the owners of the keys have to be looked up again
+func (w *routedWrite) Route(id uint64) bool {
+	changed := w.route(func(keyRange KeyRange) bool { return keyRange.Contains(id) })
+	w.ids = append(w.ids, id)
+	return changed
+}
+
+// Wait until rows anywhere in the keyspace may be written, for writes
+// that run on every cluster
+func (w *routedWrite) RouteAll() bool {
+	changed := w.route(func(KeyRange) bool { return true })
+	w.all = true
+	return changed
+}
+
+func (w *routedWrite) route(frozen func(KeyRange) bool) bool {
+	for {
+		w.gate.mu.Lock()
+		freeze, ok := w.gate.freezes[w.database]
+		w.gate.mu.Unlock()
+		if !ok || freeze.seq > w.started || !frozen(freeze.keyRange) {
+			break
+		}
+		<-freeze.thawed
+	}
+	version := w.gate.version.Load()
+	changed := version != w.version
+	w.version = version
+	return changed
+}
+
+// Whether the write was routed to a keyspace id of the range
+func (w *routedWrite) touches(keyRange KeyRange) bool {
+	return w.all || slices.ContainsFunc(w.ids, keyRange.Contains)
+}
+
+// Finish the write. Rows written inside a transaction are not committed
+// yet, so the keyspace ids stay held by the client until its transaction
+// ends and a cutover of their range waits for it
+func (w *routedWrite) Finish(client *ClientConnection) {
+	w.gate.mu.Lock()
+	defer w.gate.mu.Unlock()
+	delete(w.gate.writers, w)
+	if client == nil || !client.InTransaction() || len(w.ids) == 0 && !w.all {
+		return
+	}
+	held, ok := w.gate.transactions[client]
+	if !ok {
+		held = &routedWrite{gate: w.gate, database: w.database}
+		w.gate.transactions[client] = held
+	}
+	held.ids = append(held.ids, w.ids...)
+	held.all = held.all || w.all
+}
+
+// Let go of the keyspace ids written by the client's transaction once it
+// has ended
+func (g *routingGate) EndTransaction(client *ClientConnection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.transactions, client)
+}
+
+// Hold back new writes to the key range and wait for the writes that
+// are already running and the open transactions that wrote to the range
+// to finish
+func (g *routingGate) Freeze(databaseName string, keyRange KeyRange, timeout time.Duration) error {
+	g.mu.Lock()
+	g.freezeCount++
+	freeze := &keyRangeFreeze{keyRange: keyRange, seq: g.freezeCount, thawed: make(chan struct{})}
+	g.freezes[databaseName] = freeze
+	g.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		g.mu.Lock()
+		running := 0
+		for write := range g.writers {
+			if write.database == databaseName && write.started < freeze.seq {
+				running++
+			}
+		}
+		for _, held := range g.transactions {
+			if held.database == databaseName && held.touches(keyRange) {
+				running++
+			}
+		}
+		g.mu.Unlock()
+		if running == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			g.Thaw(databaseName)
+			return fmt.Errorf("%d writes and transactions on database %q did not finish within %s", running, databaseName, timeout)
+		}
+		time.Sleep(MOVE_FREEZE_INTERVAL)
+	}
+}
+
+// Let the writes held back by a freeze continue
+func (g *routingGate) Thaw(databaseName string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if freeze, ok := g.freezes[databaseName]; ok {
+		delete(g.freezes, databaseName)
+		close(freeze.thawed)
+	}
+}
+
+// Tell the writers to look up the owners of their keys again
+func (g *routingGate) ShardMapChanged() {
+	g.version.Add(1)
+}
+
+// Work out how the key ranges change when moving keyRange to the target
+// cluster. The source is the cluster that owns all of the range
+func planKeyRangeMove(database *DatabaseConfig, keyRangeSpec string, targetAddr string) (*KeyRangeMove, error) {
+	if !database.IsSharded() {
+		return nil, fmt.Errorf("database %q has no sharded tables", database.Name)
+	}
+	moved, err := ParseKeyRange(keyRangeSpec)
+	if err != nil {
+		return nil, err
+	}
+	if moved.IsEmpty() {
+		return nil, fmt.Errorf("key range %s is empty", keyRangeSpec)
+	}
+
+	var source, target *ClusterConfig
+	for i := range database.Clusters {
+		cluster := &database.Clusters[i]
+		keyRange, err := cluster.GetKeyRange()
+		if err != nil {
+			return nil, err
+		}
+		if cluster.GetAddr() == targetAddr {
+			target = cluster
+		} else if keyRange.ContainsRange(moved) {
+			source = cluster
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("%s is not a cluster of database %q", targetAddr, database.Name)
+	}
+	if source == nil {
+		return nil, fmt.Errorf("no other cluster of database %q owns all of key range %s", database.Name, moved)
+	}
+
+	sourceRange, _ := source.GetKeyRange()
+	targetRange, _ := target.GetKeyRange()
+	remaining, err := removeKeyRange(sourceRange, moved)
+	if err != nil {
+		return nil, err
+	}
+	joined, err := joinKeyRanges(targetRange, moved)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRangeMove{
+		Database:       database.Name,
+		KeyRange:       moved.String(),
+		Source:         source.GetAddr(),
+		Target:         target.GetAddr(),
+		SourceKeyRange: remaining.String(),
+		TargetKeyRange: joined.String(),
+	}, nil
+}
+
+// Connection string the target uses to subscribe to the source
+func replicationConnInfo(cluster *ClusterConfig) string {
+	params := [][2]string{
+		{"host", cluster.Host},
+		{"port", fmt.Sprint(cluster.Port)},
+		{"user", cluster.User},
+		{"dbname", cluster.Name},
+	}
+	if password := os.Getenv(cluster.PasswordEnv); cluster.PasswordEnv != "" && password != "" {
+		params = append(params, [2]string{"password", password})
+	}
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		value := strings.ReplaceAll(param[1], `\`, `\\`)
+		value = strings.ReplaceAll(value, `'`, `\'`)
+		parts = append(parts, fmt.Sprintf("%s='%s'", param[0], value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Run a statement on every sharded table with the condition selecting
+// the rows of the key range
+func execForShardedTables(server *ServerConnection, database *DatabaseConfig, keyRange KeyRange, statement string) error {
+	for _, table := range database.GetShardedTables() {
+		if err := server.Exec(fmt.Sprintf(statement, table.Name, keyRangeFilter(table.ShardKey, keyRange))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasRow(server *ServerConnection, query string) (bool, error) {
+	rows, err := server.QueryRows(query)
+	return len(rows) > 0, err
+}
+
+// Check that the replica identity of every sharded table on the source
+// holds its shard key. The publication of a move filters rows on the
+// shard key and postgres refuses UPDATE and DELETE on published tables
+// whose replica identity does not cover the columns of the filter
+func checkMoveReplicaIdentity(server *ServerConnection, database *DatabaseConfig) error {
+	missing := make([]string, 0)
+	for _, table := range database.GetShardedTables() {
+		rows, err := server.QueryRows(fmt.Sprintf(
+			"SELECT c.relreplident = 'f' OR EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY (i.indkey) "+
+				"WHERE i.indrelid = c.oid AND a.attname = %s AND (c.relreplident = 'd' AND i.indisprimary OR c.relreplident = 'i' AND i.indisreplident)) "+
+				"FROM pg_class c WHERE c.oid = %s::regclass",
+			quoteLiteral(table.ShardKey), quoteLiteral(table.Name),
+		))
+		if err != nil {
+			return err
+		}
+		if len(rows) != 1 || len(rows[0].Values) != 1 || string(rows[0].Values[0]) != "t" {
+			missing = append(missing, table.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"the replica identity of %s must hold the shard key, set it with ALTER TABLE ... REPLICA IDENTITY USING INDEX or REPLICA IDENTITY FULL",
+			strings.Join(missing, ", "),
+		)
+	}
+	return nil
+}
+
+// Publish the rows of the key range on the source and subscribe the
+// target to them. The subscription copies the existing rows first
+func startMoveReplication(move *KeyRangeMove, database *DatabaseConfig, keyRange KeyRange, source *ServerConnection, target *ServerConnection) error {
+	name := move.replicationName()
+	published, err := hasRow(source, fmt.Sprintf("SELECT 1 FROM pg_publication WHERE pubname = %s", quoteLiteral(name)))
+	if err != nil {
+		return err
+	}
+	if !published {
+		if err := checkMoveReplicaIdentity(source, database); err != nil {
+			return err
+		}
+		tables := make([]string, 0, len(database.Tables))
+		for _, table := range database.GetShardedTables() {
+			tables = append(tables, fmt.Sprintf("%s WHERE (%s)", table.Name, keyRangeFilter(table.ShardKey, keyRange)))
+		}
+		// A TRUNCATE on the source would empty the whole table on the target
+		err = source.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s WITH (publish = 'insert, update, delete')", name, strings.Join(tables, ", ")))
+		if err != nil {
+			return err
+		}
+	}
+
+	subscribed, err := hasRow(target, fmt.Sprintf("SELECT 1 FROM pg_subscription WHERE subname = %s", quoteLiteral(name)))
+	if err != nil || subscribed {
+		return err
+	}
+	sourceCluster, _ := database.GetClusterConfigByHostPort(move.Source)
+	return target.Exec(fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s", name, quoteLiteral(replicationConnInfo(sourceCluster)), name))
+}
+
+// Whether the target has copied every table and is close enough behind
+// the source to cut over
+func moveReplicationCaughtUp(move *KeyRangeMove, source *ServerConnection, target *ServerConnection) (bool, error) {
+	name := quoteLiteral(move.replicationName())
+	rows, err := target.QueryRows(fmt.Sprintf(
+		"SELECT count(*) FILTER (WHERE r.srsubstate <> 'r'), count(*) FROM pg_subscription_rel r JOIN pg_subscription s ON s.oid = r.srsubid WHERE s.subname = %s",
+		name,
+	))
+	if err != nil {
+		return false, err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 2 {
+		return false, fmt.Errorf("subscription %s is missing on %s", move.replicationName(), move.Target)
+	}
+	if string(rows[0].Values[0]) != "0" || string(rows[0].Values[1]) == "0" {
+		return false, nil
+	}
+
+	rows, err = source.QueryRows(fmt.Sprintf(
+		"SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn) FROM pg_replication_slots WHERE slot_name = %s",
+		name,
+	))
+	if err != nil {
+		return false, err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 1 || rows[0].Values[0] == nil {
+		return false, fmt.Errorf("replication slot %s is missing on %s", move.replicationName(), move.Source)
+	}
+	lag, err := strconv.ParseFloat(string(rows[0].Values[0]), 64)
+	if err != nil {
+		return false, err
+	}
+	return lag <= MOVE_CUTOVER_LAG, nil
+}
+
+// Switch the key range over to the target. Writes to the range are held
+// back until the target has every change the source has, then the new
+// key ranges are written to the shard metadata and swapped into the
+// running config
+func cutOverKeyRangeMove(
+	requester *ConnectionRequester,
+	store ShardMetadataStore,
+	move *KeyRangeMove,
+	keyRange KeyRange,
+	source *ServerConnection,
+) error {
+	if err := shardRouting.Freeze(move.Database, keyRange, MOVE_FREEZE_TIMEOUT); err != nil {
+		return err
+	}
+	frozen := time.Now()
+	defer shardRouting.Thaw(move.Database)
+	committed := false
+	defer func() {
+		if !committed {
+			thawOtherInstances(store, move)
+		}
+	}()
+	// Writes other proxies sent to the source before they held them back
+	// have to reach the target too
+	if err := freezeOtherInstances(store, move); err != nil {
+		return err
+	}
+	if err := waitForMoveReplication(move, source, MOVE_FREEZE_TIMEOUT); err != nil {
+		return err
+	}
+
+	metadata, err := store.Update(func(metadata *ShardMetadata) error {
+		current := metadata.getMove(move.Id)
+		if current == nil || current.State != MOVE_STATE_CATCHING_UP {
+			return fmt.Errorf("move %d is no longer catching up", move.Id)
+		}
+		// The other proxies may already let writes through again
+		if time.Until(current.FrozenUntil) < SHARD_MAP_POLL_INTERVAL {
+			return fmt.Errorf("writes to key range %s were not held back long enough for the cutover", move.KeyRange)
+		}
+		if metadata.KeyRanges[move.Database] == nil {
+			metadata.KeyRanges[move.Database] = make(map[string]string)
+		}
+		metadata.KeyRanges[move.Database][move.Source] = current.SourceKeyRange
+		metadata.KeyRanges[move.Database][move.Target] = current.TargetKeyRange
+		current.State = MOVE_STATE_CLEANING_UP
+		current.Updated = time.Now()
+		current.LastError = ""
+		current.FrozenUntil = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	committed = true
+	if err := applyShardMap(requester, metadata); err != nil {
+		return err
+	}
+	slog.Info(
+		"Moved key range",
+		"database", move.Database,
+		"keyRange", move.KeyRange,
+		"source", move.Source,
+		"target", move.Target,
+		"frozen", time.Since(frozen),
+	)
+	return nil
+}
+
+// Have every other proxy hold back its writes to the key range of the
+// move and wait until each one that is still running has confirmed it
+func freezeOtherInstances(store ShardMetadataStore, move *KeyRangeMove) error {
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		current := metadata.getMove(move.Id)
+		if current == nil {
+			return fmt.Errorf("move %d no longer exists", move.Id)
+		}
+		current.FrozenUntil = time.Now().Add(MOVE_REMOTE_FREEZE_TIMEOUT)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(MOVE_FREEZE_TIMEOUT + SHARD_MAP_POLL_INTERVAL)
+	for {
+		metadata, err := store.Read()
+		if err != nil {
+			return err
+		}
+		waiting := metadata.unfrozenInstances(move.Id)
+		if len(waiting) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxies %s did not hold back writes to key range %s", strings.Join(waiting, ", "), move.KeyRange)
+		}
+		time.Sleep(MOVE_FREEZE_CONFIRM_INTERVAL)
+	}
+}
+
+// Let the other proxies write to the key range of a move again after a
+// cutover did not go through
+func thawOtherInstances(store ShardMetadataStore, move *KeyRangeMove) {
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		if current := metadata.getMove(move.Id); current != nil {
+			current.FrozenUntil = time.Time{}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error letting other proxies write to key range again", "move", move.Id, "error", err)
+	}
+}
+
+// The running proxies other than this one that have not confirmed they
+// hold back writes for the move
+func (s *ShardMetadata) unfrozenInstances(moveId int) []string {
+	waiting := make([]string, 0)
+	for instanceId, instance := range s.Instances {
+		if instanceId == shardMapInstanceId || s.isInstanceGone(instanceId) || slices.Contains(instance.Frozen, moveId) {
+			continue
+		}
+		waiting = append(waiting, instanceId)
+	}
+	slices.Sort(waiting)
+	return waiting
+}
+
+// Hold back the writes to the key ranges of moves other proxies are
+// cutting over and let them through again once the cutover is over.
+// frozen holds the moves writes are held back for, by id, and the ids
+// are returned so the proxy can confirm them
+func syncMoveFreezes(config *SpannerConfig, metadata *ShardMetadata, frozen map[int]string) []int {
+	for _, move := range metadata.Moves {
+		if _, ok := frozen[move.Id]; ok || !move.IsFrozen() || move.Owner == shardMapInstanceId {
+			continue
+		}
+		if _, ok := config.GetDatabaseConfigByName(move.Database); !ok {
+			// Nothing to hold back
+			frozen[move.Id] = ""
+			continue
+		}
+		keyRange, err := ParseKeyRange(move.KeyRange)
+		if err == nil {
+			err = shardRouting.Freeze(move.Database, keyRange, MOVE_FREEZE_TIMEOUT)
+		}
+		if err != nil {
+			slog.Error("Error holding back writes for key range move", "move", move.Id, "error", err)
+			continue
+		}
+		slog.Info("Holding back writes for key range move", "move", move.Id, "database", move.Database, "keyRange", move.KeyRange)
+		frozen[move.Id] = move.Database
+	}
+
+	ids := make([]int, 0, len(frozen))
+	for id, databaseName := range frozen {
+		if move := metadata.getMove(id); move != nil && move.IsFrozen() {
+			ids = append(ids, id)
+			continue
+		}
+		if databaseName != "" {
+			shardRouting.Thaw(databaseName)
+		}
+		delete(frozen, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Wait until the target has received every change the source had made
+// when the wait started
+func waitForMoveReplication(move *KeyRangeMove, source *ServerConnection, timeout time.Duration) error {
+	started := time.Now()
+	rows, err := source.QueryRows("SELECT pg_current_wal_lsn()")
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 1 {
+		return fmt.Errorf("Unexpected result reading the WAL position of %s", move.Source)
+	}
+	query := fmt.Sprintf(
+		"SELECT confirmed_flush_lsn >= %s::pg_lsn FROM pg_replication_slots WHERE slot_name = %s",
+		quoteLiteral(string(rows[0].Values[0])),
+		quoteLiteral(move.replicationName()),
+	)
+	for {
+		rows, err := source.QueryRows(query)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 1 && len(rows[0].Values) == 1 && string(rows[0].Values[0]) == "t" {
+			return nil
+		}
+		if time.Since(started) > timeout {
+			return fmt.Errorf("%s did not catch up with %s within %s", move.Target, move.Source, timeout)
+		}
+		time.Sleep(MOVE_FREEZE_INTERVAL)
+	}
+}
+
+// Remove the subscription, publication and replication slot of a move
+func dropMoveReplication(move *KeyRangeMove, source *ServerConnection, target *ServerConnection) error {
+	name := move.replicationName()
+	subscribed, err := hasRow(target, fmt.Sprintf("SELECT 1 FROM pg_subscription WHERE subname = %s", quoteLiteral(name)))
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		// Dropping the subscription drops its slot on the source as well
+		if err := target.Exec("DROP SUBSCRIPTION " + name); err != nil {
+			return err
+		}
+	}
+	if err := source.Exec("DROP PUBLICATION IF EXISTS " + name); err != nil {
+		return err
+	}
+	return source.Exec(fmt.Sprintf(
+		"SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = %s AND NOT active",
+		quoteLiteral(name),
+	))
+}
+
+// Run the step of the move for its current state and return the state
+// it moves on to
+func runKeyRangeMoveStep(requester *ConnectionRequester, store ShardMetadataStore, move *KeyRangeMove, database *DatabaseConfig) (string, error) {
+	keyRange, err := ParseKeyRange(move.KeyRange)
+	if err != nil {
+		return move.State, err
+	}
+	sourceCluster, sourceOk := database.GetClusterConfigByHostPort(move.Source)
+	targetCluster, targetOk := database.GetClusterConfigByHostPort(move.Target)
+	if !sourceOk || !targetOk {
+		return move.State, fmt.Errorf("clusters %s and %s must both be configured for database %q", move.Source, move.Target, move.Database)
+	}
+	source, err := CreateServerConnection(database, sourceCluster)
+	if err != nil {
+		return move.State, err
+	}
+	defer source.Terminate()
+	target, err := CreateServerConnection(database, targetCluster)
+	if err != nil {
+		return move.State, err
+	}
+	defer target.Terminate()
+
+	switch move.State {
+	case MOVE_STATE_COPYING:
+		if err := startMoveReplication(move, database, keyRange, source, target); err != nil {
+			return move.State, err
+		}
+		return MOVE_STATE_CATCHING_UP, nil
+	case MOVE_STATE_CATCHING_UP:
+		caughtUp, err := moveReplicationCaughtUp(move, source, target)
+		if err != nil || !caughtUp {
+			return move.State, err
+		}
+		if err := cutOverKeyRangeMove(requester, store, move, keyRange, source); err != nil {
+			return move.State, err
+		}
+		return MOVE_STATE_CLEANING_UP, nil
+	case MOVE_STATE_CLEANING_UP:
+		// The running config may not have been updated if the proxy
+		// stopped right after the cutover was recorded
+		metadata, err := store.Read()
+		if err != nil {
+			return move.State, err
+		}
+		sourceRange, _ := sourceCluster.GetKeyRange()
+		if movedRange, _ := ParseKeyRange(move.SourceKeyRange); sourceRange != movedRange {
+			if err := applyShardMap(requester, metadata); err != nil {
+				return move.State, err
+			}
+		}
+		// Other proxies keep writing to the source until they switch to
+		// the new shard map. Their writes still reach the target as long
+		// as the subscription is there
+		if !metadata.AllInstancesCurrent() {
+			return move.State, nil
+		}
+		if err := waitForMoveReplication(move, source, MOVE_FREEZE_TIMEOUT); err != nil {
+			return move.State, err
+		}
+		if err := dropMoveReplication(move, source, target); err != nil {
+			return move.State, err
+		}
+		if err := execForShardedTables(source, database, keyRange, "DELETE FROM %s WHERE %s"); err != nil {
+			return move.State, err
+		}
+		return MOVE_STATE_DONE, nil
+	case MOVE_STATE_CANCELLING:
+		// The target never owned the rows it received
+		if err := dropMoveReplication(move, source, target); err != nil {
+			return move.State, err
+		}
+		if err := execForShardedTables(target, database, keyRange, "DELETE FROM %s WHERE %s"); err != nil {
+			return move.State, err
+		}
+		return MOVE_STATE_CANCELLED, nil
+	default:
+		return move.State, fmt.Errorf("unknown move state %q", move.State)
+	}
+}
+
+// Record the outcome of a step. The state only changes when the move is
+// still in the state the step started from so a cancel is not lost
+func recordKeyRangeMoveStep(store ShardMetadataStore, id int, from string, to string, stepErr error) error {
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		move := metadata.getMove(id)
+		if move == nil || move.State != from {
+			return nil
+		}
+		move.State = to
+		move.Updated = time.Now()
+		move.LastError = ""
+		if stepErr != nil {
+			move.LastError = stepErr.Error()
+		}
+		return nil
+	})
+	return err
+}
+
+// Moves being run by this process
+var runningMoves = make(map[int]bool)
+var runningMovesLock sync.Mutex
+
+func startKeyRangeMove(requester *ConnectionRequester, id int) {
+	runningMovesLock.Lock()
+	defer runningMovesLock.Unlock()
+	if runningMoves[id] {
+		return
+	}
+	runningMoves[id] = true
+	go runKeyRangeMove(requester, id)
+}
+
+// Take a move through its steps until it is done or cancelled. Failed
+// steps are retried
+func runKeyRangeMove(requester *ConnectionRequester, id int) {
+	defer func() {
+		runningMovesLock.Lock()
+		delete(runningMoves, id)
+		runningMovesLock.Unlock()
+	}()
+
+	for {
+		config := requester.GetConfig()
+		store := getShardMetadataStore(config)
+		if store == nil {
+			slog.Error("Stopping key range move. No shard metadata store is configured", "move", id)
+			return
+		}
+		metadata, err := store.Read()
+		if err != nil {
+			slog.Error("Error reading shard metadata", "move", id, "error", err)
+			time.Sleep(MOVE_RETRY_INTERVAL)
+			continue
+		}
+		move := metadata.getMove(id)
+		if move == nil || move.IsFinished() {
+			return
+		}
+		if move.Owner != shardMapInstanceId {
+			slog.Warn("Stopping key range move taken over by another proxy", "move", id, "owner", move.Owner)
+			return
+		}
+
+		state := move.State
+		database, ok := config.GetDatabaseConfigByName(move.Database)
+		var next string
+		if !ok {
+			err = fmt.Errorf("database %q is not configured", move.Database)
+		} else {
+			next, err = runKeyRangeMoveStep(requester, store, move, database)
+		}
+		if err != nil {
+			slog.Error("Key range move step failed", "move", id, "state", state, "error", err)
+			if err := recordKeyRangeMoveStep(store, id, state, state, err); err != nil {
+				slog.Error("Error recording key range move", "move", id, "error", err)
+			}
+			time.Sleep(MOVE_RETRY_INTERVAL)
+			continue
+		}
+		if next == state {
+			time.Sleep(MOVE_POLL_INTERVAL)
+			continue
+		}
+		slog.Info("Key range move advanced", "move", id, "database", move.Database, "keyRange", move.KeyRange, "from", state, "to", next)
+		if err := recordKeyRangeMoveStep(store, id, state, next, nil); err != nil {
+			slog.Error("Error recording key range move", "move", id, "error", err)
+			time.Sleep(MOVE_RETRY_INTERVAL)
+		}
+	}
+}
+
+// Claim the unfinished moves whose proxy is gone, the ones this proxy
+// ran before it restarted included. Returns the ids of the moves this
+// proxy runs
+func claimKeyRangeMoves(store ShardMetadataStore) ([]int, error) {
+	metadata, err := store.Read()
+	if err != nil {
+		return nil, err
+	}
+	claimable := false
+	for i := range metadata.Moves {
+		move := &metadata.Moves[i]
+		if !move.IsFinished() && (move.Owner == shardMapInstanceId || metadata.isInstanceGone(move.Owner)) {
+			claimable = true
+		}
+	}
+	if !claimable {
+		return nil, nil
+	}
+
+	var ids []int
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		ids = nil
+		for i := range metadata.Moves {
+			move := &metadata.Moves[i]
+			if move.IsFinished() {
+				continue
+			}
+			if move.Owner != shardMapInstanceId {
+				if !metadata.isInstanceGone(move.Owner) {
+					continue
+				}
+				slog.Info("Taking over key range move", "move", move.Id, "previousOwner", move.Owner)
+				move.Owner = shardMapInstanceId
+				move.Updated = time.Now()
+			}
+			ids = append(ids, move.Id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Run the moves that have not finished and whose proxy is gone. Called
+// on startup and whenever the proxy records its shard map version
+func ResumeKeyRangeMoves(requester *ConnectionRequester) {
+	store := getShardMetadataStore(requester.GetConfig())
+	if store == nil {
+		return
+	}
+	ids, err := claimKeyRangeMoves(store)
+	if err != nil {
+		slog.Error("Cannot resume key range moves", "error", err)
+		return
+	}
+	for _, id := range ids {
+		startKeyRangeMove(requester, id)
+	}
+}
+
+var keyRangeMoveColumns = []string{"id", "database", "key_range", "source", "target", "state", "started", "updated", "last_error", "owner"}
+
+// MOVE KEYRANGE <database> <keyrange> TO <cluster>
+func adminMoveKeyRange(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	if len(args) != 4 || !strings.EqualFold(args[2], "TO") {
+		return nil, buildAdminError("42601", "usage: MOVE KEYRANGE <database> <keyrange> TO <host:port>")
+	}
+	store := getShardMetadataStore(config)
+	if store == nil {
+		return nil, buildAdminError("55000", "ShardMetadataPath or ShardMetadataCluster must be configured to move key ranges")
+	}
+	database, ok := config.GetDatabaseConfigByName(args[0])
+	if !ok {
+		return nil, buildAdminError("3D000", fmt.Sprintf("database %q is not configured", args[0]))
+	}
+	move, err := planKeyRangeMove(database, args[1], args[3])
+	if err != nil {
+		return nil, buildAdminError("22023", err.Error())
+	}
+	sourceCluster, _ := database.GetClusterConfigByHostPort(move.Source)
+	source, err := CreateServerConnection(database, sourceCluster)
+	if err != nil {
+		return nil, err
+	}
+	err = checkMoveReplicaIdentity(source, database)
+	source.Terminate()
+	if err != nil {
+		return nil, buildAdminError("55000", err.Error())
+	}
+
+	move.Owner = shardMapInstanceId
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		for _, other := range metadata.Moves {
+			if other.Database == move.Database && !other.IsFinished() {
+				return buildAdminError("55000", fmt.Sprintf("move %d of database %q has not finished", other.Id, other.Database))
+			}
+		}
+		move.Id = metadata.NextMoveId
+		metadata.NextMoveId++
+		move.State = MOVE_STATE_COPYING
+		move.Started = time.Now()
+		move.Updated = move.Started
+		metadata.Moves = append(metadata.Moves, *move)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Starting key range move", "move", move.Id, "database", move.Database, "keyRange", move.KeyRange, "source", move.Source, "target", move.Target)
+	startKeyRangeMove(requester, move.Id)
+	return &adminResult{Columns: keyRangeMoveColumns, Rows: [][]string{move.row()}, Tag: "MOVE KEYRANGE"}, nil
+}
+
+// SHOW MOVES
+func adminShowMoves(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	result := &adminResult{Columns: keyRangeMoveColumns, Rows: make([][]string, 0)}
+	if store := getShardMetadataStore(config); store != nil {
+		metadata, err := store.Read()
+		if err != nil {
+			return nil, err
+		}
+		for _, move := range metadata.Moves {
+			result.Rows = append(result.Rows, move.row())
+		}
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
+
+// CANCEL MOVE <id>. Only moves that have not cut over can be cancelled
+func adminCancelMove(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	if len(args) != 1 {
+		return nil, buildAdminError("42601", "usage: CANCEL MOVE <id>")
+	}
+	id, err := strconv.Atoi(args[0])
+	store := getShardMetadataStore(config)
+	if err != nil || store == nil {
+		return nil, buildAdminError("22023", fmt.Sprintf("no move with id %s", args[0]))
+	}
+	var cancelled KeyRangeMove
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		move := metadata.getMove(id)
+		if move == nil {
+			return buildAdminError("22023", fmt.Sprintf("no move with id %d", id))
+		}
+		if move.State != MOVE_STATE_COPYING && move.State != MOVE_STATE_CATCHING_UP {
+			return buildAdminError("55000", fmt.Sprintf("move %d is %s and can no longer be cancelled", id, move.State))
+		}
+		move.State = MOVE_STATE_CANCELLING
+		move.Updated = time.Now()
+		cancelled = *move
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Cancelling key range move", "move", id, "owner", cancelled.Owner)
+	// The owner picks the cancellation up on its next step
+	if cancelled.Owner == shardMapInstanceId {
+		startKeyRangeMove(requester, id)
+	}
+	return &adminResult{Columns: keyRangeMoveColumns, Rows: [][]string{cancelled.row()}, Tag: "CANCEL MOVE"}, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanKeyRangeMove(t *testing.T) {
+	database := &DatabaseConfig{
+		Name:   "test",
+		Tables: []TableConfig{{Name: "users", ShardKey: "id"}},
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-80"},
+			{Host: "b", Port: 5432, KeyRange: "80-"},
+			{Host: "c", Port: 5432, KeyRange: "none"},
+		},
+	}
+
+	move, err := planKeyRangeMove(database, "40-80", "c:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if move.Source != "a:5432" || move.SourceKeyRange != "-40" || move.TargetKeyRange != "40-80" {
+		t.Fatalf("Unexpected move %+v", move)
+	}
+	move, err = planKeyRangeMove(database, "80-c0", "a:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if move.Source != "b:5432" || move.SourceKeyRange != "c0-" || move.TargetKeyRange != "-c0" {
+		t.Fatalf("Unexpected move %+v", move)
+	}
+
+	for _, c := range [][2]string{{"40-80", "d:5432"}, {"40-c0", "c:5432"}, {"20-40", "c:5432"}, {"c0-", "a:5432"}} {
+		if _, err := planKeyRangeMove(database, c[0], c[1]); err == nil {
+			t.Fatalf("Expected moving %s to %s to be rejected", c[0], c[1])
+		}
+	}
+}
+
+func TestShardMetadata(t *testing.T) {
+	store := &fileShardMetadataStore{path: filepath.Join(t.TempDir(), "shards.json")}
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		metadata.KeyRanges["test"] = map[string]string{"a:5432": "-40", "c:5432": "40-80"}
+		metadata.Moves = append(metadata.Moves, KeyRangeMove{Id: 1, Database: "test", State: MOVE_STATE_CLEANING_UP})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := store.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if move := metadata.getMove(1); move == nil || move.State != MOVE_STATE_CLEANING_UP {
+		t.Fatalf("Move was not persisted: %+v", metadata.Moves)
+	}
+	if metadata.Version != 1 {
+		t.Fatalf("Changing the key ranges should bump the version, got %d", metadata.Version)
+	}
+
+	// Instances that have not switched to the latest version hold back
+	// cleanup until they stop reporting
+	heartbeat, err := store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["1"] = ShardMapInstance{Version: 0, Seen: time.Now()}
+		metadata.Instances["2"] = ShardMapInstance{Version: 0, Seen: time.Now().Add(-2 * SHARD_MAP_INSTANCE_TIMEOUT)}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.Version != 1 {
+		t.Fatalf("Recording instances should not bump the version, got %d", heartbeat.Version)
+	}
+	if heartbeat.AllInstancesCurrent() {
+		t.Fatal("Instance 1 still runs with an old shard map")
+	}
+	heartbeat, _ = store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["1"] = ShardMapInstance{Version: 1, Seen: time.Now()}
+		return nil
+	})
+	if !heartbeat.AllInstancesCurrent() {
+		t.Fatal("Instances should be current once the live ones switched")
+	}
+
+	// A failed update writes nothing
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		metadata.KeyRanges["test"]["a:5432"] = "-"
+		return fmt.Errorf("failed")
+	})
+	if reread, _ := store.Read(); err == nil || reread.KeyRanges["test"]["a:5432"] != "-40" {
+		t.Fatal("A failed update should not change the metadata")
+	}
+
+	config := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name: "test",
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-80"},
+			{Host: "b", Port: 5432, KeyRange: "80-"},
+			{Host: "c", Port: 5432, KeyRange: "none"},
+		},
+	}}}
+	updated, err := withShardMetadata(config, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := updated.Databases[0].Clusters
+	if clusters[0].KeyRange != "-40" || clusters[1].KeyRange != "80-" || clusters[2].KeyRange != "40-80" {
+		t.Fatalf("Key ranges were not applied: %+v", clusters)
+	}
+	if config.Databases[0].Clusters[0].KeyRange != "-80" {
+		t.Fatal("Applying the metadata changed the original config")
+	}
+
+	metadata.KeyRanges["test"]["d:5432"] = "-"
+	if _, err := withShardMetadata(config, metadata); err == nil {
+		t.Fatal("Expected a key range for an unknown cluster to be rejected")
+	}
+}
+
+func TestRoutingGateFreeze(t *testing.T) {
+	gate := newTestRoutingGate()
+	moving, _ := ParseKeyRange("40-80")
+
+	// A write that started before the freeze is let through and the
+	// freeze waits for it
+	before := gate.BeginWrite("test")
+	frozen := make(chan error)
+	go func() {
+		frozen <- gate.Freeze("test", moving, time.Second)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if before.Route(0x5000000000000000) {
+		t.Fatal("Shard map should not have changed")
+	}
+	before.Finish(nil)
+	if err := <-frozen; err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that starts during the freeze waits for rows in the range
+	during := gate.BeginWrite("test")
+	defer during.Finish(nil)
+	if during.Route(0x9000000000000000) {
+		t.Fatal("Shard map should not have changed")
+	}
+	routed := make(chan bool)
+	go func() {
+		routed <- during.Route(0x5000000000000000)
+	}()
+	select {
+	case <-routed:
+		t.Fatal("Write to the frozen range was not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate.ShardMapChanged()
+	gate.Thaw("test")
+	if changed := <-routed; !changed {
+		t.Fatal("Writer was not told the shard map changed")
+	}
+
+	// A freeze gives up on writes that do not finish
+	stuck := gate.BeginWrite("test")
+	defer stuck.Finish(nil)
+	if err := gate.Freeze("test", moving, 50*time.Millisecond); err == nil {
+		t.Fatal("Expected the freeze to time out")
+	}
+	if len(gate.freezes) != 0 {
+		t.Fatal("A failed freeze should not hold back writes")
+	}
+}
+
+func newTestRoutingGate() *routingGate {
+	return &routingGate{
+		freezes:      make(map[string]*keyRangeFreeze),
+		writers:      make(map[*routedWrite]bool),
+		transactions: make(map[*ClientConnection]*routedWrite),
+	}
+}
+
+func TestRoutingGateTransactions(t *testing.T) {
+	gate := newTestRoutingGate()
+	moving, _ := ParseKeyRange("40-80")
+	other, _ := ParseKeyRange("80-c0")
+
+	// The write of a transaction that has not ended is still held back
+	// from the cutover once its statement finished
+	client := &ClientConnection{pendingBegin: "BEGIN"}
+	write := gate.BeginWrite("test")
+	write.Route(0x5000000000000000)
+	write.Finish(client)
+	if err := gate.Freeze("test", moving, 50*time.Millisecond); err == nil {
+		t.Fatal("Expected the freeze to wait for the open transaction")
+	}
+	if err := gate.Freeze("test", other, 50*time.Millisecond); err != nil {
+		t.Fatalf("Transaction outside of the range should not hold back the freeze: %s", err)
+	}
+	gate.Thaw("test")
+	gate.EndTransaction(client)
+	if err := gate.Freeze("test", moving, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	gate.Thaw("test")
+
+	// Writes outside of a transaction are not held
+	write = gate.BeginWrite("test")
+	write.RouteAll()
+	write.Finish(&ClientConnection{})
+	if len(gate.transactions) != 0 {
+		t.Fatal("Write outside of a transaction should not be held")
+	}
+}
+
+func TestClaimKeyRangeMoves(t *testing.T) {
+	store := &fileShardMetadataStore{path: filepath.Join(t.TempDir(), "shards.json")}
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["live"] = ShardMapInstance{Seen: time.Now()}
+		metadata.Instances["stale"] = ShardMapInstance{Seen: time.Now().Add(-2 * SHARD_MAP_INSTANCE_TIMEOUT)}
+		metadata.Moves = []KeyRangeMove{
+			{Id: 1, State: MOVE_STATE_COPYING, Owner: "live"},
+			{Id: 2, State: MOVE_STATE_CATCHING_UP, Owner: "stale"},
+			{Id: 3, State: MOVE_STATE_CLEANING_UP, Owner: "never seen"},
+			{Id: 4, State: MOVE_STATE_DONE, Owner: "stale"},
+			{Id: 5, State: MOVE_STATE_COPYING, Owner: shardMapInstanceId},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := claimKeyRangeMoves(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []int{2, 3, 5}) {
+		t.Fatalf("Expected moves 2, 3 and 5 to be claimed, got %v", ids)
+	}
+	metadata, _ := store.Read()
+	if metadata.getMove(1).Owner != "live" || metadata.getMove(2).Owner != shardMapInstanceId ||
+		metadata.getMove(4).Owner != "stale" {
+		t.Fatalf("Unexpected owners %+v", metadata.Moves)
+	}
+}
+
+func TestKeyRangeMoveFreezesOtherInstances(t *testing.T) {
+	previous := shardRouting
+	shardRouting = newTestRoutingGate()
+	defer func() { shardRouting = previous }()
+	config := &SpannerConfig{Databases: []DatabaseConfig{{Name: "test"}}}
+
+	// Writes are held back while another proxy cuts over its move and let
+	// through again once it is over
+	metadata := newShardMetadata()
+	metadata.Moves = []KeyRangeMove{
+		{Id: 1, Database: "test", KeyRange: "40-80", Owner: "other", FrozenUntil: time.Now().Add(time.Minute)},
+		{Id: 2, Database: "removed", KeyRange: "80-", Owner: "other", FrozenUntil: time.Now().Add(time.Minute)},
+		{Id: 3, Database: "test", KeyRange: "-40", Owner: "other"},
+	}
+	frozen := make(map[int]string)
+	if ids := syncMoveFreezes(config, metadata, frozen); !slices.Equal(ids, []int{1, 2}) {
+		t.Fatalf("Expected moves 1 and 2 to be confirmed, got %v", ids)
+	}
+	write := shardRouting.BeginWrite("test")
+	defer write.Finish(nil)
+	routed := make(chan bool)
+	go func() {
+		routed <- write.Route(0x5000000000000000)
+	}()
+	select {
+	case <-routed:
+		t.Fatal("Write to the frozen range was not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	metadata.Moves[0].FrozenUntil = time.Time{}
+	if ids := syncMoveFreezes(config, metadata, frozen); !slices.Equal(ids, []int{2}) {
+		t.Fatalf("Expected only move 2 to be confirmed, got %v", ids)
+	}
+	<-routed
+
+	// The cutover waits for the running proxies to confirm
+	store := &fileShardMetadataStore{path: filepath.Join(t.TempDir(), "shards.json")}
+	_, err := store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["live"] = ShardMapInstance{Seen: time.Now()}
+		metadata.Instances["stale"] = ShardMapInstance{Seen: time.Now().Add(-2 * SHARD_MAP_INSTANCE_TIMEOUT)}
+		metadata.Instances[shardMapInstanceId] = ShardMapInstance{Seen: time.Now()}
+		metadata.Moves = []KeyRangeMove{{Id: 4, Database: "test", KeyRange: "40-80", Owner: shardMapInstanceId}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	move := &KeyRangeMove{Id: 4, Database: "test", KeyRange: "40-80"}
+	confirmed := make(chan error)
+	go func() {
+		confirmed <- freezeOtherInstances(store, move)
+	}()
+	select {
+	case err := <-confirmed:
+		t.Fatalf("Cutover went ahead before the other proxy confirmed: %v", err)
+	case <-time.After(3 * MOVE_FREEZE_CONFIRM_INTERVAL):
+	}
+	metadata, _ = store.Read()
+	if !metadata.getMove(4).IsFrozen() {
+		t.Fatal("Expected the move to be frozen in the shard metadata")
+	}
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["live"] = ShardMapInstance{Seen: time.Now(), Frozen: []int{4}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-confirmed; err != nil {
+		t.Fatal(err)
+	}
+
+	thawOtherInstances(store, move)
+	metadata, _ = store.Read()
+	if metadata.getMove(4).IsFrozen() {
+		t.Fatal("Expected the move to be thawed in the shard metadata")
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"log/slog"
 	"os"
 )
@@ -22,23 +22,29 @@ func getLogLevel(level string) slog.Level {
 	}
 }
 
-func ConfigureLogger(config LoggingConfig) {
-	options := &slog.HandlerOptions{
-		AddSource: true,
-		Level:     getLogLevel(config.LogLevel),
-	}
+// Level of the default logger. Kept in a LevelVar so a config reload
+// can change it without replacing the handler
+var logLevel = new(slog.LevelVar)
 
+// Point the default logger at the configured destination. The logger in
+// use is kept when the log file cannot be opened
+func ConfigureLogger(config LoggingConfig) error {
 	var stream io.Writer
-	var err error
 	if config.LogFile == "" {
 		stream = os.Stdout
 	} else {
-		stream, err = os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		file, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
-			log.Fatalf("Failed to open log file: %s", err)
+			return fmt.Errorf("failed to open log file: %w", err)
 		}
+		stream = file
 	}
 
+	logLevel.Set(getLogLevel(config.LogLevel))
+	options := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     logLevel,
+	}
 	var handler slog.Handler
 	if config.Json {
 		handler = slog.NewJSONHandler(stream, options)
@@ -47,4 +53,15 @@ func ConfigureLogger(config LoggingConfig) {
 	}
 	logger := slog.New(handler)
 	slog.SetDefault(logger)
+	return nil
+}
+
+// Apply reloaded logging settings. Only a changed destination or format
+// requires a new handler
+func ReconfigureLogger(previous LoggingConfig, config LoggingConfig) error {
+	if previous.LogFile == config.LogFile && previous.Json == config.Json {
+		logLevel.Set(getLogLevel(config.LogLevel))
+		return nil
+	}
+	return ConfigureLogger(config)
 }
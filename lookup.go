@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Lookup tables map every value of a column to the shard keys of the rows holding it, so
+/// statements pinning the column run on the clusters owning its rows
+
+const LOOKUP_BACKFILL_BATCH_SIZE = 1000
+
+// A row of a lookup table. Entries are added before their rows are
+// inserted and removed once deletes and updates have committed, so an
+// entry may point at a row that does not exist but a row written
+// through the proxy always has its entry. Rows written before the
+// lookup or without the proxy are missed until BACKFILL LOOKUP
+type lookupEntry struct {
+	table string
+	value string
+	key   string
+}
+
+// Get the shard keys a lookup table maps the value to
+func readLookup(requester *ConnectionRequester, clientPid int, database *DatabaseConfig, lookupTable string, value string) ([]string, error) {
+	cluster, ok := database.GetClusterForKeyspaceId(KeyspaceId([]byte(value)))
+	if !ok {
+		return nil, fmt.Errorf("no cluster owns the keyspace id of %q", value)
+	}
+	server, err := getServerConnection(requester, database, cluster.GetAddr(), clientPid, false)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := server.QueryRows(fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = %s",
+		LOOKUP_KEY_COLUMN, lookupTable, LOOKUP_VALUE_COLUMN, quoteLiteral(value),
+	))
+	requester.ReturnConnection(server, database.Name, cluster.GetAddr(), clientPid)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, string(row.Values[0]))
+	}
+	slog.Debug("Read lookup table", "table", lookupTable, "value", value, "keys", len(keys))
+	return keys, nil
+}
+
+// Add and remove lookup entries. Entries are written to the clusters
+// owning their values outside of the client's transaction
+func changeLookupEntries(
+	requester *ConnectionRequester,
+	clientPid int,
+	database *DatabaseConfig,
+	write *routedWrite,
+	added []lookupEntry,
+	removed []lookupEntry,
+) error {
+	values := make([]string, 0, len(added)+len(removed))
+	for _, entry := range append(slices.Clip(added), removed...) {
+		values = append(values, entry.value)
+	}
+	database = routeKeys(write, requester, database, values)
+
+	// Statements by cluster, one INSERT and one DELETE per lookup table
+	inserts := make(map[string]map[string][]string)
+	deletes := make(map[string]map[string][]string)
+	group := func(statements map[string]map[string][]string, entry lookupEntry) error {
+		cluster, ok := database.GetClusterForKeyspaceId(KeyspaceId([]byte(entry.value)))
+		if !ok {
+			return fmt.Errorf("no cluster owns the keyspace id of %q", entry.value)
+		}
+		addr := cluster.GetAddr()
+		if statements[addr] == nil {
+			statements[addr] = make(map[string][]string)
+		}
+		statements[addr][entry.table] = append(
+			statements[addr][entry.table],
+			fmt.Sprintf("(%s, %s)", quoteLiteral(entry.value), quoteLiteral(entry.key)),
+		)
+		return nil
+	}
+	for _, entry := range added {
+		if err := group(inserts, entry); err != nil {
+			return err
+		}
+	}
+	for _, entry := range removed {
+		if err := group(deletes, entry); err != nil {
+			return err
+		}
+	}
+
+	for _, cluster := range database.Clusters {
+		addr := cluster.GetAddr()
+		statements := make([]string, 0)
+		for table, rows := range inserts[addr] {
+			statements = append(statements, fmt.Sprintf(
+				"INSERT INTO %s (%s, %s) VALUES %s ON CONFLICT DO NOTHING",
+				table, LOOKUP_VALUE_COLUMN, LOOKUP_KEY_COLUMN, strings.Join(rows, ", "),
+			))
+		}
+		for table, rows := range deletes[addr] {
+			statements = append(statements, fmt.Sprintf(
+				"DELETE FROM %s WHERE (%s, %s) IN (%s)",
+				table, LOOKUP_VALUE_COLUMN, LOOKUP_KEY_COLUMN, strings.Join(rows, ", "),
+			))
+		}
+		if len(statements) == 0 {
+			continue
+		}
+		server, err := getServerConnection(requester, database, addr, clientPid, false)
+		if err != nil {
+			return err
+		}
+		err = server.Exec(strings.Join(statements, "; "))
+		requester.ReturnConnection(server, database.Name, addr, clientPid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the lookup entries of the rows of an INSERT. Every row must give
+// its shard key and lookup columns as constants
+func getInsertLookupEntries(statement *query.Statement, table *TableConfig) ([]lookupEntry, *protocol.ErrorResponsePgMessage) {
+	insert, err := query.ParseInsert(statement)
+	if err != nil || len(insert.Values) == 0 || insert.Upsert {
+		return nil, buildQueryError("0A000", fmt.Sprintf(
+			"INSERT into table %s with lookup columns must give its rows in a VALUES list and cannot use ON CONFLICT DO UPDATE",
+			table.Name,
+		))
+	}
+	keyColumn := slices.Index(insert.Columns, table.ShardKey)
+	entries := make([]lookupEntry, 0, len(insert.Values)*len(table.Lookups))
+	for _, row := range insert.Values {
+		constant, ok := query.Constant{}, false
+		if keyColumn >= 0 && keyColumn < len(row) {
+			constant, ok = query.Literal(row[keyColumn])
+		}
+		if !ok {
+			return nil, buildQueryError("0A000", fmt.Sprintf("shard key %s of table %s must be given as a constant", table.ShardKey, table.Name))
+		}
+		key, err := shardKeyText(constant, table.GetShardKeyType())
+		if err != nil {
+			return nil, buildQueryError("22P02", err.Error())
+		}
+		for _, lookup := range table.Lookups {
+			column := slices.Index(insert.Columns, lookup.Column)
+			if column < 0 || column >= len(row) || query.IsNull(row[column]) {
+				continue
+			}
+			constant, ok := query.Literal(row[column])
+			if !ok {
+				return nil, buildQueryError("0A000", fmt.Sprintf("lookup column %s of table %s must be given as a constant", lookup.Column, table.Name))
+			}
+			value, err := shardKeyText(constant, SHARD_KEY_TYPE_TEXT)
+			if err != nil {
+				return nil, buildQueryError("22P02", err.Error())
+			}
+			entries = append(entries, lookupEntry{table: lookup.GetTable(table), value: value, key: key})
+		}
+	}
+	return entries, nil
+}
+
+// Read the lookup entries of the rows of a table matching the condition
+// and the shard keys of the rows, including those whose lookup columns
+// are NULL. The rows are locked when lock is set so their lookup columns
+// cannot change before they are written
+func readLookupEntries(
+	server *ServerConnection,
+	table *TableConfig,
+	ref query.TableRef,
+	lookups []LookupConfig,
+	condition string,
+	lock bool,
+) ([]lookupEntry, []string, error) {
+	columns := []string{quoteIdentifier(table.ShardKey) + "::text"}
+	for _, lookup := range lookups {
+		columns = append(columns, quoteIdentifier(lookup.Column)+"::text")
+	}
+	relation := quoteIdentifier(ref.Table)
+	if ref.Schema != "" {
+		relation = quoteIdentifier(ref.Schema) + "." + relation
+	}
+	if ref.Alias != "" {
+		relation += " " + quoteIdentifier(ref.Alias)
+	}
+	statement := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), relation)
+	if condition != "" {
+		statement += " WHERE " + condition
+	}
+	if lock {
+		statement += " FOR UPDATE"
+	}
+
+	rows, err := server.QueryRows(statement)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]lookupEntry, 0, len(rows)*len(lookups))
+	keys := make([]string, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, string(row.Values[0]))
+		for i, lookup := range lookups {
+			if row.Values[i+1] != nil {
+				entries = append(entries, lookupEntry{table: lookup.GetTable(table), value: string(row.Values[i+1]), key: string(row.Values[0])})
+			}
+		}
+	}
+	return entries, keys, nil
+}
+
+// The entries of a that are not in b
+func subtractLookupEntries(a []lookupEntry, b []lookupEntry) []lookupEntry {
+	entries := make([]lookupEntry, 0)
+	for _, entry := range a {
+		if !slices.Contains(b, entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Send writes to tables with lookup columns through handleLookupWrite.
+// Returns whether the query was handled
+func routeLookupWrites(
+	queryText string,
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	for _, statement := range statements {
+		if statement.Kind != query.KIND_INSERT && statement.Kind != query.KIND_UPDATE && statement.Kind != query.KIND_DELETE {
+			continue
+		}
+		for _, ref := range query.Tables(statement) {
+			table, ok := database.GetRelationTableConfig(ref.Schema, ref.Table)
+			if !ok || !ref.Written || len(table.Lookups) == 0 {
+				continue
+			}
+			if len(statements) > 1 {
+				writeSyntheticError(client, buildQueryError(
+					"0A000",
+					fmt.Sprintf("writes to table %s with lookup columns must be sent as a query of their own", table.Name),
+				))
+				return true
+			}
+			return handleLookupWrite(queryText, statement, table, ref, client, requester, database)
+		}
+	}
+	return false
+}
+
+// Run a write to a table with lookup columns on the cluster owning its
+// rows and keep the lookup tables up to date. Returns false for updates
+// that leave the lookup columns alone, which need no special handling
+func handleLookupWrite(
+	queryText string,
+	statement *query.Statement,
+	table *TableConfig,
+	ref query.TableRef,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	var added []lookupEntry
+	var lookups []LookupConfig
+	var errMsg *protocol.ErrorResponsePgMessage
+	switch statement.Kind {
+	case query.KIND_INSERT:
+		added, errMsg = getInsertLookupEntries(statement, table)
+	case query.KIND_UPDATE:
+		updated := query.UpdateColumns(statement)
+		for _, lookup := range table.Lookups {
+			if slices.Contains(updated, lookup.Column) {
+				lookups = append(lookups, lookup)
+			}
+		}
+		switch {
+		case slices.Contains(updated, table.ShardKey):
+			errMsg = buildQueryError("0A000", fmt.Sprintf("shard key %s of table %s with lookup columns cannot be updated", table.ShardKey, table.Name))
+		case len(lookups) == 0:
+			return false
+		case statement.HasTopLevelKeyword("FROM"):
+			errMsg = buildQueryError("0A000", fmt.Sprintf("UPDATE of lookup columns of table %s cannot use FROM", table.Name))
+		}
+	case query.KIND_DELETE:
+		lookups = table.Lookups
+		if statement.HasTopLevelKeyword("USING") {
+			errMsg = buildQueryError("0A000", fmt.Sprintf("DELETE from table %s with lookup columns cannot use USING", table.Name))
+		}
+	}
+	if errMsg != nil {
+		writeSyntheticError(client, errMsg)
+		return true
+	}
+
+	write := shardRouting.BeginWrite(database.Name)
+	defer write.Finish(client)
+	cluster, err := routeByShardKey([]*query.Statement{statement}, write, client.Ctx.ClientPid, requester, database)
+	if err == nil && cluster == nil {
+		err = buildQueryError("0A000", fmt.Sprintf(
+			"%s on table %s with lookup columns must pin %s or a lookup column with = so it runs on a single shard",
+			statement.Kind, table.Name, table.ShardKey,
+		))
+	}
+	if err == nil && len(added) > 0 {
+		err = changeLookupEntries(requester, client.Ctx.ClientPid, database, write, added, nil)
+	}
+	var server *ServerConnection
+	if err == nil {
+		server, err = getShardConnection(client, requester, database, cluster.GetAddr())
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error routing write to table with lookup columns", "table", table.Name, "error", err)
+			writeSyntheticError(client, buildQueryError("58000", err.Error()))
+		}
+		return true
+	}
+	client.pendingBegin = ""
+	servers := []*ServerConnection{server}
+
+	// Outside of a transaction the rows are read and written in one of
+	// our own so no other write can change them in between
+	inTransaction := server.InTransaction()
+	var before []lookupEntry
+	var keys []string
+	if len(lookups) > 0 {
+		condition := ""
+		if where, ok := query.Where(statement); ok {
+			condition = queryText[where.Start:where.End]
+		}
+		if !inTransaction {
+			err = server.Exec("BEGIN")
+		}
+		if err == nil {
+			before, keys, err = readLookupEntries(server, table, ref, lookups, condition, true)
+		}
+		if err != nil {
+			if !inTransaction && server.InTransaction() {
+				server.Exec("ROLLBACK")
+			}
+			releaseShardConnections(client, requester, database, servers)
+			if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+				writeShardResults(client, database.Name, []shardResult{{shardAddr: cluster.GetAddr(), transactionStatus: server.GetTransactionStatus()}}, "", errMsg)
+			} else {
+				client.Write(buildErrorResponsePacket(buildLostConnectionError(cluster.GetAddr(), database.Name, err)))
+			}
+			return true
+		}
+	}
+
+	server.IssueQuery(queryText)
+	result := readShardRows(server)
+	succeeded := result.err == nil && result.errMsg == nil
+	var after []lookupEntry
+	if succeeded && len(keys) > 0 && statement.Kind == query.KIND_UPDATE {
+		quoted := make([]string, 0, len(keys))
+		for _, key := range keys {
+			quoted = append(quoted, quoteLiteral(key))
+		}
+		condition := fmt.Sprintf("%s IN (%s)", quoteIdentifier(table.ShardKey), strings.Join(quoted, ", "))
+		after, _, err = readLookupEntries(server, table, query.TableRef{Schema: ref.Schema, Table: ref.Table}, lookups, condition, false)
+	}
+	if len(lookups) > 0 && !inTransaction && result.err == nil {
+		// The write is only kept if the lookup entries to change are known
+		end := "COMMIT"
+		if !succeeded || err != nil {
+			end = "ROLLBACK"
+		}
+		if endErr := server.Exec(end); endErr != nil && succeeded {
+			result.err = endErr
+			if endErrMsg, ok := endErr.(*protocol.ErrorResponsePgMessage); ok {
+				result.err, result.errMsg = nil, endErrMsg
+			}
+		} else if err != nil && succeeded {
+			result.errMsg = buildQueryError("58000", fmt.Sprintf("the write to %s was rolled back since its lookup entries could not be read: %s", table.Name, err))
+		}
+		result.transactionStatus = server.GetTransactionStatus()
+		succeeded = result.err == nil && result.errMsg == nil
+	}
+	if succeeded && len(keys) > 0 {
+		// Entries of rows changed inside a transaction that may still be
+		// rolled back are kept
+		var removed []lookupEntry
+		if !inTransaction {
+			removed = subtractLookupEntries(before, after)
+		}
+		if err == nil {
+			err = changeLookupEntries(requester, client.Ctx.ClientPid, database, write, subtractLookupEntries(after, before), removed)
+		}
+		if err != nil {
+			slog.Error("Error updating lookup tables", "table", table.Name, "error", err)
+			errMsg = buildQueryError("58000", fmt.Sprintf("the lookup tables of %s could not be updated: %s", table.Name, err))
+			errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: "BACKFILL LOOKUP in the admin console repairs them."}
+		}
+	}
+	releaseShardConnections(client, requester, database, servers)
+	slog.Info("Wrote to table with lookup columns", "table", table.Name, "statement", string(statement.Kind), "shard", cluster.GetAddr())
+	writeShardResults(client, database.Name, []shardResult{result}, result.tag, errMsg)
+	return true
+}
+
+// Add the entries of the rows a cluster owns to a lookup table. Rows are
+// read in batches in the order they are stored
+func backfillLookup(
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+	cluster *ClusterConfig,
+	table *TableConfig,
+	lookup *LookupConfig,
+) (int, error) {
+	keyRange, err := cluster.GetKeyRange()
+	if err != nil || keyRange.IsEmpty() {
+		return 0, err
+	}
+	server, err := CreateServerConnection(database, cluster)
+	if err != nil {
+		return 0, err
+	}
+	defer server.Terminate()
+
+	count := 0
+	last := "(0,0)"
+	for {
+		rows, err := server.QueryRows(fmt.Sprintf(
+			"SELECT ctid, %s::text, %s::text FROM %s WHERE ctid > %s::tid AND %s IS NOT NULL AND (%s) ORDER BY ctid LIMIT %d",
+			quoteIdentifier(table.ShardKey), quoteIdentifier(lookup.Column), table.Name, quoteLiteral(last),
+			quoteIdentifier(lookup.Column), keyRangeFilter(table.ShardKey, keyRange), LOOKUP_BACKFILL_BATCH_SIZE,
+		))
+		if err != nil {
+			return count, err
+		}
+		entries := make([]lookupEntry, 0, len(rows))
+		for _, row := range rows {
+			entries = append(entries, lookupEntry{table: lookup.GetTable(table), value: string(row.Values[2]), key: string(row.Values[1])})
+		}
+		if err := changeLookupEntries(requester, 0, database, nil, entries, nil); err != nil {
+			return count, err
+		}
+		count += len(entries)
+		if len(rows) < LOOKUP_BACKFILL_BATCH_SIZE {
+			return count, nil
+		}
+		last = string(rows[len(rows)-1].Values[0])
+	}
+}
+
+// BACKFILL LOOKUP <database> <table> <column>
+func adminBackfillLookup(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	if len(args) != 3 {
+		return nil, buildAdminError("42601", "usage: BACKFILL LOOKUP <database> <table> <column>")
+	}
+	database, ok := config.GetDatabaseConfigByName(args[0])
+	if !ok {
+		return nil, buildAdminError("3D000", fmt.Sprintf("database %q is not configured", args[0]))
+	}
+	table, ok := database.GetTableConfig(args[1])
+	if !ok {
+		return nil, buildAdminError("42P01", fmt.Sprintf("table %q of database %q is not configured", args[1], database.Name))
+	}
+	lookup, ok := table.GetLookup(args[2])
+	if !ok {
+		return nil, buildAdminError("42703", fmt.Sprintf("table %q has no lookup on column %q", table.Name, args[2]))
+	}
+
+	result := &adminResult{
+		Columns: []string{"database", "table", "lookup_table", "cluster", "entries"},
+		Rows:    make([][]string, 0, len(database.Clusters)),
+	}
+	for i := range database.Clusters {
+		cluster := &database.Clusters[i]
+		count, err := backfillLookup(requester, database, cluster, table, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("backfilling %s from %s: %w", lookup.GetTable(table), cluster.GetAddr(), err)
+		}
+		slog.Info("Backfilled lookup table", "database", database.Name, "table", lookup.GetTable(table), "cluster", cluster.GetAddr(), "entries", count)
+		result.Rows = append(result.Rows, []string{database.Name, table.Name, lookup.GetTable(table), cluster.GetAddr(), fmt.Sprint(count)})
+	}
+	result.Tag = "BACKFILL LOOKUP"
+	return result, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func lookupTestDatabase() *DatabaseConfig {
+	return &DatabaseConfig{
+		Name: "test",
+		Tables: []TableConfig{
+			{Name: "users", ShardKey: "id", Lookups: []LookupConfig{{Column: "username"}}},
+			{Name: "countries", Reference: true},
+		},
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-80"},
+			{Host: "b", Port: 5432, KeyRange: "80-"},
+		},
+	}
+}
+
+func TestGetInsertLookupEntries(t *testing.T) {
+	database := lookupTestDatabase()
+	table, _ := database.GetTableConfig("users")
+
+	statements, _ := query.Parse("INSERT INTO users (id, username) VALUES (1, 'bob'), (2, NULL), (3, 'eve')")
+	entries, errMsg := getInsertLookupEntries(statements[0], table)
+	if errMsg != nil {
+		t.Fatal(errMsg)
+	}
+	expected := []lookupEntry{
+		{table: "users_username_lookup", value: "bob", key: "1"},
+		{table: "users_username_lookup", value: "eve", key: "3"},
+	}
+	if len(entries) != len(expected) || entries[0] != expected[0] || entries[1] != expected[1] {
+		t.Fatalf("Expected %v, got %v", expected, entries)
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO users (id, username) VALUES (1, lower('BOB'))",
+		"INSERT INTO users (username) VALUES ('bob')",
+		"INSERT INTO users (id, username) SELECT id, username FROM staging",
+		"INSERT INTO users (id, username) VALUES (1, 'bob') ON CONFLICT (id) DO UPDATE SET username = 'bob'",
+	} {
+		statements, _ := query.Parse(sql)
+		if _, errMsg := getInsertLookupEntries(statements[0], table); errMsg == nil {
+			t.Fatalf("Expected %q to be rejected", sql)
+		}
+	}
+
+	before := []lookupEntry{{"t", "a", "1"}, {"t", "b", "2"}}
+	after := []lookupEntry{{"t", "a", "1"}, {"t", "c", "2"}}
+	if removed := subtractLookupEntries(before, after); len(removed) != 1 || removed[0].value != "b" {
+		t.Fatalf("Unexpected removed entries %v", removed)
+	}
+}
+
+// A server's answer to a query returning the rows. nil values are NULL
+func buildRows(transactionStatus byte, rows ...[][]byte) []byte {
+	var result bytes.Buffer
+	for _, row := range rows {
+		result.Write(protocol.BuildDataRowPgMessage(row).Pack())
+	}
+	result.Write(buildCompletion(fmt.Sprintf("SELECT %d", len(rows)), transactionStatus))
+	return result.Bytes()
+}
+
+func TestLookupWriteFromNull(t *testing.T) {
+	database := lookupTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	owner := func(key string) *ClusterConfig {
+		cluster, _ := database.GetClusterForKeyspaceId(KeyspaceId([]byte(key)))
+		return cluster
+	}
+
+	// The row had no username so it had no lookup entry yet. It is read
+	// and updated in a transaction of its own
+	user, userConn := newSessionServer(database, owner("1"),
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		buildRows(TRANSACTION_STATUS_ACTIVE, [][]byte{[]byte("1"), nil}),
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+		buildRows(TRANSACTION_STATUS_ACTIVE, [][]byte{[]byte("1"), []byte("bob")}),
+		buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE),
+	)
+	lookup, lookupConn := newSessionServer(database, owner("bob"), buildCompletion("INSERT 0 1", TRANSACTION_STATUS_IDLE))
+	servers := map[string][]*ServerConnection{}
+	for _, server := range []*ServerConnection{user, lookup} {
+		addr := server.GetClusterConfig().GetAddr()
+		servers[addr] = append(servers[addr], server)
+	}
+	returned := serveScriptedPool(requester, servers)
+
+	sql := "UPDATE users SET username = 'bob' WHERE id = 1"
+	statements, _ := query.Parse(sql)
+	conn := &scriptedConn{}
+	client := &ClientConnection{Conn: conn, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: 1}}
+	if !routeLookupWrites(sql, statements, client, requester, database) {
+		t.Fatal("Expected the update of a lookup column to be handled")
+	}
+	<-returned
+	<-returned
+	if code := sentErrorCode(conn); code != "" {
+		t.Fatalf("Expected the update to succeed, got %q", code)
+	}
+	expected := []string{
+		"BEGIN",
+		"SELECT id::text, username::text FROM users WHERE id = 1 FOR UPDATE",
+		sql,
+		"SELECT id::text, username::text FROM users WHERE id IN ('1')",
+		"COMMIT",
+	}
+	if queries := userConn.queries(); len(queries) < len(expected) || !slices.Equal(queries[:len(expected)], expected) {
+		t.Fatalf("Expected queries %q, got %q", expected, queries)
+	}
+	if queries := lookupConn.queries(); len(queries) == 0 || !strings.Contains(queries[0], "INSERT INTO users_username_lookup") || !strings.Contains(queries[0], "('bob', '1')") {
+		t.Fatalf("Expected the lookup entry to be added, got %q", queries)
+	}
+}
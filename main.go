@@ -7,8 +7,6 @@ import (
 	"log/slog"
 	"os"
 	"time"
-
-	"github.com/BurntSushi/toml"
 )
 
 const (
@@ -16,33 +14,65 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(RunCheckConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema-drift" {
+		os.Exit(RunSchemaDrift(os.Args[2:]))
+	}
+
 	// Read the config
 	configPath := flag.String("config", "config.toml", "Path to the config file")
 	pidFile := flag.String("pidfile", "spanner.pid", "Path to the pid file")
 	noKeepAlive := flag.Bool("nokeepalive", false, "Enable keep alive")
+	upgrade := flag.Bool("upgrade", false, "Take over the listener and clients of the running process")
 	flag.Parse()
 
 	slog.Info("Keep alive is off", "NoKeepAlive", *noKeepAlive)
 
-	var config SpannerConfig
-	_, err := toml.DecodeFile(*configPath, &config)
+	config, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Fatal("Error reading config file", err)
+		log.Fatal("Error reading config file: ", err)
 	}
 
+	writtenPidFile := ""
 	if config.PidFile != "" {
 		// Write the pid file
 		os.WriteFile(*pidFile, []byte(fmt.Sprintf("%d", os.Getpid())), 0644)
+		writtenPidFile = *pidFile
+	}
+	if err := ConfigureLogger(config.Logging); err != nil {
+		log.Fatal("Error configuring logging: ", err)
 	}
-	ConfigureLogger(config.Logging)
 
-	connRequester := NewConnectionRequester()
+	idGenerator = NewIdGenerator(config.NodeId)
+	connRequester := NewConnectionRequester(config)
+	shutdown := NewShutdownCoordinator(writtenPidFile)
+	if *upgrade {
+		if config.UpgradeSocket == "" {
+			log.Fatal("UpgradeSocket must be configured to upgrade")
+		}
+		if err := ReceiveHandoff(config.UpgradeSocket, shutdown, connRequester); err != nil {
+			log.Fatal("Error taking over from running process: ", err)
+		}
+	}
+	go shutdown.WaitForSignal(connRequester)
+	go WaitForReloadSignal(connRequester)
+	go WatchShardMap(connRequester)
+	go RecoverPreparedTransactions(connRequester)
+	ResumeKeyRangeMoves(connRequester)
+	if config.UpgradeSocket != "" {
+		go RunUpgradeListener(config.UpgradeSocket, shutdown, connRequester)
+	}
+	runClientConnectionHandler := func(config *SpannerConfig, keepAlive *KeepAlive, requester *ConnectionRequester) {
+		clientConnectionHandler(config, keepAlive, requester, shutdown)
+	}
 
 	chKeepAlive := StartComponentWithKeepAlive(
 		"clientConnectionHandler",
-		clientConnectionHandler,
+		runClientConnectionHandler,
 		TIMEOUT*2,
-		&config,
+		config,
 		connRequester,
 		*noKeepAlive,
 	)
@@ -50,17 +80,29 @@ func main() {
 		"poolManager",
 		RunPoolManager,
 		CONNECTION_SWEEP_INTERVAL*4,
-		&config,
+		config,
+		connRequester,
+		*noKeepAlive,
+	)
+	healthKeepAlive := StartComponentWithKeepAlive(
+		"healthChecker",
+		RunHealthChecker,
+		HEALTH_CHECK_INTERVAL*2,
+		config,
 		connRequester,
 		*noKeepAlive,
 	)
 	if *noKeepAlive {
-		go RunPoolManager(&config, chKeepAlive, connRequester)
-		clientConnectionHandler(&config, poolKeepAlive, connRequester)
+		go RunPoolManager(config, chKeepAlive, connRequester)
+		go RunHealthChecker(config, healthKeepAlive, connRequester)
+		runClientConnectionHandler(config, poolKeepAlive, connRequester)
+		// Wait for the shutdown to finish once the listener has closed
+		select {}
 	} else {
 		var keepAlives []*KeepAlive
 		keepAlives = append(keepAlives, chKeepAlive)
 		keepAlives = append(keepAlives, poolKeepAlive)
-		RunKeepAliveHandler(&config, keepAlives, connRequester)
+		keepAlives = append(keepAlives, healthKeepAlive)
+		RunKeepAliveHandler(config, keepAlives, connRequester)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/livinlefevreloca/pgspanner/utils"
@@ -17,6 +18,15 @@ type Pooler struct {
 	connections    []*ServerConnection
 	clusterConfig  *ClusterConfig
 	databaseConfig *DatabaseConfig
+	health         ClusterHealth
+	// Connections currently handed out to clients keyed by backend pid
+	inUse map[int]*ServerConnection
+	// Address of the configured primary of the shard the host belongs to
+	shardAddr string
+	// Whether the host allows prepared transactions. Checked on the first
+	// connection the pooler opens
+	preparedTransactionsChecked bool
+	noPreparedTransactions      bool
 }
 
 func newPooler(
@@ -28,9 +38,99 @@ func newPooler(
 		connections:    conections,
 		databaseConfig: &databaseConfig,
 		clusterConfig:  &clusterConfig,
+		health:         *newClusterHealth(databaseConfig.Name, clusterConfig.GetAddr()),
+		inUse:          make(map[int]*ServerConnection),
+		shardAddr:      clusterConfig.GetAddr(),
 	}
 }
 
+func newReplicaPooler(
+	databaseConfig DatabaseConfig,
+	replicaConfig ClusterConfig,
+	shardAddr string,
+) *Pooler {
+	pooler := newPooler(databaseConfig, replicaConfig)
+	pooler.shardAddr = shardAddr
+	pooler.health.IsReplica = true
+	return pooler
+}
+
+func (p *Pooler) checkOut(connection *ServerConnection) {
+	p.inUse[connection.GetBackendPid()] = connection
+}
+
+func (p *Pooler) checkIn(connection *ServerConnection) {
+	delete(p.inUse, connection.GetBackendPid())
+}
+
+// Close every idle connection and poison the ones handed out to
+// clients so they are closed instead of returned to the pool. Idle
+// connections are closed in the background since saying goodbye to a
+// host that went away waits for the write to time out. The channel is
+// closed once they are
+func (p *Pooler) drain() <-chan struct{} {
+	slog.Warn(
+		"Draining pool",
+		"Pooler", p.GetAddr(),
+		"Idle", len(p.connections),
+		"InUse", len(p.inUse),
+	)
+	idle := p.connections
+	p.connections = make([]*ServerConnection, 0, p.getPoolSettings().MaxOpenConns)
+	for _, connection := range p.inUse {
+		connection.Poison()
+	}
+	return terminateConnections(idle)
+}
+
+// Close connections in the background. The channel is closed once they
+// all are
+func terminateConnections(connections []*ServerConnection) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, connection := range connections {
+			connection.Terminate()
+		}
+	}()
+	return done
+}
+
+// Swap in the settings from a reloaded config. Idle connections over a
+// lowered pool size are closed. Returns a description of what changed
+func (p *Pooler) updateConfig(databaseConfig DatabaseConfig, clusterConfig ClusterConfig) string {
+	changed := make([]string, 0)
+	if databaseConfig.PoolSettings != p.databaseConfig.PoolSettings {
+		changed = append(changed, "pool settings")
+	}
+	if databaseConfig.GetReadRouting() != p.databaseConfig.GetReadRouting() ||
+		databaseConfig.MaxReplicationLag != p.databaseConfig.MaxReplicationLag {
+		changed = append(changed, "read routing")
+	}
+	if clusterConfig.Name != p.clusterConfig.Name ||
+		clusterConfig.User != p.clusterConfig.User ||
+		clusterConfig.PasswordEnv != p.clusterConfig.PasswordEnv {
+		changed = append(changed, "credentials")
+	}
+	p.databaseConfig = &databaseConfig
+	p.clusterConfig = &clusterConfig
+
+	maxOpenConns := p.getPoolSettings().MaxOpenConns
+	surplus := make([]*ServerConnection, 0)
+	for len(p.connections) > maxOpenConns {
+		var ptr **ServerConnection
+		p.connections, ptr = utils.Pop(p.connections)
+		slog.Info(
+			"Closing connection. Pool size was lowered",
+			"Pooler", p.GetAddr(),
+			"BackendPid", (*ptr).GetBackendPid(),
+		)
+		surplus = append(surplus, *ptr)
+	}
+	terminateConnections(surplus)
+	return strings.Join(changed, ", ")
+}
+
 func (p *Pooler) getPoolSettings() *PoolConfig {
 	return &p.databaseConfig.PoolSettings
 }
@@ -50,7 +150,7 @@ func (p *Pooler) removeConnection(connection *ServerConnection) {
 			break
 		}
 	}
-	slices.Delete(p.connections, index, index)
+	p.connections = slices.Delete(p.connections, index, index+1)
 }
 
 func (p *Pooler) getConnection(frontendPid int) (*ServerConnection, error) {
@@ -69,6 +169,10 @@ func (p *Pooler) getConnection(frontendPid int) (*ServerConnection, error) {
 				)
 				return nil, err
 			}
+			if !p.preparedTransactionsChecked {
+				p.checkPreparedTransactions(connection)
+			}
+			connection.noPreparedTransactions = p.noPreparedTransactions
 			break
 		}
 
@@ -88,6 +192,8 @@ func (p *Pooler) getConnection(frontendPid int) (*ServerConnection, error) {
 			connection.Close()
 			connectionCount = len(p.connections)
 		} else {
+			// Connections idle for long are checked for liveness by the
+			// client they are handed to, see requestLiveConnection
 			break
 		}
 	}
@@ -95,15 +201,34 @@ func (p *Pooler) getConnection(frontendPid int) (*ServerConnection, error) {
 	return connection, nil
 }
 
-func (p *Pooler) returnConnection(connection ServerConnection, frontendPid int) {
+// Two phase commits need max_prepared_transactions to be set on the
+// host. Writes to a host without it are committed without one
+func (p *Pooler) checkPreparedTransactions(connection *ServerConnection) {
+	allowed, err := allowsPreparedTransactions(connection)
+	if err != nil {
+		slog.Error("Error checking max_prepared_transactions", "Pooler", p.GetAddr(), "Error", err)
+		return
+	}
+	p.preparedTransactionsChecked = true
+	p.noPreparedTransactions = !allowed
+	if !allowed {
+		slog.Warn(
+			"max_prepared_transactions is 0. Writes to several clusters including this one are committed without a two phase commit",
+			"Pooler", p.GetAddr(),
+		)
+	}
+}
+
+func (p *Pooler) returnConnection(connection *ServerConnection, frontendPid int) {
 	poolSettings := p.getPoolSettings()
+	connection.MarkUsed()
 	if len(p.connections) < poolSettings.MaxOpenConns {
 		slog.Info(
 			"Returning connection",
 			"Pooler", p.GetAddr(),
 			"BackendPid", connection.GetBackendPid(),
 		)
-		p.connections = append(p.connections, &connection)
+		p.connections = append(p.connections, connection)
 	} else if connection.GetAge() > int64(poolSettings.MaxConnLifetime) {
 		slog.Info(
 			"Closing connection. Connection has exceeded max lifetime",
@@ -127,34 +252,145 @@ func (p *Pooler) CloseConnection(connection *ServerConnection, frontendPid int)
 
 type PoolerManager struct {
 	poolers          map[string]map[string]*Pooler
+	shards           map[string]map[string]*shardTopology
+	replicaCursors   map[string]int
 	ConnectionServer *ConnectionRequester
 	connectionTable  map[int][]ServerProcessIdentity
 }
 
 func NewPoolerManager(config *SpannerConfig, server *ConnectionRequester) *PoolerManager {
 	poolers := make(map[string]map[string]*Pooler)
+	shards := make(map[string]map[string]*shardTopology)
 	for _, database := range config.Databases {
 		for _, cluster := range database.Clusters {
 			if poolers[database.Name] == nil {
 				poolers[database.Name] = make(map[string]*Pooler)
+				shards[database.Name] = make(map[string]*shardTopology)
 			}
-			poolers[database.Name][cluster.GetAddr()] = newPooler(database, cluster)
+			primary := newPooler(database, cluster)
+			poolers[database.Name][cluster.GetAddr()] = primary
+			shard := newShardTopology(primary)
+			for _, replica := range cluster.GetReplicaConfigs() {
+				pooler := newReplicaPooler(database, replica, cluster.GetAddr())
+				poolers[database.Name][replica.GetAddr()] = pooler
+				shard.replicas = append(shard.replicas, pooler)
+			}
+			shards[database.Name][cluster.GetAddr()] = shard
 		}
 	}
 	return &PoolerManager{
 		poolers:          poolers,
+		shards:           shards,
+		replicaCursors:   make(map[string]int),
 		ConnectionServer: server,
 	}
 }
 
+// Pick the replica of a cluster that should serve the next read
+// according to the database's read routing policy. Returns nil if
+// no replica is fit to serve reads
+func (pm *PoolerManager) selectReplica(database string, shardAddr string) *Pooler {
+	shard, ok := pm.shards[database][shardAddr]
+	if !ok {
+		return nil
+	}
+	candidates := make([]*Pooler, 0)
+	for _, replica := range shard.replicas {
+		if replica.health.CanServeReads(replica.databaseConfig.MaxReplicationLag) {
+			candidates = append(candidates, replica)
+		} else {
+			slog.Debug(
+				"Skipping replica that cannot serve reads",
+				"replica", replica.GetAddr(),
+				"state", replica.health.State,
+				"lag", replica.health.ReplicationLag,
+			)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch candidates[0].databaseConfig.GetReadRouting() {
+	case READ_ROUTING_LEAST_CONNECTIONS:
+		selected := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if len(candidate.inUse) < len(selected.inUse) {
+				selected = candidate
+			}
+		}
+		return selected
+	case READ_ROUTING_ROUND_ROBIN:
+		key := database + "/" + shardAddr
+		selected := candidates[pm.replicaCursors[key]%len(candidates)]
+		pm.replicaCursors[key]++
+		return selected
+	default:
+		return nil
+	}
+}
+
+// Send a connection that can serve read only queries for the cluster.
+// Falls back to the primary if no replica is available
+func (pm *PoolerManager) SendReadConnection(request ConnectionRequest) {
+	if replica := pm.selectReplica(request.database, request.clusterAddr); replica != nil {
+		pm.sendPoolerConnection(request, replica)
+		return
+	}
+	pm.SendConnection(request)
+}
+
+// Send a connection to the current primary of the cluster
 func (pm *PoolerManager) SendConnection(request ConnectionRequest) {
-	pooler := pm.poolers[request.database][request.clusterAddr]
+	shard, ok := pm.shards[request.database][request.clusterAddr]
+	if !ok {
+		pooler, ok := pm.poolers[request.database][request.clusterAddr]
+		if !ok {
+			request.responder <- ConnectionResponse{
+				Event:  ACTION_GET_CONNECTION,
+				Result: RESULT_ERROR,
+				Detail: ClusterNotFoundError{DatabaseName: request.database, ClusterAddr: request.clusterAddr},
+			}
+			return
+		}
+		pm.sendPoolerConnection(request, pooler)
+		return
+	}
+	// Hold on to the request while a failover may still happen
+	if shard.failoverPending(time.Now()) {
+		shard.queue(request)
+		return
+	}
+	pm.sendPoolerConnection(request, shard.primary)
+}
+
+func (pm *PoolerManager) sendPoolerConnection(request ConnectionRequest, pooler *Pooler) {
 	var response ConnectionResponse
+	request.clusterAddr = pooler.GetAddr()
 	slog.Info(
 		"Received connection request for cluster",
 		"cluster", request.clusterAddr,
 		"database", request.database,
 	)
+	// Fail fast rather than dialing a cluster we already know is down
+	if pooler.health.IsDown() {
+		slog.Warn(
+			"Rejecting connection request for cluster that is down",
+			"cluster", request.clusterAddr,
+			"database", request.database,
+		)
+		request.responder <- ConnectionResponse{
+			Event:  ACTION_GET_CONNECTION,
+			Result: RESULT_ERROR,
+			Detail: ClusterDownError{
+				DatabaseName: request.database,
+				ClusterAddr:  request.clusterAddr,
+				LastError:    pooler.health.LastError,
+				NextCheck:    pooler.health.NextCheck,
+			},
+		}
+		return
+	}
 	connection, err := pooler.getConnection(request.FrontendPid)
 	if err != nil {
 		response = ConnectionResponse{
@@ -167,8 +403,9 @@ func (pm *PoolerManager) SendConnection(request ConnectionRequest) {
 		return
 	}
 	response = ConnectionResponse{
-		Event: ACTION_GET_CONNECTION,
-		Conn:  connection,
+		Event:  ACTION_GET_CONNECTION,
+		Result: RESULT_SUCCESS,
+		Conn:   connection,
 	}
 	if pm.connectionTable == nil {
 		pm.connectionTable = make(map[int][]ServerProcessIdentity)
@@ -177,11 +414,13 @@ func (pm *PoolerManager) SendConnection(request ConnectionRequest) {
 		pm.connectionTable[request.FrontendPid] = make([]ServerProcessIdentity, 0)
 	}
 	pm.connectionTable[request.FrontendPid] = append(pm.connectionTable[request.FrontendPid], connection.GetServerIdentity())
+	connection.shardAddr = pooler.shardAddr
+	pooler.checkOut(connection)
 	request.responder <- response
 }
 
 func (pm *PoolerManager) CloseConnection(request ConnectionRequest) {
-	pooler := pm.poolers[request.database][request.clusterAddr]
+	pooler, ok := pm.poolers[request.database][request.clusterAddr]
 	if request.Connection == nil {
 		slog.Error(
 			"Received nil connection in CloseConnection",
@@ -200,11 +439,17 @@ func (pm *PoolerManager) CloseConnection(request ConnectionRequest) {
 		pm.connectionTable[request.FrontendPid],
 		request.Connection.GetServerIdentity(),
 	)
+	// The cluster may have been removed by a config reload
+	if !ok {
+		request.Connection.Close()
+		return
+	}
+	pooler.checkIn(request.Connection)
 	pooler.CloseConnection(request.Connection, request.FrontendPid)
 }
 
 func (pm *PoolerManager) ReturnConnection(request ConnectionRequest) {
-	pooler := pm.poolers[request.database][request.clusterAddr]
+	pooler, ok := pm.poolers[request.database][request.clusterAddr]
 	if request.Connection == nil {
 		slog.Error(
 			"Received nil connection in ReturnConnection",
@@ -223,7 +468,27 @@ func (pm *PoolerManager) ReturnConnection(request ConnectionRequest) {
 		pm.connectionTable[request.FrontendPid],
 		request.Connection.GetServerIdentity(),
 	)
-	pooler.returnConnection(*request.Connection, request.FrontendPid)
+	// The cluster may have been removed by a config reload
+	if !ok {
+		slog.Info(
+			"Closing connection. Cluster is no longer configured",
+			"cluster", request.clusterAddr,
+			"database", request.database,
+		)
+		terminateConnections([]*ServerConnection{request.Connection})
+		return
+	}
+	pooler.checkIn(request.Connection)
+	pooler.returnConnection(request.Connection, request.FrontendPid)
+}
+
+type ClusterNotFoundError struct {
+	DatabaseName string
+	ClusterAddr  string
+}
+
+func (e ClusterNotFoundError) Error() string {
+	return fmt.Sprintf("Cluster %s is not configured for database %s", e.ClusterAddr, e.DatabaseName)
 }
 
 type ConnectionMappingNotFound struct {
@@ -258,9 +523,76 @@ func (pm *PoolerManager) SendConnectionMapping(request ConnectionRequest) {
 	request.responder <- response
 }
 
+func (pm *PoolerManager) UpdateClusterHealth(request ConnectionRequest) {
+	pooler, ok := pm.poolers[request.database][request.clusterAddr]
+	if !ok {
+		slog.Warn(
+			"Received health report for unknown cluster",
+			"cluster", request.clusterAddr,
+			"database", request.database,
+		)
+		return
+	}
+	shard := pm.shards[request.database][pooler.shardAddr]
+	// Idle connections to a host that has gone away are useless
+	if request.Health.IsDown() && !pooler.health.IsDown() {
+		pooler.drain()
+		if shard.primary == pooler {
+			shard.primaryDown = time.Now()
+		}
+	}
+	pooler.health = request.Health
+	pooler.health.IsReplica = shard.primary != pooler
+	pm.checkFailover(shard, pooler)
+}
+
+func (pm *PoolerManager) SendClusterHealth(request ConnectionRequest) {
+	health := make([]ClusterHealth, 0)
+	for _, databasePoolers := range pm.poolers {
+		for _, pooler := range databasePoolers {
+			health = append(health, pooler.health)
+		}
+	}
+	slices.SortFunc(health, func(a, b ClusterHealth) int {
+		if a.DatabaseName != b.DatabaseName {
+			return strings.Compare(a.DatabaseName, b.DatabaseName)
+		}
+		return strings.Compare(a.ClusterAddr, b.ClusterAddr)
+	})
+	request.responder <- ConnectionResponse{
+		Event:  ACTION_GET_CLUSTER_HEALTH,
+		Result: RESULT_SUCCESS,
+		Health: health,
+	}
+}
+
+// Close every connection in every pool. Called on shutdown once the
+// clients have gone away
+func (pm *PoolerManager) CloseAllConnections(request ConnectionRequest) {
+	drained := make([]<-chan struct{}, 0)
+	for _, databasePoolers := range pm.poolers {
+		for _, pooler := range databasePoolers {
+			drained = append(drained, pooler.drain())
+		}
+	}
+	// Answer once the servers were told, so they do not log the proxy
+	// exiting as a lost connection
+	go func() {
+		for _, done := range drained {
+			<-done
+		}
+		request.responder <- ConnectionResponse{
+			Event:  ACTION_SHUTDOWN,
+			Result: RESULT_SUCCESS,
+		}
+	}()
+}
+
 func RunPoolManager(config *SpannerConfig, keepAlive *KeepAlive, connectionReqester *ConnectionRequester) {
 	// Start the pool manager
-	poolManager := NewPoolerManager(config, connectionReqester)
+	// Build the pools from the running config in case the pool manager
+	// is restarted after a reload
+	poolManager := NewPoolerManager(connectionReqester.GetConfig(), connectionReqester)
 	timeout := time.After(CONNECTION_SWEEP_INTERVAL)
 	for {
 		select {
@@ -269,14 +601,25 @@ func RunPoolManager(config *SpannerConfig, keepAlive *KeepAlive, connectionReqes
 			switch request.Event {
 			case ACTION_GET_CONNECTION:
 				poolManager.SendConnection(*request)
+			case ACTION_GET_READ_CONNECTION:
+				poolManager.SendReadConnection(*request)
 			case ACTION_RETURN_CONNECTION:
 				poolManager.ReturnConnection(*request)
 			case ACTION_CLOSE_CONNECTION:
 				poolManager.CloseConnection(*request)
 			case ACTION_GET_CONNECTION_MAPPING:
 				poolManager.SendConnectionMapping(*request)
+			case ACTION_REPORT_CLUSTER_HEALTH:
+				poolManager.UpdateClusterHealth(*request)
+			case ACTION_GET_CLUSTER_HEALTH:
+				poolManager.SendClusterHealth(*request)
+			case ACTION_SHUTDOWN:
+				poolManager.CloseAllConnections(*request)
+			case ACTION_RELOAD_CONFIG:
+				poolManager.ApplyConfig(*request)
 			}
 		case <-timeout:
+			poolManager.ExpireQueuedRequests()
 			keepAlive.Notify()
 			timeout = time.After(CONNECTION_SWEEP_INTERVAL)
 		}
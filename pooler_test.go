@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+)
+
+func newReadRoutingManager(readRouting string) *PoolerManager {
+	config := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:              "test",
+		ReadRouting:       readRouting,
+		MaxReplicationLag: 10,
+		PoolSettings:      PoolConfig{MaxOpenConns: 5, MaxConnLifetime: 3600},
+		Clusters: []ClusterConfig{{
+			Host:     "a",
+			Port:     5432,
+			Replicas: []ReplicaConfig{{Host: "b", Port: 5432}, {Host: "c", Port: 5432}},
+		}},
+	}}}
+	return NewPoolerManager(config, nil)
+}
+
+func requestReadConnection(pm *PoolerManager) ConnectionResponse {
+	response := make(chan ConnectionResponse, 1)
+	pm.SendReadConnection(ConnectionRequest{
+		Event:       ACTION_GET_READ_CONNECTION,
+		database:    "test",
+		clusterAddr: "a:5432",
+		responder:   response,
+		FrontendPid: 1,
+	})
+	return <-response
+}
+
+func TestSelectReplica(t *testing.T) {
+	pm := newReadRoutingManager(READ_ROUTING_ROUND_ROBIN)
+	b, c := pm.poolers["test"]["b:5432"], pm.poolers["test"]["c:5432"]
+	selected := func() string {
+		if replica := pm.selectReplica("test", "a:5432"); replica != nil {
+			return replica.GetAddr()
+		}
+		return ""
+	}
+
+	// Round robin takes turns between the replicas
+	for _, expected := range []string{"b:5432", "c:5432", "b:5432"} {
+		if addr := selected(); addr != expected {
+			t.Fatalf("Expected %s, got %s", expected, addr)
+		}
+	}
+
+	// Replicas lagging too far behind or not healthy are skipped
+	c.health.ReplicationLag = 30
+	for i := 0; i < 2; i++ {
+		if addr := selected(); addr != "b:5432" {
+			t.Fatalf("Expected the lagging replica to be skipped, got %s", addr)
+		}
+	}
+	b.health.State = CLUSTER_STATE_DEGRADED
+	if addr := selected(); addr != "" {
+		t.Fatalf("Expected no replica to be fit for reads, got %s", addr)
+	}
+	if pm.selectReplica("test", "z:5432") != nil {
+		t.Fatal("Expected no replica for an unknown cluster")
+	}
+
+	// Least connections picks the replica with the fewest handed out
+	pm = newReadRoutingManager(READ_ROUTING_LEAST_CONNECTIONS)
+	b, c = pm.poolers["test"]["b:5432"], pm.poolers["test"]["c:5432"]
+	busy, _ := addIdleConnection(b, 1)
+	b.connections = nil
+	b.checkOut(busy)
+	for i := 0; i < 2; i++ {
+		if addr := selected(); addr != "c:5432" {
+			t.Fatalf("Expected the idle replica, got %s", addr)
+		}
+	}
+}
+
+func TestSendReadConnection(t *testing.T) {
+	pm := newReadRoutingManager(READ_ROUTING_ROUND_ROBIN)
+	primary, b, c := pm.poolers["test"]["a:5432"], pm.poolers["test"]["b:5432"], pm.poolers["test"]["c:5432"]
+	fromReplica, _ := addIdleConnection(b, 1)
+	fromPrimary, _ := addIdleConnection(primary, 2)
+
+	if answer := requestReadConnection(pm); answer.Result != RESULT_SUCCESS || answer.Conn != fromReplica {
+		t.Fatalf("Expected a connection to the replica, got %s", answer.Result)
+	}
+	if len(b.inUse) != 1 {
+		t.Fatal("Expected the replica connection to be checked out")
+	}
+
+	// Reads go to the primary when no replica can serve them
+	b.health.State = CLUSTER_STATE_DOWN
+	c.health.ReplicationLag = 30
+	if answer := requestReadConnection(pm); answer.Result != RESULT_SUCCESS || answer.Conn != fromPrimary {
+		t.Fatalf("Expected a connection to the primary, got %s", answer.Result)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/// Ends the transactions a two phase commit left prepared, see endPreparedTransaction, when a
+/// COMMIT PREPARED was lost or the proxy stopped part way
+
+const (
+	PREPARED_TRANSACTION_PREFIX = "pgspanner_"
+	// The last cluster of a two phase commit prepares the transaction
+	// under its id with this suffix once every other cluster has
+	// prepared it, and commits it once every other cluster has committed
+	// it. A leftover transaction is committed when its decision is still
+	// prepared and rolled back otherwise
+	PREPARED_TRANSACTION_DECISION_SUFFIX = "_commit"
+	// Transactions prepared more recently may still be ended by the
+	// proxy that prepared them
+	PREPARED_TRANSACTION_RECOVERY_AGE      = time.Minute
+	PREPARED_TRANSACTION_RECOVERY_INTERVAL = time.Minute
+	PREPARED_TRANSACTIONS_QUERY            = `SELECT gid, extract(epoch FROM now() - prepared)::bigint
+		FROM pg_prepared_xacts
+		WHERE database = current_database() AND starts_with(gid, '` + PREPARED_TRANSACTION_PREFIX + `')`
+)
+
+// Whether the server allows prepared transactions
+func allowsPreparedTransactions(server *ServerConnection) (bool, error) {
+	rows, err := server.QueryRows("SHOW max_prepared_transactions")
+	if err != nil {
+		return false, err
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 1 {
+		return false, fmt.Errorf("Unexpected result reading max_prepared_transactions")
+	}
+	return string(rows[0].Values[0]) != "0", nil
+}
+
+// A transaction the proxy left prepared on a cluster
+type leftoverTransaction struct {
+	server *ServerConnection
+	gid    string
+	age    time.Duration
+}
+
+// Read the transactions the proxy prepared on the cluster of the server
+func readPreparedTransactions(server *ServerConnection) ([]leftoverTransaction, error) {
+	rows, err := server.QueryRows(PREPARED_TRANSACTIONS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	transactions := make([]leftoverTransaction, 0, len(rows))
+	for _, row := range rows {
+		if len(row.Values) != 2 {
+			return nil, fmt.Errorf("Unexpected result reading prepared transactions on %s", server.GetClusterConfig().GetAddr())
+		}
+		seconds, err := strconv.ParseInt(string(row.Values[1]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, leftoverTransaction{
+			server: server,
+			gid:    string(row.Values[0]),
+			age:    time.Duration(seconds) * time.Second,
+		})
+	}
+	return transactions, nil
+}
+
+// Commit or roll back the transactions left prepared on the clusters of
+// a database. The decision of a transaction is committed last so it is
+// still there for the next attempt when a commit fails. Returns the
+// number of transactions ended
+func resolvePreparedTransactions(databaseName string, transactions []leftoverTransaction) int {
+	byId := make(map[string][]leftoverTransaction)
+	for _, transaction := range transactions {
+		id := strings.TrimSuffix(transaction.gid, PREPARED_TRANSACTION_DECISION_SUFFIX)
+		byId[id] = append(byId[id], transaction)
+	}
+	ids := make([]string, 0, len(byId))
+	for id := range byId {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	resolved := 0
+	for _, id := range ids {
+		parts := byId[id]
+		commit := false
+		recent := false
+		for _, part := range parts {
+			commit = commit || part.gid != id
+			recent = recent || part.age < PREPARED_TRANSACTION_RECOVERY_AGE
+		}
+		if recent {
+			continue
+		}
+		// The decision sorts after the other parts
+		sort.SliceStable(parts, func(i, j int) bool { return parts[i].gid < parts[j].gid })
+
+		action := "ROLLBACK PREPARED "
+		if commit {
+			action = "COMMIT PREPARED "
+		}
+		ended := true
+		for _, part := range parts {
+			if part.gid != id && !ended {
+				break
+			}
+			if err := part.server.Exec(action + quoteLiteral(part.gid)); err != nil {
+				slog.Error(
+					"Error ending prepared transaction",
+					"database", databaseName,
+					"cluster", part.server.GetClusterConfig().GetAddr(),
+					"transaction", part.gid,
+					"error", err,
+				)
+				ended = false
+			}
+		}
+		if ended {
+			slog.Info("Ended prepared transaction left by the proxy", "database", databaseName, "transaction", id, "committed", commit, "clusters", len(parts))
+			resolved++
+		}
+	}
+	return resolved
+}
+
+// Read the transactions left prepared on every cluster of the database
+// and end them. Nothing is ended unless every cluster could be read
+// since the decision of a transaction may be on the one that could not
+func recoverPreparedTransactions(database *DatabaseConfig) {
+	servers := make([]*ServerConnection, 0, len(database.Clusters))
+	defer func() {
+		for _, server := range servers {
+			server.Terminate()
+		}
+	}()
+	transactions := make([]leftoverTransaction, 0)
+	for i := range database.Clusters {
+		server, err := CreateServerConnection(database, &database.Clusters[i])
+		if err != nil {
+			slog.Error("Cannot recover prepared transactions", "database", database.Name, "cluster", database.Clusters[i].GetAddr(), "error", err)
+			return
+		}
+		servers = append(servers, server)
+		found, err := readPreparedTransactions(server)
+		if err != nil {
+			slog.Error("Cannot recover prepared transactions", "database", database.Name, "cluster", database.Clusters[i].GetAddr(), "error", err)
+			return
+		}
+		transactions = append(transactions, found...)
+	}
+	resolvePreparedTransactions(database.Name, transactions)
+}
+
+// End the transactions left prepared on the clusters of every database
+// that spans several clusters, at startup and every
+// PREPARED_TRANSACTION_RECOVERY_INTERVAL after
+func RecoverPreparedTransactions(requester *ConnectionRequester) {
+	for {
+		for _, database := range requester.GetConfig().Databases {
+			if len(database.Clusters) > 1 {
+				recoverPreparedTransactions(&database)
+			}
+		}
+		time.Sleep(PREPARED_TRANSACTION_RECOVERY_INTERVAL)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAllowsPreparedTransactions(t *testing.T) {
+	for value, expected := range map[string]bool{"0": false, "10": true} {
+		server, _ := newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildRows(TRANSACTION_STATUS_IDLE, [][]byte{[]byte(value)}))
+		allowed, err := allowsPreparedTransactions(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != expected {
+			t.Fatalf("Expected max_prepared_transactions = %s to allow prepared transactions to be %t", value, expected)
+		}
+	}
+}
+
+func TestResolvePreparedTransactions(t *testing.T) {
+	old := []byte("3600")
+	first, firstConn := newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildRows(TRANSACTION_STATUS_IDLE,
+		[][]byte{[]byte("pgspanner_ddl_1_2_1"), old},
+		[][]byte{[]byte("pgspanner_ddl_1_2_2"), old},
+		[][]byte{[]byte("pgspanner_ddl_1_2_3"), []byte("5")},
+	), buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE), buildCompletion("ROLLBACK PREPARED", TRANSACTION_STATUS_IDLE))
+	second, secondConn := newScriptedServer(&ClusterConfig{Host: "b", Port: 5432}, buildRows(TRANSACTION_STATUS_IDLE,
+		[][]byte{[]byte("pgspanner_ddl_1_2_1_commit"), old},
+		[][]byte{[]byte("pgspanner_ddl_1_2_3_commit"), []byte("5")},
+	), buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE))
+
+	transactions := make([]leftoverTransaction, 0)
+	for _, server := range []*ServerConnection{first, second} {
+		found, err := readPreparedTransactions(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transactions = append(transactions, found...)
+	}
+	// A transaction with its decision prepared is committed, decision
+	// last, one without is rolled back and recent ones are left to the
+	// proxy that prepared them
+	if resolved := resolvePreparedTransactions("test", transactions); resolved != 2 {
+		t.Fatalf("Expected 2 transactions to be ended, got %d", resolved)
+	}
+	expected := []string{PREPARED_TRANSACTIONS_QUERY, "COMMIT PREPARED 'pgspanner_ddl_1_2_1'", "ROLLBACK PREPARED 'pgspanner_ddl_1_2_2'"}
+	if queries := firstConn.queries(); !slices.Equal(queries, expected) {
+		t.Fatalf("Expected queries %q, got %q", expected, queries)
+	}
+	expected = []string{PREPARED_TRANSACTIONS_QUERY, "COMMIT PREPARED 'pgspanner_ddl_1_2_1_commit'"}
+	if queries := secondConn.queries(); !slices.Equal(queries, expected) {
+		t.Fatalf("Expected queries %q, got %q", expected, queries)
+	}
+
+	// A failed commit keeps the decision prepared for the next attempt
+	first, firstConn = newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildFailure("08006", TRANSACTION_STATUS_IDLE))
+	second, secondConn = newScriptedServer(&ClusterConfig{Host: "b", Port: 5432})
+	transactions = []leftoverTransaction{
+		{server: second, gid: "pgspanner_ddl_1_2_4_commit", age: PREPARED_TRANSACTION_RECOVERY_AGE},
+		{server: first, gid: "pgspanner_ddl_1_2_4", age: PREPARED_TRANSACTION_RECOVERY_AGE},
+	}
+	if resolved := resolvePreparedTransactions("test", transactions); resolved != 0 {
+		t.Fatalf("Expected no transaction to be ended, got %d", resolved)
+	}
+	if queries := firstConn.queries(); !slices.Equal(queries, []string{"COMMIT PREPARED 'pgspanner_ddl_1_2_4'"}) {
+		t.Fatalf("Expected the commit to be tried, got %q", queries)
+	}
+	if queries := secondConn.queries(); len(queries) != 0 {
+		t.Fatalf("Expected the decision to stay prepared, got %q", queries)
+	}
+}
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"errors"
+
 	"github.com/livinlefevreloca/pgspanner/protocol/parsing"
 )
 
@@ -18,6 +20,7 @@ const (
 	BMESSAGE_DATA_ROW         = 68
 	BMESSAGE_COMMAND_COMPLETE = 67
 	BMESSAGE_ERROR_RESPONSE   = 69
+	BMESSAGE_NOTICE_RESPONSE  = 78
 )
 
 const (
@@ -230,6 +233,20 @@ func BuildRowDescriptionPgMessage(fieldsMap map[string][]int) *RowDescriptionPgM
 	return &RowDescriptionPgMessage{fields}
 }
 
+const (
+	TEXT_TYPE_OID = 25
+)
+
+// Build a new RowDescriptionPgMessage describing text columns in the given order
+func BuildTextRowDescriptionPgMessage(names []string) *RowDescriptionPgMessage {
+	fields := make([]FieldDescription, 0, len(names))
+	for _, name := range names {
+		field := buildFieldDescription(name, 0, 0, TEXT_TYPE_OID, -1, -1, 0)
+		fields = append(fields, *field)
+	}
+	return &RowDescriptionPgMessage{fields}
+}
+
 // PostgresMessage interface implementation for RowDescriptionPgMessage
 func (m *RowDescriptionPgMessage) Unpack(message *RawPgMessage) (*RowDescriptionPgMessage, error) {
 	idx := 0
@@ -351,12 +368,21 @@ func (m *DataRowPgMessage) getByteLength() int {
 
 // PostgresMessage interface implementation for DataRowPgMessage
 func (m *DataRowPgMessage) Unpack(message *RawPgMessage) (*DataRowPgMessage, error) {
+	var valueLength int
+	var value []byte
+	var err error
+
 	idx := 0
 	idx, rowCount := parsing.ParseInt16(message.Data, idx)
 	values := make([][]byte, rowCount)
 	for i := 0; i < rowCount; i++ {
-		idx, valueLength := parsing.ParseInt32(message.Data, idx)
-		idx, value, err := parsing.ParseBytes(message.Data, idx, valueLength)
+		idx, valueLength = parsing.ParseInt32(message.Data, idx)
+		// A length of -1 indicates a NULL value
+		if int32(valueLength) == -1 {
+			values[i] = nil
+			continue
+		}
+		idx, value, err = parsing.ParseBytes(message.Data, idx, valueLength)
 		if err != nil {
 			return nil, err
 		}
@@ -375,6 +401,11 @@ func (m *DataRowPgMessage) Pack() []byte {
 	idx = parsing.WriteInt32(out, idx, messageLength)
 	idx = parsing.WriteInt16(out, idx, len(m.Values))
 	for _, value := range m.Values {
+		// nil values are sent as NULL
+		if value == nil {
+			idx = parsing.WriteInt32(out, idx, -1)
+			continue
+		}
 		idx = parsing.WriteInt32(out, idx, len(value))
 		idx = parsing.WriteBytes(out, idx, value)
 	}
@@ -390,7 +421,7 @@ func (d FieldDescription) byteLength() int {
 
 func (d FieldDescription) Pack() []byte {
 	messageLength := d.byteLength()
-	out := make([]byte, messageLength+1) // +1 for the kind of message
+	out := make([]byte, messageLength) // field descriptions have no kind byte
 
 	idx := 0
 	// Write the name of the field
@@ -496,7 +527,10 @@ func BuildReadyForQueryPgMessage(status byte) *ReadyForQueryPgMessage {
 
 // Postgres Message interface implementation for ReadyForQueryPgMessage
 func (m *ReadyForQueryPgMessage) Unpack(message *RawPgMessage) (*ReadyForQueryPgMessage, error) {
-	return &ReadyForQueryPgMessage{}, nil
+	if len(message.Data) < 1 {
+		return nil, errors.New("Ready for query message is missing transaction status")
+	}
+	return &ReadyForQueryPgMessage{message.Data[0]}, nil
 }
 
 func (m *ReadyForQueryPgMessage) Pack() []byte {
@@ -600,7 +634,11 @@ func (m *ErrorResponsePgMessage) Unpack(message *RawPgMessage) (*ErrorResponsePg
 
 	for idx < len(message.Data) {
 		typ := message.Data[idx]
-		idx, value, err = parsing.ParseCString(message.Data, idx)
+		// The fields are terminated by a single null byte
+		if typ == 0 {
+			break
+		}
+		idx, value, err = parsing.ParseCString(message.Data, idx+1)
 		if err != nil {
 			return nil, err
 		}
@@ -635,6 +673,30 @@ func (m *ErrorResponsePgMessage) Pack() []byte {
 	return out[:idx]
 }
 
+// NoticeResponsePgMessage represents a message the server sends to warn or inform the client.
+// It carries the same fields as an ErrorResponsePgMessage
+type NoticeResponsePgMessage struct {
+	ErrorResponsePgMessage
+}
+
+func BuildNoticeResponsePgMessage(params map[string]string) *NoticeResponsePgMessage {
+	return &NoticeResponsePgMessage{*BuildErrorResponsePgMessage(params)}
+}
+
+func (m *NoticeResponsePgMessage) Unpack(message *RawPgMessage) (*NoticeResponsePgMessage, error) {
+	errMsg, err := m.ErrorResponsePgMessage.Unpack(message)
+	if err != nil {
+		return nil, err
+	}
+	return &NoticeResponsePgMessage{*errMsg}, nil
+}
+
+func (m *NoticeResponsePgMessage) Pack() []byte {
+	out := m.ErrorResponsePgMessage.Pack()
+	out[0] = byte(BMESSAGE_NOTICE_RESPONSE)
+	return out
+}
+
 type ErrorField struct {
 	Type  byte
 	Value string
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/livinlefevreloca/pgspanner/protocol/parsing"
+)
+
+/// Messages of the COPY sub-protocol, sent in both directions. Described in detail at
+/// https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-COPY
+
+const (
+	BMESSAGE_COPY_IN_RESPONSE  = 71
+	BMESSAGE_COPY_OUT_RESPONSE = 72
+	MESSAGE_COPY_DATA          = 100
+	MESSAGE_COPY_DONE          = 99
+	FMESSAGE_COPY_FAIL         = 102
+)
+
+// Overall format of a COPY. Text covers both the text and csv formats
+const (
+	COPY_FORMAT_TEXT   = 0
+	COPY_FORMAT_BINARY = 1
+)
+
+// CopyResponsePgMessage represents the CopyInResponse and CopyOutResponse
+// messages sent by the server when it enters a COPY
+type CopyResponsePgMessage struct {
+	Kind          int
+	Format        int
+	ColumnFormats []int
+}
+
+func BuildCopyInResponsePgMessage(format int, columnFormats []int) *CopyResponsePgMessage {
+	return &CopyResponsePgMessage{BMESSAGE_COPY_IN_RESPONSE, format, columnFormats}
+}
+
+func BuildCopyOutResponsePgMessage(format int, columnFormats []int) *CopyResponsePgMessage {
+	return &CopyResponsePgMessage{BMESSAGE_COPY_OUT_RESPONSE, format, columnFormats}
+}
+
+// PgMessage interface implementation for CopyResponsePgMessage
+func (m *CopyResponsePgMessage) Unpack(message *RawPgMessage) (*CopyResponsePgMessage, error) {
+	if len(message.Data) < 3 {
+		return nil, errors.New("Copy response message is too short")
+	}
+	idx := 0
+	format := int(message.Data[idx])
+	idx, columns := parsing.ParseInt16(message.Data, idx+1)
+	if len(message.Data) < idx+2*columns {
+		return nil, errors.New("Copy response message is missing column formats")
+	}
+	columnFormats := make([]int, columns)
+	for i := range columnFormats {
+		idx, columnFormats[i] = parsing.ParseInt16(message.Data, idx)
+	}
+	return &CopyResponsePgMessage{message.Kind, format, columnFormats}, nil
+}
+
+func (m *CopyResponsePgMessage) Pack() []byte {
+	messageLength := 4 + 1 + 2 + 2*len(m.ColumnFormats) // length + format + column count + column formats
+	out := make([]byte, messageLength+1)                // +1 for the kind of message
+
+	idx := 0
+	idx = parsing.WriteByte(out, idx, byte(m.Kind))
+	idx = parsing.WriteInt32(out, idx, messageLength)
+	idx = parsing.WriteByte(out, idx, byte(m.Format))
+	idx = parsing.WriteInt16(out, idx, len(m.ColumnFormats))
+	for _, format := range m.ColumnFormats {
+		idx = parsing.WriteInt16(out, idx, format)
+	}
+
+	return out
+}
+
+// CopyDataPgMessage carries a chunk of the data being copied. Chunks do
+// not have to line up with rows
+type CopyDataPgMessage struct {
+	Data []byte
+}
+
+func BuildCopyDataPgMessage(data []byte) *CopyDataPgMessage {
+	return &CopyDataPgMessage{data}
+}
+
+// PgMessage interface implementation for CopyDataPgMessage
+func (m *CopyDataPgMessage) Unpack(message *RawPgMessage) (*CopyDataPgMessage, error) {
+	return &CopyDataPgMessage{message.Data}, nil
+}
+
+func (m *CopyDataPgMessage) Pack() []byte {
+	messageLength := 4 + len(m.Data)     // length + data
+	out := make([]byte, messageLength+1) // +1 for the kind of message
+
+	idx := 0
+	idx = parsing.WriteByte(out, idx, byte(MESSAGE_COPY_DATA))
+	idx = parsing.WriteInt32(out, idx, messageLength)
+	parsing.WriteBytes(out, idx, m.Data)
+
+	return out
+}
+
+// CopyDonePgMessage marks the end of the data being copied
+type CopyDonePgMessage struct{}
+
+func BuildCopyDonePgMessage() *CopyDonePgMessage {
+	return &CopyDonePgMessage{}
+}
+
+// PgMessage interface implementation for CopyDonePgMessage
+func (m *CopyDonePgMessage) Unpack(message *RawPgMessage) (*CopyDonePgMessage, error) {
+	return &CopyDonePgMessage{}, nil
+}
+
+func (m *CopyDonePgMessage) Pack() []byte {
+	messageLength := 4
+	out := make([]byte, messageLength+1) // +1 for the kind of message
+
+	idx := 0
+	idx = parsing.WriteByte(out, idx, byte(MESSAGE_COPY_DONE))
+	parsing.WriteInt32(out, idx, messageLength)
+
+	return out
+}
+
+// CopyFailPgMessage is sent by the client to abort a COPY FROM STDIN
+type CopyFailPgMessage struct {
+	Message string
+}
+
+func BuildCopyFailPgMessage(message string) *CopyFailPgMessage {
+	return &CopyFailPgMessage{message}
+}
+
+// PgMessage interface implementation for CopyFailPgMessage
+func (m *CopyFailPgMessage) Unpack(message *RawPgMessage) (*CopyFailPgMessage, error) {
+	if len(message.Data) == 0 {
+		return &CopyFailPgMessage{}, nil
+	}
+	return &CopyFailPgMessage{string(message.Data[:len(message.Data)-1])}, nil
+}
+
+func (m *CopyFailPgMessage) Pack() []byte {
+	messageLength := 4 + len(m.Message) + 1 // length + message + null terminator
+	out := make([]byte, messageLength+1)    // +1 for the kind of message
+
+	idx := 0
+	idx = parsing.WriteByte(out, idx, byte(FMESSAGE_COPY_FAIL))
+	idx = parsing.WriteInt32(out, idx, messageLength)
+	parsing.WriteCString(out, idx, m.Message)
+
+	return out
+}
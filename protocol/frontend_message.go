@@ -156,6 +156,29 @@ func (m PasswordPgMessage) Pack() []byte {
 	return out
 }
 
+// TerminatePgMessage represents the message sent by the client to close the connection
+type TerminatePgMessage struct{}
+
+func BuildTerminateMessage() *TerminatePgMessage {
+	return &TerminatePgMessage{}
+}
+
+// PgMessage interface implementation for TerminatePgMessage
+func (m *TerminatePgMessage) Unpack(message *RawPgMessage) (*TerminatePgMessage, error) {
+	return &TerminatePgMessage{}, nil
+}
+
+func (m TerminatePgMessage) Pack() []byte {
+	messageLength := 4 // length
+	out := make([]byte, messageLength+1)
+
+	idx := 0
+	idx = parsing.WriteByte(out, idx, byte(FMESSAGE_TERMINATE))
+	parsing.WriteInt32(out, idx, messageLength)
+
+	return out
+}
+
 const (
 	CANCEL_REQUEST_CODE int = 80877102
 )
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Headers of the HAProxy PROXY protocol sent by load balancers ahead of
+// the client's own traffic. See
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	PROXY_V1_PREFIX     = "PROXY "
+	PROXY_V1_MAX_LENGTH = 107
+	PROXY_V2_HEADER_LEN = 16
+
+	PROXY_V2_COMMAND_LOCAL = 0x0
+	PROXY_V2_COMMAND_PROXY = 0x1
+
+	PROXY_V2_FAMILY_UNSPEC = 0x0
+	PROXY_V2_FAMILY_INET   = 0x1
+	PROXY_V2_FAMILY_INET6  = 0x2
+	PROXY_V2_FAMILY_UNIX   = 0x3
+)
+
+var PROXY_V2_SIGNATURE = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+type ProxyHeader struct {
+	Version int
+	// The connection was made by the load balancer itself, e.g. for a
+	// health check, and carries no client address
+	Local           bool
+	SourceAddr      net.Addr
+	DestinationAddr net.Addr
+}
+
+// Reads a PROXY protocol v1 or v2 header off the connection. Exactly the
+// bytes of the header are consumed
+func ReadProxyHeader(reader io.Reader) (*ProxyHeader, error) {
+	prefix := make([]byte, len(PROXY_V1_PREFIX))
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+	if string(prefix) == PROXY_V1_PREFIX {
+		return readProxyHeaderV1(reader)
+	}
+	if bytes.Equal(prefix, PROXY_V2_SIGNATURE[:len(prefix)]) {
+		return readProxyHeaderV2(reader, prefix)
+	}
+	return nil, fmt.Errorf("%w: missing signature", ErrInvalidProxyHeader)
+}
+
+func readProxyHeaderV1(reader io.Reader) (*ProxyHeader, error) {
+	// The line has to be read one byte at a time so nothing after the
+	// header is consumed
+	line := make([]byte, 0, PROXY_V1_MAX_LENGTH)
+	line = append(line, PROXY_V1_PREFIX...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXY_V1_MAX_LENGTH {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+		}
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidProxyHeader)
+	}
+	source, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.SourceAddr = source
+	header.DestinationAddr = destination
+	return header, nil
+}
+
+func parseProxyV1Addr(ip string, port string) (*net.TCPAddr, error) {
+	parsedIp := net.ParseIP(ip)
+	parsedPort, err := strconv.Atoi(port)
+	if parsedIp == nil || err != nil || parsedPort < 0 || parsedPort > 65535 {
+		return nil, fmt.Errorf("%w: invalid address %s:%s", ErrInvalidProxyHeader, ip, port)
+	}
+	return &net.TCPAddr{IP: parsedIp, Port: parsedPort}, nil
+}
+
+func readProxyHeaderV2(reader io.Reader, prefix []byte) (*ProxyHeader, error) {
+	fixed := make([]byte, PROXY_V2_HEADER_LEN)
+	copy(fixed, prefix)
+	if _, err := io.ReadFull(reader, fixed[len(prefix):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:len(PROXY_V2_SIGNATURE)], PROXY_V2_SIGNATURE) {
+		return nil, fmt.Errorf("%w: bad v2 signature", ErrInvalidProxyHeader)
+	}
+	versionCommand := fixed[12]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+	family := fixed[13] >> 4
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch versionCommand & 0x0F {
+	case PROXY_V2_COMMAND_LOCAL:
+		header.Local = true
+		return header, nil
+	case PROXY_V2_COMMAND_PROXY:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidProxyHeader, versionCommand&0x0F)
+	}
+
+	switch family {
+	case PROXY_V2_FAMILY_INET:
+		if length < 12 {
+			return nil, fmt.Errorf("%w: short v2 address block", ErrInvalidProxyHeader)
+		}
+		header.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.DestinationAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case PROXY_V2_FAMILY_INET6:
+		if length < 36 {
+			return nil, fmt.Errorf("%w: short v2 address block", ErrInvalidProxyHeader)
+		}
+		header.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.DestinationAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	case PROXY_V2_FAMILY_UNIX:
+		if length < 216 {
+			return nil, fmt.Errorf("%w: short v2 address block", ErrInvalidProxyHeader)
+		}
+		header.SourceAddr = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+		header.DestinationAddr = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+	default:
+		// Unspecified family, the addresses are unknown
+		header.Local = true
+	}
+	return header, nil
+}
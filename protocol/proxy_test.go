@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	reader := bytes.NewReader([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 5432\r\nstartup"))
+	header, err := ReadProxyHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 1 || header.Local || header.SourceAddr.String() != "203.0.113.7:51234" {
+		t.Fatalf("Unexpected header %+v", header)
+	}
+	rest := make([]byte, reader.Len())
+	reader.Read(rest)
+	if string(rest) != "startup" {
+		t.Fatalf("Header read consumed the following bytes, left %q", rest)
+	}
+
+	header, err = ReadProxyHeader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n")))
+	if err != nil || !header.Local {
+		t.Fatalf("Expected a local header, got %+v %v", header, err)
+	}
+
+	for _, line := range []string{"PROXY TCP4 nonsense\r\n", "PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n", "GET / HTTP/1.1\r\n"} {
+		if _, err := ReadProxyHeader(bytes.NewReader([]byte(line))); !errors.Is(err, ErrInvalidProxyHeader) {
+			t.Fatalf("Expected invalid header error for %q, got %v", line, err)
+		}
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, 0x21, PROXY_V2_FAMILY_INET<<4|0x1)
+	header = binary.BigEndian.AppendUint16(header, 12+5)
+	header = append(header, 198, 51, 100, 9, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, 40000)
+	header = binary.BigEndian.AppendUint16(header, 5432)
+	// A TLV the proxy does not use
+	header = append(header, 0x04, 0x00, 0x02, 0xaa, 0xbb)
+
+	reader := bytes.NewReader(append(header, "startup"...))
+	parsed, err := ReadProxyHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Version != 2 || parsed.Local || parsed.SourceAddr.String() != "198.51.100.9:40000" {
+		t.Fatalf("Unexpected header %+v", parsed)
+	}
+	if reader.Len() != len("startup") {
+		t.Fatalf("Header read left %d bytes, expected %d", reader.Len(), len("startup"))
+	}
+
+	local := append([]byte{}, PROXY_V2_SIGNATURE...)
+	local = append(local, 0x20, 0x00, 0x00, 0x00)
+	parsed, err = ReadProxyHeader(bytes.NewReader(local))
+	if err != nil || !parsed.Local {
+		t.Fatalf("Expected a local header, got %+v %v", parsed, err)
+	}
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
@@ -33,7 +34,23 @@ func handleSSLRequest(conn net.Conn) error {
 	return nil
 }
 
-func GetRawStartupPgMessage(conn net.Conn) (*RawPgMessage, error) {
+// Reads the first message of a connection. When the connection comes
+// from a trusted load balancer the PROXY protocol header it sends ahead
+// of the message is read first and returned
+func GetRawStartupPgMessage(conn net.Conn, expectProxyHeader bool) (*RawPgMessage, *ProxyHeader, error) {
+	var proxyHeader *ProxyHeader
+	if expectProxyHeader {
+		header, err := ReadProxyHeader(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		proxyHeader = header
+	}
+	message, err := getRawStartupPgMessage(conn)
+	return message, proxyHeader, err
+}
+
+func getRawStartupPgMessage(conn net.Conn) (*RawPgMessage, error) {
 	length, err := parsing.ReadInt32(conn)
 	if err != nil {
 		return nil, err
@@ -69,6 +86,21 @@ func GetRawStartupPgMessage(conn net.Conn) (*RawPgMessage, error) {
 	return &RawPgMessage{FMESSAGE_STARTUP, messageLength, ctxData}, nil
 }
 
+// Reads the kind and length of the next message into header, which
+// must hold at least 5 bytes. The body is left on the reader so it can
+// be copied elsewhere without being buffered. The length includes the 4
+// bytes of the length itself like RawPgMessage.Length
+func ReadPgMessageHeader(reader io.Reader, header []byte) (int, int, error) {
+	if _, err := io.ReadFull(reader, header[:5]); err != nil {
+		return 0, 0, err
+	}
+	_, length := parsing.ParseInt32(header, 1)
+	if length < 4 {
+		return 0, 0, fmt.Errorf("invalid message length %d", length)
+	}
+	return int(header[0]), length, nil
+}
+
 // Reads a raw message from a connection
 func GetRawPgMessage(conn io.Reader) (*RawPgMessage, error) {
 	header := make([]byte, 5)
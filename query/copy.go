@@ -0,0 +1,240 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	COPY_FORMAT_TEXT   = "text"
+	COPY_FORMAT_CSV    = "csv"
+	COPY_FORMAT_BINARY = "binary"
+)
+
+// The parts of a COPY statement needed to route its data
+type CopyStatement struct {
+	// The table as written in the statement, quoting included
+	Relation string
+	Schema   string
+	Table    string
+	Columns  []string
+	// COPY (SELECT ...) TO copies the result of a query instead of a table
+	Query bool
+	// The text of the query copied
+	QueryText string
+	// FROM copies data into the table, TO copies it out
+	From bool
+	// The data is sent over the connection rather than read from or
+	// written to a file or program on the server
+	Stdio     bool
+	Format    string
+	Delimiter byte
+	Null      string
+	Header    bool
+	Quote     byte
+	Escape    byte
+}
+
+// Parse a COPY statement. Both the current option list syntax and the
+// syntax from before Postgres 9.0 are understood
+func ParseCopy(statement *Statement) (*CopyStatement, error) {
+	if statement.Kind != KIND_COPY {
+		return nil, fmt.Errorf("statement is not a COPY: %s", statement)
+	}
+	tokens := statement.Tokens
+	parsed := &CopyStatement{Format: COPY_FORMAT_TEXT}
+	idx := 1
+	if idx < len(tokens) && tokens[idx].IsKeyword("BINARY") {
+		parsed.Format = COPY_FORMAT_BINARY
+		idx++
+	}
+	if idx >= len(tokens) {
+		return nil, errors.New("COPY is missing a table")
+	}
+
+	if tokens[idx].IsPunct("(") {
+		parsed.Query = true
+		end, err := closingParen(tokens, idx)
+		if err != nil {
+			return nil, err
+		}
+		if end > idx+1 {
+			parsed.QueryText = statement.Text[tokens[idx+1].Start-tokens[0].Start : tokens[end-1].End-tokens[0].Start]
+		}
+		idx = end + 1
+	} else {
+		start := idx
+		names := make([]string, 0, 2)
+		for idx < len(tokens) && (tokens[idx].Kind == TOKEN_IDENT || tokens[idx].Kind == TOKEN_QUOTED_IDENT) {
+			names = append(names, tokens[idx].Name())
+			idx++
+			if idx < len(tokens) && tokens[idx].IsPunct(".") {
+				idx++
+				continue
+			}
+			break
+		}
+		if len(names) == 0 || len(names) > 2 {
+			return nil, errors.New("COPY has an invalid table name")
+		}
+		parsed.Relation = statement.Text[tokens[start].Start-tokens[0].Start : tokens[idx-1].End-tokens[0].Start]
+		parsed.Table = names[len(names)-1]
+		if len(names) == 2 {
+			parsed.Schema = names[0]
+		}
+		if idx < len(tokens) && tokens[idx].IsPunct("(") {
+			end, err := closingParen(tokens, idx)
+			if err != nil {
+				return nil, err
+			}
+			for _, token := range tokens[idx+1 : end] {
+				if !token.IsPunct(",") {
+					parsed.Columns = append(parsed.Columns, token.Name())
+				}
+			}
+			idx = end + 1
+		}
+	}
+
+	if idx >= len(tokens) || !(tokens[idx].IsKeyword("FROM") || tokens[idx].IsKeyword("TO")) {
+		return nil, errors.New("COPY is missing FROM or TO")
+	}
+	parsed.From = tokens[idx].IsKeyword("FROM")
+	idx++
+	if idx >= len(tokens) {
+		return nil, errors.New("COPY is missing a source or destination")
+	}
+	parsed.Stdio = tokens[idx].IsKeyword("STDIN") || tokens[idx].IsKeyword("STDOUT")
+	if tokens[idx].IsKeyword("PROGRAM") {
+		idx++
+	}
+	idx++
+
+	if idx < len(tokens) && tokens[idx].IsKeyword("WITH") {
+		idx++
+	}
+	if idx < len(tokens) && tokens[idx].IsPunct("(") {
+		end, err := closingParen(tokens, idx)
+		if err != nil {
+			return nil, err
+		}
+		if err := parsed.parseOptions(tokens[idx+1:end], ","); err != nil {
+			return nil, err
+		}
+	} else if err := parsed.parseOptions(tokens[idx:], ""); err != nil {
+		return nil, err
+	}
+
+	if parsed.Delimiter == 0 {
+		parsed.Delimiter = '\t'
+		if parsed.Format == COPY_FORMAT_CSV {
+			parsed.Delimiter = ','
+		}
+	}
+	if parsed.Quote == 0 {
+		parsed.Quote = '"'
+	}
+	if parsed.Escape == 0 {
+		parsed.Escape = parsed.Quote
+	}
+	if parsed.Null == "" && parsed.Format == COPY_FORMAT_TEXT {
+		parsed.Null = `\N`
+	}
+	return parsed, nil
+}
+
+// Parse a list of options. Options are separated by separator in the
+// current syntax and follow each other in the old one
+func (c *CopyStatement) parseOptions(tokens []Token, separator string) error {
+	idx := 0
+	next := func() (Token, bool) {
+		for idx < len(tokens) && (tokens[idx].IsKeyword("AS") || (separator != "" && tokens[idx].IsPunct(separator))) {
+			idx++
+		}
+		if idx >= len(tokens) {
+			return Token{}, false
+		}
+		idx++
+		return tokens[idx-1], true
+	}
+	char := func(option string, value Token, ok bool) (byte, error) {
+		if !ok || value.Kind != TOKEN_STRING || len(value.Value) != 1 {
+			return 0, fmt.Errorf("COPY %s must be a single one-byte character", option)
+		}
+		return value.Value[0], nil
+	}
+
+	for {
+		option, ok := next()
+		if !ok {
+			return nil
+		}
+		if option.Kind != TOKEN_IDENT {
+			continue
+		}
+		var err error
+		switch strings.ToUpper(option.Value) {
+		case "FORMAT":
+			value, ok := next()
+			if !ok {
+				return errors.New("COPY FORMAT is missing a value")
+			}
+			c.Format = strings.ToLower(value.Value)
+		case "BINARY":
+			c.Format = COPY_FORMAT_BINARY
+		case "CSV":
+			c.Format = COPY_FORMAT_CSV
+		case "HEADER":
+			c.Header = true
+			// HEADER takes an optional boolean in the current syntax
+			if separator != "" && idx < len(tokens) && !tokens[idx].IsPunct(separator) {
+				value, _ := next()
+				c.Header = !(value.IsKeyword("false") || value.IsKeyword("off") || value.Value == "0")
+			}
+		case "DELIMITER":
+			value, ok := next()
+			c.Delimiter, err = char("DELIMITER", value, ok)
+		case "QUOTE":
+			value, ok := next()
+			c.Quote, err = char("QUOTE", value, ok)
+		case "ESCAPE":
+			value, ok := next()
+			c.Escape, err = char("ESCAPE", value, ok)
+		case "NULL":
+			value, ok := next()
+			if !ok || value.Kind != TOKEN_STRING {
+				return errors.New("COPY NULL must be a string")
+			}
+			c.Null = value.Value
+		default:
+			// Skip the column list of options like FORCE_QUOTE
+			if idx < len(tokens) && tokens[idx].IsPunct("(") {
+				end, err := closingParen(tokens, idx)
+				if err != nil {
+					return err
+				}
+				idx = end + 1
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Find the index of the parenthesis closing the one at start
+func closingParen(tokens []Token, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		if tokens[i].IsPunct("(") {
+			depth++
+		} else if tokens[i].IsPunct(")") {
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("unbalanced parentheses")
+}
@@ -0,0 +1,58 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Comments starting with the prefix are read by the proxy
+const HINT_PREFIX = "pgspanner:"
+
+// The clusters a query asks to run on through a comment in front of it
+type Hint struct {
+	// The cluster in the order of the configuration, counting from 1.
+	// 0 when not given
+	Shard int
+	// The host:port of the cluster
+	Cluster string
+	// Run on every cluster
+	All bool
+}
+
+// Read a hint like /* pgspanner: shard=2 */ in a block comment at the
+// start of a query. Returns the query without the comment. Queries
+// starting with another comment are returned unchanged with no hint
+func ParseHint(sql string) (*Hint, string, error) {
+	start := len(sql) - len(strings.TrimLeft(sql, " \t\n\r\f"))
+	if !strings.HasPrefix(sql[start:], "/*") {
+		return nil, sql, nil
+	}
+	end, err := skipBlockComment(sql, start)
+	if err != nil {
+		return nil, sql, nil
+	}
+	body := strings.TrimSpace(sql[start+2 : end-2])
+	if len(body) < len(HINT_PREFIX) || !strings.EqualFold(body[:len(HINT_PREFIX)], HINT_PREFIX) {
+		return nil, sql, nil
+	}
+	text := strings.TrimSpace(body[len(HINT_PREFIX):])
+
+	hint := &Hint{}
+	name, value, hasValue := strings.Cut(text, "=")
+	name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+	switch {
+	case name == "all" && !hasValue:
+		hint.All = true
+	case name == "shard" && hasValue:
+		hint.Shard, err = strconv.Atoi(value)
+		if err != nil || hint.Shard < 1 {
+			return nil, sql, fmt.Errorf("shard of hint %q must be a number from 1", text)
+		}
+	case name == "cluster" && hasValue && value != "":
+		hint.Cluster = value
+	default:
+		return nil, sql, fmt.Errorf("hint %q must be one of shard=<n>, cluster=<host:port> or all", text)
+	}
+	return hint, sql[:start] + sql[end:], nil
+}
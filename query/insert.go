@@ -0,0 +1,190 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The parts of an INSERT statement needed to add a column to it. Offsets
+// are byte offsets in the original query
+type InsertStatement struct {
+	Schema  string
+	Table   string
+	Columns []string
+	// Offset just after the parenthesis opening the column list. -1 when
+	// the statement has no column list
+	ColumnsStart int
+	// Offsets just after the parenthesis opening each row of the VALUES
+	// list. Empty for INSERT ... SELECT and DEFAULT VALUES
+	Rows []int
+	// Offsets just after the parenthesis closing each row
+	RowsEnd []int
+	// The tokens of the expressions of each row of the VALUES list
+	Values [][][]Token
+	// The statement has an ON CONFLICT ... DO UPDATE clause
+	Upsert bool
+}
+
+// Parse an INSERT statement, including one inside of a CTE
+func ParseInsert(statement *Statement) (*InsertStatement, error) {
+	if statement.Kind != KIND_INSERT {
+		return nil, fmt.Errorf("statement is not an INSERT: %s", statement)
+	}
+	tokens := statement.Tokens
+	idx := 0
+	depth := 0
+	for ; idx < len(tokens); idx++ {
+		if tokens[idx].IsPunct("(") {
+			depth++
+		} else if tokens[idx].IsPunct(")") {
+			depth--
+		} else if depth == 0 && tokens[idx].IsKeyword("INSERT") {
+			break
+		}
+	}
+	idx++
+	if idx >= len(tokens) || !tokens[idx].IsKeyword("INTO") {
+		return nil, errors.New("INSERT is missing INTO")
+	}
+	idx++
+
+	parsed := &InsertStatement{ColumnsStart: -1}
+	names := make([]string, 0, 2)
+	for idx < len(tokens) && (tokens[idx].Kind == TOKEN_IDENT || tokens[idx].Kind == TOKEN_QUOTED_IDENT) {
+		names = append(names, tokens[idx].Name())
+		idx++
+		if idx < len(tokens) && tokens[idx].IsPunct(".") {
+			idx++
+			continue
+		}
+		break
+	}
+	if len(names) == 0 || len(names) > 2 {
+		return nil, errors.New("INSERT has an invalid table name")
+	}
+	parsed.Table = names[len(names)-1]
+	if len(names) == 2 {
+		parsed.Schema = names[0]
+	}
+
+	// Skip the alias
+	if idx < len(tokens) && tokens[idx].IsKeyword("AS") {
+		idx += 2
+	}
+	if idx < len(tokens) && tokens[idx].IsPunct("(") {
+		end, err := closingParen(tokens, idx)
+		if err != nil {
+			return nil, err
+		}
+		parsed.ColumnsStart = tokens[idx].End
+		parsed.Columns = make([]string, 0, (end-idx)/2)
+		for _, token := range tokens[idx+1 : end] {
+			if !token.IsPunct(",") {
+				parsed.Columns = append(parsed.Columns, token.Name())
+			}
+		}
+		idx = end + 1
+	}
+
+	// OVERRIDING { SYSTEM | USER } VALUE
+	if idx < len(tokens) && tokens[idx].IsKeyword("OVERRIDING") {
+		idx += 3
+	}
+	if idx >= len(tokens) || !tokens[idx].IsKeyword("VALUES") {
+		return parsed, nil
+	}
+	idx++
+	for idx < len(tokens) && tokens[idx].IsPunct("(") {
+		end, err := closingParen(tokens, idx)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Rows = append(parsed.Rows, tokens[idx].End)
+		parsed.RowsEnd = append(parsed.RowsEnd, tokens[end].End)
+		parsed.Values = append(parsed.Values, splitList(tokens[idx+1:end]))
+		idx = end + 1
+		if idx >= len(tokens) || !tokens[idx].IsPunct(",") {
+			break
+		}
+		idx++
+	}
+	for ; idx+1 < len(tokens); idx++ {
+		if tokens[idx].IsKeyword("DO") && tokens[idx+1].IsKeyword("UPDATE") {
+			parsed.Upsert = true
+		}
+	}
+	return parsed, nil
+}
+
+// Split a list of expressions at its top level commas
+func splitList(tokens []Token) [][]Token {
+	items := make([][]Token, 0, 4)
+	start := 0
+	depth := 0
+	for i, token := range tokens {
+		if token.IsPunct("(") || token.IsPunct("[") {
+			depth++
+		} else if token.IsPunct(")") || token.IsPunct("]") {
+			depth--
+		} else if depth == 0 && token.IsPunct(",") {
+			items = append(items, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, tokens[start:])
+}
+
+// Whether the statement lists the column
+func (i *InsertStatement) HasColumn(column string) bool {
+	for _, c := range i.Columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// A call to a function in a statement
+type FunctionCall struct {
+	// Byte offsets of the call in the original query, from the start of
+	// the function name to the closing parenthesis
+	Start int
+	End   int
+	// The tokens of each argument
+	Args [][]Token
+}
+
+// Find the calls to a function qualified with the schema
+func FindFunctionCalls(statement *Statement, schema string, function string) ([]FunctionCall, error) {
+	tokens := statement.Tokens
+	calls := make([]FunctionCall, 0)
+	for i := 0; i+3 < len(tokens); i++ {
+		if tokens[i].Kind != TOKEN_IDENT || tokens[i].Name() != schema || !tokens[i+1].IsPunct(".") ||
+			tokens[i+2].Name() != function || !tokens[i+3].IsPunct("(") {
+			continue
+		}
+		end, err := closingParen(tokens, i+3)
+		if err != nil {
+			return nil, err
+		}
+		call := FunctionCall{Start: tokens[i].Start, End: tokens[end].End, Args: make([][]Token, 0, 1)}
+		argStart := i + 4
+		depth := 0
+		for j := i + 4; j < end; j++ {
+			if tokens[j].IsPunct("(") {
+				depth++
+			} else if tokens[j].IsPunct(")") {
+				depth--
+			} else if depth == 0 && tokens[j].IsPunct(",") {
+				call.Args = append(call.Args, tokens[argStart:j])
+				argStart = j + 1
+			}
+		}
+		if argStart < end {
+			call.Args = append(call.Args, tokens[argStart:end])
+		}
+		calls = append(calls, call)
+		i = end
+	}
+	return calls, nil
+}
@@ -0,0 +1,173 @@
+package query
+
+// A column qualified with the table or alias it belongs to
+type ColumnRef struct {
+	Qualifier string
+	Column    string
+}
+
+// A condition equating a column of one table with a column of another
+type JoinEquality struct {
+	Left  ColumnRef
+	Right ColumnRef
+}
+
+// Keywords ending an ON or WHERE condition
+var conditionEndKeywords = []string{
+	"JOIN", "LEFT", "RIGHT", "INNER", "FULL", "CROSS", "NATURAL", "WHERE", "GROUP", "ORDER",
+	"LIMIT", "OFFSET", "FETCH", "HAVING", "WINDOW", "UNION", "EXCEPT", "INTERSECT", "FOR", "RETURNING",
+}
+
+// Keywords that may come between a table and the JOIN keyword after it
+var joinTypeKeywords = []string{"LEFT", "RIGHT", "FULL", "INNER", "OUTER"}
+
+// Find the conditions equating qualified columns that every row of the
+// statement satisfies. They come from ON and WHERE conditions, including
+// those of subqueries, whose conditions are joined by AND alone, and from
+// JOIN ... USING lists. Conditions of a clause using OR are left out
+func JoinEqualities(statement *Statement) []JoinEquality {
+	tokens := statement.Tokens
+	equalities := make([]JoinEquality, 0, 2)
+	for i, token := range tokens {
+		switch {
+		case token.IsKeyword("ON"), token.IsKeyword("WHERE"):
+			equalities = append(equalities, conditionEqualities(tokens[i+1:])...)
+		case token.IsKeyword("USING") && i+1 < len(tokens) && tokens[i+1].IsPunct("("):
+			equalities = append(equalities, usingEqualities(tokens, i)...)
+		}
+	}
+	return equalities
+}
+
+// Read the column = column conjuncts of the condition the tokens start with
+func conditionEqualities(tokens []Token) []JoinEquality {
+	end := len(tokens)
+	depth := 0
+	for i, token := range tokens {
+		if token.IsPunct("(") {
+			depth++
+		} else if token.IsPunct(")") {
+			depth--
+		}
+		if depth < 0 || depth == 0 && (token.IsPunct(",") || isConditionEnd(token)) {
+			end = i
+			break
+		}
+	}
+
+	equalities := make([]JoinEquality, 0, 1)
+	conjunctStart := 0
+	for i := 0; i <= end; i++ {
+		if i < end && tokens[i].IsPunct("(") {
+			closing, err := closingParen(tokens, i)
+			if err != nil {
+				return nil
+			}
+			i = closing
+			continue
+		}
+		if i < end && tokens[i].IsKeyword("OR") {
+			return nil
+		}
+		if i == end || tokens[i].IsKeyword("AND") {
+			if equality, ok := parseJoinEquality(tokens[conjunctStart:i]); ok {
+				equalities = append(equalities, equality)
+			}
+			conjunctStart = i + 1
+		}
+	}
+	return equalities
+}
+
+func isConditionEnd(token Token) bool {
+	for _, keyword := range conditionEndKeywords {
+		if token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a conjunct of the form qualifier.column = qualifier.column
+func parseJoinEquality(tokens []Token) (JoinEquality, bool) {
+	if len(tokens) != 7 || !tokens[3].IsOperator("=") {
+		return JoinEquality{}, false
+	}
+	left, ok := parseQualifiedColumn(tokens[:3])
+	if !ok {
+		return JoinEquality{}, false
+	}
+	right, ok := parseQualifiedColumn(tokens[4:])
+	if !ok {
+		return JoinEquality{}, false
+	}
+	return JoinEquality{left, right}, true
+}
+
+func parseQualifiedColumn(tokens []Token) (ColumnRef, bool) {
+	isName := func(token Token) bool {
+		return token.Kind == TOKEN_IDENT || token.Kind == TOKEN_QUOTED_IDENT
+	}
+	if !isName(tokens[0]) || !tokens[1].IsPunct(".") || !isName(tokens[2]) {
+		return ColumnRef{}, false
+	}
+	return ColumnRef{Qualifier: tokens[0].Name(), Column: tokens[2].Name()}, true
+}
+
+// Read the columns of a USING list as conditions equating the column of
+// the table joined with the one of the table before the JOIN
+func usingEqualities(tokens []Token, using int) []JoinEquality {
+	closing, err := closingParen(tokens, using+1)
+	if err != nil {
+		return nil
+	}
+	join := -1
+	for i := using - 1; i >= 0; i-- {
+		if tokens[i].IsKeyword("JOIN") {
+			join = i
+			break
+		}
+	}
+	if join < 0 {
+		return nil
+	}
+	joined := readTableList(tokens, join+1, false, true)
+	if len(joined) == 0 {
+		return nil
+	}
+	right := joined[0].Table
+	if joined[0].Alias != "" {
+		right = joined[0].Alias
+	}
+
+	// The table before the JOIN is named by its alias or its name
+	before := join - 1
+	for before >= 0 && isJoinType(tokens[before]) {
+		before--
+	}
+	if before < 0 || (tokens[before].Kind != TOKEN_IDENT && tokens[before].Kind != TOKEN_QUOTED_IDENT) {
+		return nil
+	}
+	left := tokens[before].Name()
+
+	equalities := make([]JoinEquality, 0, 1)
+	for _, column := range tokens[using+2 : closing] {
+		if column.IsPunct(",") {
+			continue
+		}
+		equalities = append(equalities, JoinEquality{
+			Left:  ColumnRef{Qualifier: left, Column: column.Name()},
+			Right: ColumnRef{Qualifier: right, Column: column.Name()},
+		})
+	}
+	return equalities
+}
+
+func isJoinType(token Token) bool {
+	for _, keyword := range joinTypeKeywords {
+		if token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
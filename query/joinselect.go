@@ -0,0 +1,221 @@
+package query
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A SELECT joining two tables on equal columns. The proxy can run it by
+// reading each table on its own and joining the rows itself
+type JoinSelect struct {
+	Tables [2]TableRef
+	// The items of the select list in order
+	Items []JoinItem
+	// Columns of each table the rows are joined on, pairwise equal
+	Keys [2][]string
+	// Conditions using a single table, as written
+	Filters [2][]string
+}
+
+// An item of the select list using the columns of a single table
+type JoinItem struct {
+	// Index of the table in Tables
+	Table int
+	// The item as written, alias included
+	Text string
+	// The item is table.*
+	Star bool
+}
+
+// Clauses that need every joined row at once or change which tables
+// are read
+var joinSelectUnsupported = []string{
+	"DISTINCT", "GROUP", "ORDER", "LIMIT", "OFFSET", "FETCH", "HAVING", "WINDOW", "UNION", "EXCEPT",
+	"INTERSECT", "FOR", "INTO", "LEFT", "RIGHT", "FULL", "CROSS", "NATURAL", "USING", "LATERAL",
+}
+
+// Read a SELECT of two tables joined on equal columns. The error says
+// why any other statement cannot be run as such a join
+func ParseJoinSelect(statement *Statement) (*JoinSelect, error) {
+	tokens := statement.Tokens
+	if statement.Kind != KIND_SELECT || !tokens[0].IsKeyword("SELECT") {
+		return nil, fmt.Errorf("only SELECT statements can be joined by the proxy")
+	}
+	tables := Tables(statement)
+	if len(tables) != 2 {
+		return nil, fmt.Errorf("the proxy only joins statements reading two tables")
+	}
+	join := &JoinSelect{Tables: [2]TableRef{tables[0], tables[1]}}
+
+	from, where, on := -1, -1, -1
+	depth := 0
+	for i, token := range tokens {
+		switch {
+		case token.IsPunct("("):
+			depth++
+		case token.IsPunct(")"):
+			depth--
+		case depth > 0:
+		case from == -1 && token.IsKeyword("FROM"):
+			from = i
+		case token.IsKeyword("ON"):
+			on = i
+		case token.IsKeyword("WHERE"):
+			where = i
+		default:
+			for _, keyword := range joinSelectUnsupported {
+				if token.IsKeyword(keyword) {
+					return nil, fmt.Errorf("the proxy cannot join statements using %s", keyword)
+				}
+			}
+		}
+	}
+	if from == -1 {
+		return nil, fmt.Errorf("the proxy only joins statements reading two tables")
+	}
+
+	for _, item := range splitList(tokens[1:from]) {
+		used, err := join.usedTables(item)
+		if err != nil {
+			return nil, err
+		}
+		text := tokenText(statement, item)
+		if len(used) != 1 {
+			return nil, fmt.Errorf("select list item %s must use the columns of exactly one table", text)
+		}
+		star := len(item) == 3 && item[2].IsOperator("*")
+		// The fields of a table not named by other items are all its star
+		// stands for, a second star would have none left
+		if star && slices.ContainsFunc(join.Items, func(other JoinItem) bool { return other.Star && other.Table == used[0] }) {
+			return nil, fmt.Errorf("select list item %s may only appear once", text)
+		}
+		join.Items = append(join.Items, JoinItem{Table: used[0], Text: text, Star: star})
+	}
+
+	// Conditions follow ON and WHERE and run to the end of the statement
+	conditions := make([][]Token, 0, 2)
+	if on != -1 {
+		end := len(tokens)
+		if where > on {
+			end = where
+		}
+		conditions = append(conditions, tokens[on+1:end])
+	}
+	if where != -1 {
+		conditions = append(conditions, tokens[where+1:])
+	}
+	for _, condition := range conditions {
+		conjuncts, err := splitConjuncts(condition)
+		if err != nil {
+			return nil, err
+		}
+		for _, conjunct := range conjuncts {
+			if err := join.addCondition(statement, conjunct); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(join.Keys[0]) == 0 {
+		return nil, fmt.Errorf("the proxy only joins tables on conditions equating a column of each")
+	}
+	return join, nil
+}
+
+// The name statements refer to a table by
+func (j *JoinSelect) TableName(table int) string {
+	if j.Tables[table].Alias != "" {
+		return j.Tables[table].Alias
+	}
+	return j.Tables[table].Table
+}
+
+// Find which of the two tables an expression uses through qualified
+// column references
+func (j *JoinSelect) usedTables(tokens []Token) ([]int, error) {
+	used := make([]int, 0, 2)
+	for i := 0; i+2 < len(tokens); i++ {
+		if (tokens[i].Kind != TOKEN_IDENT && tokens[i].Kind != TOKEN_QUOTED_IDENT) || !tokens[i+1].IsPunct(".") ||
+			(i > 0 && tokens[i-1].IsPunct(".")) {
+			continue
+		}
+		table := -1
+		for t := range j.Tables {
+			if tokens[i].Name() == j.TableName(t) {
+				table = t
+			}
+		}
+		switch {
+		case table == -1 && i+3 < len(tokens) && tokens[i+3].IsPunct("("):
+			// A function qualified with its schema
+		case table == -1:
+			return nil, fmt.Errorf("%s is not one of the joined tables", tokens[i].Name())
+		case !slices.Contains(used, table):
+			used = append(used, table)
+		}
+	}
+	return used, nil
+}
+
+// Add a conjunct of the ON or WHERE conditions as a join key or as a
+// filter of the table it uses
+func (j *JoinSelect) addCondition(statement *Statement, conjunct []Token) error {
+	used, err := j.usedTables(conjunct)
+	if err != nil {
+		return err
+	}
+	text := tokenText(statement, conjunct)
+	switch len(used) {
+	case 0:
+		return fmt.Errorf("condition %s must qualify its columns with the table they belong to", text)
+	case 1:
+		j.Filters[used[0]] = append(j.Filters[used[0]], text)
+		return nil
+	}
+	equality, ok := parseJoinEquality(conjunct)
+	if !ok {
+		return fmt.Errorf("condition %s using both tables must equate a column of each", text)
+	}
+	left, right := equality.Left.Column, equality.Right.Column
+	if equality.Left.Qualifier != j.TableName(0) {
+		left, right = right, left
+	}
+	j.Keys[0] = append(j.Keys[0], left)
+	j.Keys[1] = append(j.Keys[1], right)
+	return nil
+}
+
+// Split a condition on the ANDs joining it. BETWEEN keeps its AND
+func splitConjuncts(tokens []Token) ([][]Token, error) {
+	conjuncts := make([][]Token, 0, 2)
+	start := 0
+	depth := 0
+	between := false
+	for i, token := range tokens {
+		switch {
+		case token.IsPunct("("):
+			depth++
+		case token.IsPunct(")"):
+			depth--
+		case depth > 0:
+		case token.IsKeyword("OR"):
+			return nil, fmt.Errorf("the proxy cannot join statements with OR conditions")
+		case token.IsKeyword("BETWEEN"):
+			between = true
+		case token.IsKeyword("AND") && between:
+			between = false
+		case token.IsKeyword("AND"):
+			conjuncts = append(conjuncts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(conjuncts, tokens[start:]), nil
+}
+
+// The text of the statement the tokens span
+func tokenText(statement *Statement, tokens []Token) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	base := statement.Tokens[0].Start
+	return statement.Text[tokens[0].Start-base : tokens[len(tokens)-1].End-base]
+}
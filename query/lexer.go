@@ -0,0 +1,292 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+/// A small lexer for the subset of the Postgres SQL grammar pgspanner needs
+/// to understand in order to route queries. Lexical rules are described at
+/// https://www.postgresql.org/docs/current/sql-syntax-lexical.html
+
+type TokenKind int
+
+const (
+	TOKEN_IDENT        TokenKind = iota // Keywords and unquoted identifiers
+	TOKEN_QUOTED_IDENT                  // "Quoted" identifiers
+	TOKEN_STRING                        // String constants in any quoting style
+	TOKEN_NUMBER                        // Numeric constants
+	TOKEN_PARAM                         // Positional parameters like $1
+	TOKEN_OPERATOR                      // Operators like =, <>, ::
+	TOKEN_PUNCT                         // One of ( ) [ ] , ; . :
+)
+
+type Token struct {
+	Kind  TokenKind
+	Value string
+	// Byte offsets of the token in the original query
+	Start int
+	End   int
+}
+
+// Whether the token is the given keyword. Keywords are case insensitive
+func (t Token) IsKeyword(keyword string) bool {
+	return t.Kind == TOKEN_IDENT && strings.EqualFold(t.Value, keyword)
+}
+
+func (t Token) IsPunct(punct string) bool {
+	return t.Kind == TOKEN_PUNCT && t.Value == punct
+}
+
+func (t Token) IsOperator(operator string) bool {
+	return t.Kind == TOKEN_OPERATOR && t.Value == operator
+}
+
+// The name an identifier refers to. Unquoted identifiers are folded to
+// lower case like postgres does
+func (t Token) Name() string {
+	if t.Kind == TOKEN_IDENT {
+		return strings.ToLower(t.Value)
+	}
+	return t.Value
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isOperatorChar(c byte) bool {
+	return strings.IndexByte("+-*/<>=~!@#%^&|`?", c) != -1
+}
+
+// Postgres does not end an operator of several characters with + or -
+// unless it has one of ~ ! @ # % ^ & | ` ?, so that id=-5 compares id to
+// -5. Returns where the operator starting at start ends
+func trimOperator(sql string, start int, end int) int {
+	if strings.ContainsAny(sql[start:end], "~!@#%^&|`?") {
+		return end
+	}
+	for end-start > 1 && (sql[end-1] == '+' || sql[end-1] == '-') {
+		end--
+	}
+	return end
+}
+
+// Tokenize a query. Whitespace and comments are dropped
+func Tokenize(sql string) ([]Token, error) {
+	tokens := make([]Token, 0, 32)
+	idx := 0
+	for idx < len(sql) {
+		c := sql[idx]
+		start := idx
+		switch {
+		case isSpace(c):
+			idx++
+		case strings.HasPrefix(sql[idx:], "--"):
+			end := strings.IndexByte(sql[idx:], '\n')
+			if end == -1 {
+				idx = len(sql)
+			} else {
+				idx += end + 1
+			}
+		case strings.HasPrefix(sql[idx:], "/*"):
+			end, err := skipBlockComment(sql, idx)
+			if err != nil {
+				return nil, err
+			}
+			idx = end
+		case (c == 'E' || c == 'e') && idx+1 < len(sql) && sql[idx+1] == '\'':
+			end, value, err := scanString(sql, idx+1, true)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{TOKEN_STRING, value, start, end})
+			idx = end
+		case c == '\'':
+			end, value, err := scanString(sql, idx, false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{TOKEN_STRING, value, start, end})
+			idx = end
+		case c == '"':
+			end, value, err := scanQuotedIdent(sql, idx)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{TOKEN_QUOTED_IDENT, value, start, end})
+			idx = end
+		case c == '$' && idx+1 < len(sql) && isDigit(sql[idx+1]):
+			idx++
+			for idx < len(sql) && isDigit(sql[idx]) {
+				idx++
+			}
+			tokens = append(tokens, Token{TOKEN_PARAM, sql[start:idx], start, idx})
+		case c == '$':
+			end, value, err := scanDollarString(sql, idx)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{TOKEN_STRING, value, start, end})
+			idx = end
+		case isIdentStart(c):
+			for idx < len(sql) && isIdentChar(sql[idx]) {
+				idx++
+			}
+			tokens = append(tokens, Token{TOKEN_IDENT, sql[start:idx], start, idx})
+		case isDigit(c) || (c == '.' && idx+1 < len(sql) && isDigit(sql[idx+1])):
+			idx = scanNumber(sql, idx)
+			tokens = append(tokens, Token{TOKEN_NUMBER, sql[start:idx], start, idx})
+		case c == ':' && idx+1 < len(sql) && sql[idx+1] == ':':
+			idx += 2
+			tokens = append(tokens, Token{TOKEN_OPERATOR, "::", start, idx})
+		case strings.IndexByte("()[],;.:", c) != -1:
+			idx++
+			tokens = append(tokens, Token{TOKEN_PUNCT, sql[start:idx], start, idx})
+		case isOperatorChar(c):
+			for idx < len(sql) && isOperatorChar(sql[idx]) {
+				if strings.HasPrefix(sql[idx:], "--") || strings.HasPrefix(sql[idx:], "/*") {
+					break
+				}
+				idx++
+			}
+			idx = trimOperator(sql, start, idx)
+			tokens = append(tokens, Token{TOKEN_OPERATOR, sql[start:idx], start, idx})
+		default:
+			return nil, fmt.Errorf("Unexpected character %q at position %d", c, idx)
+		}
+	}
+	return tokens, nil
+}
+
+// Block comments nest in postgres
+func skipBlockComment(sql string, idx int) (int, error) {
+	depth := 0
+	for idx < len(sql) {
+		if strings.HasPrefix(sql[idx:], "/*") {
+			depth++
+			idx += 2
+		} else if strings.HasPrefix(sql[idx:], "*/") {
+			depth--
+			idx += 2
+			if depth == 0 {
+				return idx, nil
+			}
+		} else {
+			idx++
+		}
+	}
+	return idx, fmt.Errorf("Unterminated block comment")
+}
+
+func scanString(sql string, idx int, escapes bool) (int, string, error) {
+	var value strings.Builder
+	idx++ // opening quote
+	for idx < len(sql) {
+		c := sql[idx]
+		switch {
+		case c == '\'' && idx+1 < len(sql) && sql[idx+1] == '\'':
+			value.WriteByte('\'')
+			idx += 2
+		case c == '\'':
+			return idx + 1, value.String(), nil
+		case c == '\\' && escapes && idx+1 < len(sql):
+			value.WriteByte(unescape(sql[idx+1]))
+			idx += 2
+		default:
+			value.WriteByte(c)
+			idx++
+		}
+	}
+	return idx, "", fmt.Errorf("Unterminated string constant")
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	default:
+		return c
+	}
+}
+
+func scanQuotedIdent(sql string, idx int) (int, string, error) {
+	var value strings.Builder
+	idx++ // opening quote
+	for idx < len(sql) {
+		c := sql[idx]
+		if c == '"' && idx+1 < len(sql) && sql[idx+1] == '"' {
+			value.WriteByte('"')
+			idx += 2
+		} else if c == '"' {
+			return idx + 1, value.String(), nil
+		} else {
+			value.WriteByte(c)
+			idx++
+		}
+	}
+	return idx, "", fmt.Errorf("Unterminated quoted identifier")
+}
+
+func scanDollarString(sql string, idx int) (int, string, error) {
+	end := idx + 1
+	for end < len(sql) && sql[end] != '$' {
+		if !isIdentChar(sql[end]) {
+			return idx, "", fmt.Errorf("Unexpected character %q at position %d", sql[idx], idx)
+		}
+		end++
+	}
+	if end == len(sql) {
+		return idx, "", fmt.Errorf("Unterminated dollar quote")
+	}
+	tag := sql[idx : end+1]
+	bodyStart := end + 1
+	bodyEnd := strings.Index(sql[bodyStart:], tag)
+	if bodyEnd == -1 {
+		return idx, "", fmt.Errorf("Unterminated dollar quoted string")
+	}
+	return bodyStart + bodyEnd + len(tag), sql[bodyStart : bodyStart+bodyEnd], nil
+}
+
+func scanNumber(sql string, idx int) int {
+	for idx < len(sql) && (isDigit(sql[idx]) || sql[idx] == '.' || sql[idx] == '_') {
+		// Avoid swallowing the range operator in array slices like a[1..2]
+		if sql[idx] == '.' && idx+1 < len(sql) && sql[idx+1] == '.' {
+			return idx
+		}
+		idx++
+	}
+	if idx < len(sql) && (sql[idx] == 'e' || sql[idx] == 'E') {
+		next := idx + 1
+		if next < len(sql) && (sql[next] == '+' || sql[next] == '-') {
+			next++
+		}
+		if next < len(sql) && isDigit(sql[next]) {
+			idx = next
+			for idx < len(sql) && isDigit(sql[idx]) {
+				idx++
+			}
+		}
+	}
+	return idx
+}
@@ -0,0 +1,43 @@
+package query
+
+import (
+	"slices"
+	"strings"
+)
+
+// Clauses of a SELECT that work on all of its rows at once
+var mergingClauses = []string{
+	"DISTINCT", "GROUP", "HAVING", "ORDER", "LIMIT", "OFFSET", "FETCH", "WINDOW", "UNION", "EXCEPT", "INTERSECT",
+}
+
+// Aggregate functions built into postgres
+var aggregateFunctions = []string{
+	"count", "sum", "avg", "min", "max", "array_agg", "string_agg", "json_agg", "jsonb_agg", "json_object_agg",
+	"jsonb_object_agg", "bool_and", "bool_or", "every", "bit_and", "bit_or", "bit_xor", "stddev", "stddev_pop",
+	"stddev_samp", "variance", "var_pop", "var_samp", "percentile_cont", "percentile_disc", "mode",
+}
+
+// Find the clause or aggregate at the top level of a SELECT that needs
+// all of its rows at once. Running such a SELECT on several shards and
+// putting their rows one after the other gives a different result.
+// Returns "" when there is none
+func MergingClause(statement *Statement) string {
+	tokens := statement.Tokens
+	depth := 0
+	for i, token := range tokens {
+		switch {
+		case token.IsPunct("("):
+			depth++
+		case token.IsPunct(")"):
+			depth--
+		case depth > 0 || token.Kind != TOKEN_IDENT:
+		case slices.ContainsFunc(mergingClauses, token.IsKeyword):
+			return strings.ToUpper(token.Value)
+		case token.IsKeyword("OVER"):
+			return "window function"
+		case i+1 < len(tokens) && tokens[i+1].IsPunct("(") && slices.Contains(aggregateFunctions, token.Name()):
+			return token.Name() + "()"
+		}
+	}
+	return ""
+}
@@ -1 +1,278 @@
 package query
+
+import (
+	"strings"
+)
+
+type StatementKind string
+
+const (
+	KIND_SELECT   StatementKind = "SELECT"
+	KIND_INSERT   StatementKind = "INSERT"
+	KIND_UPDATE   StatementKind = "UPDATE"
+	KIND_DELETE   StatementKind = "DELETE"
+	KIND_BEGIN    StatementKind = "BEGIN"
+	KIND_COMMIT   StatementKind = "COMMIT"
+	KIND_ROLLBACK StatementKind = "ROLLBACK"
+	KIND_SET      StatementKind = "SET"
+	KIND_SHOW     StatementKind = "SHOW"
+	KIND_EXPLAIN  StatementKind = "EXPLAIN"
+	KIND_COPY     StatementKind = "COPY"
+	KIND_DDL      StatementKind = "DDL"
+	KIND_OTHER    StatementKind = "OTHER"
+)
+
+// Functions that modify state even when called from a SELECT
+var writeFunctions = []string{
+	"nextval",
+	"setval",
+	"pg_advisory_lock",
+	"pg_advisory_xact_lock",
+	"pg_try_advisory_lock",
+	"pg_try_advisory_xact_lock",
+	"pg_notify",
+	"lo_create",
+	"lo_import",
+	"lo_unlink",
+	"set_config",
+}
+
+// A single statement in a query
+type Statement struct {
+	Kind   StatementKind
+	Tokens []Token
+	// The text of the statement in the original query
+	Text string
+	// The statement does not modify data and can be run on a replica
+	ReadOnly bool
+	// The statement starts a read only transaction or makes the current
+	// transaction read only
+	ReadOnlyTransaction bool
+}
+
+// Parse a query into its statements
+func Parse(sql string) ([]*Statement, error) {
+	tokens, err := Tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := make([]*Statement, 0, 1)
+	start := 0
+	for i, token := range tokens {
+		if token.IsPunct(";") {
+			if i > start {
+				statements = append(statements, newStatement(sql, tokens[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		statements = append(statements, newStatement(sql, tokens[start:]))
+	}
+	return statements, nil
+}
+
+func newStatement(sql string, tokens []Token) *Statement {
+	statement := &Statement{
+		Kind:   classify(tokens),
+		Tokens: tokens,
+		Text:   sql[tokens[0].Start:tokens[len(tokens)-1].End],
+	}
+	statement.ReadOnly = isReadOnly(statement.Kind, tokens)
+	statement.ReadOnlyTransaction = isReadOnlyTransaction(statement.Kind, tokens)
+	return statement
+}
+
+func classify(tokens []Token) StatementKind {
+	first := tokens[0]
+	switch {
+	case first.IsKeyword("SELECT"), first.IsKeyword("VALUES"), first.IsKeyword("TABLE"), first.IsPunct("("):
+		return KIND_SELECT
+	case first.IsKeyword("WITH"):
+		// The kind of a CTE query is the kind of its main statement
+		// which follows the last top level parenthesised expression
+		depth := 0
+		for i, token := range tokens {
+			if token.IsPunct("(") {
+				depth++
+			} else if token.IsPunct(")") {
+				depth--
+			} else if depth == 0 && i > 0 && tokens[i-1].IsPunct(")") && !token.IsPunct(",") {
+				return classify(tokens[i:])
+			}
+		}
+		return KIND_OTHER
+	case first.IsKeyword("INSERT"):
+		return KIND_INSERT
+	case first.IsKeyword("UPDATE"):
+		return KIND_UPDATE
+	case first.IsKeyword("DELETE"):
+		return KIND_DELETE
+	case first.IsKeyword("BEGIN"), first.IsKeyword("START"):
+		return KIND_BEGIN
+	case first.IsKeyword("COMMIT"), first.IsKeyword("END"):
+		return KIND_COMMIT
+	case first.IsKeyword("ROLLBACK"), first.IsKeyword("ABORT"):
+		// ROLLBACK TO SAVEPOINT does not end the transaction
+		if hasKeyword(tokens, "TO") {
+			return KIND_OTHER
+		}
+		return KIND_ROLLBACK
+	case first.IsKeyword("SET"):
+		return KIND_SET
+	case first.IsKeyword("SHOW"):
+		return KIND_SHOW
+	case first.IsKeyword("EXPLAIN"):
+		return KIND_EXPLAIN
+	case first.IsKeyword("COPY"):
+		return KIND_COPY
+	case first.IsKeyword("CREATE"):
+		// Temporary objects only live in the session that creates them
+		if len(tokens) > 1 && (tokens[1].IsKeyword("TEMP") || tokens[1].IsKeyword("TEMPORARY") ||
+			(tokens[1].IsKeyword("LOCAL") || tokens[1].IsKeyword("GLOBAL")) && len(tokens) > 2 && (tokens[2].IsKeyword("TEMP") || tokens[2].IsKeyword("TEMPORARY"))) {
+			return KIND_OTHER
+		}
+		return KIND_DDL
+	case first.IsKeyword("ALTER"), first.IsKeyword("DROP"), first.IsKeyword("COMMENT"),
+		first.IsKeyword("GRANT"), first.IsKeyword("REVOKE"), first.IsKeyword("REINDEX"):
+		return KIND_DDL
+	default:
+		return KIND_OTHER
+	}
+}
+
+func isReadOnly(kind StatementKind, tokens []Token) bool {
+	switch kind {
+	case KIND_SHOW:
+		return true
+	case KIND_SELECT:
+		// Data modifying CTEs, row locks, SELECT INTO and volatile
+		// functions with side effects all need to run on the primary
+		for i, token := range tokens {
+			if token.IsKeyword("INSERT") || token.IsKeyword("UPDATE") || token.IsKeyword("DELETE") || token.IsKeyword("MERGE") || token.IsKeyword("INTO") {
+				return false
+			}
+			if token.IsKeyword("FOR") && i+1 < len(tokens) {
+				next := tokens[i+1]
+				if next.IsKeyword("UPDATE") || next.IsKeyword("SHARE") || next.IsKeyword("NO") || next.IsKeyword("KEY") {
+					return false
+				}
+			}
+			if token.Kind == TOKEN_IDENT && i+1 < len(tokens) && tokens[i+1].IsPunct("(") {
+				for _, function := range writeFunctions {
+					if token.Name() == function {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	case KIND_EXPLAIN:
+		// EXPLAIN ANALYZE executes the statement
+		if !hasKeyword(tokens, "ANALYZE") {
+			return true
+		}
+		for i, token := range tokens {
+			if i > 0 && classify(tokens[i:]) != KIND_OTHER && !token.IsPunct("(") {
+				return isReadOnly(classify(tokens[i:]), tokens[i:])
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func isReadOnlyTransaction(kind StatementKind, tokens []Token) bool {
+	switch kind {
+	case KIND_BEGIN:
+		return hasSequence(tokens, "READ", "ONLY")
+	case KIND_SET:
+		return len(tokens) > 1 && tokens[1].IsKeyword("TRANSACTION") && hasSequence(tokens, "READ", "ONLY")
+	default:
+		return false
+	}
+}
+
+func hasKeyword(tokens []Token, keyword string) bool {
+	for _, token := range tokens {
+		if token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the keywords appear next to each other in the statement
+func hasSequence(tokens []Token, keywords ...string) bool {
+	for i := 0; i+len(keywords) <= len(tokens); i++ {
+		matched := true
+		for j, keyword := range keywords {
+			if !tokens[i+j].IsKeyword(keyword) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the keyword appears outside of any parentheses
+func (s *Statement) HasTopLevelKeyword(keyword string) bool {
+	depth := 0
+	for _, token := range s.Tokens {
+		if token.IsPunct("(") {
+			depth++
+		} else if token.IsPunct(")") {
+			depth--
+		} else if depth == 0 && token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the statement may run inside a transaction block. Postgres
+// refuses to run concurrent index builds and a few cluster wide commands
+// in one
+func (s *Statement) CanRunInTransaction() bool {
+	if s.Kind != KIND_DDL {
+		return true
+	}
+	if hasKeyword(s.Tokens, "CONCURRENTLY") {
+		return false
+	}
+	if len(s.Tokens) > 1 && (s.Tokens[0].IsKeyword("CREATE") || s.Tokens[0].IsKeyword("DROP")) &&
+		(s.Tokens[1].IsKeyword("DATABASE") || s.Tokens[1].IsKeyword("TABLESPACE")) {
+		return false
+	}
+	if len(s.Tokens) > 1 && s.Tokens[0].IsKeyword("ALTER") && s.Tokens[1].IsKeyword("SYSTEM") {
+		return false
+	}
+	if len(s.Tokens) > 1 && s.Tokens[0].IsKeyword("REINDEX") && (hasKeyword(s.Tokens, "DATABASE") || hasKeyword(s.Tokens, "SYSTEM")) {
+		return false
+	}
+	return true
+}
+
+// Whether every statement in the query can be run on a replica
+func IsReadOnly(statements []*Statement) bool {
+	if len(statements) == 0 {
+		return false
+	}
+	for _, statement := range statements {
+		if !statement.ReadOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalise a statement for logging
+func (s *Statement) String() string {
+	return strings.Join(strings.Fields(s.Text), " ")
+}
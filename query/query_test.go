@@ -0,0 +1,488 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	sql := `SELECT "Id", E'it\'s', $$a;b$$ /* c /* nested */ */ FROM t WHERE x::int >= $1 -- trailing`
+	tokens, err := Tokenize(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Token{
+		{Kind: TOKEN_IDENT, Value: "SELECT"},
+		{Kind: TOKEN_QUOTED_IDENT, Value: "Id"},
+		{Kind: TOKEN_PUNCT, Value: ","},
+		{Kind: TOKEN_STRING, Value: "it's"},
+		{Kind: TOKEN_PUNCT, Value: ","},
+		{Kind: TOKEN_STRING, Value: "a;b"},
+		{Kind: TOKEN_IDENT, Value: "FROM"},
+		{Kind: TOKEN_IDENT, Value: "t"},
+		{Kind: TOKEN_IDENT, Value: "WHERE"},
+		{Kind: TOKEN_IDENT, Value: "x"},
+		{Kind: TOKEN_OPERATOR, Value: "::"},
+		{Kind: TOKEN_IDENT, Value: "int"},
+		{Kind: TOKEN_OPERATOR, Value: ">="},
+		{Kind: TOKEN_PARAM, Value: "$1"},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %v", len(expected), len(tokens), tokens)
+	}
+	for i, token := range tokens {
+		if token.Kind != expected[i].Kind || token.Value != expected[i].Value {
+			t.Fatalf("Token %d: expected %v, got %v", i, expected[i], token)
+		}
+	}
+}
+
+func TestTokenizeUnterminated(t *testing.T) {
+	for _, sql := range []string{"SELECT 'abc", `SELECT "abc`, "SELECT $$abc", "SELECT /* abc"} {
+		if _, err := Tokenize(sql); err == nil {
+			t.Fatalf("Expected error tokenizing %q", sql)
+		}
+	}
+}
+
+func TestParseReadOnly(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT * FROM users":                                true,
+		"select 1; select 2":                                 true,
+		"SHOW search_path":                                   true,
+		"WITH u AS (SELECT * FROM users) SELECT * FROM u":    true,
+		"EXPLAIN SELECT * FROM users":                        true,
+		"EXPLAIN ANALYZE SELECT * FROM users":                true,
+		"EXPLAIN ANALYZE DELETE FROM users":                  false,
+		"SELECT * FROM users FOR UPDATE":                     false,
+		"SELECT * INTO copy FROM users":                      false,
+		"SELECT nextval('users_id_seq')":                     false,
+		"WITH d AS (DELETE FROM users RETURNING *) SELECT 1": false,
+		"INSERT INTO users VALUES (1, 'a', 'b')":             false,
+		"select 1; update users set username = 'x'":          false,
+		"SELECT 'insert into users' AS not_a_write":          true,
+		"BEGIN": false,
+	}
+	for sql, expected := range cases {
+		statements, err := Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsReadOnly(statements) != expected {
+			t.Fatalf("Expected read only to be %v for %q", expected, sql)
+		}
+	}
+}
+
+func TestParseTransactions(t *testing.T) {
+	cases := []struct {
+		sql      string
+		kind     StatementKind
+		readOnly bool
+	}{
+		{"BEGIN", KIND_BEGIN, false},
+		{"BEGIN READ ONLY", KIND_BEGIN, true},
+		{"START TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY", KIND_BEGIN, true},
+		{"SET TRANSACTION READ ONLY", KIND_SET, true},
+		{"SET TRANSACTION READ WRITE", KIND_SET, false},
+		{"COMMIT", KIND_COMMIT, false},
+		{"END", KIND_COMMIT, false},
+		{"ROLLBACK", KIND_ROLLBACK, false},
+		{"ROLLBACK TO SAVEPOINT a", KIND_OTHER, false},
+	}
+	for _, c := range cases {
+		statements, err := Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statements) != 1 {
+			t.Fatalf("Expected 1 statement for %q, got %d", c.sql, len(statements))
+		}
+		if statements[0].Kind != c.kind || statements[0].ReadOnlyTransaction != c.readOnly {
+			t.Fatalf("Unexpected classification for %q: %s %v", c.sql, statements[0].Kind, statements[0].ReadOnlyTransaction)
+		}
+	}
+}
+
+func TestParseCopy(t *testing.T) {
+	parse := func(sql string) *CopyStatement {
+		statements, err := Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseCopy(statements[0])
+		if err != nil {
+			t.Fatalf("Error parsing %q: %s", sql, err)
+		}
+		return parsed
+	}
+
+	parsed := parse(`COPY public."Users" (id, "Name") FROM STDIN WITH (FORMAT csv, HEADER, DELIMITER ';', FORCE_NOT_NULL (id))`)
+	if parsed.Relation != `public."Users"` || parsed.Schema != "public" || parsed.Table != "Users" {
+		t.Fatalf("Unexpected table %q %q %q", parsed.Relation, parsed.Schema, parsed.Table)
+	}
+	if len(parsed.Columns) != 2 || parsed.Columns[0] != "id" || parsed.Columns[1] != "Name" {
+		t.Fatalf("Unexpected columns %v", parsed.Columns)
+	}
+	if !parsed.From || !parsed.Stdio || parsed.Format != COPY_FORMAT_CSV || !parsed.Header || parsed.Delimiter != ';' || parsed.Null != "" {
+		t.Fatalf("Unexpected options %+v", parsed)
+	}
+
+	parsed = parse(`copy users to stdout`)
+	if parsed.From || !parsed.Stdio || parsed.Format != COPY_FORMAT_TEXT || parsed.Delimiter != '\t' || parsed.Null != `\N` || parsed.Header {
+		t.Fatalf("Unexpected defaults %+v", parsed)
+	}
+
+	parsed = parse(`COPY users FROM '/tmp/users.csv' WITH CSV HEADER QUOTE AS '''' NULL 'none'`)
+	if parsed.Stdio || parsed.Format != COPY_FORMAT_CSV || !parsed.Header || parsed.Quote != '\'' || parsed.Escape != '\'' || parsed.Null != "none" {
+		t.Fatalf("Unexpected legacy options %+v", parsed)
+	}
+
+	parsed = parse(`COPY (SELECT * FROM users WHERE id > 3) TO STDOUT (FORMAT binary)`)
+	if !parsed.Query || parsed.Table != "" || parsed.Format != COPY_FORMAT_BINARY {
+		t.Fatalf("Unexpected query copy %+v", parsed)
+	}
+}
+
+func TestParseInsert(t *testing.T) {
+	sql := `INSERT INTO public.users AS u (name, email) VALUES ('a', 'a@x'), (lower('B'), 'b@x') RETURNING id`
+	statements, err := Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseInsert(statements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Schema != "public" || parsed.Table != "users" || len(parsed.Columns) != 2 || parsed.HasColumn("id") {
+		t.Fatalf("Unexpected insert %+v", parsed)
+	}
+	if sql[parsed.ColumnsStart:parsed.ColumnsStart+4] != "name" || len(parsed.Rows) != 2 {
+		t.Fatalf("Unexpected offsets %+v", parsed)
+	}
+	if sql[parsed.Rows[0]:parsed.Rows[0]+3] != "'a'" || sql[parsed.Rows[1]:parsed.Rows[1]+5] != "lower" {
+		t.Fatalf("Unexpected row offsets %v", parsed.Rows)
+	}
+
+	if len(parsed.Values) != 2 || len(parsed.Values[1]) != 2 || len(parsed.Values[1][0]) != 4 || parsed.Upsert {
+		t.Fatalf("Unexpected values %v", parsed.Values)
+	}
+	if value, ok := Literal(parsed.Values[0][1]); !ok || value.Value != "a@x" {
+		t.Fatalf("Expected a@x, got %q", value.Value)
+	}
+
+	statements, _ = Parse(`INSERT INTO users (id) VALUES (1) ON CONFLICT (id) DO UPDATE SET id = 2`)
+	if parsed, err = ParseInsert(statements[0]); err != nil || !parsed.Upsert {
+		t.Fatalf("Expected an upsert %+v %v", parsed, err)
+	}
+
+	statements, _ = Parse(`WITH s AS (SELECT 1) INSERT INTO users SELECT * FROM s`)
+	parsed, err = ParseInsert(statements[0])
+	if err != nil || parsed.Table != "users" || parsed.ColumnsStart != -1 || len(parsed.Rows) != 0 {
+		t.Fatalf("Unexpected insert from select %+v %v", parsed, err)
+	}
+}
+
+func TestFindFunctionCalls(t *testing.T) {
+	sql := `SELECT pgspanner.next_id('users'), PGSPANNER.next_id(f(1, 2), 3), next_id('x')`
+	statements, _ := Parse(sql)
+	calls, err := FindFunctionCalls(statements[0], "pgspanner", "next_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 calls, got %d", len(calls))
+	}
+	if sql[calls[0].Start:calls[0].End] != "pgspanner.next_id('users')" || len(calls[0].Args) != 1 || calls[0].Args[0][0].Value != "users" {
+		t.Fatalf("Unexpected call %+v", calls[0])
+	}
+	if len(calls[1].Args) != 2 || len(calls[1].Args[0]) != 6 {
+		t.Fatalf("Unexpected arguments %+v", calls[1].Args)
+	}
+}
+
+func TestTables(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected []TableRef
+	}{
+		{"SELECT * FROM users u, comments JOIN public.posts AS p ON p.user_id = u.id WHERE true FOR UPDATE", []TableRef{
+			{Table: "users", Alias: "u"}, {Table: "comments"}, {Schema: "public", Table: "posts", Alias: "p"},
+		}},
+		{"INSERT INTO countries (code) VALUES ('nl') ON CONFLICT (code) DO UPDATE SET code = 'nl'", []TableRef{
+			{Table: "countries", Written: true},
+		}},
+		{"UPDATE ONLY countries SET name = c.name FROM staging c", []TableRef{
+			{Table: "countries", Written: true}, {Table: "staging", Alias: "c"},
+		}},
+		{"DELETE FROM countries WHERE code IN (SELECT code FROM banned)", []TableRef{
+			{Table: "countries", Written: true}, {Table: "banned"},
+		}},
+		{"TRUNCATE TABLE a, b CASCADE", []TableRef{{Table: "a", Written: true}, {Table: "b", Written: true}}},
+		{"SELECT * FROM generate_series(1, 3)", []TableRef{}},
+		{"SELECT 1 INTO copy_of", []TableRef{}},
+	}
+	for _, c := range cases {
+		statements, err := Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables := Tables(statements[0])
+		if len(tables) != len(c.expected) {
+			t.Fatalf("Expected %v for %q, got %v", c.expected, c.sql, tables)
+		}
+		for i := range tables {
+			if tables[i] != c.expected[i] {
+				t.Fatalf("Expected %v for %q, got %v", c.expected, c.sql, tables)
+			}
+		}
+	}
+}
+
+func TestParseDDL(t *testing.T) {
+	cases := []struct {
+		sql           string
+		kind          StatementKind
+		inTransaction bool
+	}{
+		{"CREATE TABLE users (id bigint)", KIND_DDL, true},
+		{"ALTER TABLE users ADD COLUMN email text", KIND_DDL, true},
+		{"CREATE UNIQUE INDEX CONCURRENTLY users_email ON users (email)", KIND_DDL, false},
+		{"DROP INDEX CONCURRENTLY users_email", KIND_DDL, false},
+		{"CREATE DATABASE other", KIND_DDL, false},
+		{"CREATE TEMP TABLE scratch (id int)", KIND_OTHER, true},
+		{"CREATE LOCAL TEMPORARY TABLE scratch (id int)", KIND_OTHER, true},
+	}
+	for _, c := range cases {
+		statements, err := Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statements[0].Kind != c.kind || statements[0].CanRunInTransaction() != c.inTransaction {
+			t.Fatalf("Unexpected classification for %q: %s %v", c.sql, statements[0].Kind, statements[0].CanRunInTransaction())
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	cases := []struct {
+		sql        string
+		condition  string
+		equalities []Equality
+	}{
+		{"SELECT * FROM users WHERE username = 'bob' AND u.id = 5 ORDER BY id", "username = 'bob' AND u.id = 5", []Equality{
+			{Column: "username", Value: Constant{Value: "bob"}}, {Qualifier: "u", Column: "id", Value: Constant{Value: "5", Numeric: true}},
+		}},
+		{"DELETE FROM users WHERE 7 = id AND (a = 1 OR b = 2) AND c BETWEEN 1 AND 2", "7 = id AND (a = 1 OR b = 2) AND c BETWEEN 1 AND 2", []Equality{
+			{Column: "id", Value: Constant{Value: "7", Numeric: true}},
+		}},
+		{"SELECT * FROM users WHERE id=-5 AND name = 'a'::character varying", "id=-5 AND name = 'a'::character varying", []Equality{
+			{Column: "id", Value: Constant{Value: "-5", Numeric: true}}, {Column: "name", Value: Constant{Value: "a", Cast: "character varying"}},
+		}},
+		{"UPDATE users SET name = 'x' WHERE id = 1 OR id = 2 RETURNING id", "id = 1 OR id = 2", []Equality{}},
+		{"SELECT * FROM users WHERE id = other_id + 1 AND NOT id = 3 AND id::text = '4'", "id = other_id + 1 AND NOT id = 3 AND id::text = '4'", []Equality{}},
+		{"SELECT * FROM users WHERE id IN (SELECT id FROM a WHERE x = 1)", "id IN (SELECT id FROM a WHERE x = 1)", []Equality{}},
+	}
+	for _, c := range cases {
+		statements, err := Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		where, ok := Where(statements[0])
+		if !ok {
+			t.Fatalf("Expected a WHERE clause in %q", c.sql)
+		}
+		if condition := c.sql[where.Start:where.End]; condition != c.condition {
+			t.Fatalf("Expected condition %q, got %q", c.condition, condition)
+		}
+		if len(where.Equalities) != len(c.equalities) {
+			t.Fatalf("Expected %v for %q, got %v", c.equalities, c.sql, where.Equalities)
+		}
+		for i := range c.equalities {
+			if where.Equalities[i] != c.equalities[i] {
+				t.Fatalf("Expected %v for %q, got %v", c.equalities, c.sql, where.Equalities)
+			}
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM users",
+		"SELECT * FROM a WHERE id = 1 UNION SELECT * FROM b WHERE id = 1",
+	} {
+		statements, _ := Parse(sql)
+		if where, ok := Where(statements[0]); ok {
+			t.Fatalf("Expected no usable WHERE clause in %q, got %+v", sql, where)
+		}
+	}
+}
+
+func TestUpdateColumns(t *testing.T) {
+	statements, _ := Parse("UPDATE users u SET name = lower('A'), (email, age) = ('a@x', 3), score = (SELECT 1) FROM b WHERE u.id = 1")
+	columns := UpdateColumns(statements[0])
+	expected := []string{"name", "email", "age", "score"}
+	if len(columns) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, columns)
+	}
+	for i := range expected {
+		if columns[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, columns)
+		}
+	}
+}
+
+func TestParseSet(t *testing.T) {
+	cases := []struct {
+		sql    string
+		name   string
+		local  bool
+		values []string
+		text   string
+	}{
+		{"SET pgspanner.tenant = 'acme'", "pgspanner.tenant", false, []string{"acme"}, "'acme'"},
+		{"SET LOCAL search_path TO acme, \"Public\"", "search_path", true, []string{"acme", "Public"}, "acme, \"Public\""},
+		{"SET SESSION search_path = DEFAULT", "search_path", false, []string{}, "DEFAULT"},
+		{"RESET pgspanner.tenant", "pgspanner.tenant", false, []string{}, ""},
+		{"RESET ALL", "all", false, []string{}, ""},
+	}
+	for _, c := range cases {
+		statements, _ := Parse(c.sql)
+		set, ok := ParseSet(statements[0])
+		if !ok {
+			t.Fatalf("Expected %q to parse", c.sql)
+		}
+		if set.Name != c.name || set.Local != c.local || set.Text != c.text || len(set.Values) != len(c.values) {
+			t.Fatalf("Unexpected result for %q: %+v", c.sql, set)
+		}
+		for i := range c.values {
+			if set.Values[i] != c.values[i] {
+				t.Fatalf("Unexpected values for %q: %v", c.sql, set.Values)
+			}
+		}
+	}
+
+	for _, sql := range []string{"SET TRANSACTION READ ONLY", "SET TIME ZONE 'UTC'", "SET search_path TO lower('a')", "SELECT 1"} {
+		statements, _ := Parse(sql)
+		if _, ok := ParseSet(statements[0]); ok {
+			t.Fatalf("Expected %q not to parse", sql)
+		}
+	}
+}
+
+func TestJoinEqualities(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected []JoinEquality
+	}{
+		{
+			"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id AND c.post_id = p.id WHERE p.title = 'a'",
+			[]JoinEquality{
+				{ColumnRef{"c", "user_id"}, ColumnRef{"p", "user_id"}},
+				{ColumnRef{"c", "post_id"}, ColumnRef{"p", "id"}},
+			},
+		},
+		{
+			"SELECT * FROM posts LEFT OUTER JOIN comments c USING (user_id)",
+			[]JoinEquality{{ColumnRef{"posts", "user_id"}, ColumnRef{"c", "user_id"}}},
+		},
+		{
+			"SELECT * FROM posts p WHERE EXISTS (SELECT 1 FROM comments c WHERE c.user_id = p.user_id)",
+			[]JoinEquality{{ColumnRef{"c", "user_id"}, ColumnRef{"p", "user_id"}}},
+		},
+		{"SELECT * FROM posts p JOIN comments c ON c.user_id = p.user_id OR c.id = 1", []JoinEquality{}},
+		{"SELECT * FROM posts p, comments c WHERE c.user_id = 1 AND p.user_id = 1", []JoinEquality{}},
+	}
+	for _, c := range cases {
+		statements, _ := Parse(c.sql)
+		equalities := JoinEqualities(statements[0])
+		if len(equalities) != len(c.expected) {
+			t.Fatalf("Expected %v for %q, got %v", c.expected, c.sql, equalities)
+		}
+		for i := range c.expected {
+			if equalities[i] != c.expected[i] {
+				t.Fatalf("Expected %v for %q, got %v", c.expected, c.sql, equalities)
+			}
+		}
+	}
+}
+
+func TestParseJoinSelect(t *testing.T) {
+	statements, _ := Parse("SELECT p.title, c.* FROM posts p JOIN comments c ON c.post_id = p.id WHERE p.user_id = 3 AND c.score BETWEEN 1 AND 5")
+	join, err := ParseJoinSelect(statements[0])
+	if err != nil {
+		t.Fatalf("Expected a join, got %s", err)
+	}
+	if join.Keys[0][0] != "id" || join.Keys[1][0] != "post_id" {
+		t.Fatalf("Expected the join on p.id and c.post_id, got %v", join.Keys)
+	}
+	if len(join.Items) != 2 || join.Items[0] != (JoinItem{0, "p.title", false}) || join.Items[1] != (JoinItem{1, "c.*", true}) {
+		t.Fatalf("Unexpected select list %v", join.Items)
+	}
+	if len(join.Filters[0]) != 1 || join.Filters[0][0] != "p.user_id = 3" ||
+		len(join.Filters[1]) != 1 || join.Filters[1][0] != "c.score BETWEEN 1 AND 5" {
+		t.Fatalf("Unexpected filters %v", join.Filters)
+	}
+
+	rejected := []string{
+		"SELECT p.title, c.body FROM posts p JOIN comments c ON c.post_id = p.id ORDER BY p.title",
+		"SELECT p.title FROM posts p LEFT JOIN comments c ON c.post_id = p.id",
+		"SELECT p.title FROM posts p JOIN comments c ON c.post_id = p.id OR c.id = 1",
+		"SELECT p.title || c.body FROM posts p JOIN comments c ON c.post_id = p.id",
+		"SELECT p.title FROM posts p JOIN comments c ON c.post_id > p.id",
+		"SELECT title FROM posts p JOIN comments c ON c.post_id = p.id",
+		"SELECT p.title FROM posts p, comments c WHERE p.id = 1",
+		"SELECT p.*, c.body, p.* FROM posts p JOIN comments c ON c.post_id = p.id",
+	}
+	for _, sql := range rejected {
+		statements, _ := Parse(sql)
+		if _, err := ParseJoinSelect(statements[0]); err == nil {
+			t.Fatalf("Expected %q not to be joined by the proxy", sql)
+		}
+	}
+}
+
+func TestParseHint(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected *Hint
+		stripped string
+	}{
+		{"/* pgspanner: shard=2 */ SELECT 1", &Hint{Shard: 2}, " SELECT 1"},
+		{"  /*PGSPANNER:cluster = postgres2:5433*/UPDATE t SET a = 1", &Hint{Cluster: "postgres2:5433"}, "  UPDATE t SET a = 1"},
+		{"/* pgspanner: all */ CREATE INDEX CONCURRENTLY i ON t (a)", &Hint{All: true}, " CREATE INDEX CONCURRENTLY i ON t (a)"},
+		{"/* nightly report */ SELECT 1", nil, "/* nightly report */ SELECT 1"},
+		{"SELECT 1 /* pgspanner: all */", nil, "SELECT 1 /* pgspanner: all */"},
+	}
+	for _, c := range cases {
+		hint, stripped, err := ParseHint(c.sql)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.sql, err)
+		}
+		if (hint == nil) != (c.expected == nil) || hint != nil && *hint != *c.expected || stripped != c.stripped {
+			t.Fatalf("Expected %v and %q for %q, got %v and %q", c.expected, c.stripped, c.sql, hint, stripped)
+		}
+	}
+
+	for _, sql := range []string{"/* pgspanner: shard=0 */ SELECT 1", "/* pgspanner: shard=two */ SELECT 1", "/* pgspanner: replica */ SELECT 1"} {
+		if _, _, err := ParseHint(sql); err == nil {
+			t.Fatalf("Expected an error for %q", sql)
+		}
+	}
+}
+
+func TestMergingClause(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM users WHERE id > 1":                                    "",
+		"SELECT * FROM users WHERE id IN (SELECT user_id FROM posts LIMIT 5)": "",
+		"SELECT count(DISTINCT name) FROM users":                              "count()",
+		"SELECT DISTINCT name FROM users":                                     "DISTINCT",
+		"SELECT name FROM users ORDER BY name":                                "ORDER",
+		"SELECT * FROM users limit 10":                                        "LIMIT",
+		"SELECT name, rank() OVER (ORDER BY id) FROM users":                   "window function",
+		"SELECT id FROM users UNION SELECT id FROM admins":                    "UNION",
+	}
+	for sql, expected := range cases {
+		statements, _ := Parse(sql)
+		if clause := MergingClause(statements[0]); clause != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, sql, clause)
+		}
+	}
+}
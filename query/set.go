@@ -0,0 +1,79 @@
+package query
+
+import "strings"
+
+// A SET or RESET of a run time parameter
+type SetStatement struct {
+	// The parameter name in lower case, e.g. search_path or pgspanner.tenant.
+	// "all" for RESET ALL
+	Name string
+	// SET LOCAL only lasts until the end of the transaction
+	Local bool
+	// The values of the list given to SET. Empty for RESET and SET ... TO DEFAULT
+	Values []string
+	// The value list as written in the query
+	Text string
+}
+
+// Parse SET name { TO | = } value [, ...] and RESET name. Other forms of
+// SET like SET TRANSACTION and SET TIME ZONE are not parsed
+func ParseSet(statement *Statement) (*SetStatement, bool) {
+	tokens := statement.Tokens
+	if len(tokens) < 2 {
+		return nil, false
+	}
+	reset := tokens[0].IsKeyword("RESET")
+	if !reset && statement.Kind != KIND_SET {
+		return nil, false
+	}
+
+	set := &SetStatement{Values: make([]string, 0, 1)}
+	idx := 1
+	if !reset && (tokens[idx].IsKeyword("SESSION") || tokens[idx].IsKeyword("LOCAL")) {
+		set.Local = tokens[idx].IsKeyword("LOCAL")
+		idx++
+	}
+	// Parameter names may be qualified like pgspanner.tenant
+	name := make([]string, 0, 2)
+	for ; idx < len(tokens); idx++ {
+		token := tokens[idx]
+		if len(name)%2 == 0 && token.Kind == TOKEN_IDENT && !token.IsKeyword("TO") {
+			name = append(name, token.Name())
+		} else if len(name)%2 == 1 && token.IsPunct(".") {
+			name = append(name, ".")
+		} else {
+			break
+		}
+	}
+	if len(name) == 0 || len(name)%2 == 0 {
+		return nil, false
+	}
+	set.Name = strings.Join(name, "")
+	if reset {
+		return set, idx == len(tokens)
+	}
+
+	if idx == len(tokens) || !(tokens[idx].IsKeyword("TO") || tokens[idx].IsOperator("=")) {
+		return nil, false
+	}
+	idx++
+	if idx == len(tokens) {
+		return nil, false
+	}
+	set.Text = statement.Text[tokens[idx].Start-tokens[0].Start:]
+	if idx == len(tokens)-1 && tokens[idx].IsKeyword("DEFAULT") {
+		return set, true
+	}
+	for i := idx; i < len(tokens); i += 2 {
+		switch tokens[i].Kind {
+		case TOKEN_IDENT, TOKEN_QUOTED_IDENT, TOKEN_STRING, TOKEN_NUMBER:
+			set.Values = append(set.Values, tokens[i].Name())
+		default:
+			return nil, false
+		}
+		if i+1 < len(tokens) && !tokens[i+1].IsPunct(",") {
+			return nil, false
+		}
+	}
+	return set, true
+}
@@ -0,0 +1,109 @@
+package query
+
+// A table a statement reads from or writes to
+type TableRef struct {
+	Schema string
+	Table  string
+	// The name the statement gives the table, if any
+	Alias string
+	// The statement inserts, updates or deletes rows of the table
+	Written bool
+}
+
+// Keywords that can follow a table in a FROM list and are therefore not
+// an alias of it
+var tableClauseKeywords = []string{
+	"WHERE", "JOIN", "LEFT", "RIGHT", "INNER", "FULL", "CROSS", "NATURAL", "ON", "USING",
+	"GROUP", "ORDER", "LIMIT", "OFFSET", "FETCH", "HAVING", "WINDOW", "UNION", "EXCEPT",
+	"INTERSECT", "FOR", "SET", "VALUES", "SELECT", "DEFAULT", "OVERRIDING", "RETURNING",
+	"RESTART", "CONTINUE", "CASCADE", "RESTRICT", "WHEN", "TABLESAMPLE",
+}
+
+// Find the tables a statement refers to. Tables are found after FROM,
+// JOIN, INTO, UPDATE and TRUNCATE. Functions in a FROM list are skipped
+// and names defined by a CTE are reported like tables
+func Tables(statement *Statement) []TableRef {
+	tokens := statement.Tokens
+	tables := make([]TableRef, 0, 2)
+	for i, token := range tokens {
+		written := false
+		switch {
+		case token.IsKeyword("FROM"):
+			written = i > 0 && tokens[i-1].IsKeyword("DELETE")
+		case token.IsKeyword("JOIN"):
+		case token.IsKeyword("INTO"):
+			// SELECT INTO creates a table on the server it runs on
+			written = i > 0 && (tokens[i-1].IsKeyword("INSERT") || tokens[i-1].IsKeyword("MERGE"))
+			if !written {
+				continue
+			}
+		case token.IsKeyword("UPDATE"):
+			// FOR UPDATE locks rows and DO UPDATE belongs to an INSERT
+			if i > 0 && (tokens[i-1].IsKeyword("FOR") || tokens[i-1].IsKeyword("DO") || tokens[i-1].IsKeyword("KEY")) {
+				continue
+			}
+			written = true
+		case token.IsKeyword("TRUNCATE"):
+			written = true
+		case token.IsKeyword("TABLE") && (i == 0 || tokens[i-1].IsKeyword("TRUNCATE")):
+			if i > 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		tables = append(tables, readTableList(tokens, i+1, written, token.IsKeyword("FROM") || token.IsKeyword("JOIN"))...)
+	}
+	return tables
+}
+
+// Read the comma separated tables starting at idx. A name followed by a
+// parenthesis is a function call when reading a FROM list
+func readTableList(tokens []Token, idx int, written bool, fromList bool) []TableRef {
+	tables := make([]TableRef, 0, 1)
+	for idx < len(tokens) {
+		if tokens[idx].IsKeyword("ONLY") || tokens[idx].IsKeyword("LATERAL") || tokens[idx].IsKeyword("TABLE") {
+			idx++
+			continue
+		}
+		if idx >= len(tokens) || (tokens[idx].Kind != TOKEN_IDENT && tokens[idx].Kind != TOKEN_QUOTED_IDENT) {
+			return tables
+		}
+		ref := TableRef{Table: tokens[idx].Name(), Written: written}
+		idx++
+		if idx+1 < len(tokens) && tokens[idx].IsPunct(".") {
+			ref.Schema, ref.Table = ref.Table, tokens[idx+1].Name()
+			idx += 2
+		}
+		if fromList && idx < len(tokens) && tokens[idx].IsPunct("(") {
+			return tables
+		}
+		tables = append(tables, ref)
+
+		// Skip the alias and a trailing *
+		if idx < len(tokens) && tokens[idx].IsOperator("*") {
+			idx++
+		}
+		if idx+1 < len(tokens) && tokens[idx].IsKeyword("AS") {
+			tables[len(tables)-1].Alias = tokens[idx+1].Name()
+			idx += 2
+		} else if idx < len(tokens) && (tokens[idx].Kind == TOKEN_QUOTED_IDENT || (tokens[idx].Kind == TOKEN_IDENT && !isClauseKeyword(tokens[idx]))) {
+			tables[len(tables)-1].Alias = tokens[idx].Name()
+			idx++
+		}
+		if idx >= len(tokens) || !tokens[idx].IsPunct(",") {
+			return tables
+		}
+		idx++
+	}
+	return tables
+}
+
+func isClauseKeyword(token Token) bool {
+	for _, keyword := range tableClauseKeywords {
+		if token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package query
+
+import "strings"
+
+// A condition of a WHERE clause comparing a column to a constant
+type Equality struct {
+	// The table or alias the column is qualified with, if any
+	Qualifier string
+	Column    string
+	Value     Constant
+}
+
+// A constant as it is written in a query, like 'a', -5 or '42'::bigint
+type Constant struct {
+	// The text of the constant without its quotes
+	Value string
+	// A numeric constant rather than a string
+	Numeric bool
+	// The type the constant is cast to, lower case, if any
+	Cast string
+}
+
+// The WHERE clause of a SELECT, UPDATE or DELETE
+type WhereClause struct {
+	// Byte offsets of the condition in the original query
+	Start int
+	End   int
+	// Column = constant conditions every row matched by the clause
+	// satisfies. Empty when the conditions are joined by OR
+	Equalities []Equality
+}
+
+// Keywords ending the WHERE clause of the main statement
+var whereEndKeywords = []string{
+	"GROUP", "ORDER", "LIMIT", "OFFSET", "FETCH", "HAVING", "WINDOW", "FOR", "RETURNING",
+}
+
+// Find the WHERE clause of the main statement. Clauses of subqueries and
+// CTEs are ignored. Statements combining queries with UNION, EXCEPT or
+// INTERSECT have no clause that applies to all of their rows
+func Where(statement *Statement) (*WhereClause, bool) {
+	tokens := statement.Tokens
+	start := -1
+	end := len(tokens)
+	depth := 0
+	for i, token := range tokens {
+		switch {
+		case token.IsPunct("("):
+			depth++
+		case token.IsPunct(")"):
+			depth--
+		case depth > 0:
+		case token.IsKeyword("UNION"), token.IsKeyword("EXCEPT"), token.IsKeyword("INTERSECT"):
+			return nil, false
+		case start == -1 && token.IsKeyword("WHERE"):
+			start = i + 1
+		case start != -1 && end == len(tokens) && isWhereEnd(token):
+			end = i
+		}
+	}
+	if start == -1 || start >= end {
+		return nil, false
+	}
+
+	where := &WhereClause{
+		Start:      tokens[start].Start,
+		End:        tokens[end-1].End,
+		Equalities: make([]Equality, 0, 1),
+	}
+	conjunctStart := start
+	for i := start; i <= end; i++ {
+		if i < end && tokens[i].IsPunct("(") {
+			closing, err := closingParen(tokens, i)
+			if err != nil {
+				return nil, false
+			}
+			i = closing
+			continue
+		}
+		if i < end && tokens[i].IsKeyword("OR") {
+			where.Equalities = where.Equalities[:0]
+			return where, true
+		}
+		if i == end || tokens[i].IsKeyword("AND") {
+			if equality, ok := parseEquality(tokens[conjunctStart:i]); ok {
+				where.Equalities = append(where.Equalities, equality)
+			}
+			conjunctStart = i + 1
+		}
+	}
+	return where, true
+}
+
+func isWhereEnd(token Token) bool {
+	for _, keyword := range whereEndKeywords {
+		if token.IsKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a condition of the form column = constant or constant = column
+func parseEquality(tokens []Token) (Equality, bool) {
+	for i, token := range tokens {
+		if !token.IsOperator("=") {
+			continue
+		}
+		if value, ok := Literal(tokens[i+1:]); ok {
+			return parseColumnRef(tokens[:i], value)
+		}
+		if value, ok := Literal(tokens[:i]); ok {
+			return parseColumnRef(tokens[i+1:], value)
+		}
+		return Equality{}, false
+	}
+	return Equality{}, false
+}
+
+func parseColumnRef(tokens []Token, value Constant) (Equality, bool) {
+	for i, token := range tokens {
+		if i%2 == 0 && token.Kind != TOKEN_IDENT && token.Kind != TOKEN_QUOTED_IDENT {
+			return Equality{}, false
+		}
+		if i%2 == 1 && !token.IsPunct(".") {
+			return Equality{}, false
+		}
+	}
+	switch len(tokens) {
+	case 1:
+		return Equality{Column: tokens[0].Name(), Value: value}, true
+	case 3:
+		return Equality{Qualifier: tokens[0].Name(), Column: tokens[2].Name(), Value: value}, true
+	default:
+		return Equality{}, false
+	}
+}
+
+// Read an expression that is a single string or numeric constant. A
+// number may be negated and the constant may be cast to a type
+func Literal(tokens []Token) (Constant, bool) {
+	constant := Constant{}
+	if len(tokens) > 1 && tokens[0].IsOperator("-") && tokens[1].Kind == TOKEN_NUMBER {
+		constant.Value = "-"
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 || (tokens[0].Kind != TOKEN_STRING && tokens[0].Kind != TOKEN_NUMBER) {
+		return Constant{}, false
+	}
+	constant.Value += tokens[0].Value
+	constant.Numeric = tokens[0].Kind == TOKEN_NUMBER
+	tokens = tokens[1:]
+	if len(tokens) == 0 {
+		return constant, true
+	}
+	// Type names may be several words, like double precision
+	if len(tokens) < 2 || !tokens[0].IsOperator("::") {
+		return Constant{}, false
+	}
+	words := make([]string, 0, len(tokens)-1)
+	for _, token := range tokens[1:] {
+		if token.Kind != TOKEN_IDENT {
+			return Constant{}, false
+		}
+		words = append(words, strings.ToLower(token.Value))
+	}
+	constant.Cast = strings.Join(words, " ")
+	return constant, true
+}
+
+// Whether the expression is the NULL constant
+func IsNull(tokens []Token) bool {
+	return len(tokens) == 1 && tokens[0].IsKeyword("NULL")
+}
+
+// The columns an UPDATE assigns to in its SET list
+func UpdateColumns(statement *Statement) []string {
+	columns := make([]string, 0, 2)
+	if statement.Kind != KIND_UPDATE {
+		return columns
+	}
+	tokens := statement.Tokens
+	depth := 0
+	inSet := false
+	expectColumn := false
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case inSet && expectColumn && depth == 0 && token.IsPunct("("):
+			// (a, b) = (...) assigns to several columns
+			closing, err := closingParen(tokens, i)
+			if err != nil {
+				return columns
+			}
+			for _, column := range tokens[i+1 : closing] {
+				if !column.IsPunct(",") {
+					columns = append(columns, column.Name())
+				}
+			}
+			expectColumn = false
+			i = closing
+		case token.IsPunct("("):
+			depth++
+		case token.IsPunct(")"):
+			depth--
+		case depth > 0:
+		case !inSet && token.IsKeyword("SET"):
+			inSet = true
+			expectColumn = true
+		case inSet && token.IsPunct(","):
+			expectColumn = true
+		case inSet && (token.IsKeyword("FROM") || token.IsKeyword("WHERE") || token.IsKeyword("RETURNING")):
+			return columns
+		case inSet && expectColumn:
+			columns = append(columns, token.Name())
+			expectColumn = false
+		}
+	}
+	return columns
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Reference tables have a full copy on every cluster so joins against them never leave a shard.
+/// Writes go to every cluster in one coordinated transaction and reads to any one of them
+
+const (
+	REFERENCE_STATUS_OK       = "ok"
+	REFERENCE_STATUS_DIVERGED = "diverged"
+	REFERENCE_STATUS_ERROR    = "error"
+)
+
+// A row count and checksum of the contents of a table that does not
+// depend on the order the rows are stored in
+const REFERENCE_CHECKSUM_QUERY = "SELECT count(*), coalesce(md5(string_agg(md5(t::text), '' ORDER BY md5(t::text))), '') FROM %s t"
+
+// Send queries that write to a reference table to every cluster and
+// queries that only read reference tables to a single one. Returns
+// whether the query was handled
+func routeReferenceTables(
+	queryText string,
+	statements []*query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	if len(statements) == 0 || len(database.GetReferenceTables()) == 0 {
+		return false
+	}
+
+	readsOnlyReference := true
+	for _, statement := range statements {
+		tables := query.Tables(statement)
+		if len(tables) == 0 {
+			readsOnlyReference = false
+		}
+		var written *TableConfig
+		var sharded *TableConfig
+		for _, ref := range tables {
+			table, ok := database.GetRelationTableConfig(ref.Schema, ref.Table)
+			if !ok || !table.Reference {
+				readsOnlyReference = false
+			}
+			if ok && table.Reference && ref.Written {
+				written = table
+			} else if ok && !table.Reference {
+				sharded = table
+			}
+		}
+		if written == nil {
+			continue
+		}
+		if len(statements) > 1 {
+			writeSyntheticError(client, buildQueryError(
+				"0A000",
+				fmt.Sprintf("writes to reference table %s must be sent as a query of their own", written.Name),
+			))
+			return true
+		}
+		if sharded != nil {
+			writeSyntheticError(client, buildQueryError(
+				"0A000",
+				fmt.Sprintf("writes to reference table %s cannot use sharded table %s", written.Name, sharded.Name),
+			))
+			return true
+		}
+		handleReferenceWrite(queryText, statement, client, requester, database)
+		return true
+	}
+
+	// A client inside a transaction keeps using the clusters it holds
+	if readsOnlyReference && query.IsReadOnly(statements) && !client.InTransaction() {
+		handleReferenceRead(queryText, client, requester, database)
+		return true
+	}
+	return false
+}
+
+// Run a write to a reference table on every cluster. Outside of a
+// transaction the write is prepared on every cluster before it is
+// committed on any. The client sees the result of the first cluster
+func handleReferenceWrite(
+	queryText string,
+	statement *query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	coordinated := !client.InTransaction()
+	servers, err := getShardConnections(client, requester, database)
+	if err == nil && coordinated {
+		if err = beginCoordinatedTransaction(servers); err != nil {
+			releaseShardConnections(client, requester, database, servers)
+		}
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for reference table write", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+
+	for _, server := range servers {
+		server.IssueQuery(queryText)
+	}
+	results := make([]shardResult, 0, len(servers))
+	for i, server := range servers {
+		if i == 0 {
+			results = append(results, readShardRows(server))
+		} else {
+			results = append(results, readShardResult(server))
+		}
+	}
+	if coordinated {
+		endPreparedTransaction(servers, results, newPreparedTransactionId("reference", client.Ctx.ClientPid), database.Name)
+	}
+	releaseShardConnections(client, requester, database, servers)
+
+	tag := results[0].tag
+	for _, result := range results[1:] {
+		if result.errMsg == nil && result.err == nil && result.tag != tag {
+			slog.Warn("Reference table write changed different rows on shards", "statement", statement.String(), "tag", tag, "shard", result.shardAddr, "shardTag", result.tag)
+		}
+	}
+	slog.Info("Wrote to reference table on every shard", "statement", string(statement.Kind), "shards", len(servers))
+	writeShardResults(client, database.Name, results, tag, nil)
+}
+
+// Run a read of reference tables on a single cluster. Clients are spread
+// over the clusters by their pid and move on to the next cluster when
+// theirs is down
+func handleReferenceRead(
+	queryText string,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	var server *ServerConnection
+	var firstErr error
+	for i := range database.Clusters {
+		cluster := database.Clusters[(client.Ctx.ClientPid+i)%len(database.Clusters)]
+		// A cluster waiting for a key range may not have the reference
+		// tables yet
+		if keyRange, _ := cluster.GetKeyRange(); keyRange.IsEmpty() {
+			continue
+		}
+		var err error
+		server, err = getServerConnection(requester, database, cluster.GetAddr(), client.Ctx.ClientPid, database.UsesReplicas())
+		if err == nil {
+			break
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if server == nil {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no cluster of database %q serves reference tables", database.Name)
+		}
+		if errMsg, ok := firstErr.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting server connection for reference table read", "error", firstErr)
+			writeSyntheticError(client, buildQueryError("08006", firstErr.Error()))
+		}
+		return
+	}
+	serverAddr := server.GetClusterConfig().GetAddr()
+
+	server.IssueQuery(queryText)
+	relay := newResultRelay(client)
+	transactionStatus, err := relay.ForwardUntilReady(server)
+	relay.Release()
+	if err != nil {
+		slog.Error("Error relaying reference table read", "error", err)
+		requester.ReturnConnection(server, database.Name, serverAddr, client.Ctx.ClientPid)
+		writeSyntheticError(client, buildLostConnectionError(serverAddr, database.Name, err))
+		return
+	}
+	server.SetTransactionStatus(transactionStatus)
+	requester.ReturnConnection(server, database.Name, serverAddr, client.Ctx.ClientPid)
+}
+
+// The contents of a reference table on one cluster
+type referenceChecksum struct {
+	cluster  string
+	rows     string
+	checksum string
+	err      error
+}
+
+func readReferenceChecksum(database *DatabaseConfig, cluster *ClusterConfig, table *TableConfig) referenceChecksum {
+	server, err := CreateServerConnection(database, cluster)
+	if err != nil {
+		return referenceChecksum{cluster: cluster.GetAddr(), err: err}
+	}
+	defer server.Terminate()
+	return checksumReferenceTable(server, cluster.GetAddr(), table)
+}
+
+func checksumReferenceTable(server *ServerConnection, addr string, table *TableConfig) referenceChecksum {
+	result := referenceChecksum{cluster: addr}
+	rows, err := server.QueryRows(fmt.Sprintf(REFERENCE_CHECKSUM_QUERY, quoteTableName(table.Name)))
+	if err == nil && (len(rows) != 1 || len(rows[0].Values) != 2) {
+		err = fmt.Errorf("Unexpected result checking reference table %s on %s", table.Name, addr)
+	}
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.rows = string(rows[0].Values[0])
+	result.checksum = string(rows[0].Values[1])
+	return result
+}
+
+// Compare the contents of every reference table across the clusters of
+// the database
+func checkReferenceTables(database *DatabaseConfig) [][]string {
+	report := make([][]string, 0)
+	for _, table := range database.GetReferenceTables() {
+		checksums := make([]referenceChecksum, 0, len(database.Clusters))
+		for _, cluster := range database.Clusters {
+			checksums = append(checksums, readReferenceChecksum(database, &cluster, &table))
+		}
+		report = append(report, compareReferenceChecksums(database.Name, &table, checksums)...)
+	}
+	return report
+}
+
+// The report rows of a reference table given its checksum on every
+// cluster. The first cluster is taken as the source of truth
+func compareReferenceChecksums(databaseName string, table *TableConfig, checksums []referenceChecksum) [][]string {
+	report := make([][]string, 0, len(checksums))
+	var expected *referenceChecksum
+	for i, checksum := range checksums {
+		status := REFERENCE_STATUS_OK
+		detail := ""
+		switch {
+		case checksum.err != nil:
+			status = REFERENCE_STATUS_ERROR
+			detail = checksum.err.Error()
+		case expected == nil:
+			expected = &checksums[i]
+		case checksum.checksum != expected.checksum:
+			status = REFERENCE_STATUS_DIVERGED
+			detail = fmt.Sprintf("differs from %s", expected.cluster)
+			slog.Warn(
+				"Reference table has diverged",
+				"database", databaseName,
+				"table", table.Name,
+				"cluster", checksum.cluster,
+				"rows", checksum.rows,
+				"expectedCluster", expected.cluster,
+				"expectedRows", expected.rows,
+			)
+		}
+		report = append(report, []string{databaseName, table.Name, checksum.cluster, checksum.rows, checksum.checksum, status, detail})
+	}
+	return report
+}
+
+// CHECK REFERENCE TABLES [database]
+func adminCheckReferenceTables(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	result := &adminResult{
+		Columns: []string{"database", "table", "cluster", "rows", "checksum", "status", "detail"},
+		Rows:    make([][]string, 0),
+	}
+	for _, database := range config.Databases {
+		if len(args) > 0 && !strings.EqualFold(args[0], database.Name) {
+			continue
+		}
+		result.Rows = append(result.Rows, checkReferenceTables(&database)...)
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
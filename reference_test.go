@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+// The transaction status of the ReadyForQuery the client was sent last.
+// Zero when none was sent
+func sentReadyStatus(conn *scriptedConn) byte {
+	status := byte(0)
+	sent := bytes.NewReader(conn.sent.Bytes())
+	for {
+		rm, err := protocol.GetRawPgMessage(sent)
+		if err != nil {
+			return status
+		}
+		if rm.Kind == protocol.BMESSAGE_READY_FOR_QUERY && len(rm.Data) > 0 {
+			status = rm.Data[0]
+		}
+	}
+}
+
+func newReferenceClient(clientPid int) (*ClientConnection, *scriptedConn) {
+	conn := &scriptedConn{}
+	return &ClientConnection{Conn: conn, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: clientPid}}, conn
+}
+
+func TestReferenceWrite(t *testing.T) {
+	database := lookupTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+
+	// Every cluster prepares the write before any commits it
+	servers := map[string][]*ServerConnection{}
+	conns := make([]*scriptedConn, 0)
+	for i := range database.Clusters {
+		server, conn := newSessionServer(database, &database.Clusters[i],
+			buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+			buildCompletion("INSERT 0 1", TRANSACTION_STATUS_ACTIVE),
+			buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE),
+			buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE),
+		)
+		servers[database.Clusters[i].GetAddr()] = []*ServerConnection{server}
+		conns = append(conns, conn)
+	}
+	returned := serveScriptedPool(requester, servers)
+
+	sql := "INSERT INTO countries (code) VALUES ('nl')"
+	statements, _ := query.Parse(sql)
+	client, clientConn := newReferenceClient(1)
+	if !routeReferenceTables(sql, statements, client, requester, database) {
+		t.Fatal("Expected the write to the reference table to be handled")
+	}
+	<-returned
+	<-returned
+	if code := sentErrorCode(clientConn); code != "" {
+		t.Fatalf("Expected the write to succeed, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_IDLE {
+		t.Fatalf("Expected the client to be idle, got %q", status)
+	}
+	for _, conn := range conns {
+		queries := conn.queries()
+		if len(queries) < 4 || !slices.Equal(queries[:2], []string{"BEGIN", sql}) ||
+			!strings.HasPrefix(queries[2], "PREPARE TRANSACTION 'pgspanner_reference_") ||
+			queries[3] != "COMMIT PREPARED "+strings.TrimPrefix(queries[2], "PREPARE TRANSACTION ") {
+			t.Fatalf("Expected the write to be prepared and committed, got %q", queries)
+		}
+	}
+
+	// A cluster that is down fails the write before it starts anywhere
+	server, conn := newSessionServer(database, &database.Clusters[0])
+	servers[database.Clusters[0].GetAddr()] = []*ServerConnection{server}
+	servers[database.Clusters[1].GetAddr()] = []*ServerConnection{nil}
+	client, clientConn = newReferenceClient(1)
+	routeReferenceTables(sql, statements, client, requester, database)
+	<-returned
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the write to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_IDLE {
+		t.Fatalf("Expected the client to be told it is idle, got %q", status)
+	}
+	if queries := conn.queries(); slices.Contains(queries, "BEGIN") || slices.Contains(queries, sql) {
+		t.Fatalf("Expected the write not to start on the cluster that is up, got %q", queries)
+	}
+}
+
+func TestReferenceRead(t *testing.T) {
+	database := lookupTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	a, b := database.Clusters[0].GetAddr(), database.Clusters[1].GetAddr()
+	servers := map[string][]*ServerConnection{}
+	returned := serveScriptedPool(requester, servers)
+	sql := "SELECT * FROM countries"
+	statements, _ := query.Parse(sql)
+	read := func(clientPid int) *scriptedConn {
+		client, clientConn := newReferenceClient(clientPid)
+		if !routeReferenceTables(sql, statements, client, requester, database) {
+			t.Fatal("Expected the read of the reference table to be handled")
+		}
+		return clientConn
+	}
+
+	// Clients are spread over the clusters by their pid
+	for clientPid, cluster := range []*ClusterConfig{&database.Clusters[0], &database.Clusters[1]} {
+		server, conn := newSessionServer(database, cluster, buildResult(2, TRANSACTION_STATUS_IDLE))
+		servers[cluster.GetAddr()] = []*ServerConnection{server}
+		clientConn := read(clientPid)
+		<-returned
+		if code := sentErrorCode(clientConn); code != "" {
+			t.Fatalf("Expected the read to succeed, got %q", code)
+		}
+		if queries := conn.queries(); len(queries) == 0 || queries[0] != sql {
+			t.Fatalf("Expected client %d to read from %s, got %q", clientPid, cluster.GetAddr(), queries)
+		}
+	}
+
+	// A client whose cluster is down moves on to the next one
+	server, conn := newSessionServer(database, &database.Clusters[0], buildResult(2, TRANSACTION_STATUS_IDLE))
+	servers[a] = []*ServerConnection{server}
+	servers[b] = []*ServerConnection{nil}
+	clientConn := read(1)
+	<-returned
+	if code := sentErrorCode(clientConn); code != "" {
+		t.Fatalf("Expected the read to fall through to %s, got %q", a, code)
+	}
+	if queries := conn.queries(); len(queries) == 0 || queries[0] != sql {
+		t.Fatalf("Expected the read to run on %s, got %q", a, queries)
+	}
+
+	// With every cluster down the client gets the error and can go on
+	servers[a] = []*ServerConnection{nil}
+	servers[b] = []*ServerConnection{nil}
+	clientConn = read(1)
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the read to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_IDLE {
+		t.Fatalf("Expected the client to be told it is idle, got %q", status)
+	}
+}
+
+func TestCheckReferenceTables(t *testing.T) {
+	table := &TableConfig{Name: "Geo.countries", Reference: true}
+	server, conn := newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildRows(TRANSACTION_STATUS_IDLE, [][]byte{[]byte("3"), []byte("abc")}))
+	checksum := checksumReferenceTable(server, "a:5432", table)
+	if checksum.err != nil || checksum.rows != "3" || checksum.checksum != "abc" {
+		t.Fatalf("Unexpected checksum %+v", checksum)
+	}
+	if queries := conn.queries(); len(queries) != 1 || !strings.HasSuffix(queries[0], ` FROM "Geo".countries t`) {
+		t.Fatalf("Expected the table name to be quoted, got %q", queries)
+	}
+
+	// The first cluster is the source of truth
+	report := compareReferenceChecksums("test", table, []referenceChecksum{
+		{cluster: "a:5432", rows: "3", checksum: "abc"},
+		{cluster: "b:5432", rows: "3", checksum: "abc"},
+		{cluster: "c:5432", rows: "2", checksum: "def"},
+		{cluster: "d:5432", err: errors.New("connection refused")},
+	})
+	statuses := make([]string, 0, len(report))
+	for _, row := range report {
+		statuses = append(statuses, row[5])
+	}
+	expected := []string{REFERENCE_STATUS_OK, REFERENCE_STATUS_OK, REFERENCE_STATUS_DIVERGED, REFERENCE_STATUS_ERROR}
+	if !slices.Equal(statuses, expected) {
+		t.Fatalf("Expected statuses %v, got %v", expected, statuses)
+	}
+	if report[2][6] != "differs from a:5432" || report[3][6] != "connection refused" {
+		t.Fatalf("Unexpected details %q", report)
+	}
+
+	// A cluster that could not be read is not taken as the source of truth
+	report = compareReferenceChecksums("test", table, []referenceChecksum{
+		{cluster: "a:5432", err: errors.New("connection refused")},
+		{cluster: "b:5432", rows: "3", checksum: "abc"},
+		{cluster: "c:5432", rows: "2", checksum: "def"},
+	})
+	if report[1][5] != REFERENCE_STATUS_OK || report[2][6] != "differs from b:5432" {
+		t.Fatalf("Unexpected report %q", report)
+	}
+}
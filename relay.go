@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Size of the buffers used to read from servers and write to clients
+const RELAY_BUFFER_SIZE = 32 * 1024
+
+var relayWriterPool = sync.Pool{
+	New: func() any { return bufio.NewWriterSize(nil, RELAY_BUFFER_SIZE) },
+}
+
+// Streams a server's response to a client. Messages are copied straight
+// from the server's read buffer into a pooled write buffer that is
+// flushed when it fills up or the server is ready for the next query,
+// so a large result costs a handful of syscalls instead of one per row.
+// When the server asks for COPY data it is read from the client and
+// passed on to the server the same way
+type resultRelay struct {
+	client io.Reader
+	output clientWriter
+	writer *bufio.Writer
+	header [5]byte
+	// Rows forwarded by ForwardUntilReady and whether one of the messages
+	// forwarded was an error
+	rows   int
+	failed bool
+}
+
+// Writes to the client and keeps the time spent waiting on it, so a
+// slow client does not count against the server's latency
+type clientWriter struct {
+	client  io.Writer
+	blocked time.Duration
+}
+
+func (w *clientWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.client.Write(p)
+	w.blocked += time.Since(start)
+	return n, err
+}
+
+func newResultRelay(client io.ReadWriter) *resultRelay {
+	relay := &resultRelay{client: client, output: clientWriter{client: client}}
+	relay.writer = relayWriterPool.Get().(*bufio.Writer)
+	relay.writer.Reset(&relay.output)
+	return relay
+}
+
+// Flush whatever is left and give the write buffer back to the pool
+func (r *resultRelay) Release() {
+	r.writer.Flush()
+	r.writer.Reset(nil)
+	relayWriterPool.Put(r.writer)
+	r.writer = nil
+}
+
+// Forward messages from the server to the client until the server sends
+// ReadyForQuery. Returns the transaction status it reported. Only a
+// failure to read from the server is returned as an error. Write errors
+// are left for the client's next read to find
+func (r *resultRelay) ForwardUntilReady(server io.ReadWriter) (byte, error) {
+	for {
+		kind, length, err := protocol.ReadPgMessageHeader(server, r.header[:])
+		if err != nil {
+			return 0, err
+		}
+		r.writer.Write(r.header[:])
+		switch kind {
+		case protocol.BMESSAGE_DATA_ROW:
+			r.rows++
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			r.failed = true
+		}
+		if kind == protocol.BMESSAGE_READY_FOR_QUERY {
+			status := make([]byte, length-4)
+			if _, err := io.ReadFull(server, status); err != nil {
+				return 0, err
+			}
+			r.writer.Write(status)
+			r.writer.Flush()
+			if len(status) == 0 {
+				return TRANSACTION_STATUS_IDLE, nil
+			}
+			return status[0], nil
+		}
+		if err := r.copyBody(server, length-4); err != nil {
+			return 0, err
+		}
+		if kind == protocol.BMESSAGE_COPY_IN_RESPONSE {
+			r.writer.Flush()
+			r.forwardCopyIn(server)
+		}
+	}
+}
+
+// Pass the client's COPY data on to the server until the client ends or
+// aborts the copy. The server answers with the usual CommandComplete or
+// ErrorResponse once it has the end of the copy
+func (r *resultRelay) forwardCopyIn(server io.Writer) {
+	writer := relayWriterPool.Get().(*bufio.Writer)
+	writer.Reset(server)
+	defer func() {
+		writer.Flush()
+		writer.Reset(nil)
+		relayWriterPool.Put(writer)
+	}()
+
+	for {
+		kind, length, err := protocol.ReadPgMessageHeader(r.client, r.header[:])
+		if err != nil {
+			writer.Write(protocol.BuildCopyFailPgMessage("client connection lost during COPY").Pack())
+			return
+		}
+		switch kind {
+		case protocol.MESSAGE_COPY_DATA, protocol.MESSAGE_COPY_DONE, protocol.FMESSAGE_COPY_FAIL:
+			writer.Write(r.header[:])
+			if _, err := io.CopyN(writer, r.client, int64(length-4)); err != nil {
+				writer.Write(protocol.BuildCopyFailPgMessage("client connection lost during COPY").Pack())
+				return
+			}
+			if kind != protocol.MESSAGE_COPY_DATA {
+				return
+			}
+		default:
+			// Flush and Sync may be sent during a copy and are
+			// ignored by the server
+			if _, err := io.CopyN(io.Discard, r.client, int64(length-4)); err != nil {
+				writer.Write(protocol.BuildCopyFailPgMessage("client connection lost during COPY").Pack())
+				return
+			}
+		}
+	}
+}
+
+// Copy a message body into the write buffer. Reading and writing are
+// done separately so a failed client write is not mistaken for a lost
+// server
+func (r *resultRelay) copyBody(server io.Reader, remaining int) error {
+	for remaining > 0 {
+		if r.writer.Available() == 0 {
+			r.writer.Flush()
+			if r.writer.Available() == 0 {
+				// The client is gone. Keep draining the server so
+				// its connection stays usable
+				r.writer.Reset(io.Discard)
+			}
+		}
+		chunk := r.writer.AvailableBuffer()[:min(remaining, r.writer.Available())]
+		n, err := io.ReadFull(server, chunk)
+		r.writer.Write(chunk[:n])
+		remaining -= n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forward the rows of a COPY TO STDOUT the server is sending without the
+// CopyDone that ends them, so the rows of several servers can be sent
+// to the client as one copy. The first row is dropped when it is a
+// header the client already received. Reads up to the server's
+// ReadyForQuery and returns how the copy ended
+func (r *resultRelay) ForwardCopyOut(server *ServerConnection, dropHeader bool) shardResult {
+	result := shardResult{shardAddr: server.GetClusterConfig().GetAddr()}
+	for {
+		kind, length, err := protocol.ReadPgMessageHeader(server, r.header[:])
+		if err != nil {
+			result.err = err
+			return result
+		}
+		if kind == protocol.MESSAGE_COPY_DATA && !dropHeader && result.errMsg == nil {
+			r.writer.Write(r.header[:])
+			if err := r.copyBody(server, length-4); err != nil {
+				result.err = err
+				return result
+			}
+			continue
+		}
+		if kind == protocol.MESSAGE_COPY_DATA {
+			dropHeader = false
+			if _, err := io.CopyN(io.Discard, server, int64(length-4)); err != nil {
+				result.err = err
+				return result
+			}
+			continue
+		}
+
+		rm := &protocol.RawPgMessage{Kind: kind, Length: length, Data: make([]byte, length-4)}
+		if _, err := io.ReadFull(server, rm.Data); err != nil {
+			result.err = err
+			return result
+		}
+		if result.readOutcome(server, rm) {
+			return result
+		}
+	}
+}
+
+// Forward the rows of a statement the server is running without the
+// CommandComplete and ReadyForQuery that end them, so the rows of
+// several servers can be sent to the client as one result. The
+// RowDescription is dropped when the client already has one. Reads up
+// to the server's ReadyForQuery and returns how the statement ended
+func (r *resultRelay) ForwardRows(server *ServerConnection, dropDescription bool) shardResult {
+	result := shardResult{shardAddr: server.GetClusterConfig().GetAddr()}
+	for {
+		kind, length, err := protocol.ReadPgMessageHeader(server, r.header[:])
+		if err != nil {
+			result.err = err
+			return result
+		}
+		if kind == protocol.BMESSAGE_DATA_ROW || kind == protocol.BMESSAGE_ROW_DESCRIPTION && !dropDescription {
+			r.writer.Write(r.header[:])
+			if err := r.copyBody(server, length-4); err != nil {
+				result.err = err
+				return result
+			}
+			continue
+		}
+		rm := &protocol.RawPgMessage{Kind: kind, Length: length, Data: make([]byte, length-4)}
+		if _, err := io.ReadFull(server, rm.Data); err != nil {
+			result.err = err
+			return result
+		}
+		if result.readOutcome(server, rm) {
+			return result
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Counts the calls made to it to stand in for the syscalls a socket
+// would cost
+type countingStream struct {
+	reader io.Reader
+	writer io.Writer
+	calls  int
+}
+
+func (c *countingStream) Read(p []byte) (int, error) {
+	c.calls++
+	return c.reader.Read(p)
+}
+
+func (c *countingStream) Write(p []byte) (int, error) {
+	c.calls++
+	return c.writer.Write(p)
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// The connection of a server that answers with a prepared response and
+// keeps what the proxy sends it
+type scriptedConn struct {
+	net.Conn
+	response io.Reader
+	sent     bytes.Buffer
+	closed   bool
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) {
+	return c.response.Read(p)
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return c.sent.Write(p)
+}
+
+func (c *scriptedConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *scriptedConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *scriptedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// The queries the proxy sent
+func (c *scriptedConn) queries() []string {
+	queries := make([]string, 0)
+	sent := bytes.NewReader(c.sent.Bytes())
+	for {
+		rm, err := protocol.GetRawPgMessage(sent)
+		if err != nil {
+			return queries
+		}
+		if rm.Kind == protocol.FMESSAGE_QUERY {
+			queries = append(queries, strings.TrimRight(string(rm.Data), "\x00"))
+		}
+	}
+}
+
+// A server connection to the cluster answering with the messages
+func newScriptedServer(cluster *ClusterConfig, messages ...[]byte) (*ServerConnection, *scriptedConn) {
+	conn := &scriptedConn{response: bytes.NewReader(bytes.Join(messages, nil))}
+	return &ServerConnection{Conn: conn, Context: &serverConnectionContext{Cluster: cluster}}, conn
+}
+
+// Build the server side of a SELECT returning rows rows
+func buildResult(rows int, transactionStatus byte) []byte {
+	var result bytes.Buffer
+	result.Write(protocol.BuildTextRowDescriptionPgMessage([]string{"id", "name"}).Pack())
+	for i := 0; i < rows; i++ {
+		row := protocol.BuildDataRowPgMessage([][]byte{[]byte(fmt.Sprint(i)), []byte("some user name")})
+		result.Write(row.Pack())
+	}
+	result.Write(protocol.BuildCommandCompletePgMessage(fmt.Sprintf("SELECT %d", rows)).Pack())
+	result.Write(protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack())
+	return result.Bytes()
+}
+
+func TestResultRelay(t *testing.T) {
+	result := buildResult(10000, TRANSACTION_STATUS_ACTIVE)
+	// The server already sent part of the next response
+	trailing := protocol.BuildCommandCompletePgMessage("BEGIN").Pack()
+
+	var client bytes.Buffer
+	server := bufio.NewReader(bytes.NewReader(append(append([]byte{}, result...), trailing...)))
+	relay := newResultRelay(&client)
+	status, err := relay.ForwardUntilReady(readWriter{server, io.Discard})
+	relay.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != TRANSACTION_STATUS_ACTIVE {
+		t.Fatalf("Expected transaction status %c, got %c", TRANSACTION_STATUS_ACTIVE, status)
+	}
+	if !bytes.Equal(client.Bytes(), result) {
+		t.Fatalf("Relayed %d bytes that differ from the %d sent by the server", client.Len(), len(result))
+	}
+	if server.Buffered() != len(trailing) {
+		t.Fatalf("Relay read past ReadyForQuery")
+	}
+
+	// A server that goes away mid result is reported
+	relay = newResultRelay(&bytes.Buffer{})
+	_, err = relay.ForwardUntilReady(readWriter{bytes.NewReader(result[:len(result)/2]), io.Discard})
+	relay.Release()
+	if err == nil {
+		t.Fatal("Expected an error relaying a truncated result")
+	}
+}
+
+// A client that takes its time reading
+type slowClient struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (c *slowClient) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Buffer.Write(p)
+}
+
+func TestResultRelayClientTime(t *testing.T) {
+	result := buildResult(10000, TRANSACTION_STATUS_IDLE)
+	client := &slowClient{delay: 5 * time.Millisecond}
+	relay := newResultRelay(client)
+	if _, err := relay.ForwardUntilReady(readWriter{bytes.NewReader(result), io.Discard}); err != nil {
+		t.Fatal(err)
+	}
+	relay.Release()
+	// Every flush of the write buffer waited on the client
+	flushes := (len(result) + RELAY_BUFFER_SIZE - 1) / RELAY_BUFFER_SIZE
+	if relay.output.blocked < time.Duration(flushes)*client.delay {
+		t.Fatalf("Expected at least %d waits on the client, got %s", flushes, relay.output.blocked)
+	}
+}
+
+func benchmarkRelay(b *testing.B, rows int, relay func(server io.ReadWriter, client io.ReadWriter) error) {
+	result := buildResult(rows, TRANSACTION_STATUS_IDLE)
+	b.SetBytes(int64(len(result)))
+	b.ResetTimer()
+	var calls int
+	for i := 0; i < b.N; i++ {
+		stream := &countingStream{reader: bytes.NewReader(result), writer: io.Discard}
+		if err := relay(stream, stream); err != nil {
+			b.Fatal(err)
+		}
+		calls += stream.calls
+	}
+	b.ReportMetric(float64(calls)/float64(b.N), "syscalls/op")
+}
+
+// The relay handleQuery used before results were streamed through
+// buffers: one allocation, re-pack and write per message
+func relayPerMessage(server io.ReadWriter, client io.ReadWriter) error {
+	for {
+		rm, err := protocol.GetRawPgMessage(server)
+		if err != nil {
+			return err
+		}
+		client.Write(rm.Pack())
+		if rm.Kind == protocol.BMESSAGE_READY_FOR_QUERY {
+			return nil
+		}
+	}
+}
+
+func relayBuffered(server io.ReadWriter, client io.ReadWriter) error {
+	relay := newResultRelay(client)
+	defer relay.Release()
+	_, err := relay.ForwardUntilReady(readWriter{bufio.NewReaderSize(server, RELAY_BUFFER_SIZE), server})
+	return err
+}
+
+func BenchmarkRelayPerMessage1MRows(b *testing.B) {
+	benchmarkRelay(b, 1000000, relayPerMessage)
+}
+
+func BenchmarkRelayBuffered1MRows(b *testing.B) {
+	benchmarkRelay(b, 1000000, relayBuffered)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	CONFIG_CHANGE_ADDED   = "added"
+	CONFIG_CHANGE_REMOVED = "removed"
+	CONFIG_CHANGE_UPDATED = "updated"
+	CONFIG_CHANGE_IGNORED = "ignored"
+)
+
+// A change made to the running proxy when a new config was applied
+type ConfigChange struct {
+	Action   string
+	Database string
+	Cluster  string
+	Detail   string
+}
+
+// Read and validate the config file at path
+func LoadConfig(path string) (*SpannerConfig, error) {
+	var config SpannerConfig
+	metadata, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		return nil, err
+	}
+	config.path = path
+	// A misspelled setting would otherwise be silently left at its default
+	unknown := make([]error, 0)
+	for _, problem := range checkUndecodedKeys(metadata) {
+		unknown = append(unknown, errors.New(problem.Message))
+	}
+	if len(unknown) > 0 {
+		return nil, errors.Join(unknown...)
+	}
+	// Key ranges moved while the proxy was running replace the configured ones
+	withMetadata, err := applyShardMetadata(&config)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateConfig(withMetadata); err != nil {
+		return nil, err
+	}
+	return withMetadata, nil
+}
+
+// Re-read the config file the proxy was started with and have the pool
+// manager apply it
+func ReloadConfig(requester *ConnectionRequester) ([]ConfigChange, error) {
+	current := requester.GetConfig()
+	config, err := LoadConfig(current.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", current.path, err)
+	}
+	response := requester.RequestConfigReload(config)
+	if response.Result != RESULT_SUCCESS {
+		return nil, response.Detail
+	}
+	return response.Changes, nil
+}
+
+// Reload the config every time the process receives SIGHUP
+func WaitForReloadSignal(requester *ConnectionRequester) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		slog.Info("Received SIGHUP. Reloading config")
+		changes, err := ReloadConfig(requester)
+		if err != nil {
+			slog.Error("Config reload failed. Keeping the running config", "error", err)
+			continue
+		}
+		slog.Info("Config reloaded", "changes", len(changes))
+	}
+}
+
+type reloadHost struct {
+	database  DatabaseConfig
+	cluster   ClusterConfig
+	shardAddr string
+}
+
+// Bring the pools in line with a new config. Poolers are created for
+// new hosts, removed hosts are drained and settings of existing hosts
+// are swapped in place so their idle connections survive
+func (pm *PoolerManager) ApplyConfig(request ConnectionRequest) {
+	config := request.Config
+	current := pm.ConnectionServer.GetConfig()
+	changes := make([]ConfigChange, 0)
+
+	// The logger is switched first so a log file that cannot be opened
+	// rejects the config before any of it is applied
+	if config.Logging != current.Logging {
+		if err := ReconfigureLogger(current.Logging, config.Logging); err != nil {
+			request.responder <- ConnectionResponse{
+				Event:  ACTION_RELOAD_CONFIG,
+				Result: RESULT_ERROR,
+				Detail: err,
+			}
+			return
+		}
+		changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_UPDATED, Detail: "logging"})
+	}
+	if !reflect.DeepEqual(config.GetListenerConfigs(), current.GetListenerConfigs()) {
+		changes = append(changes, ConfigChange{
+			Action: CONFIG_CHANGE_IGNORED,
+			Detail: "listen address changes require a restart",
+		})
+	}
+	if config.UpgradeSocket != current.UpgradeSocket {
+		changes = append(changes, ConfigChange{
+			Action: CONFIG_CHANGE_IGNORED,
+			Detail: "upgrade socket changes require a restart",
+		})
+	}
+	if config.NodeId != current.NodeId {
+		changes = append(changes, ConfigChange{
+			Action: CONFIG_CHANGE_IGNORED,
+			Detail: "node id changes require a restart",
+		})
+	}
+
+	wanted := make(map[string]map[string]reloadHost)
+	for _, database := range config.Databases {
+		wanted[database.Name] = make(map[string]reloadHost)
+		for _, cluster := range database.Clusters {
+			wanted[database.Name][cluster.GetAddr()] = reloadHost{database, cluster, cluster.GetAddr()}
+			for _, replica := range cluster.GetReplicaConfigs() {
+				wanted[database.Name][replica.GetAddr()] = reloadHost{database, replica, cluster.GetAddr()}
+			}
+		}
+	}
+
+	// Drop the hosts that are gone or have moved to another shard
+	for databaseName, databasePoolers := range pm.poolers {
+		for addr, pooler := range databasePoolers {
+			host, ok := wanted[databaseName][addr]
+			if ok && host.shardAddr == pooler.shardAddr {
+				continue
+			}
+			pooler.drain()
+			delete(databasePoolers, addr)
+			changes = append(changes, ConfigChange{CONFIG_CHANGE_REMOVED, databaseName, addr, ""})
+		}
+		if _, ok := wanted[databaseName]; !ok {
+			delete(pm.poolers, databaseName)
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_REMOVED, Database: databaseName})
+		}
+	}
+
+	for _, database := range config.Databases {
+		if pm.poolers[database.Name] == nil {
+			pm.poolers[database.Name] = make(map[string]*Pooler)
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_ADDED, Database: database.Name})
+		}
+		for addr, host := range wanted[database.Name] {
+			pooler, ok := pm.poolers[database.Name][addr]
+			if !ok {
+				if host.shardAddr == addr {
+					pooler = newPooler(host.database, host.cluster)
+				} else {
+					pooler = newReplicaPooler(host.database, host.cluster, host.shardAddr)
+				}
+				pm.poolers[database.Name][addr] = pooler
+				changes = append(changes, ConfigChange{CONFIG_CHANGE_ADDED, database.Name, addr, ""})
+				continue
+			}
+			if detail := pooler.updateConfig(host.database, host.cluster); detail != "" {
+				changes = append(changes, ConfigChange{CONFIG_CHANGE_UPDATED, database.Name, addr, detail})
+			}
+		}
+	}
+
+	pm.rebuildShards(config)
+	pm.ConnectionServer.setConfig(config)
+	for _, change := range changes {
+		slog.Info(
+			"Applied config change",
+			"action", change.Action,
+			"database", change.Database,
+			"cluster", change.Cluster,
+			"detail", change.Detail,
+		)
+	}
+	request.responder <- ConnectionResponse{
+		Event:   ACTION_RELOAD_CONFIG,
+		Result:  RESULT_SUCCESS,
+		Changes: changes,
+	}
+}
+
+// Rebuild the shard topologies from the poolers. A replica that was
+// promoted during a failover stays primary as long as it is still
+// part of the shard
+func (pm *PoolerManager) rebuildShards(config *SpannerConfig) {
+	shards := make(map[string]map[string]*shardTopology)
+	for _, database := range config.Databases {
+		shards[database.Name] = make(map[string]*shardTopology)
+		databasePoolers := pm.poolers[database.Name]
+		for _, cluster := range database.Clusters {
+			shardAddr := cluster.GetAddr()
+			shard, ok := pm.shards[database.Name][shardAddr]
+			if !ok {
+				shard = newShardTopology(databasePoolers[shardAddr])
+			} else if databasePoolers[shard.primary.GetAddr()] != shard.primary {
+				shard.primary = databasePoolers[shardAddr]
+			}
+			shard.replicas = make([]*Pooler, 0, len(cluster.Replicas))
+			for _, pooler := range databasePoolers {
+				if pooler.shardAddr == shardAddr && pooler != shard.primary {
+					shard.replicas = append(shard.replicas, pooler)
+				}
+			}
+			for _, pooler := range append([]*Pooler{shard.primary}, shard.replicas...) {
+				pooler.health.IsReplica = pooler != shard.primary
+			}
+			shards[database.Name][shardAddr] = shard
+		}
+	}
+
+	// Requests waiting on a shard that no longer exists will never be served
+	for databaseName, databaseShards := range pm.shards {
+		for shardAddr, shard := range databaseShards {
+			if _, ok := shards[databaseName][shardAddr]; ok {
+				continue
+			}
+			for _, q := range shard.queued {
+				q.request.responder <- ConnectionResponse{
+					Event:  ACTION_GET_CONNECTION,
+					Result: RESULT_ERROR,
+					Detail: ClusterNotFoundError{DatabaseName: databaseName, ClusterAddr: shardAddr},
+				}
+			}
+		}
+	}
+	pm.shards = shards
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	current := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:         "test",
+		PoolSettings: PoolConfig{MaxOpenConns: 5},
+		Clusters:     []ClusterConfig{{Host: "a", Port: 5432, Replicas: []ReplicaConfig{{Host: "b", Port: 5432}}}},
+	}}}
+	requester := NewConnectionRequester(current)
+	pm := NewPoolerManager(current, requester)
+	primary, replica := pm.poolers["test"]["a:5432"], pm.poolers["test"]["b:5432"]
+	kept, _ := addIdleConnection(primary, 1)
+	addIdleConnection(primary, 2)
+	inUse, _ := addIdleConnection(replica, 3)
+	replica.connections = nil
+	replica.checkOut(inUse)
+
+	// The replica is dropped, a cluster is added, the pool of the primary
+	// shrinks and the node id cannot change without a restart
+	config := &SpannerConfig{NodeId: 1, Databases: []DatabaseConfig{{
+		Name:         "test",
+		PoolSettings: PoolConfig{MaxOpenConns: 1},
+		Clusters:     []ClusterConfig{{Host: "a", Port: 5432}, {Host: "c", Port: 5432}},
+	}}}
+	response := make(chan ConnectionResponse, 1)
+	pm.ApplyConfig(ConnectionRequest{Event: ACTION_RELOAD_CONFIG, Config: config, responder: response})
+	answer := <-response
+	if answer.Result != RESULT_SUCCESS {
+		t.Fatalf("Expected the config to be applied, got %s", answer.Result)
+	}
+	for _, expected := range []ConfigChange{
+		{Action: CONFIG_CHANGE_IGNORED, Detail: "node id changes require a restart"},
+		{CONFIG_CHANGE_REMOVED, "test", "b:5432", ""},
+		{CONFIG_CHANGE_ADDED, "test", "c:5432", ""},
+		{CONFIG_CHANGE_UPDATED, "test", "a:5432", "pool settings"},
+	} {
+		if !slices.Contains(answer.Changes, expected) {
+			t.Fatalf("Expected change %+v, got %+v", expected, answer.Changes)
+		}
+	}
+	if len(answer.Changes) != 4 {
+		t.Fatalf("Expected 4 changes, got %+v", answer.Changes)
+	}
+
+	if pm.poolers["test"]["a:5432"] != primary || pm.poolers["test"]["b:5432"] != nil || pm.poolers["test"]["c:5432"] == nil {
+		t.Fatal("Expected the poolers to match the new config")
+	}
+	if !inUse.IsPoisoned() {
+		t.Fatal("Expected connections to a removed host to be poisoned")
+	}
+	if len(primary.connections) != 1 || primary.connections[0] != kept {
+		t.Fatal("Expected idle connections within the new pool size to survive")
+	}
+	if shard := pm.shards["test"]["a:5432"]; shard.primary != primary || len(shard.replicas) != 0 || pm.shards["test"]["c:5432"] == nil {
+		t.Fatal("Expected the shards to be rebuilt")
+	}
+	if requester.GetConfig() != config {
+		t.Fatal("Expected the new config to be the running one")
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	for _, content := range []string{
+		"[[Databases]\n",
+		// A misspelled setting is rejected rather than left at its default
+		"[[databases]]\nname = \"test\"\n[[databases.clusters]]\nhost = \"a\"\nport = 5432\npasswrdEnv = \"PG_PASSWORD\"\n",
+	} {
+		path := filepath.Join(t.TempDir(), "pgspanner.toml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		current := &SpannerConfig{path: path}
+		requester := NewConnectionRequester(current)
+		if _, err := ReloadConfig(requester); err == nil {
+			t.Fatalf("Expected %q to be rejected", content)
+		}
+		if requester.GetConfig() != current {
+			t.Fatal("Expected the running config to be kept")
+		}
+	}
+}
+
+func TestApplyConfigUnwritableLogFile(t *testing.T) {
+	current := &SpannerConfig{Databases: []DatabaseConfig{{
+		Name:     "test",
+		Clusters: []ClusterConfig{{Host: "a", Port: 5432}},
+	}}}
+	requester := NewConnectionRequester(current)
+	pm := NewPoolerManager(current, requester)
+	logger := slog.Default()
+
+	config := &SpannerConfig{
+		Logging: LoggingConfig{LogFile: filepath.Join(t.TempDir(), "missing", "pgspanner.log")},
+		Databases: []DatabaseConfig{{
+			Name:     "test",
+			Clusters: []ClusterConfig{{Host: "a", Port: 5432}, {Host: "b", Port: 5432}},
+		}},
+	}
+	response := make(chan ConnectionResponse, 1)
+	pm.ApplyConfig(ConnectionRequest{Event: ACTION_RELOAD_CONFIG, Config: config, responder: response})
+	if answer := <-response; answer.Result != RESULT_ERROR || answer.Detail == nil {
+		t.Fatalf("Expected a log file that cannot be opened to reject the config, got %s", answer.Result)
+	}
+	if slog.Default() != logger {
+		t.Fatal("Expected the running logger to be kept")
+	}
+	if requester.GetConfig() != current || pm.poolers["test"]["b:5432"] != nil {
+		t.Fatal("Expected none of the config to be applied")
+	}
+}
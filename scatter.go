@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Statements on sharded tables that do not pin a single cluster run on every cluster that may
+/// own their rows
+
+// The query one cluster runs for a statement spread over several
+type shardQuery struct {
+	cluster *ClusterConfig
+	text    string
+}
+
+// Run statements on sharded tables that pin no single cluster on every
+// cluster that may own their rows, or reject them. A SELECT whose result
+// needs all of its rows at once, like one with ORDER BY, is rejected and
+// the rows of an INSERT are split by the cluster owning their shard key.
+// Other kinds of statements, like EXPLAIN, still run on the first
+// cluster. Returns whether the query was handled
+func routeUnpinned(
+	queryText string,
+	statements []*query.Statement,
+	write *routedWrite,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) bool {
+	var refs []shardedRef
+	for _, statement := range statements {
+		refs = append(refs, findShardedTables(statement, database)...)
+	}
+	if len(refs) == 0 {
+		return false
+	}
+	statement := statements[0]
+	table := refs[0].table
+	for _, ref := range refs {
+		if ref.ref.Written {
+			table = ref.table
+			break
+		}
+	}
+	if len(statements) > 1 {
+		writeSyntheticError(client, buildUnpinnedError(
+			fmt.Sprintf("statements on sharded table %s that do not pin %s must be sent as a query of their own", table.Name, table.ShardKey),
+		))
+		return true
+	}
+	if statement.Kind != query.KIND_SELECT && statement.Kind != query.KIND_INSERT &&
+		statement.Kind != query.KIND_UPDATE && statement.Kind != query.KIND_DELETE {
+		return false
+	}
+	if clause := query.MergingClause(statement); statement.Kind == query.KIND_SELECT && clause != "" {
+		writeSyntheticError(client, buildUnpinnedError(fmt.Sprintf(
+			"SELECT using %s on sharded table %s must pin %s so it runs on a single shard", clause, table.Name, table.ShardKey,
+		)))
+		return true
+	}
+
+	// Shard keys were routed when looking for a single owner, the
+	// current shard map tells where they go
+	if write != nil {
+		if statement.Kind != query.KIND_INSERT {
+			write.RouteAll()
+		}
+		if current, ok := requester.GetConfig().GetDatabaseConfigByName(database.Name); ok {
+			database = current
+		}
+	}
+	var shards []shardQuery
+	if statement.Kind == query.KIND_INSERT {
+		var errMsg *protocol.ErrorResponsePgMessage
+		if shards, errMsg = getInsertShards(queryText, statement, table, database); errMsg != nil {
+			writeSyntheticError(client, errMsg)
+			return true
+		}
+	} else {
+		// A cluster waiting for a key range to be moved to it has no rows
+		// of its own yet
+		for i := range database.Clusters {
+			if keyRange, _ := database.Clusters[i].GetKeyRange(); !keyRange.IsEmpty() {
+				shards = append(shards, shardQuery{&database.Clusters[i], queryText})
+			}
+		}
+	}
+	handleScatteredQuery(shards, statement, client, requester, database)
+	return true
+}
+
+// Stream the rows of every server to the client one after the other as
+// a single result, without keeping them in memory. Nothing more goes to
+// the client once a server failed, the client gets its error in place
+// of the CommandComplete. Returns the result of each server
+func relayShardRows(client io.ReadWriter, servers []*ServerConnection) []shardResult {
+	relay := newResultRelay(client)
+	defer relay.Release()
+	results := make([]shardResult, 0, len(servers))
+	failed := false
+	for i, server := range servers {
+		var result shardResult
+		if failed {
+			// The rest of the servers are read so their connections
+			// stay usable
+			result = readShardResult(server)
+		} else {
+			result = relay.ForwardRows(server, i > 0)
+		}
+		failed = failed || result.err != nil || result.errMsg != nil
+		results = append(results, result)
+	}
+	return results
+}
+
+func buildUnpinnedError(message string) *protocol.ErrorResponsePgMessage {
+	errMsg := buildQueryError("0A000", message)
+	errMsg.Fields[protocol.NOTICE_KIND_HINT] = protocol.ErrorField{
+		Type: 'H', Value: "Pin the shard key with = or pick the clusters with a /* pgspanner: shard=<n> */ hint.",
+	}
+	return errMsg
+}
+
+// Split the rows of an INSERT by the cluster owning their shard key. Each
+// cluster gets the statement with only its own rows
+func getInsertShards(
+	queryText string,
+	statement *query.Statement,
+	table *TableConfig,
+	database *DatabaseConfig,
+) ([]shardQuery, *protocol.ErrorResponsePgMessage) {
+	insert, err := query.ParseInsert(statement)
+	if err != nil || len(insert.Values) == 0 {
+		return nil, buildUnpinnedError(fmt.Sprintf(
+			"INSERT into sharded table %s must give its rows in VALUES to be split over the shards", table.Name,
+		))
+	}
+	column := slices.Index(insert.Columns, table.ShardKey)
+	if column < 0 {
+		return nil, buildUnpinnedError(fmt.Sprintf("INSERT into sharded table %s must list its shard key %s", table.Name, table.ShardKey))
+	}
+
+	rows := make(map[string][]string)
+	for i, row := range insert.Values {
+		constant, ok := query.Constant{}, false
+		if column < len(row) {
+			constant, ok = query.Literal(row[column])
+		}
+		if !ok {
+			return nil, buildUnpinnedError(fmt.Sprintf(
+				"shard key %s of the rows inserted into %s must be constants", table.ShardKey, table.Name,
+			))
+		}
+		key, err := shardKeyText(constant, table.GetShardKeyType())
+		if err != nil {
+			return nil, buildQueryError("22P02", err.Error())
+		}
+		cluster, ok := database.GetClusterForKeyspaceId(KeyspaceId([]byte(key)))
+		if !ok {
+			return nil, buildQueryError("58000", fmt.Sprintf("no cluster owns the keyspace id of %q", key))
+		}
+		rows[cluster.GetAddr()] = append(rows[cluster.GetAddr()], queryText[insert.Rows[i]-1:insert.RowsEnd[i]])
+	}
+
+	prefix := queryText[:insert.Rows[0]-1]
+	suffix := queryText[insert.RowsEnd[len(insert.RowsEnd)-1]:]
+	shards := make([]shardQuery, 0, len(rows))
+	for i := range database.Clusters {
+		if owned, ok := rows[database.Clusters[i].GetAddr()]; ok {
+			shards = append(shards, shardQuery{&database.Clusters[i], prefix + strings.Join(owned, ", ") + suffix})
+		}
+	}
+	return shards, nil
+}
+
+// Run a statement on several clusters and send the client the rows of
+// all of them one after the other
+func handleScatteredQuery(
+	shards []shardQuery,
+	statement *query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	coordinated := !statement.ReadOnly && !client.InTransaction()
+	servers := make([]*ServerConnection, 0, len(shards))
+	var err error
+	for _, shard := range shards {
+		var server *ServerConnection
+		if server, err = getShardConnection(client, requester, database, shard.cluster.GetAddr()); err != nil {
+			releaseShardConnections(client, requester, database, servers)
+			break
+		}
+		servers = append(servers, server)
+	}
+	// Every server has the client's deferred BEGIN once it has a
+	// connection to all of them
+	if err == nil {
+		client.pendingBegin = ""
+	}
+	if err == nil && coordinated {
+		if err = beginCoordinatedTransaction(servers); err != nil {
+			releaseShardConnections(client, requester, database, servers)
+		}
+	}
+	if err != nil {
+		if errMsg, ok := err.(*protocol.ErrorResponsePgMessage); ok {
+			writeSyntheticError(client, errMsg)
+		} else {
+			slog.Error("Error getting shard connections for scattered query", "error", err)
+			writeSyntheticError(client, buildQueryError("08006", err.Error()))
+		}
+		return
+	}
+
+	for i, server := range servers {
+		server.IssueQuery(shards[i].text)
+	}
+	results := relayShardRows(client, servers)
+	if coordinated {
+		endPreparedTransaction(servers, results, newPreparedTransactionId("scatter", client.Ctx.ClientPid), database.Name)
+	}
+	releaseShardConnections(client, requester, database, servers)
+
+	slog.Debug("Ran statement on several shards", "statement", string(statement.Kind), "shards", len(servers))
+	writeShardResults(client, database.Name, results, sumCommandTags(results), nil)
+}
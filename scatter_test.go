@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestGetInsertShards(t *testing.T) {
+	database := lookupTestDatabase()
+	table, _ := database.GetTableConfig("users")
+	owner := func(key string) string {
+		cluster, _ := database.GetClusterForKeyspaceId(KeyspaceId([]byte(key)))
+		return cluster.GetAddr()
+	}
+	other := 2
+	for owner(fmt.Sprint(other)) == owner("1") {
+		other++
+	}
+
+	sql := fmt.Sprintf("INSERT INTO users (id, name) VALUES (1, 'a'), (%d, 'b'), (1, 'c') ON CONFLICT (id) DO NOTHING RETURNING id", other)
+	statements, _ := query.Parse(sql)
+	shards, errMsg := getInsertShards(sql, statements[0], table, database)
+	if errMsg != nil {
+		t.Fatal(errMsg)
+	}
+	expected := map[string]string{
+		owner("1"):               "INSERT INTO users (id, name) VALUES (1, 'a'), (1, 'c') ON CONFLICT (id) DO NOTHING RETURNING id",
+		owner(fmt.Sprint(other)): fmt.Sprintf("INSERT INTO users (id, name) VALUES (%d, 'b') ON CONFLICT (id) DO NOTHING RETURNING id", other),
+	}
+	if len(shards) != 2 {
+		t.Fatalf("Expected the rows to be split over 2 shards, got %v", shards)
+	}
+	for _, shard := range shards {
+		if expected[shard.cluster.GetAddr()] != shard.text {
+			t.Fatalf("Expected %q on %s, got %q", expected[shard.cluster.GetAddr()], shard.cluster.GetAddr(), shard.text)
+		}
+	}
+
+	// Negative keys and keys cast to a type are constants too
+	sql = "INSERT INTO users (id, name) VALUES (-5, 'a'), ('42'::bigint, 'b')"
+	statements, _ = query.Parse(sql)
+	if shards, errMsg = getInsertShards(sql, statements[0], table, database); errMsg != nil {
+		t.Fatal(errMsg)
+	}
+	for _, shard := range shards {
+		for key, row := range map[string]string{"-5": "(-5, 'a')", "42": "('42'::bigint, 'b')"} {
+			if owns := strings.Contains(shard.text, row); owns != (owner(key) == shard.cluster.GetAddr()) {
+				t.Fatalf("Expected the row with key %s on %s only, got %q on %s", key, owner(key), shard.text, shard.cluster.GetAddr())
+			}
+		}
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO users (name) VALUES ('a'), ('b')",
+		"INSERT INTO users (id, name) VALUES (1, 'a'), (lower('B'), 'b')",
+		"INSERT INTO users (id, name) SELECT id, name FROM staging",
+	} {
+		statements, _ := query.Parse(sql)
+		if _, errMsg := getInsertShards(sql, statements[0], table, database); errMsg == nil {
+			t.Fatalf("Expected %q to be rejected", sql)
+		}
+	}
+}
+
+func TestRelayShardRows(t *testing.T) {
+	first, _ := newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, buildResult(2, TRANSACTION_STATUS_IDLE))
+	second, _ := newScriptedServer(&ClusterConfig{Host: "b", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+
+	var client bytes.Buffer
+	results := relayShardRows(&readWriter{&bytes.Buffer{}, &client}, []*ServerConnection{first, second})
+	if tag := sumCommandTags(results); tag != "SELECT 3" {
+		t.Fatalf("Expected SELECT 3, got %q", tag)
+	}
+	// The rows are sent as they are read and the result is ended by
+	// the caller
+	var kinds []byte
+	for {
+		rm, err := protocol.GetRawPgMessage(&client)
+		if err != nil {
+			break
+		}
+		kinds = append(kinds, byte(rm.Kind))
+	}
+	if string(kinds) != "TDDD" {
+		t.Fatalf("Expected one RowDescription followed by 3 rows, got messages %q", kinds)
+	}
+
+	// Nothing is sent after a server failed
+	failing := buildQueryError("57014", "canceling statement due to user request").Pack()
+	failing = append(failing, protocol.BuildReadyForQueryPgMessage(TRANSACTION_STATUS_IDLE).Pack()...)
+	first, _ = newScriptedServer(&ClusterConfig{Host: "a", Port: 5432}, failing)
+	second, secondConn := newScriptedServer(&ClusterConfig{Host: "b", Port: 5432}, buildResult(1, TRANSACTION_STATUS_IDLE))
+	client.Reset()
+	results = relayShardRows(&readWriter{&bytes.Buffer{}, &client}, []*ServerConnection{first, second})
+	if results[0].errMsg == nil || results[1].tag != "SELECT 1" {
+		t.Fatalf("Expected the first server to fail and the second to be read, got %+v", results)
+	}
+	if client.Len() != 0 {
+		t.Fatalf("Expected nothing sent to the client, got %q", client.Bytes())
+	}
+	if _, err := secondConn.response.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected the second server to be read to its ReadyForQuery")
+	}
+}
+
+func TestScatteredQueryInTransaction(t *testing.T) {
+	database := lookupTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	sql := "UPDATE users SET name = 'x'"
+	statements, _ := query.Parse(sql)
+	shards := []shardQuery{{&database.Clusters[0], sql}, {&database.Clusters[1], sql}}
+	begin := "BEGIN ISOLATION LEVEL SERIALIZABLE"
+
+	// The client's deferred BEGIN is kept when a shard cannot be reached
+	first, firstConn := newSessionServer(database, &database.Clusters[0], buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE))
+	second, secondConn := newSessionServer(database, &database.Clusters[0],
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+	)
+	third, thirdConn := newSessionServer(database, &database.Clusters[1],
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+	)
+	serveScriptedPool(requester, map[string][]*ServerConnection{
+		"a:5432": {first, second},
+		"b:5432": {nil, third},
+	})
+	clientConn := &scriptedConn{}
+	client := &ClientConnection{Conn: clientConn, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: 1}}
+	client.pendingBegin = begin
+	handleScatteredQuery(shards, statements[0], client, requester, database)
+	if code := sentErrorCode(clientConn); code != "08006" {
+		t.Fatalf("Expected the statement to fail with 08006, got %q", code)
+	}
+	if status := sentReadyStatus(clientConn); status != TRANSACTION_STATUS_ACTIVE || client.pendingBegin != begin {
+		t.Fatalf("Expected the client to still be in its transaction, got %q with pending BEGIN %q", status, client.pendingBegin)
+	}
+	if queries := firstConn.queries(); !slices.Equal(queries, []string{begin}) {
+		t.Fatalf("Expected only the BEGIN to run, got %q", queries)
+	}
+
+	// A write inside the client's transaction is left for the client to
+	// commit
+	client = &ClientConnection{Conn: &scriptedConn{}, Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: 1}}
+	client.pendingBegin = "BEGIN"
+	handleScatteredQuery(shards, statements[0], client, requester, database)
+	for _, conn := range []*scriptedConn{secondConn, thirdConn} {
+		if queries := conn.queries(); !slices.Equal(queries, []string{"BEGIN", sql}) {
+			t.Fatalf("Expected the write to run in the client's transaction, got %q", queries)
+		}
+	}
+	if client.pendingBegin != "" || !client.InMultiShardTransaction() {
+		t.Fatal("Expected the client's transaction to have started on both shards")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+/// Compares the schema of every cluster of a sharded database with the first one to find the
+/// clusters a migration that failed part way left different
+
+const (
+	SCHEMA_OBJECT_TABLE      = "table"
+	SCHEMA_OBJECT_COLUMN     = "column"
+	SCHEMA_OBJECT_INDEX      = "index"
+	SCHEMA_OBJECT_CONSTRAINT = "constraint"
+
+	SCHEMA_DRIFT_MISSING = "missing"
+	SCHEMA_DRIFT_EXTRA   = "extra"
+	SCHEMA_DRIFT_DIFFERS = "differs"
+	SCHEMA_DRIFT_ERROR   = "error"
+)
+
+// Schemas that belong to postgres itself
+const SCHEMA_DRIFT_USER_SCHEMAS = "n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp_%'"
+
+// Queries listing the objects of each kind. Each returns the name of an
+// object and a definition that has to match across clusters
+var schemaDriftQueries = []struct {
+	kind  string
+	query string
+}{
+	{SCHEMA_OBJECT_TABLE, `SELECT n.nspname || '.' || c.relname, c.relkind::text
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f') AND ` + SCHEMA_DRIFT_USER_SCHEMAS},
+	{SCHEMA_OBJECT_COLUMN, `SELECT n.nspname || '.' || c.relname || '.' || a.attname,
+			format_type(a.atttypid, a.atttypmod)
+			|| CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+			|| coalesce(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attnum > 0 AND NOT a.attisdropped AND c.relkind IN ('r', 'p', 'v', 'm', 'f') AND ` + SCHEMA_DRIFT_USER_SCHEMAS},
+	{SCHEMA_OBJECT_INDEX, `SELECT n.nspname || '.' || c.relname,
+			pg_get_indexdef(i.indexrelid) || CASE WHEN i.indisvalid THEN '' ELSE ' INVALID' END
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + SCHEMA_DRIFT_USER_SCHEMAS},
+	{SCHEMA_OBJECT_CONSTRAINT, `SELECT n.nspname || '.' || c.relname || '.' || con.conname, pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + SCHEMA_DRIFT_USER_SCHEMAS},
+}
+
+type schemaObject struct {
+	kind string
+	name string
+}
+
+// A difference between the schema of a cluster and the first cluster of
+// the database
+type schemaDrift struct {
+	database string
+	object   schemaObject
+	cluster  string
+	drift    string
+	expected string
+	actual   string
+}
+
+func (d schemaDrift) row() []string {
+	return []string{d.database, d.object.kind, d.object.name, d.cluster, d.drift, d.expected, d.actual}
+}
+
+// Read the definitions of every object in the user schemas of a cluster
+func readClusterSchema(database *DatabaseConfig, cluster *ClusterConfig) (map[schemaObject]string, error) {
+	server, err := CreateServerConnection(database, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Terminate()
+
+	schema := make(map[schemaObject]string)
+	for _, query := range schemaDriftQueries {
+		rows, err := server.QueryRows(query.query)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if len(row.Values) != 2 {
+				return nil, fmt.Errorf("Unexpected result reading %s definitions on %s", query.kind, cluster.GetAddr())
+			}
+			schema[schemaObject{query.kind, string(row.Values[0])}] = string(row.Values[1])
+		}
+	}
+	return schema, nil
+}
+
+// Compare the schemas of the clusters against the schema of the first
+// one. Clusters without a schema could not be read and are skipped
+func compareSchemas(databaseName string, clusters []string, schemas []map[schemaObject]string) []schemaDrift {
+	drifts := make([]schemaDrift, 0)
+	if len(schemas) == 0 || schemas[0] == nil {
+		return drifts
+	}
+	objects := make(map[schemaObject]bool)
+	for _, schema := range schemas {
+		for object := range schema {
+			objects[object] = true
+		}
+	}
+
+	expectedSchema := schemas[0]
+	for object := range objects {
+		expected, expectedOk := expectedSchema[object]
+		for i, schema := range schemas[1:] {
+			if schema == nil {
+				continue
+			}
+			actual, ok := schema[object]
+			drift := schemaDrift{database: databaseName, object: object, cluster: clusters[i+1], expected: expected, actual: actual}
+			switch {
+			case expectedOk && !ok:
+				drift.drift = SCHEMA_DRIFT_MISSING
+			case !expectedOk && ok:
+				drift.drift = SCHEMA_DRIFT_EXTRA
+			case expected != actual:
+				drift.drift = SCHEMA_DRIFT_DIFFERS
+			default:
+				continue
+			}
+			drifts = append(drifts, drift)
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		a, b := drifts[i], drifts[j]
+		if a.object.name != b.object.name {
+			return a.object.name < b.object.name
+		}
+		if a.object.kind != b.object.kind {
+			return a.object.kind < b.object.kind
+		}
+		return a.cluster < b.cluster
+	})
+	return drifts
+}
+
+// Find the schema differences between the clusters of a database
+func checkSchemaDrift(database *DatabaseConfig) []schemaDrift {
+	clusters := make([]string, len(database.Clusters))
+	schemas := make([]map[schemaObject]string, len(database.Clusters))
+	failures := make([]schemaDrift, 0)
+	for i := range database.Clusters {
+		clusters[i] = database.Clusters[i].GetAddr()
+		schema, err := readClusterSchema(database, &database.Clusters[i])
+		if err != nil {
+			failures = append(failures, schemaDrift{database: database.Name, cluster: clusters[i], drift: SCHEMA_DRIFT_ERROR, actual: err.Error()})
+			continue
+		}
+		schemas[i] = schema
+	}
+	return append(failures, compareSchemas(database.Name, clusters, schemas)...)
+}
+
+func getSchemaDrift(config *SpannerConfig, databaseName string) ([]schemaDrift, error) {
+	drifts := make([]schemaDrift, 0)
+	found := false
+	for _, database := range config.Databases {
+		if databaseName != "" && !strings.EqualFold(databaseName, database.Name) {
+			continue
+		}
+		found = true
+		drifts = append(drifts, checkSchemaDrift(&database)...)
+	}
+	if !found {
+		return nil, fmt.Errorf("database %q is not configured", databaseName)
+	}
+	return drifts, nil
+}
+
+// SHOW SCHEMA DRIFT [database]
+func adminShowSchemaDrift(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	databaseName := ""
+	if len(args) > 0 {
+		databaseName = args[0]
+	}
+	drifts, err := getSchemaDrift(config, databaseName)
+	if err != nil {
+		return nil, buildAdminError("3D000", err.Error())
+	}
+	result := &adminResult{
+		Columns: []string{"database", "object_type", "object", "cluster", "drift", "expected", "actual"},
+		Rows:    make([][]string, 0, len(drifts)),
+	}
+	for _, drift := range drifts {
+		result.Rows = append(result.Rows, drift.row())
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
+
+// Print the schema differences between the clusters of the configured
+// databases. Exits with 1 when the schemas differ and 2 when a cluster
+// could not be checked
+func RunSchemaDrift(args []string) int {
+	flags := flag.NewFlagSet("schema-drift", flag.ExitOnError)
+	configPath := flags.String("config", "config.toml", "Path to the config file")
+	flags.Parse(args)
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: cannot read %s: %s\n", *configPath, err)
+		return 2
+	}
+	drifts, err := getSchemaDrift(config, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DATABASE\tTYPE\tOBJECT\tCLUSTER\tDRIFT\tEXPECTED\tACTUAL")
+	differences, failures := 0, 0
+	for _, drift := range drifts {
+		fmt.Fprintln(writer, strings.Join(drift.row(), "\t"))
+		if drift.drift == SCHEMA_DRIFT_ERROR {
+			failures++
+		} else {
+			differences++
+		}
+	}
+	writer.Flush()
+	fmt.Printf("%d differences found, %d clusters could not be checked\n", differences, failures)
+	switch {
+	case failures > 0:
+		return 2
+	case differences > 0:
+		return 1
+	default:
+		return 0
+	}
+}
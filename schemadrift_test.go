@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+func TestCompareSchemas(t *testing.T) {
+	users := schemaObject{SCHEMA_OBJECT_TABLE, "public.users"}
+	email := schemaObject{SCHEMA_OBJECT_COLUMN, "public.users.email"}
+	index := schemaObject{SCHEMA_OBJECT_INDEX, "public.users_email"}
+	extra := schemaObject{SCHEMA_OBJECT_TABLE, "public.scratch"}
+
+	schemas := []map[schemaObject]string{
+		{users: "r", email: "text NOT NULL", index: "CREATE INDEX users_email ON public.users USING btree (email)"},
+		{users: "r", email: "text", index: "CREATE INDEX users_email ON public.users USING btree (email) INVALID"},
+		nil,
+		{users: "r", email: "text NOT NULL", extra: "r"},
+	}
+	drifts := compareSchemas("test", []string{"a", "b", "c", "d"}, schemas)
+
+	expected := []struct {
+		object  schemaObject
+		cluster string
+		drift   string
+	}{
+		{extra, "d", SCHEMA_DRIFT_EXTRA},
+		{email, "b", SCHEMA_DRIFT_DIFFERS},
+		{index, "b", SCHEMA_DRIFT_DIFFERS},
+		{index, "d", SCHEMA_DRIFT_MISSING},
+	}
+	if len(drifts) != len(expected) {
+		t.Fatalf("Expected %d differences, got %d: %v", len(expected), len(drifts), drifts)
+	}
+	for i, drift := range drifts {
+		if drift.object != expected[i].object || drift.cluster != expected[i].cluster || drift.drift != expected[i].drift {
+			t.Fatalf("Difference %d: expected %v, got %v", i, expected[i], drift)
+		}
+	}
+
+	if drifts := compareSchemas("test", []string{"a", "b"}, []map[schemaObject]string{schemas[0], schemas[0]}); len(drifts) != 0 {
+		t.Fatalf("Expected no differences, got %v", drifts)
+	}
+}
+
+// Serve a cluster on a unix socket in a new directory. The catalog holds
+// the definitions of the objects of each kind the schema drift queries
+// read. Any other query fails
+func serveCatalogCluster(t *testing.T, catalog map[string][][2]string) ClusterConfig {
+	t.Helper()
+	dir := t.TempDir()
+	listener, err := net.Listen("unix", unixSocketPath(dir, 5432))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveCatalogConn(conn, catalog)
+		}
+	}()
+	return ClusterConfig{Host: dir, Port: 5432, User: "postgres", Name: "postgres"}
+}
+
+func serveCatalogConn(conn net.Conn, catalog map[string][][2]string) {
+	defer conn.Close()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint32(header))-4); err != nil {
+		return
+	}
+	conn.Write(protocol.BuildAuthenticationOkPgMessage().Pack())
+	conn.Write(protocol.BuildBackendKeyDataPgMessage(1, 1).Pack())
+	conn.Write(protocol.BuildReadyForQueryPgMessage(TRANSACTION_STATUS_IDLE).Pack())
+	for {
+		rm, err := protocol.GetRawPgMessage(conn)
+		if err != nil || rm.Kind != protocol.FMESSAGE_QUERY {
+			return
+		}
+		sql := strings.TrimRight(string(rm.Data), "\x00")
+		index := slices.IndexFunc(schemaDriftQueries, func(query struct{ kind, query string }) bool { return query.query == sql })
+		if index == -1 {
+			conn.Write(buildFailure("42601", TRANSACTION_STATUS_IDLE))
+			continue
+		}
+		rows := make([][][]byte, 0)
+		for _, object := range catalog[schemaDriftQueries[index].kind] {
+			rows = append(rows, [][]byte{[]byte(object[0]), []byte(object[1])})
+		}
+		conn.Write(buildRows(TRANSACTION_STATUS_IDLE, rows...))
+	}
+}
+
+func TestShowSchemaDrift(t *testing.T) {
+	expected := map[string][][2]string{
+		SCHEMA_OBJECT_TABLE:  {{"public.users", "r"}},
+		SCHEMA_OBJECT_COLUMN: {{"public.users.id", "bigint NOT NULL"}, {"public.users.email", "text"}},
+		SCHEMA_OBJECT_INDEX:  {{"public.users_email", "CREATE INDEX users_email ON public.users USING btree (email)"}},
+	}
+	drifted := map[string][][2]string{
+		SCHEMA_OBJECT_TABLE:  {{"public.users", "r"}, {"public.scratch", "r"}},
+		SCHEMA_OBJECT_COLUMN: {{"public.users.id", "integer NOT NULL"}, {"public.users.email", "text"}},
+	}
+	clusters := []ClusterConfig{
+		serveCatalogCluster(t, expected),
+		serveCatalogCluster(t, expected),
+		serveCatalogCluster(t, drifted),
+		// Nothing listens on the last cluster
+		{Host: t.TempDir(), Port: 5432, User: "postgres", Name: "postgres"},
+	}
+	config := &SpannerConfig{Databases: []DatabaseConfig{
+		{Name: "test", Clusters: clusters},
+		{Name: "other", Clusters: clusters[:2]},
+	}}
+
+	result, err := adminShowSchemaDrift([]string{"test"}, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driftedAt, down := clusters[2].GetAddr(), clusters[3].GetAddr()
+	expectedRows := [][]string{
+		{"test", "", "", down, SCHEMA_DRIFT_ERROR},
+		{"test", SCHEMA_OBJECT_TABLE, "public.scratch", driftedAt, SCHEMA_DRIFT_EXTRA},
+		{"test", SCHEMA_OBJECT_COLUMN, "public.users.id", driftedAt, SCHEMA_DRIFT_DIFFERS},
+		{"test", SCHEMA_OBJECT_INDEX, "public.users_email", driftedAt, SCHEMA_DRIFT_MISSING},
+	}
+	if len(result.Rows) != len(expectedRows) || result.Tag != "SHOW 4" {
+		t.Fatalf("Expected %d rows, got %q %v", len(expectedRows), result.Tag, result.Rows)
+	}
+	for i, row := range result.Rows {
+		if !slices.Equal(row[:5], expectedRows[i]) {
+			t.Fatalf("Row %d: expected %v, got %v", i, expectedRows[i], row)
+		}
+	}
+	if row := result.Rows[2]; row[5] != "bigint NOT NULL" || row[6] != "integer NOT NULL" {
+		t.Fatalf("Expected the differing definitions, got %v", row)
+	}
+
+	// Clusters with the same schema have no drift
+	if result, err := adminShowSchemaDrift([]string{"other"}, config, nil); err != nil || len(result.Rows) != 0 {
+		t.Fatalf("Expected no drift, got %v %v", result, err)
+	}
+	if _, err := adminShowSchemaDrift([]string{"missing"}, config, nil); err == nil {
+		t.Fatal("Expected an unknown database to be rejected")
+	}
+}
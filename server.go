@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/livinlefevreloca/pgspanner/protocol"
@@ -49,16 +51,59 @@ func (s *serverConnectionContext) SetParameter(key string, value string) {
 	s.Parmeters[key] = value
 }
 
+const (
+	HEALTH_CHECK_QUERY   = "SELECT 1"
+	HEALTH_CHECK_TIMEOUT = 2 * time.Second
+	CONNECT_TIMEOUT      = 5 * time.Second
+)
+
+// Transaction status indicators sent by the server in ReadyForQuery
+const (
+	TRANSACTION_STATUS_IDLE   = 'I'
+	TRANSACTION_STATUS_ACTIVE = 'T'
+	TRANSACTION_STATUS_FAILED = 'E'
+)
+
 // An object representing a connection to a server
 type ServerConnection struct {
-	Conn       net.Conn
-	Context    *serverConnectionContext
-	createTime int64
-	poisoned   bool
+	Conn              net.Conn
+	Context           *serverConnectionContext
+	createTime        int64
+	lastUsed          int64
+	transactionStatus byte
+	// Buffers reads once the connection is started up so relaying a
+	// result does not cost two syscalls per message
+	reader *bufio.Reader
+	// Connections can be poisoned by the pool manager while a client
+	// is using them so this needs to be safe for concurrent access
+	poisoned atomic.Bool
+	// Address of the configured primary of the shard the connection was
+	// handed out for. Set by the pool manager
+	shardAddr string
+	// The host does not allow prepared transactions. Set by the pool
+	// manager
+	noPreparedTransactions bool
 }
 
 func (s *ServerConnection) IsPoisoned() bool {
-	return s.poisoned
+	return s.poisoned.Load()
+}
+
+func (s *ServerConnection) Poison() {
+	s.poisoned.Store(true)
+}
+
+func (s *ServerConnection) GetTransactionStatus() byte {
+	return s.transactionStatus
+}
+
+func (s *ServerConnection) SetTransactionStatus(status byte) {
+	s.transactionStatus = status
+}
+
+// Whether the server has an open (or aborted) transaction on this connection
+func (s *ServerConnection) InTransaction() bool {
+	return s.transactionStatus == TRANSACTION_STATUS_ACTIVE || s.transactionStatus == TRANSACTION_STATUS_FAILED
 }
 
 func (s *ServerConnection) GetBackendPid() int {
@@ -77,6 +122,15 @@ func (s *ServerConnection) GetClusterConfig() *ClusterConfig {
 	return s.Context.Cluster
 }
 
+// The address clients pin the connection by. It differs from the
+// cluster's address for replicas and promoted primaries
+func (s *ServerConnection) GetShardAddr() string {
+	if s.shardAddr == "" {
+		return s.GetClusterConfig().GetAddr()
+	}
+	return s.shardAddr
+}
+
 func (s *ServerConnection) GetDatabaseConfig() *DatabaseConfig {
 	return s.Context.Database
 }
@@ -85,7 +139,7 @@ func (s *ServerConnection) GetDatabaseConfig() *DatabaseConfig {
 func (s *ServerConnection) Write(p []byte) (n int, err error) {
 	if n, err := s.Conn.Write(p); err != nil {
 		slog.Error("Error writing to server", "error", err)
-		s.poisoned = true
+		s.poisoned.Store(true)
 		return n, err
 	} else {
 		return n, nil
@@ -94,9 +148,12 @@ func (s *ServerConnection) Write(p []byte) (n int, err error) {
 
 // implement the Reader interface for the ServerConnection
 func (s *ServerConnection) Read(p []byte) (n int, err error) {
-	if n, err := s.Conn.Read(p); err != nil {
+	if s.reader == nil {
+		s.reader = bufio.NewReaderSize(s.Conn, RELAY_BUFFER_SIZE)
+	}
+	if n, err := s.reader.Read(p); err != nil {
 		slog.Error("Error reading from server", "error", err)
-		s.poisoned = true
+		s.poisoned.Store(true)
 		return n, err
 	} else {
 		return n, nil
@@ -107,10 +164,26 @@ func (s *ServerConnection) GetAge() int64 {
 	return time.Now().Unix() - s.createTime
 }
 
+// Seconds since the connection was last returned to the pool
+func (s *ServerConnection) GetIdleTime() int64 {
+	return time.Now().Unix() - s.lastUsed
+}
+
+func (s *ServerConnection) MarkUsed() {
+	s.lastUsed = time.Now().Unix()
+}
+
 func (s *ServerConnection) Close() {
 	s.Conn.Close()
 }
 
+// Tell the server we are going away before closing the connection
+func (s *ServerConnection) Terminate() {
+	s.Conn.SetWriteDeadline(time.Now().Add(HEALTH_CHECK_TIMEOUT))
+	s.Conn.Write(protocol.BuildTerminateMessage().Pack())
+	s.Conn.Close()
+}
+
 func handleStartup(
 	server *ServerConnection,
 ) (*ServerConnection, error) {
@@ -169,31 +242,38 @@ func CreateUnititializedServerConnection(
 	clusterConfig *ClusterConfig,
 ) (*ServerConnection, error) {
 	serverContext := newServerConnectionContext(clusterConfig, databaseConfig)
-	addrs, err := net.LookupHost(clusterConfig.Host)
-	if err != nil {
-		return nil, err
-	}
+	network, addr := clusterConfig.GetNetworkAddr()
+	if network == "tcp" {
+		addrs, err := net.LookupHost(clusterConfig.Host)
+		if err != nil {
+			return nil, err
+		}
 
-	var IP string
-	if len(addrs) == 2 {
-		IP = addrs[1]
-	} else {
-		IP = addrs[0]
-	}
+		var IP string
+		if len(addrs) == 2 {
+			IP = addrs[1]
+		} else {
+			IP = addrs[0]
+		}
 
-	hostAddr := net.TCPAddr{
-		IP:   net.ParseIP(IP),
-		Port: clusterConfig.Port,
+		hostAddr := net.TCPAddr{
+			IP:   net.ParseIP(IP),
+			Port: clusterConfig.Port,
+		}
+		addr = hostAddr.String()
 	}
 
-	conn, err := net.DialTCP("tcp", nil, &hostAddr)
+	conn, err := net.DialTimeout(network, addr, CONNECT_TIMEOUT)
 	if err != nil {
 		return nil, err
 	}
+	now := time.Now().Unix()
 	serverConnection := ServerConnection{
-		Conn:       conn,
-		Context:    serverContext,
-		createTime: time.Now().Unix(),
+		Conn:              conn,
+		Context:           serverContext,
+		createTime:        now,
+		lastUsed:          now,
+		transactionStatus: TRANSACTION_STATUS_IDLE,
 	}
 
 	return &serverConnection, nil
@@ -237,3 +317,105 @@ func (s *ServerConnection) IssueQuery(query string) {
 	queryMessage := protocol.BuildQueryMessage(query)
 	s.Conn.Write(queryMessage.Pack())
 }
+
+// Run a query on the connection and discard its results. Any error
+// returned by the server is returned as an ErrorResponsePgMessage
+func (s *ServerConnection) Exec(query string) error {
+	_, err := s.QueryRows(query)
+	return err
+}
+
+// Run a query on the connection and collect the rows it returns. Any
+// error returned by the server is returned as an ErrorResponsePgMessage
+func (s *ServerConnection) QueryRows(query string) ([]*protocol.DataRowPgMessage, error) {
+	queryMessage := protocol.BuildQueryMessage(query)
+	if _, err := s.Write(queryMessage.Pack()); err != nil {
+		return nil, err
+	}
+
+	rows := make([]*protocol.DataRowPgMessage, 0)
+	var serverErr error
+	for {
+		rm, err := protocol.GetRawPgMessage(s)
+		if err != nil {
+			return nil, err
+		}
+		switch rm.Kind {
+		case protocol.BMESSAGE_DATA_ROW:
+			row := &protocol.DataRowPgMessage{}
+			row, err = row.Unpack(rm)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			errMsg := &protocol.ErrorResponsePgMessage{}
+			errMsg, err = errMsg.Unpack(rm)
+			if err != nil {
+				return nil, err
+			}
+			serverErr = errMsg
+		case protocol.BMESSAGE_READY_FOR_QUERY:
+			readyForQuery := &protocol.ReadyForQueryPgMessage{}
+			readyForQuery, err = readyForQuery.Unpack(rm)
+			if err != nil {
+				return nil, err
+			}
+			s.SetTransactionStatus(readyForQuery.TransactionStatus)
+			if serverErr != nil {
+				return nil, serverErr
+			}
+			return rows, nil
+		}
+	}
+}
+
+// Clear any session state left on the connection by a client so it
+// can be safely handed to another one. Open transactions are rolled
+// back before the configured reset query is run. If anything fails or
+// the server does not answer within HEALTH_CHECK_TIMEOUT the connection
+// is poisoned so the pool discards it.
+func (s *ServerConnection) Reset() {
+	if s.IsPoisoned() {
+		return
+	}
+	s.Conn.SetDeadline(time.Now().Add(HEALTH_CHECK_TIMEOUT))
+	defer s.Conn.SetDeadline(time.Time{})
+
+	poolSettings := s.GetDatabaseConfig().PoolSettings
+	if s.InTransaction() {
+		slog.Info(
+			"Rolling back open transaction on returned connection",
+			"BackendPid", s.GetBackendPid(),
+			"TransactionStatus", string(s.transactionStatus),
+		)
+		if err := s.Exec("ROLLBACK"); err != nil {
+			slog.Error("Error rolling back transaction", "error", err, "BackendPid", s.GetBackendPid())
+			s.poisoned.Store(true)
+			return
+		}
+	}
+	if err := s.Exec(poolSettings.GetResetQuery()); err != nil {
+		slog.Error("Error running reset query", "error", err, "BackendPid", s.GetBackendPid())
+		s.poisoned.Store(true)
+	}
+}
+
+// Run a cheap query against the connection to verify that the server
+// is still there. The connection is poisoned if the check fails.
+func (s *ServerConnection) CheckLiveness() bool {
+	s.Conn.SetDeadline(time.Now().Add(HEALTH_CHECK_TIMEOUT))
+	defer s.Conn.SetDeadline(time.Time{})
+
+	if err := s.Exec(HEALTH_CHECK_QUERY); err != nil {
+		slog.Warn(
+			"Liveness check failed",
+			"error", err,
+			"Cluster", s.GetClusterConfig().GetAddr(),
+			"BackendPid", s.GetBackendPid(),
+		)
+		s.poisoned.Store(true)
+		return false
+	}
+	return true
+}
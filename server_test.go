@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResetTimeout(t *testing.T) {
+	proxyEnd, serverEnd := net.Pipe()
+	defer proxyEnd.Close()
+	defer serverEnd.Close()
+	// The server takes the queries but never answers
+	go io.Copy(io.Discard, serverEnd)
+	server := &ServerConnection{
+		Conn:    proxyEnd,
+		Context: &serverConnectionContext{Cluster: &ClusterConfig{Host: "a", Port: 5432}, Database: &DatabaseConfig{Name: "test"}},
+	}
+	server.SetTransactionStatus(TRANSACTION_STATUS_ACTIVE)
+
+	start := time.Now()
+	server.Reset()
+	if !server.IsPoisoned() {
+		t.Fatal("Expected a connection that did not answer the reset to be poisoned")
+	}
+	if elapsed := time.Since(start); elapsed > 2*HEALTH_CHECK_TIMEOUT {
+		t.Fatalf("Expected the reset to give up after %s, took %s", HEALTH_CHECK_TIMEOUT, elapsed)
+	}
+}
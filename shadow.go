@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// A cluster about to take over from another can be given a sample of the reads of the cluster it
+/// replaces. The shadow's rows are thrown away and only compared with the source's
+
+const (
+	// Mismatches kept per database
+	SHADOW_MISMATCH_HISTORY = 100
+	// Reads slower than the source by no more than this are never
+	// latency mismatches so fast reads are not flagged for noise
+	SHADOW_LATENCY_TOLERANCE = 10 * time.Millisecond
+	// Connections to the shadow cluster are closed after being idle this long
+	SHADOW_IDLE_TIMEOUT = time.Minute
+)
+
+// A read that ran on the source cluster and how it went
+type shadowRead struct {
+	query      string
+	searchPath string
+	rows       int
+	failed     bool
+	latency    time.Duration
+}
+
+type shadowMismatch struct {
+	time          time.Time
+	query         string
+	reason        string
+	sourceRows    int
+	shadowRows    int
+	sourceLatency time.Duration
+	shadowLatency time.Duration
+}
+
+// Mirrors reads of a database to its shadow cluster
+type shadowMirror struct {
+	database DatabaseConfig
+	reads    chan shadowRead
+
+	mu         sync.RWMutex
+	closed     bool
+	mismatches []shadowMismatch
+
+	mirrored   atomic.Int64
+	dropped    atomic.Int64
+	failed     atomic.Int64
+	mismatched atomic.Int64
+	// Microseconds the mirrored reads took on each cluster
+	sourceLatency atomic.Int64
+	shadowLatency atomic.Int64
+}
+
+// The mirror of every database with a shadow, replaced when a reload
+// changes its settings
+var shadowMirrors = struct {
+	sync.Mutex
+	keys    map[string]string
+	mirrors map[string]*shadowMirror
+}{keys: make(map[string]string), mirrors: make(map[string]*shadowMirror)}
+
+func shadowMirrorKey(database *DatabaseConfig) string {
+	return fmt.Sprintf("%+v %s", database.Shadow, database.Shadow.GetSource(database))
+}
+
+func getShadowMirror(database *DatabaseConfig) *shadowMirror {
+	shadowMirrors.Lock()
+	defer shadowMirrors.Unlock()
+	key := shadowMirrorKey(database)
+	if mirror, ok := shadowMirrors.mirrors[database.Name]; ok {
+		if shadowMirrors.keys[database.Name] == key {
+			return mirror
+		}
+		mirror.close()
+	}
+	mirror := newShadowMirror(database)
+	shadowMirrors.keys[database.Name] = key
+	shadowMirrors.mirrors[database.Name] = mirror
+	return mirror
+}
+
+func newShadowMirror(database *DatabaseConfig) *shadowMirror {
+	mirror := &shadowMirror{
+		database: *database,
+		reads:    make(chan shadowRead, database.Shadow.GetQueueSize()),
+	}
+	for i := 0; i < database.Shadow.GetMaxConns(); i++ {
+		worker := &shadowWorker{mirror: mirror}
+		go worker.run()
+	}
+	slog.Info(
+		"Mirroring reads to shadow cluster",
+		"database", database.Name,
+		"shadow", database.Shadow.Cluster.GetAddr(),
+		"source", database.Shadow.GetSource(database),
+		"sampleRate", database.Shadow.SampleRate,
+	)
+	return mirror
+}
+
+// Pick the reads of a query to mirror at the sample rate of the
+// database's shadow. Only SELECTs outside of transactions that ran on the
+// source cluster are mirrored. Returns nil for the other queries
+func sampleShadowRead(
+	statements []*query.Statement,
+	cluster *ClusterConfig,
+	server *ServerConnection,
+	database *DatabaseConfig,
+) *shadowMirror {
+	shadow := &database.Shadow
+	if !shadow.Enabled() || server.InTransaction() || !query.IsReadOnly(statements) {
+		return nil
+	}
+	for _, statement := range statements {
+		if statement.Kind != query.KIND_SELECT {
+			return nil
+		}
+	}
+	if cluster.GetAddr() != shadow.GetSource(database) || rand.Float64()*100 >= shadow.SampleRate {
+		return nil
+	}
+	return getShadowMirror(database)
+}
+
+// Queue a read for the shadow cluster without waiting. Reads are queued
+// once the client has its answer so the client never waits on the
+// shadow, and dropped when the queue is full
+func (m *shadowMirror) enqueue(read shadowRead) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.reads <- read:
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+// Stop the workers once they finished the reads already queued
+func (m *shadowMirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.reads)
+	}
+}
+
+func (m *shadowMirror) compare(read shadowRead, rows int, failed bool, latency time.Duration) {
+	m.mirrored.Add(1)
+	m.sourceLatency.Add(read.latency.Microseconds())
+	m.shadowLatency.Add(latency.Microseconds())
+	reason := getShadowMismatch(read, rows, failed, latency, m.database.Shadow.GetMaxLatencyRatio())
+	if reason == "" {
+		return
+	}
+	m.mismatched.Add(1)
+	slog.Warn(
+		"Shadow read mismatch",
+		"database", m.database.Name,
+		"reason", reason,
+		"query", read.query,
+		"sourceRows", read.rows,
+		"shadowRows", rows,
+		"sourceLatency", read.latency,
+		"shadowLatency", latency,
+	)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mismatches = append(m.mismatches, shadowMismatch{
+		time:          time.Now(),
+		query:         read.query,
+		reason:        reason,
+		sourceRows:    read.rows,
+		shadowRows:    rows,
+		sourceLatency: read.latency,
+		shadowLatency: latency,
+	})
+	if len(m.mismatches) > SHADOW_MISMATCH_HISTORY {
+		m.mismatches = slices.Delete(m.mismatches, 0, len(m.mismatches)-SHADOW_MISMATCH_HISTORY)
+	}
+}
+
+// Why a read on the shadow cluster does not match the source: it returned
+// a different number of rows, failed when the source did not or the other
+// way around, or was more than maxLatencyRatio times slower. Returns an
+// empty string when it matches
+func getShadowMismatch(read shadowRead, rows int, failed bool, latency time.Duration, maxLatencyRatio float64) string {
+	switch {
+	case failed && !read.failed:
+		return "failed on the shadow cluster only"
+	case !failed && read.failed:
+		return "failed on the source cluster only"
+	case failed:
+		return ""
+	case rows != read.rows:
+		return fmt.Sprintf("returned %d rows instead of %d", rows, read.rows)
+	case latency > read.latency+SHADOW_LATENCY_TOLERANCE && float64(latency) > float64(read.latency)*maxLatencyRatio:
+		return fmt.Sprintf("took %s instead of %s", latency.Round(time.Millisecond), read.latency.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// Runs queued reads on a connection of its own to the shadow cluster
+type shadowWorker struct {
+	mirror     *shadowMirror
+	server     *ServerConnection
+	searchPath string
+}
+
+func (w *shadowWorker) run() {
+	defer w.disconnect()
+	for {
+		select {
+		case read, ok := <-w.mirror.reads:
+			if !ok {
+				return
+			}
+			w.replay(read)
+		case <-time.After(SHADOW_IDLE_TIMEOUT):
+			w.disconnect()
+		}
+	}
+}
+
+func (w *shadowWorker) disconnect() {
+	if w.server != nil {
+		w.server.Terminate()
+		w.server = nil
+	}
+}
+
+// Run a read on the shadow cluster and compare it with the source. A read
+// the shadow cluster could not be asked counts as failed, not as a
+// mismatch
+func (w *shadowWorker) replay(read shadowRead) {
+	database := &w.mirror.database
+	if w.server == nil {
+		server, err := CreateServerConnection(database, &database.Shadow.Cluster)
+		if err != nil {
+			w.mirror.failed.Add(1)
+			slog.Warn("Unable to connect to shadow cluster", "database", database.Name, "shadow", database.Shadow.Cluster.GetAddr(), "error", err)
+			return
+		}
+		w.server = server
+		w.searchPath = ""
+	}
+	if read.searchPath != w.searchPath {
+		searchPath := read.searchPath
+		if searchPath == "" {
+			searchPath = "DEFAULT"
+		}
+		if err := w.server.Exec("SET search_path TO " + searchPath); err != nil {
+			w.mirror.failed.Add(1)
+			w.disconnect()
+			return
+		}
+		w.searchPath = read.searchPath
+	}
+
+	start := time.Now()
+	w.server.IssueQuery(read.query)
+	rows, failed, err := readShadowResult(w.server)
+	latency := time.Since(start)
+	if err != nil || w.server.InTransaction() {
+		w.mirror.failed.Add(1)
+		slog.Warn("Lost connection to shadow cluster", "database", database.Name, "shadow", database.Shadow.Cluster.GetAddr(), "error", err)
+		w.disconnect()
+		return
+	}
+	w.mirror.compare(read, rows, failed, latency)
+}
+
+// Read a server's answer up to ReadyForQuery counting its rows
+func readShadowResult(server *ServerConnection) (int, bool, error) {
+	rows := 0
+	failed := false
+	for {
+		rm, err := protocol.GetRawPgMessage(server)
+		if err != nil {
+			return rows, failed, err
+		}
+		switch rm.Kind {
+		case protocol.BMESSAGE_DATA_ROW:
+			rows++
+		case protocol.BMESSAGE_ERROR_RESPONSE:
+			failed = true
+		case protocol.BMESSAGE_READY_FOR_QUERY:
+			readyForQuery := &protocol.ReadyForQueryPgMessage{}
+			if readyForQuery, err = readyForQuery.Unpack(rm); err != nil {
+				return rows, failed, err
+			}
+			server.SetTransactionStatus(readyForQuery.TransactionStatus)
+			return rows, failed, nil
+		}
+	}
+}
+
+var shadowColumns = []string{
+	"database", "shadow", "source", "sample_rate", "mirrored", "dropped", "failed", "mismatches", "source_avg_ms", "shadow_avg_ms",
+}
+
+// SHOW SHADOW lists how the reads mirrored to each shadow cluster compare
+func adminShowShadow(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	result := &adminResult{Columns: shadowColumns, Rows: make([][]string, 0)}
+	for _, mirror := range getConfiguredShadowMirrors(config) {
+		shadow := &mirror.database.Shadow
+		mirrored := mirror.mirrored.Load()
+		average := func(total int64) string {
+			if mirrored == 0 {
+				return ""
+			}
+			return fmt.Sprintf("%.3f", float64(total)/float64(mirrored)/1000)
+		}
+		result.Rows = append(result.Rows, []string{
+			mirror.database.Name,
+			shadow.Cluster.GetAddr(),
+			shadow.GetSource(&mirror.database),
+			fmt.Sprint(shadow.SampleRate),
+			fmt.Sprint(mirrored),
+			fmt.Sprint(mirror.dropped.Load()),
+			fmt.Sprint(mirror.failed.Load()),
+			fmt.Sprint(mirror.mismatched.Load()),
+			average(mirror.sourceLatency.Load()),
+			average(mirror.shadowLatency.Load()),
+		})
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
+
+var shadowMismatchColumns = []string{
+	"database", "time", "reason", "source_rows", "shadow_rows", "source_ms", "shadow_ms", "query",
+}
+
+// SHOW SHADOW MISMATCHES lists the latest reads that did not match,
+// oldest first
+func adminShowShadowMismatches(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	result := &adminResult{Columns: shadowMismatchColumns, Rows: make([][]string, 0)}
+	for _, mirror := range getConfiguredShadowMirrors(config) {
+		mirror.mu.RLock()
+		for _, mismatch := range mirror.mismatches {
+			result.Rows = append(result.Rows, []string{
+				mirror.database.Name,
+				formatAdminTime(mismatch.time),
+				mismatch.reason,
+				fmt.Sprint(mismatch.sourceRows),
+				fmt.Sprint(mismatch.shadowRows),
+				fmt.Sprintf("%.3f", float64(mismatch.sourceLatency.Microseconds())/1000),
+				fmt.Sprintf("%.3f", float64(mismatch.shadowLatency.Microseconds())/1000),
+				mismatch.query,
+			})
+		}
+		mirror.mu.RUnlock()
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
+
+// The mirrors of the databases that still have a shadow in the config,
+// in the order of the config
+func getConfiguredShadowMirrors(config *SpannerConfig) []*shadowMirror {
+	mirrors := make([]*shadowMirror, 0)
+	for i := range config.Databases {
+		database := &config.Databases[i]
+		if database.Shadow.Enabled() {
+			mirrors = append(mirrors, getShadowMirror(database))
+		}
+	}
+	return mirrors
+}
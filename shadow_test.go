@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestGetShadowMismatch(t *testing.T) {
+	read := shadowRead{rows: 3, latency: 20 * time.Millisecond}
+	cases := []struct {
+		rows     int
+		failed   bool
+		latency  time.Duration
+		mismatch bool
+	}{
+		{3, false, 30 * time.Millisecond, false},
+		{2, false, 20 * time.Millisecond, true},
+		{0, true, 20 * time.Millisecond, true},
+		{3, false, 45 * time.Millisecond, true},
+		// Fast reads are not flagged for being slower
+		{3, false, 25 * time.Millisecond, false},
+	}
+	for _, c := range cases {
+		reason := getShadowMismatch(read, c.rows, c.failed, c.latency, DEFAULT_SHADOW_MAX_LATENCY_RATIO)
+		if (reason != "") != c.mismatch {
+			t.Fatalf("Expected mismatch %v for %d rows, failed %v in %s, got %q", c.mismatch, c.rows, c.failed, c.latency, reason)
+		}
+	}
+
+	failed := shadowRead{failed: true}
+	if reason := getShadowMismatch(failed, 0, true, time.Second, DEFAULT_SHADOW_MAX_LATENCY_RATIO); reason != "" {
+		t.Fatalf("Expected reads failing on both clusters to match, got %q", reason)
+	}
+	if reason := getShadowMismatch(failed, 1, false, 0, DEFAULT_SHADOW_MAX_LATENCY_RATIO); reason == "" {
+		t.Fatalf("Expected a read failing on the source only to be a mismatch")
+	}
+}
+
+func TestSampleShadowRead(t *testing.T) {
+	database := joinTestDatabase()
+	database.Shadow = ShadowConfig{Cluster: ClusterConfig{Name: "test", Host: "shadow", Port: 5432}, SampleRate: 100}
+	server := &ServerConnection{transactionStatus: TRANSACTION_STATUS_IDLE}
+	statements, _ := query.Parse("SELECT * FROM users")
+	writes, _ := query.Parse("UPDATE users SET a = 1")
+	if sampleShadowRead(statements, &database.Clusters[1], server, database) != nil {
+		t.Fatalf("Expected reads of another cluster than the source not to be mirrored")
+	}
+	if sampleShadowRead(writes, &database.Clusters[0], server, database) != nil {
+		t.Fatalf("Expected writes not to be mirrored")
+	}
+	mirror := sampleShadowRead(statements, &database.Clusters[0], server, database)
+	if mirror == nil {
+		t.Fatalf("Expected reads of the source to be mirrored")
+	}
+	mirror.close()
+}
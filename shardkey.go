@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// Statements on a sharded table that pin its shard key, or a lookup column, with constants run
+/// on the cluster owning the key
+
+// The text postgres prints for a shard key constant of a column of the
+// type, which key range moves hash. A cast decides the type of the
+// constant and a number is an integer. Constants the proxy cannot print
+// the same way postgres does, like 1.5, are rejected
+func shardKeyText(constant query.Constant, keyType string) (string, error) {
+	switch constant.Cast {
+	case "":
+		if constant.Numeric && keyType != SHARD_KEY_TYPE_UUID {
+			keyType = SHARD_KEY_TYPE_INTEGER
+		}
+	case "smallint", "integer", "int", "bigint", "int2", "int4", "int8":
+		keyType = SHARD_KEY_TYPE_INTEGER
+	case "uuid":
+		keyType = SHARD_KEY_TYPE_UUID
+	case "text", "varchar", "character varying":
+		keyType = SHARD_KEY_TYPE_TEXT
+	default:
+		return "", fmt.Errorf("shard key %q cannot be cast to %s", constant.Value, constant.Cast)
+	}
+
+	switch keyType {
+	case SHARD_KEY_TYPE_INTEGER:
+		value, ok := new(big.Int).SetString(strings.TrimSpace(constant.Value), 10)
+		if !ok {
+			return "", fmt.Errorf("shard key %q is not an integer", constant.Value)
+		}
+		return value.String(), nil
+	case SHARD_KEY_TYPE_UUID:
+		// Postgres takes uuids in upper case, without hyphens or in braces
+		digits := strings.ReplaceAll(strings.TrimSpace(constant.Value), "-", "")
+		if strings.HasPrefix(digits, "{") && strings.HasSuffix(digits, "}") {
+			digits = digits[1 : len(digits)-1]
+		}
+		value, err := hex.DecodeString(digits)
+		if constant.Numeric || err != nil || len(value) != 16 {
+			return "", fmt.Errorf("shard key %q is not a uuid", constant.Value)
+		}
+		digits = hex.EncodeToString(value)
+		return digits[:8] + "-" + digits[8:12] + "-" + digits[12:16] + "-" + digits[16:20] + "-" + digits[20:], nil
+	default:
+		return constant.Value, nil
+	}
+}
+
+// Find the shard keys of the rows a statement touches. Returns false
+// when the statement does not pin them
+func getStatementShardKeys(
+	statement *query.Statement,
+	clientPid int,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) ([]string, bool, error) {
+	refs := findShardedTables(statement, database)
+	if len(refs) == 0 || len(refs) > 1 && (statement.Kind == query.KIND_INSERT || checkColocated(statement, refs) != nil) {
+		return nil, false, nil
+	}
+
+	switch statement.Kind {
+	case query.KIND_INSERT:
+		table := refs[0].table
+		insert, err := query.ParseInsert(statement)
+		if err != nil || len(insert.Values) == 0 {
+			return nil, false, nil
+		}
+		column := slices.Index(insert.Columns, table.ShardKey)
+		keys := make([]string, 0, len(insert.Values))
+		for _, row := range insert.Values {
+			if column < 0 || column >= len(row) {
+				return nil, false, nil
+			}
+			constant, ok := query.Literal(row[column])
+			if !ok {
+				return nil, false, nil
+			}
+			// getInsertShards reports the key it cannot route
+			key, err := shardKeyText(constant, table.GetShardKeyType())
+			if err != nil {
+				return nil, false, nil
+			}
+			keys = append(keys, key)
+		}
+		return keys, true, nil
+	case query.KIND_SELECT, query.KIND_UPDATE, query.KIND_DELETE:
+		where, ok := query.Where(statement)
+		if !ok {
+			return nil, false, nil
+		}
+		// An unqualified column could belong to any of the tables. The
+		// tables of a co-located join share their shard key values so a
+		// key bound on any of them pins the rows of all of them
+		unqualified := len(query.Tables(statement)) == 1
+		var lookupTable string
+		var lookupValue string
+		for _, equality := range where.Equalities {
+			for _, ref := range refs {
+				if equality.Qualifier == "" && !unqualified ||
+					equality.Qualifier != "" && equality.Qualifier != ref.ref.Table && equality.Qualifier != ref.ref.Alias {
+					continue
+				}
+				// A key the proxy cannot hash runs on every cluster
+				if equality.Column == ref.table.ShardKey {
+					if key, err := shardKeyText(equality.Value, ref.table.GetShardKeyType()); err == nil {
+						return []string{key}, true, nil
+					}
+				}
+				if found, ok := ref.table.GetLookup(equality.Column); ok && lookupTable == "" {
+					if value, err := shardKeyText(equality.Value, SHARD_KEY_TYPE_TEXT); err == nil {
+						lookupTable, lookupValue = found.GetTable(ref.table), value
+					}
+				}
+			}
+		}
+		if lookupTable != "" {
+			keys, err := readLookup(requester, clientPid, database, lookupTable, lookupValue)
+			return keys, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Find the cluster a query runs on from the shard keys it pins. Writes
+// wait for key ranges that are being moved. Returns nil when the query
+// does not pin its keys to a single cluster
+func routeByShardKey(
+	statements []*query.Statement,
+	write *routedWrite,
+	clientPid int,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) (*ClusterConfig, error) {
+	if len(statements) != 1 || !database.IsSharded() {
+		return nil, nil
+	}
+	keys, pinned, err := getStatementShardKeys(statements[0], clientPid, requester, database)
+	if err != nil || !pinned {
+		return nil, err
+	}
+	// No row has the looked up value so any cluster gives the same answer
+	if len(keys) == 0 {
+		return &database.Clusters[0], nil
+	}
+
+	database = routeKeys(write, requester, database, keys)
+	var owner *ClusterConfig
+	for _, key := range keys {
+		cluster, ok := database.GetClusterForKeyspaceId(KeyspaceId([]byte(key)))
+		if !ok || (owner != nil && owner.GetAddr() != cluster.GetAddr()) {
+			return nil, nil
+		}
+		owner = cluster
+	}
+	return owner, nil
+}
+
+// Wait until rows with the keys may be written. Returns the current
+// config of the database since a cutover may have finished after the
+// query looked it up
+func routeKeys(write *routedWrite, requester *ConnectionRequester, database *DatabaseConfig, keys []string) *DatabaseConfig {
+	if write == nil {
+		return database
+	}
+	for _, key := range keys {
+		write.Route(KeyspaceId([]byte(key)))
+	}
+	if current, ok := requester.GetConfig().GetDatabaseConfigByName(database.Name); ok {
+		return current
+	}
+	return database
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+func TestRouteByShardKey(t *testing.T) {
+	database := lookupTestDatabase()
+	owner := func(key string) string {
+		cluster, _ := database.GetClusterForKeyspaceId(KeyspaceId([]byte(key)))
+		return cluster.GetAddr()
+	}
+
+	cases := []struct {
+		sql      string
+		expected string
+	}{
+		{"SELECT * FROM users WHERE id = 42", owner("42")},
+		{"SELECT * FROM users u JOIN countries c ON c.code = u.country WHERE u.id = '7' AND c.code = 'nl'", owner("7")},
+		{"UPDATE users SET name = 'x' WHERE id = 3", owner("3")},
+		{"INSERT INTO users (id, name) VALUES (5, 'a')", owner("5")},
+		{"INSERT INTO users (id, name) VALUES (-5, 'a')", owner("-5")},
+		{"SELECT * FROM users WHERE id=-5", owner("-5")},
+		{"SELECT * FROM users WHERE id = '42'::bigint", owner("42")},
+		// Not pinned to a single cluster
+		{"SELECT * FROM users u JOIN countries c ON c.code = u.country WHERE id = 7", ""},
+		{"SELECT * FROM users WHERE id = 1 OR id = 2", ""},
+		{"SELECT * FROM users WHERE id > 1", ""},
+		{"INSERT INTO users (id) VALUES (pgspanner.next_id('users'))", ""},
+		{"SELECT * FROM countries WHERE id = 1", ""},
+	}
+	for _, c := range cases {
+		statements, err := query.Parse(c.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster, err := routeByShardKey(statements, nil, 0, nil, database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ""
+		if cluster != nil {
+			addr = cluster.GetAddr()
+		}
+		if addr != c.expected {
+			t.Fatalf("Expected %q to route to %q, got %q", c.sql, c.expected, addr)
+		}
+	}
+
+	// Rows owned by different clusters
+	other := 2
+	for owner(fmt.Sprint(other)) == owner("1") {
+		other++
+	}
+	statements, _ := query.Parse(fmt.Sprintf("INSERT INTO users (id) VALUES (1), (%d)", other))
+	if cluster, _ := routeByShardKey(statements, nil, 0, nil, database); cluster != nil {
+		t.Fatalf("Expected rows on two clusters not to be routed, got %s", cluster.GetAddr())
+	}
+}
+
+func TestShardKeyText(t *testing.T) {
+	uuid := "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"
+	cases := []struct {
+		constant query.Constant
+		keyType  string
+		expected string
+	}{
+		{query.Constant{Value: "007", Numeric: true}, SHARD_KEY_TYPE_TEXT, "7"},
+		{query.Constant{Value: "-0", Numeric: true}, SHARD_KEY_TYPE_INTEGER, "0"},
+		{query.Constant{Value: " 007"}, SHARD_KEY_TYPE_INTEGER, "7"},
+		{query.Constant{Value: "007"}, SHARD_KEY_TYPE_TEXT, "007"},
+		{query.Constant{Value: "007", Cast: "bigint"}, SHARD_KEY_TYPE_TEXT, "7"},
+		{query.Constant{Value: "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11"}, SHARD_KEY_TYPE_UUID, uuid},
+		{query.Constant{Value: "{a0eebc999c0b4ef8bb6d6bb9bd380a11}"}, SHARD_KEY_TYPE_TEXT, "{a0eebc999c0b4ef8bb6d6bb9bd380a11}"},
+		{query.Constant{Value: "{a0eebc999c0b4ef8bb6d6bb9bd380a11}", Cast: "uuid"}, SHARD_KEY_TYPE_TEXT, uuid},
+	}
+	for _, c := range cases {
+		text, err := shardKeyText(c.constant, c.keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != c.expected {
+			t.Fatalf("Expected %+v of a %s key to be %q, got %q", c.constant, c.keyType, c.expected, text)
+		}
+	}
+
+	for _, c := range []struct {
+		constant query.Constant
+		keyType  string
+	}{
+		{query.Constant{Value: "1.0", Numeric: true}, SHARD_KEY_TYPE_INTEGER},
+		{query.Constant{Value: "1e3", Numeric: true}, SHARD_KEY_TYPE_TEXT},
+		{query.Constant{Value: "seven"}, SHARD_KEY_TYPE_INTEGER},
+		{query.Constant{Value: "a0eebc99"}, SHARD_KEY_TYPE_UUID},
+		{query.Constant{Value: "2024-01-01", Cast: "date"}, SHARD_KEY_TYPE_TEXT},
+	} {
+		if text, err := shardKeyText(c.constant, c.keyType); err == nil {
+			t.Fatalf("Expected %+v of a %s key to be rejected, got %q", c.constant, c.keyType, text)
+		}
+	}
+}
+
+func TestRouteNonCanonicalKeys(t *testing.T) {
+	// The keyspace id of 7 starts with 8f and the one of 007 with 9e, so
+	// they would go to different clusters if hashed as written
+	database := &DatabaseConfig{
+		Name:   "test",
+		Tables: []TableConfig{{Name: "users", ShardKey: "id", ShardKeyType: SHARD_KEY_TYPE_INTEGER}},
+		Clusters: []ClusterConfig{
+			{Host: "a", Port: 5432, KeyRange: "-90"},
+			{Host: "b", Port: 5432, KeyRange: "90-"},
+		},
+	}
+	for _, sql := range []string{
+		"SELECT * FROM users WHERE id = 7",
+		"SELECT * FROM users WHERE id = 007",
+		"SELECT * FROM users WHERE id = '007'",
+		"INSERT INTO users (id) VALUES (007)",
+		"UPDATE users SET name = 'x' WHERE id = '7'::int",
+	} {
+		statements, _ := query.Parse(sql)
+		cluster, err := routeByShardKey(statements, nil, 0, nil, database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cluster == nil || cluster.GetAddr() != "a:5432" {
+			t.Fatalf("Expected %q to route to a:5432, got %v", sql, cluster)
+		}
+	}
+
+	// A key that cannot be hashed as postgres prints it is not pinned
+	statements, _ := query.Parse("SELECT * FROM users WHERE id = 7.0")
+	if cluster, _ := routeByShardKey(statements, nil, 0, nil, database); cluster != nil {
+		t.Fatalf("Expected 7.0 not to be routed, got %s", cluster.GetAddr())
+	}
+	sql := "INSERT INTO users (id) VALUES (7.5)"
+	statements, _ = query.Parse(sql)
+	if _, errMsg := getInsertShards(sql, statements[0], &database.Tables[0], database); errMsg == nil {
+		t.Fatal("Expected an INSERT of key 7.5 to be rejected")
+	}
+}
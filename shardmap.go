@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Sharding keys are mapped to a 64 bit keyspace id and every cluster of
+// a sharded database owns a contiguous range of keyspace ids. Ranges
+// are written as hex prefixes of the keyspace id, "-80" is the lower
+// half of the keyspace and "80-" the upper half
+type KeyRange struct {
+	Start uint64
+	// Exclusive. Zero means the range runs to the end of the keyspace
+	End uint64
+}
+
+var FULL_KEY_RANGE = KeyRange{Start: 0, End: 0}
+
+// A cluster waiting to receive part of the keyspace owns no keyspace ids.
+// Its range is written as "none"
+const KEY_RANGE_NONE = "none"
+
+var EMPTY_KEY_RANGE = KeyRange{Start: 1, End: 1}
+
+func parseKeyRangeBound(bound string) (uint64, error) {
+	if bound == "" {
+		return 0, nil
+	}
+	if len(bound) > 16 {
+		return 0, fmt.Errorf("key range bound %q is longer than 16 hex digits", bound)
+	}
+	padded := bound + strings.Repeat("0", 16-len(bound))
+	return strconv.ParseUint(padded, 16, 64)
+}
+
+func ParseKeyRange(spec string) (KeyRange, error) {
+	if spec == "" || spec == "-" {
+		return FULL_KEY_RANGE, nil
+	}
+	if spec == KEY_RANGE_NONE {
+		return EMPTY_KEY_RANGE, nil
+	}
+	start, end, ok := strings.Cut(spec, "-")
+	if !ok {
+		return KeyRange{}, fmt.Errorf("key range %q is not of the form start-end", spec)
+	}
+	startId, err := parseKeyRangeBound(start)
+	if err != nil {
+		return KeyRange{}, fmt.Errorf("invalid key range %q: %w", spec, err)
+	}
+	endId, err := parseKeyRangeBound(end)
+	if err != nil {
+		return KeyRange{}, fmt.Errorf("invalid key range %q: %w", spec, err)
+	}
+	if end != "" && endId <= startId {
+		return KeyRange{}, fmt.Errorf("key range %q ends before it starts", spec)
+	}
+	return KeyRange{Start: startId, End: endId}, nil
+}
+
+// Map a shard key value to its keyspace id. Values are hashed in the
+// text postgres prints for them, see shardKeyText, so the proxy routes
+// a key the same way as keyRangeFilter finds its row
+func KeyspaceId(value []byte) uint64 {
+	sum := md5.Sum(value)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Write a bound in whole bytes like key ranges are configured, so the
+// upper quarter of the keyspace is "c0" and not "c"
+func formatKeyRangeBound(id uint64) string {
+	bound := fmt.Sprintf("%016x", id)
+	for strings.HasSuffix(bound, "00") {
+		bound = bound[:len(bound)-2]
+	}
+	return bound
+}
+
+func (r KeyRange) String() string {
+	if r.IsEmpty() {
+		return KEY_RANGE_NONE
+	}
+	end := ""
+	if r.End != 0 {
+		end = formatKeyRangeBound(r.End)
+	}
+	return formatKeyRangeBound(r.Start) + "-" + end
+}
+
+func (r KeyRange) Contains(id uint64) bool {
+	return id >= r.Start && (r.End == 0 || id < r.End)
+}
+
+func (r KeyRange) IsEmpty() bool {
+	return r.End != 0 && r.End <= r.Start
+}
+
+// Whether every keyspace id of other is in the range
+func (r KeyRange) ContainsRange(other KeyRange) bool {
+	if other.IsEmpty() {
+		return true
+	}
+	return r.Contains(other.Start) && (r.End == 0 || (other.End != 0 && other.End <= r.End))
+}
+
+// The last keyspace id in the range
+func (r KeyRange) last() uint64 {
+	if r.End == 0 {
+		return math.MaxUint64
+	}
+	return r.End - 1
+}
+
+// Check that the ranges cover every keyspace id exactly once
+func checkKeyRangeCoverage(ranges []KeyRange) error {
+	if len(ranges) == 0 {
+		return fmt.Errorf("no key ranges")
+	}
+	sorted := make([]KeyRange, 0, len(ranges))
+	for _, keyRange := range ranges {
+		if !keyRange.IsEmpty() {
+			sorted = append(sorted, keyRange)
+		}
+	}
+	if len(sorted) == 0 {
+		return fmt.Errorf("no cluster owns any keyspace ids")
+	}
+	slices.SortFunc(sorted, func(a, b KeyRange) int {
+		if a.Start < b.Start {
+			return -1
+		} else if a.Start > b.Start {
+			return 1
+		}
+		return 0
+	})
+
+	if sorted[0].Start != 0 {
+		return fmt.Errorf("keyspace ids below %s are not covered", formatKeyRangeBound(sorted[0].Start))
+	}
+	for i := 1; i < len(sorted); i++ {
+		previous, current := sorted[i-1], sorted[i]
+		if previous.End == 0 || previous.last() >= current.Start {
+			return fmt.Errorf("key ranges %s and %s overlap", previous, current)
+		}
+		if previous.End != current.Start {
+			return fmt.Errorf("keyspace ids between %s and %s are not covered", previous, current)
+		}
+	}
+	if last := sorted[len(sorted)-1]; last.End != 0 {
+		return fmt.Errorf("keyspace ids from %s up are not covered", formatKeyRangeBound(last.End))
+	}
+	return nil
+}
+
+// The part of owner left after removing moved from it. Only a range at
+// either end of owner can be removed so what is left stays contiguous
+func removeKeyRange(owner KeyRange, moved KeyRange) (KeyRange, error) {
+	if moved.IsEmpty() || !owner.ContainsRange(moved) {
+		return KeyRange{}, fmt.Errorf("key range %s is not part of %s", moved, owner)
+	}
+	switch {
+	case moved == owner:
+		return EMPTY_KEY_RANGE, nil
+	case moved.Start == owner.Start:
+		return KeyRange{Start: moved.End, End: owner.End}, nil
+	case moved.End == owner.End:
+		return KeyRange{Start: owner.Start, End: moved.Start}, nil
+	default:
+		return KeyRange{}, fmt.Errorf("key range %s is in the middle of %s. Only the start or the end of a range can be moved", moved, owner)
+	}
+}
+
+// The union of two ranges that are next to each other
+func joinKeyRanges(a KeyRange, b KeyRange) (KeyRange, error) {
+	switch {
+	case a.IsEmpty():
+		return b, nil
+	case b.IsEmpty():
+		return a, nil
+	case a.End != 0 && a.End == b.Start:
+		return KeyRange{Start: a.Start, End: b.End}, nil
+	case b.End != 0 && b.End == a.Start:
+		return KeyRange{Start: b.Start, End: a.End}, nil
+	default:
+		return KeyRange{}, fmt.Errorf("key ranges %s and %s are not next to each other", a, b)
+	}
+}
+
+// A SQL condition matching the rows whose shard key falls in the range.
+// It computes the keyspace id the same way as KeyspaceId and compares
+// its hex digits
+func keyRangeFilter(column string, r KeyRange) string {
+	keyspaceId := fmt.Sprintf("substr(md5(%s::text), 1, 16) COLLATE \"C\"", quoteIdentifier(column))
+	conditions := make([]string, 0, 2)
+	if r.Start != 0 {
+		conditions = append(conditions, fmt.Sprintf("%s >= '%016x'", keyspaceId, r.Start))
+	}
+	if r.End != 0 {
+		conditions = append(conditions, fmt.Sprintf("%s < '%016x'", keyspaceId, r.End))
+	}
+	if len(conditions) == 0 {
+		return "true"
+	}
+	return strings.Join(conditions, " AND ")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseKeyRange(t *testing.T) {
+	cases := map[string]KeyRange{
+		"":      FULL_KEY_RANGE,
+		"-":     FULL_KEY_RANGE,
+		"-80":   {Start: 0, End: 0x8000000000000000},
+		"80-":   {Start: 0x8000000000000000, End: 0},
+		"40-c0": {Start: 0x4000000000000000, End: 0xc000000000000000},
+	}
+	for spec, expected := range cases {
+		keyRange, err := ParseKeyRange(spec)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s", spec, err)
+		}
+		if keyRange != expected {
+			t.Fatalf("Parsing %q: expected %v, got %v", spec, expected, keyRange)
+		}
+	}
+
+	for _, spec := range []string{"80", "c0-40", "zz-", "-00000000000000001"} {
+		if _, err := ParseKeyRange(spec); err == nil {
+			t.Fatalf("Expected error parsing %q", spec)
+		}
+	}
+
+	keyRange, _ := ParseKeyRange("40-c0")
+	if keyRange.String() != "40-c0" {
+		t.Fatalf("Unexpected key range string %q", keyRange.String())
+	}
+	if keyRange, _ := ParseKeyRange("0450-"); keyRange.String() != "0450-" {
+		t.Fatalf("Unexpected key range string %q", keyRange.String())
+	}
+	if !keyRange.Contains(0x4000000000000000) || keyRange.Contains(0xc000000000000000) {
+		t.Fatal("Key range bounds are not start inclusive and end exclusive")
+	}
+}
+
+func TestKeyRangeCoverage(t *testing.T) {
+	parse := func(specs ...string) []KeyRange {
+		ranges := make([]KeyRange, 0, len(specs))
+		for _, spec := range specs {
+			keyRange, err := ParseKeyRange(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ranges = append(ranges, keyRange)
+		}
+		return ranges
+	}
+
+	for _, specs := range [][]string{{"-"}, {"-80", "80-"}, {"80-c0", "-80", "c0-"}} {
+		if err := checkKeyRangeCoverage(parse(specs...)); err != nil {
+			t.Fatalf("Expected %v to cover the keyspace: %s", specs, err)
+		}
+	}
+	for _, specs := range [][]string{{"-80"}, {"80-"}, {"-40", "80-"}, {"-80", "40-"}, {"-", "80-"}} {
+		if err := checkKeyRangeCoverage(parse(specs...)); err == nil {
+			t.Fatalf("Expected %v to be rejected", specs)
+		}
+	}
+}
+
+func TestMoveKeyRanges(t *testing.T) {
+	parse := func(spec string) KeyRange {
+		keyRange, err := ParseKeyRange(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyRange
+	}
+
+	if parse(KEY_RANGE_NONE) != EMPTY_KEY_RANGE || EMPTY_KEY_RANGE.String() != KEY_RANGE_NONE || EMPTY_KEY_RANGE.Contains(1) {
+		t.Fatal("Empty key range does not round trip or contains ids")
+	}
+	if err := checkKeyRangeCoverage([]KeyRange{parse("-80"), parse("none"), parse("80-")}); err != nil {
+		t.Fatalf("Empty key ranges should not affect coverage: %s", err)
+	}
+
+	removed := []struct{ owner, moved, remaining string }{
+		{"-80", "-40", "40-80"},
+		{"-80", "40-80", "-40"},
+		{"80-", "c0-", "80-c0"},
+		{"80-", "80-", "none"},
+	}
+	for _, c := range removed {
+		remaining, err := removeKeyRange(parse(c.owner), parse(c.moved))
+		if err != nil || remaining != parse(c.remaining) {
+			t.Fatalf("Removing %s from %s: expected %s, got %s (%v)", c.moved, c.owner, c.remaining, remaining, err)
+		}
+	}
+	for _, c := range [][2]string{{"-80", "20-40"}, {"-80", "40-c0"}, {"-80", "none"}} {
+		if _, err := removeKeyRange(parse(c[0]), parse(c[1])); err == nil {
+			t.Fatalf("Expected removing %s from %s to fail", c[1], c[0])
+		}
+	}
+
+	joined := []struct{ a, b, union string }{
+		{"none", "40-80", "40-80"},
+		{"-40", "40-80", "-80"},
+		{"c0-", "80-c0", "80-"},
+	}
+	for _, c := range joined {
+		union, err := joinKeyRanges(parse(c.a), parse(c.b))
+		if err != nil || union != parse(c.union) {
+			t.Fatalf("Joining %s and %s: expected %s, got %s (%v)", c.a, c.b, c.union, union, err)
+		}
+	}
+	if _, err := joinKeyRanges(parse("-40"), parse("80-")); err == nil {
+		t.Fatal("Expected joining ranges with a gap to fail")
+	}
+
+	filter := keyRangeFilter("user_id", parse("40-80"))
+	expected := `substr(md5(user_id::text), 1, 16) COLLATE "C" >= '4000000000000000' AND substr(md5(user_id::text), 1, 16) COLLATE "C" < '8000000000000000'`
+	if filter != expected {
+		t.Fatalf("Unexpected key range filter %s", filter)
+	}
+	if keyRangeFilter("id", FULL_KEY_RANGE) != "true" {
+		t.Fatal("The full key range should match every row")
+	}
+}
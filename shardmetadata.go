@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+/// Key ranges, their moves and the proxies using them are kept in a metadata store, a local file
+/// or a postgres table several proxies share, and each change is a new version of the shard map
+
+const (
+	SHARD_MAP_POLL_INTERVAL = time.Second
+	// How often a proxy records the version of the shard map it runs
+	// with when nothing changed
+	SHARD_MAP_HEARTBEAT_INTERVAL = 10 * time.Second
+	// A proxy that has not recorded its version for this long is
+	// assumed to be gone
+	SHARD_MAP_INSTANCE_TIMEOUT = 6 * SHARD_MAP_HEARTBEAT_INTERVAL
+)
+
+// Identifies this process among the proxies sharing the shard metadata.
+// Node ids cannot be used as they default to 0 and a restarted or
+// upgraded proxy keeps its node id
+var shardMapInstanceId = newShardMapInstanceId()
+
+func newShardMapInstanceId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// Database name used for connections to the metadata cluster in logs
+const SHARD_METADATA_DATABASE_NAME = "pgspanner_metadata"
+
+var SHARD_METADATA_SCHEMA = []string{
+	`CREATE TABLE IF NOT EXISTS pgspanner_shard_map (
+		id int PRIMARY KEY CHECK (id = 1),
+		version bigint NOT NULL,
+		metadata jsonb NOT NULL,
+		updated timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS pgspanner_shard_map_history (
+		version bigint PRIMARY KEY,
+		key_ranges jsonb NOT NULL,
+		created timestamptz NOT NULL DEFAULT now()
+	)`,
+}
+
+type ShardMetadata struct {
+	// Incremented every time the key ranges change
+	Version int64 `json:"version"`
+	// Key ranges that replace the ones in the config, by database and
+	// cluster address
+	KeyRanges map[string]map[string]string `json:"keyRanges"`
+	Moves     []KeyRangeMove               `json:"moves"`
+	// Id of the next move started
+	NextMoveId int `json:"nextMoveId"`
+	// The version of the shard map each proxy runs with, by instance id
+	Instances map[string]ShardMapInstance `json:"instances"`
+}
+
+// A proxy using the shard map
+type ShardMapInstance struct {
+	Version int64     `json:"version"`
+	Seen    time.Time `json:"seen"`
+	// Ids of the moves the proxy holds back writes for
+	Frozen []int `json:"frozen,omitempty"`
+}
+
+func newShardMetadata() *ShardMetadata {
+	return &ShardMetadata{
+		KeyRanges:  make(map[string]map[string]string),
+		Moves:      make([]KeyRangeMove, 0),
+		NextMoveId: 1,
+		Instances:  make(map[string]ShardMapInstance),
+	}
+}
+
+func decodeShardMetadata(data []byte) (*ShardMetadata, error) {
+	metadata := newShardMetadata()
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// Apply a change to a copy of the metadata. The version is bumped when
+// the key ranges changed
+func changeShardMetadata(metadata *ShardMetadata, update func(metadata *ShardMetadata) error) (*ShardMetadata, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := decodeShardMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(changed); err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(changed.KeyRanges, metadata.KeyRanges) {
+		changed.Version = metadata.Version + 1
+	}
+	return changed, nil
+}
+
+// Whether the proxy with the instance id has stopped recording its shard
+// map version
+func (s *ShardMetadata) isInstanceGone(instanceId string) bool {
+	instance, ok := s.Instances[instanceId]
+	return !ok || time.Since(instance.Seen) >= SHARD_MAP_INSTANCE_TIMEOUT
+}
+
+// Whether every proxy that is still running has switched to the current
+// version of the shard map
+func (s *ShardMetadata) AllInstancesCurrent() bool {
+	for _, instance := range s.Instances {
+		if time.Since(instance.Seen) < SHARD_MAP_INSTANCE_TIMEOUT && instance.Version < s.Version {
+			return false
+		}
+	}
+	return true
+}
+
+// Where the shard metadata is kept
+type ShardMetadataStore interface {
+	Read() (*ShardMetadata, error)
+	// Read, change and write back the metadata as one atomic change.
+	// Nothing is written when update returns an error
+	Update(update func(metadata *ShardMetadata) error) (*ShardMetadata, error)
+	Close()
+}
+
+// Metadata kept in a local file. Proxies on the same host can share the
+// file, changes are serialized with a lock on a file next to it
+type fileShardMetadataStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileShardMetadataStore) lock(how int) (func(), error) {
+	s.mu.Lock()
+	lockFile, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), how); err != nil {
+		lockFile.Close()
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+		s.mu.Unlock()
+	}, nil
+}
+
+// Read the file. A file that does not exist yet holds no changes
+func (s *fileShardMetadataStore) read() (*ShardMetadata, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newShardMetadata(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := decodeShardMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard metadata %s: %w", s.path, err)
+	}
+	return metadata, nil
+}
+
+func (s *fileShardMetadataStore) Read() (*ShardMetadata, error) {
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.read()
+}
+
+// The file is written next to the old one and renamed over it so a
+// crash leaves either the old or the new version
+func (s *fileShardMetadataStore) Update(update func(metadata *ShardMetadata) error) (*ShardMetadata, error) {
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	current, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := changeShardMetadata(current, update)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (s *fileShardMetadataStore) Close() {}
+
+// Metadata kept in a postgres cluster. The metadata is a single row that
+// is locked while it is changed, and every version of the key ranges is
+// kept in a history table
+type postgresShardMetadataStore struct {
+	database DatabaseConfig
+	cluster  ClusterConfig
+	mu       sync.Mutex
+	server   *ServerConnection
+}
+
+func newPostgresShardMetadataStore(cluster ClusterConfig) *postgresShardMetadataStore {
+	return &postgresShardMetadataStore{
+		database: DatabaseConfig{Name: SHARD_METADATA_DATABASE_NAME},
+		cluster:  cluster,
+	}
+}
+
+func (s *postgresShardMetadataStore) connect() (*ServerConnection, error) {
+	if s.server != nil {
+		return s.server, nil
+	}
+	server, err := CreateServerConnection(&s.database, &s.cluster)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range SHARD_METADATA_SCHEMA {
+		if err := server.Exec(statement); err != nil {
+			server.Terminate()
+			return nil, err
+		}
+	}
+	s.server = server
+	return server, nil
+}
+
+// Drop the connection when it was lost so the next call opens a new one.
+// An error from the server leaves the connection usable
+func (s *postgresShardMetadataStore) fail(err error) error {
+	if _, ok := err.(*protocol.ErrorResponsePgMessage); !ok && s.server != nil {
+		s.server.Terminate()
+		s.server = nil
+	}
+	return err
+}
+
+func (s *postgresShardMetadataStore) read(server *ServerConnection, lock string) (*ShardMetadata, error) {
+	rows, err := server.QueryRows("SELECT metadata FROM pgspanner_shard_map WHERE id = 1" + lock)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return newShardMetadata(), nil
+	}
+	if len(rows[0].Values) != 1 {
+		return nil, fmt.Errorf("Unexpected result reading shard metadata from %s", s.cluster.GetAddr())
+	}
+	return decodeShardMetadata(rows[0].Values[0])
+}
+
+func (s *postgresShardMetadataStore) Read() (*ShardMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := s.read(server, "")
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	return metadata, nil
+}
+
+func (s *postgresShardMetadataStore) Update(update func(metadata *ShardMetadata) error) (*ShardMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Exec("BEGIN"); err != nil {
+		return nil, s.fail(err)
+	}
+	metadata, err := s.write(server, update)
+	if err != nil {
+		if rollbackErr := server.Exec("ROLLBACK"); rollbackErr != nil {
+			s.fail(rollbackErr)
+		}
+		return nil, err
+	}
+	if err := server.Exec("COMMIT"); err != nil {
+		return nil, s.fail(err)
+	}
+	return metadata, nil
+}
+
+func (s *postgresShardMetadataStore) write(server *ServerConnection, update func(metadata *ShardMetadata) error) (*ShardMetadata, error) {
+	current, err := s.read(server, " FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := changeShardMetadata(current, update)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = server.Exec(fmt.Sprintf(
+		"INSERT INTO pgspanner_shard_map (id, version, metadata) VALUES (1, %d, %s) "+
+			"ON CONFLICT (id) DO UPDATE SET version = excluded.version, metadata = excluded.metadata, updated = now()",
+		metadata.Version, quoteLiteral(string(data)),
+	))
+	if err != nil || metadata.Version == current.Version {
+		return metadata, err
+	}
+	keyRanges, err := json.Marshal(metadata.KeyRanges)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, server.Exec(fmt.Sprintf(
+		"INSERT INTO pgspanner_shard_map_history (version, key_ranges) VALUES (%d, %s)",
+		metadata.Version, quoteLiteral(string(keyRanges)),
+	))
+}
+
+func (s *postgresShardMetadataStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil {
+		s.server.Terminate()
+		s.server = nil
+	}
+}
+
+// The store named by the running config is kept open between calls and
+// replaced when a reload points the config at another one
+var shardMetadataStores = struct {
+	sync.Mutex
+	key   string
+	store ShardMetadataStore
+}{}
+
+func shardMetadataStoreKey(config *SpannerConfig) string {
+	if config.ShardMetadataCluster.Host != "" {
+		return "postgres " + config.ShardMetadataCluster.GetAddr() + " " + config.ShardMetadataCluster.Name
+	}
+	if config.ShardMetadataPath != "" {
+		return "file " + config.ShardMetadataPath
+	}
+	return ""
+}
+
+// Get the metadata store of the config. Returns nil when the config has
+// none
+func getShardMetadataStore(config *SpannerConfig) ShardMetadataStore {
+	shardMetadataStores.Lock()
+	defer shardMetadataStores.Unlock()
+	key := shardMetadataStoreKey(config)
+	if key == shardMetadataStores.key {
+		return shardMetadataStores.store
+	}
+	if shardMetadataStores.store != nil {
+		shardMetadataStores.store.Close()
+	}
+	shardMetadataStores.key = key
+	switch {
+	case config.ShardMetadataCluster.Host != "":
+		shardMetadataStores.store = newPostgresShardMetadataStore(config.ShardMetadataCluster)
+	case config.ShardMetadataPath != "":
+		shardMetadataStores.store = &fileShardMetadataStore{path: config.ShardMetadataPath}
+	default:
+		shardMetadataStores.store = nil
+	}
+	return shardMetadataStores.store
+}
+
+// Get a copy of the config with the key ranges of its clusters replaced
+// by the ones in the metadata
+func withShardMetadata(config *SpannerConfig, metadata *ShardMetadata) (*SpannerConfig, error) {
+	updated := *config
+	updated.shardMapVersion = metadata.Version
+	updated.Databases = slices.Clone(config.Databases)
+	for i := range updated.Databases {
+		database := &updated.Databases[i]
+		keyRanges, ok := metadata.KeyRanges[database.Name]
+		if !ok {
+			continue
+		}
+		database.Clusters = slices.Clone(database.Clusters)
+		for addr, keyRange := range keyRanges {
+			found := false
+			for j := range database.Clusters {
+				if database.Clusters[j].GetAddr() == addr {
+					database.Clusters[j].KeyRange = keyRange
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("shard metadata gives key range %s of database %q to cluster %s which is not configured", keyRange, database.Name, addr)
+			}
+		}
+	}
+	return &updated, nil
+}
+
+// Apply the shard map of the metadata store named by the config, if any
+func applyShardMetadata(config *SpannerConfig) (*SpannerConfig, error) {
+	store := getShardMetadataStore(config)
+	if store == nil {
+		return config, nil
+	}
+	metadata, err := store.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read shard metadata: %w", err)
+	}
+	return withShardMetadata(config, metadata)
+}
+
+// Swap the key ranges of the metadata into the running config. Writes
+// routed by key look up the owners of their keys again
+func applyShardMap(requester *ConnectionRequester, metadata *ShardMetadata) error {
+	config, err := withShardMetadata(requester.GetConfig(), metadata)
+	if err != nil {
+		return err
+	}
+	response := requester.RequestConfigReload(config)
+	if response.Result != RESULT_SUCCESS {
+		return response.Detail
+	}
+	shardRouting.ShardMapChanged()
+	return nil
+}
+
+// What a proxy last recorded in the shard metadata
+type shardMapWatcher struct {
+	reported       int64
+	reportedFrozen []int
+	lastReport     time.Time
+	// Moves writes are held back for, see syncMoveFreezes
+	frozen map[int]string
+}
+
+func newShardMapWatcher() *shardMapWatcher {
+	return &shardMapWatcher{reported: -1, reportedFrozen: make([]int, 0), frozen: make(map[int]string)}
+}
+
+// Keep the running config on the latest version of the shard map and
+// record the version this proxy runs with so moves know when every
+// proxy has switched over. Writes are held back for the cutovers other
+// proxies run, which is recorded as well
+func WatchShardMap(requester *ConnectionRequester) {
+	watcher := newShardMapWatcher()
+	for range time.Tick(SHARD_MAP_POLL_INTERVAL) {
+		watcher.poll(requester)
+	}
+}
+
+func (w *shardMapWatcher) poll(requester *ConnectionRequester) {
+	config := requester.GetConfig()
+	store := getShardMetadataStore(config)
+	if store == nil {
+		return
+	}
+	metadata, err := store.Read()
+	if err != nil {
+		slog.Error("Error reading shard metadata", "error", err)
+		return
+	}
+	if metadata.Version != config.shardMapVersion {
+		if err := applyShardMap(requester, metadata); err != nil {
+			slog.Error("Error applying new shard map", "version", metadata.Version, "error", err)
+			return
+		}
+		slog.Info("Switched to new shard map", "version", metadata.Version, "previous", config.shardMapVersion)
+	}
+
+	frozenIds := syncMoveFreezes(requester.GetConfig(), metadata, w.frozen)
+	applied := requester.GetConfig().shardMapVersion
+	if applied == w.reported && slices.Equal(frozenIds, w.reportedFrozen) && time.Since(w.lastReport) < SHARD_MAP_HEARTBEAT_INTERVAL {
+		return
+	}
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		for instanceId := range metadata.Instances {
+			if metadata.isInstanceGone(instanceId) {
+				delete(metadata.Instances, instanceId)
+			}
+		}
+		metadata.Instances[shardMapInstanceId] = ShardMapInstance{Version: applied, Seen: time.Now(), Frozen: frozenIds}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error recording shard map version", "error", err)
+		return
+	}
+	w.reported = applied
+	w.reportedFrozen = frozenIds
+	w.lastReport = time.Now()
+	// Moves of proxies that stopped are picked up here
+	ResumeKeyRangeMoves(requester)
+}
+
+// SHOW SHARD MAP
+func adminShowShardMap(args []string, config *SpannerConfig, requester *ConnectionRequester) (*adminResult, error) {
+	result := &adminResult{
+		Columns: []string{"database", "cluster", "key_range", "version"},
+		Rows:    make([][]string, 0),
+	}
+	for _, database := range config.Databases {
+		if !database.IsSharded() {
+			continue
+		}
+		for _, cluster := range database.Clusters {
+			keyRange, _ := cluster.GetKeyRange()
+			result.Rows = append(result.Rows, []string{database.Name, cluster.GetAddr(), keyRange.String(), fmt.Sprint(config.shardMapVersion)})
+		}
+	}
+	result.Tag = fmt.Sprintf("SHOW %d", len(result.Rows))
+	return result, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardMapWatcher(t *testing.T) {
+	previous := shardRouting
+	shardRouting = newTestRoutingGate()
+	defer func() { shardRouting = previous }()
+	path := filepath.Join(t.TempDir(), "shards.json")
+	requester := NewConnectionRequester(&SpannerConfig{
+		ShardMetadataPath: path,
+		Databases: []DatabaseConfig{{
+			Name:     "test",
+			Clusters: []ClusterConfig{{Host: "a", Port: 5432, KeyRange: "-80"}, {Host: "b", Port: 5432, KeyRange: "80-"}},
+		}},
+	})
+	defer close(requester.channel)
+	serveConfigReloads(requester, requester.channel)
+	store := getShardMetadataStore(requester.GetConfig())
+	update := func(change func(metadata *ShardMetadata)) {
+		t.Helper()
+		_, err := store.Update(func(metadata *ShardMetadata) error {
+			change(metadata)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := func() ShardMapInstance {
+		t.Helper()
+		metadata, err := store.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.Instances[shardMapInstanceId]
+	}
+
+	// A new version of the shard map is swapped into the running config
+	// and the version the proxy runs with is recorded
+	update(func(metadata *ShardMetadata) {
+		metadata.KeyRanges["test"] = map[string]string{"a:5432": "-40", "b:5432": "40-"}
+	})
+	watcher := newShardMapWatcher()
+	watcher.poll(requester)
+	config := requester.GetConfig()
+	clusters := config.Databases[0].Clusters
+	if config.shardMapVersion != 1 || clusters[0].KeyRange != "-40" || clusters[1].KeyRange != "40-" {
+		t.Fatalf("Expected shard map version 1 to be applied, got version %d with %+v", config.shardMapVersion, clusters)
+	}
+	if shardRouting.version.Load() != 1 {
+		t.Fatal("Expected writers to be told the shard map changed")
+	}
+	first := recorded()
+	if first.Version != 1 {
+		t.Fatalf("Expected version 1 to be recorded, got %d", first.Version)
+	}
+
+	// Nothing is recorded again until the next heartbeat
+	watcher.poll(requester)
+	if !recorded().Seen.Equal(first.Seen) {
+		t.Fatal("Expected the unchanged version not to be recorded again")
+	}
+
+	// A shard map naming a cluster that is not configured is not applied
+	update(func(metadata *ShardMetadata) {
+		metadata.KeyRanges["test"]["d:5432"] = "-"
+	})
+	watcher.poll(requester)
+	if requester.GetConfig().shardMapVersion != 1 {
+		t.Fatal("Expected the invalid shard map to be skipped")
+	}
+
+	// Writes held back for a cutover of another proxy are confirmed
+	// right away
+	update(func(metadata *ShardMetadata) {
+		delete(metadata.KeyRanges["test"], "d:5432")
+		metadata.Instances["other"] = ShardMapInstance{Version: metadata.Version, Seen: time.Now()}
+		metadata.Moves = []KeyRangeMove{{
+			Id:          1,
+			Database:    "test",
+			KeyRange:    "40-80",
+			State:       MOVE_STATE_CATCHING_UP,
+			Owner:       "other",
+			FrozenUntil: time.Now().Add(time.Minute),
+		}}
+	})
+	watcher.poll(requester)
+	if instance := recorded(); instance.Version != 3 || !slices.Equal(instance.Frozen, []int{1}) {
+		t.Fatalf("Expected version 3 and the held back move to be recorded, got %+v", instance)
+	}
+	if len(shardRouting.freezes) != 1 {
+		t.Fatal("Expected writes to the moving key range to be held back")
+	}
+}
+
+func TestPostgresShardMetadataStore(t *testing.T) {
+	current := newShardMetadata()
+	current.Version = 1
+	current.KeyRanges["test"] = map[string]string{"a:5432": "-80", "b:5432": "80-"}
+	data, _ := json.Marshal(current)
+	row := buildRows(TRANSACTION_STATUS_ACTIVE, [][]byte{data})
+	server, conn := newScriptedServer(&ClusterConfig{Host: "meta", Port: 5432},
+		// Key ranges changing
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		row,
+		buildCompletion("INSERT 0 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("INSERT 0 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE),
+		// A heartbeat
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		row,
+		buildCompletion("INSERT 0 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("COMMIT", TRANSACTION_STATUS_IDLE),
+		// A failed update
+		buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE),
+		row,
+		buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE),
+	)
+	store := newPostgresShardMetadataStore(ClusterConfig{Host: "meta", Port: 5432})
+	store.server = server
+	expectQueries := func(expected ...string) {
+		t.Helper()
+		queries := conn.queries()
+		conn.sent.Reset()
+		if len(queries) != len(expected) {
+			t.Fatalf("Expected queries starting with %q, got %q", expected, queries)
+		}
+		for i := range expected {
+			if !strings.HasPrefix(queries[i], expected[i]) {
+				t.Fatalf("Expected queries starting with %q, got %q", expected, queries)
+			}
+		}
+	}
+	lock := "SELECT metadata FROM pgspanner_shard_map WHERE id = 1 FOR UPDATE"
+
+	// The row is locked while it is changed and a new version of the key
+	// ranges is added to the history
+	metadata, err := store.Update(func(metadata *ShardMetadata) error {
+		metadata.KeyRanges["test"]["a:5432"] = "-40"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Version != 2 {
+		t.Fatalf("Expected version 2, got %d", metadata.Version)
+	}
+	expectQueries(
+		"BEGIN",
+		lock,
+		"INSERT INTO pgspanner_shard_map (id, version, metadata) VALUES (1, 2, ",
+		`INSERT INTO pgspanner_shard_map_history (version, key_ranges) VALUES (2, '{"test":{"a:5432":"-40","b:5432":"80-"}}')`,
+		"COMMIT",
+	)
+
+	// Changes that leave the key ranges alone add no history
+	_, err = store.Update(func(metadata *ShardMetadata) error {
+		metadata.Instances["1"] = ShardMapInstance{Version: 1, Seen: time.Now()}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectQueries("BEGIN", lock, "INSERT INTO pgspanner_shard_map (id, version, metadata) VALUES (1, 1, ", "COMMIT")
+
+	// A failed update is rolled back and keeps the connection
+	if _, err = store.Update(func(metadata *ShardMetadata) error { return errors.New("failed") }); err == nil {
+		t.Fatal("Expected the update to fail")
+	}
+	expectQueries("BEGIN", lock, "ROLLBACK")
+	if store.server != server {
+		t.Fatal("Expected the connection to be kept after a failed update")
+	}
+
+	// A lost connection is dropped so the next call opens a new one
+	if _, err := store.Read(); err == nil {
+		t.Fatal("Expected the read to fail")
+	}
+	if store.server != nil || !conn.closed {
+		t.Fatal("Expected the lost connection to be closed")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+// What a server answered to a statement that was run on several shards
+type shardResult struct {
+	shardAddr         string
+	tag               string
+	errMsg            *protocol.ErrorResponsePgMessage
+	transactionStatus byte
+	// The connection to the server was lost
+	err error
+	// The rows the statement returned, packed for the client
+	rows []byte
+	// The statement succeeded but was rolled back with the rest of a
+	// coordinated transaction
+	rolledBack bool
+}
+
+// Read a server's answer up to ReadyForQuery. Rows and notices are
+// dropped, only the outcome is kept
+func readShardResult(server *ServerConnection) shardResult {
+	return readShardOutput(server, false)
+}
+
+// Read a server's answer up to ReadyForQuery keeping the rows so they
+// can be sent to the client
+func readShardRows(server *ServerConnection) shardResult {
+	return readShardOutput(server, true)
+}
+
+func readShardOutput(server *ServerConnection, keepRows bool) shardResult {
+	result := shardResult{shardAddr: server.GetClusterConfig().GetAddr()}
+	for {
+		rm, err := protocol.GetRawPgMessage(server)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		if keepRows && (rm.Kind == protocol.BMESSAGE_ROW_DESCRIPTION || rm.Kind == protocol.BMESSAGE_DATA_ROW) {
+			result.rows = append(result.rows, rm.Pack()...)
+		}
+		if result.readOutcome(server, rm) {
+			return result
+		}
+	}
+}
+
+// Keep what a message of the server's answer says about how the
+// statement ended. Returns whether the server is ready for the next
+// query, or the answer could not be read
+func (result *shardResult) readOutcome(server *ServerConnection, rm *protocol.RawPgMessage) bool {
+	var err error
+	switch rm.Kind {
+	case protocol.BMESSAGE_COMMAND_COMPLETE:
+		complete := &protocol.CommandCompletePgMessage{}
+		complete, _ = complete.Unpack(rm)
+		result.tag = strings.TrimRight(complete.Command, "\x00")
+	case protocol.BMESSAGE_ERROR_RESPONSE:
+		errMsg := &protocol.ErrorResponsePgMessage{}
+		if errMsg, err = errMsg.Unpack(rm); err == nil {
+			result.errMsg = errMsg
+		}
+	case protocol.BMESSAGE_READY_FOR_QUERY:
+		readyForQuery := &protocol.ReadyForQueryPgMessage{}
+		if readyForQuery, err = readyForQuery.Unpack(rm); err != nil {
+			result.err = err
+			return true
+		}
+		result.transactionStatus = readyForQuery.TransactionStatus
+		server.SetTransactionStatus(result.transactionStatus)
+		return true
+	}
+	return false
+}
+
+// The transaction status to report to a client that ran a statement on
+// several shards. A failed shard fails the client's transaction
+func combineTransactionStatus(statuses []byte) byte {
+	combined := byte(TRANSACTION_STATUS_IDLE)
+	for _, status := range statuses {
+		if status == TRANSACTION_STATUS_FAILED {
+			return TRANSACTION_STATUS_FAILED
+		}
+		if status == TRANSACTION_STATUS_ACTIVE {
+			combined = TRANSACTION_STATUS_ACTIVE
+		}
+	}
+	return combined
+}
+
+// Answer the client for a statement run on several shards. The first
+// error wins and its detail lists the shards that failed. Outside of a
+// transaction the shards that succeeded keep their changes, which the
+// detail points out as well. On success the rows kept from the first
+// shard are sent
+func writeShardResults(
+	client *ClientConnection,
+	databaseName string,
+	results []shardResult,
+	tag string,
+	errMsg *protocol.ErrorResponsePgMessage,
+) {
+	statuses := make([]byte, 0, len(results))
+	failed := make([]string, 0)
+	succeeded := make([]string, 0)
+	for _, result := range results {
+		statuses = append(statuses, result.transactionStatus)
+		switch {
+		case result.err != nil:
+			failed = append(failed, result.shardAddr)
+			if errMsg == nil {
+				errMsg = buildLostConnectionError(result.shardAddr, databaseName, result.err)
+			}
+		case result.errMsg != nil:
+			failed = append(failed, result.shardAddr)
+			if errMsg == nil {
+				errMsg = result.errMsg
+			}
+		case !result.rolledBack:
+			succeeded = append(succeeded, result.shardAddr)
+		}
+	}
+	transactionStatus := combineTransactionStatus(statuses)
+
+	if errMsg == nil {
+		var packet []byte
+		if len(results) > 0 {
+			packet = append(packet, results[0].rows...)
+		}
+		packet = append(packet, protocol.BuildCommandCompletePgMessage(tag).Pack()...)
+		packet = append(packet, protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...)
+		client.Write(packet)
+		return
+	}
+
+	detail := errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL)
+	if len(failed) > 0 {
+		detail = strings.TrimSpace(detail + " Failed on shards " + strings.Join(failed, ", ") + ".")
+	}
+	if len(failed) > 0 && len(succeeded) > 0 && transactionStatus == TRANSACTION_STATUS_IDLE {
+		detail = strings.TrimSpace(detail + " Succeeded on shards " + strings.Join(succeeded, ", ") + ".")
+	}
+	if detail != "" {
+		errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: detail}
+	}
+	slog.Error("Statement failed on shards", "error", errMsg.Error(), "failed", len(failed), "succeeded", len(succeeded))
+	packet := errMsg.Pack()
+	packet = append(packet, protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...)
+	client.Write(packet)
+}
+
+// Get a connection to the primary of every cluster of the database. The
+// connections the client holds for its transaction are reused and new
+// connections join the transaction
+func getShardConnections(
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) ([]*ServerConnection, error) {
+	servers := make([]*ServerConnection, 0, len(database.Clusters))
+	for _, cluster := range database.Clusters {
+		server, err := getShardConnection(client, requester, database, cluster.GetAddr())
+		if err != nil {
+			releaseShardConnections(client, requester, database, servers)
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	client.pendingBegin = ""
+	return servers, nil
+}
+
+// Get a connection to the primary of one cluster of the database. The
+// caller clears the client's pending BEGIN once it has every connection
+// it needs
+func getShardConnection(
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+	shardAddr string,
+) (*ServerConnection, error) {
+	if server, ok := client.GetPinnedConnection(shardAddr); ok {
+		return server, nil
+	}
+	begin := client.pendingBegin
+	if begin == "" && client.InTransaction() {
+		begin = "BEGIN"
+	}
+	server, err := getServerConnection(requester, database, shardAddr, client.Ctx.ClientPid, false)
+	if err == nil {
+		err = applySessionSettings(client, server)
+		if err == nil && begin != "" {
+			err = server.Exec(begin)
+		}
+		if err != nil {
+			requester.ReturnConnection(server, database.Name, server.GetClusterConfig().GetAddr(), client.Ctx.ClientPid)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Keep the connections that are inside a transaction pinned to the
+// client and give the others back to the pool. Connections are pinned
+// by the shard they were requested for, which is not the address of the
+// host serving it after a failover
+func releaseShardConnections(
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+	servers []*ServerConnection,
+) {
+	for _, server := range servers {
+		shardAddr := server.GetShardAddr()
+		if server.InTransaction() && !server.IsPoisoned() {
+			client.PinConnection(shardAddr, server)
+			continue
+		}
+		client.UnpinConnection(shardAddr)
+		requester.ReturnConnection(server, database.Name, server.GetClusterConfig().GetAddr(), client.Ctx.ClientPid)
+	}
+}
+
+// Used to give each prepared transaction its own id
+var preparedTransactionCount atomic.Int64
+
+// An id for a prepared transaction of a client. kind names what the
+// transaction is for, e.g. ddl, so one left prepared can be told apart
+func newPreparedTransactionId(kind string, clientPid int) string {
+	return fmt.Sprintf("pgspanner_%s_%d_%d_%d", kind, os.Getpid(), clientPid, preparedTransactionCount.Add(1))
+}
+
+// End a transaction that spans several shards on every shard taking
+// part in it. A COMMIT is a two phase commit, see endPreparedTransaction,
+// and a transaction that failed on a shard is rolled back on all of
+// them. A ROLLBACK, or a COMMIT AND CHAIN which cannot be prepared, is
+// sent to the shards one after the other, so a failed COMMIT AND CHAIN
+// can leave the transaction committed on some of them, which the error
+// reports
+func handleMultiShardTransactionEnd(
+	queryText string,
+	statement *query.Statement,
+	client *ClientConnection,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) {
+	servers := make([]*ServerConnection, 0, len(client.pinned))
+	for _, server := range client.pinned {
+		servers = append(servers, server)
+	}
+	slices.SortFunc(servers, func(a, b *ServerConnection) int { return strings.Compare(a.GetShardAddr(), b.GetShardAddr()) })
+	tag := string(statement.Kind)
+	if statement.Kind == query.KIND_COMMIT && client.TransactionStatus() == TRANSACTION_STATUS_FAILED {
+		queryText, tag = "ROLLBACK", string(query.KIND_ROLLBACK)
+	}
+	chain := statement.HasTopLevelKeyword("CHAIN") && !statement.HasTopLevelKeyword("NO")
+	if tag == string(query.KIND_COMMIT) && !chain {
+		results := make([]shardResult, 0, len(servers))
+		for _, server := range servers {
+			results = append(results, shardResult{shardAddr: server.GetClusterConfig().GetAddr(), tag: tag})
+		}
+		endPreparedTransaction(servers, results, newPreparedTransactionId("commit", client.Ctx.ClientPid), database.Name)
+		releaseShardConnections(client, requester, database, servers)
+		slog.Info("Committed transaction on shards", "shards", len(servers))
+		writeShardResults(client, database.Name, results, tag, nil)
+		return
+	}
+
+	results := make([]shardResult, 0, len(servers))
+	for _, server := range servers {
+		server.IssueQuery(queryText)
+		results = append(results, readShardResult(server))
+	}
+	releaseShardConnections(client, requester, database, servers)
+	slog.Info("Ended transaction on shards", "statement", tag, "shards", len(servers))
+	for _, result := range results {
+		if result.tag != "" && result.errMsg == nil {
+			// COMMIT of an aborted transaction answers ROLLBACK
+			tag = result.tag
+		}
+	}
+	writeShardResults(client, database.Name, results, tag, nil)
+}
+
+// Start a transaction on every shard so a write to all of them can be
+// committed or rolled back as one. Shards that already started are
+// rolled back when one of them fails
+func beginCoordinatedTransaction(servers []*ServerConnection) error {
+	for i, server := range servers {
+		if err := server.Exec("BEGIN"); err != nil {
+			for _, started := range servers[:i] {
+				started.Exec("ROLLBACK")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// End a coordinated transaction. It is committed when the statement
+// succeeded on every shard and rolled back otherwise. Shards commit one
+// after the other. A failed COMMIT replaces the result of its shard and
+// rolls back the shards after it while the shards before it stay
+// committed
+func endCoordinatedTransaction(servers []*ServerConnection, results []shardResult) {
+	commit := true
+	for _, result := range results {
+		if result.err != nil || result.errMsg != nil {
+			commit = false
+		}
+	}
+	for i, server := range servers {
+		if results[i].err != nil {
+			continue
+		}
+		if !commit {
+			server.IssueQuery("ROLLBACK")
+			ended := readShardResult(server)
+			results[i].transactionStatus = ended.transactionStatus
+			results[i].rolledBack = results[i].errMsg == nil
+			continue
+		}
+		server.IssueQuery("COMMIT")
+		ended := readShardResult(server)
+		if ended.err != nil || ended.errMsg != nil || ended.tag != "COMMIT" {
+			if ended.err == nil && ended.errMsg == nil {
+				ended.errMsg = buildQueryError("40000", "transaction was rolled back on commit")
+			}
+			ended.rows = results[i].rows
+			results[i] = ended
+			commit = false
+			continue
+		}
+		results[i].transactionStatus = ended.transactionStatus
+	}
+}
+
+// End a coordinated transaction with a two phase commit. Every shard
+// prepares the transaction before any of them commits it, so a shard
+// that cannot commit is found while the others can still roll back.
+// The last shard prepares it as the commit decision, see prepared.go,
+// and commits it once every other shard has. A shard that fails to
+// commit a prepared transaction keeps it prepared, along with the last
+// shard, and the error names it. The prepared transaction recovery
+// commits it later. When the last shard is lost while preparing, every
+// shard is left prepared for the recovery to end. Shards that do not allow prepared transactions are
+// committed one after the other instead
+func endPreparedTransaction(servers []*ServerConnection, results []shardResult, gid string, databaseName string) {
+	for _, result := range results {
+		if result.err != nil || result.errMsg != nil {
+			endCoordinatedTransaction(servers, results)
+			return
+		}
+	}
+	for _, server := range servers {
+		if server.noPreparedTransactions {
+			slog.Warn(
+				"Committing without a two phase commit. A cluster does not allow prepared transactions",
+				"cluster", server.GetClusterConfig().GetAddr(),
+				"database", databaseName,
+			)
+			endCoordinatedTransaction(servers, results)
+			return
+		}
+	}
+
+	gids := make([]string, len(servers))
+	for i := range servers {
+		gids[i] = gid
+	}
+	gids[len(gids)-1] = gid + PREPARED_TRANSACTION_DECISION_SUFFIX
+
+	prepared := 0
+	for i, server := range servers {
+		server.IssueQuery("PREPARE TRANSACTION " + quoteLiteral(gids[i]))
+		ended := readShardResult(server)
+		if ended.err != nil && i == len(servers)-1 {
+			// The decision may have been prepared before the connection
+			// was lost. Rolling back the other shards could undo a
+			// transaction the recovery then commits, so they stay
+			// prepared and the recovery ends all of them the same way
+			ended.errMsg = buildLostConnectionError(ended.shardAddr, databaseName, ended.err)
+			ended.err = nil
+			detail := ended.errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL)
+			detail = strings.TrimSpace(detail + " Transaction " + gid + " is still prepared on every shard and will be committed or rolled back by the proxy.")
+			ended.errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: detail}
+			results[i] = ended
+			return
+		}
+		if ended.err != nil || ended.errMsg != nil {
+			ended.rows = results[i].rows
+			results[i] = ended
+			break
+		}
+		results[i].transactionStatus = ended.transactionStatus
+		prepared++
+	}
+	if prepared < len(servers) {
+		for i, server := range servers {
+			switch {
+			case i < prepared:
+				server.IssueQuery("ROLLBACK PREPARED " + quoteLiteral(gids[i]))
+			case i > prepared:
+				server.IssueQuery("ROLLBACK")
+			default:
+				// A failed PREPARE rolls the transaction back itself
+				continue
+			}
+			ended := readShardResult(server)
+			results[i].transactionStatus = ended.transactionStatus
+			results[i].rolledBack = true
+		}
+		return
+	}
+
+	committed := true
+	for i, server := range servers {
+		if i == len(servers)-1 && !committed {
+			break
+		}
+		server.IssueQuery("COMMIT PREPARED " + quoteLiteral(gids[i]))
+		ended := readShardResult(server)
+		if ended.err == nil && ended.errMsg == nil {
+			continue
+		}
+		committed = false
+		if ended.errMsg == nil {
+			ended.errMsg = buildLostConnectionError(ended.shardAddr, databaseName, ended.err)
+			ended.err = nil
+		}
+		detail := ended.errMsg.GetErrorResponseField(protocol.NOTICE_KIND_DETAIL)
+		detail = strings.TrimSpace(detail + " Transaction " + gids[i] + " is still prepared on shard " + ended.shardAddr + " and will be committed by the proxy.")
+		ended.errMsg.Fields[protocol.NOTICE_KIND_DETAIL] = protocol.ErrorField{Type: 'D', Value: detail}
+		ended.rows = results[i].rows
+		results[i] = ended
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReleaseShardConnections(t *testing.T) {
+	database := &DatabaseConfig{Name: "test"}
+	// A replica promoted to primary of shard a serves its connections
+	promoted, _ := newScriptedServer(&ClusterConfig{Host: "b", Port: 5432})
+	promoted.shardAddr = "a:5432"
+	promoted.SetTransactionStatus(TRANSACTION_STATUS_ACTIVE)
+	idle, _ := newScriptedServer(&ClusterConfig{Host: "c", Port: 5432}, buildCompletion("DISCARD ALL", TRANSACTION_STATUS_IDLE))
+	idle.Context.Database = database
+	idle.MarkUsed()
+
+	requester := NewConnectionRequester(nil)
+	defer close(requester.channel)
+	returned := serveScriptedPool(requester, nil)
+	client := &ClientConnection{Ctx: &ClientConnectionContext{ClientPid: 1}}
+	client.PinConnection("c:5432", idle)
+	releaseShardConnections(client, requester, database, []*ServerConnection{promoted, idle})
+
+	if server, ok := client.GetPinnedConnection("a:5432"); !ok || server != promoted {
+		t.Fatal("Expected the connection in a transaction to be pinned by the shard it was requested for")
+	}
+	if _, ok := client.GetPinnedConnection("c:5432"); ok {
+		t.Fatal("Expected the idle connection to be unpinned")
+	}
+	if request := <-returned; request.Event != ACTION_RETURN_CONNECTION || request.Connection != idle || request.clusterAddr != "c:5432" {
+		t.Fatalf("Expected the idle connection to go back to its pool, got %s", request.clusterAddr)
+	}
+}
+
+func TestMultiShardCommit(t *testing.T) {
+	database := joinTestDatabase()
+	requester := NewConnectionRequester(&SpannerConfig{Databases: []DatabaseConfig{*database}})
+	defer close(requester.channel)
+	update := "UPDATE users SET name = 'x'"
+	newServer := func(cluster *ClusterConfig, updated []byte, ended ...[]byte) (*ServerConnection, *scriptedConn) {
+		return newSessionServer(database, cluster, append([][]byte{buildCompletion("BEGIN", TRANSACTION_STATUS_ACTIVE), updated}, ended...)...)
+	}
+	first, firstConn := newServer(&database.Clusters[0],
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE),
+		buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE),
+	)
+	second, secondConn := newServer(&database.Clusters[1],
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("PREPARE TRANSACTION", TRANSACTION_STATUS_IDLE),
+		buildCompletion("COMMIT PREPARED", TRANSACTION_STATUS_IDLE),
+	)
+	failedFirst, failedFirstConn := newServer(&database.Clusters[0],
+		buildCompletion("UPDATE 1", TRANSACTION_STATUS_ACTIVE),
+		buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE),
+	)
+	failedSecond, failedSecondConn := newServer(&database.Clusters[1],
+		buildFailure("23505", TRANSACTION_STATUS_FAILED),
+		buildCompletion("ROLLBACK", TRANSACTION_STATUS_IDLE),
+	)
+	returned := serveScriptedPool(requester, map[string][]*ServerConnection{
+		"a:5432": {first, failedFirst},
+		"b:5432": {second, failedSecond},
+	})
+	conn := startQuerySession(t, requester, "test")
+	run := func(expected ...string) {
+		t.Helper()
+		sqls := []string{"BEGIN", "/* pgspanner: shard=1 */ " + update, "/* pgspanner: shard=2 */ " + update, "COMMIT"}
+		for i, sql := range sqls {
+			if code := sendSessionQuery(t, conn, sql); code != expected[i] {
+				t.Fatalf("Expected %q to answer %q, got %q", sql, expected[i], code)
+			}
+		}
+		<-returned
+		<-returned
+	}
+
+	// The COMMIT prepares the transaction on every shard before it is
+	// committed on any
+	run("", "", "", "")
+	prepare := firstConn.queries()[2]
+	if !strings.HasPrefix(prepare, "PREPARE TRANSACTION 'pgspanner_commit_") {
+		t.Fatalf("Expected the transaction to be prepared, got %q", firstConn.queries())
+	}
+	gid := strings.TrimPrefix(prepare, "PREPARE TRANSACTION ")
+	decision := strings.TrimSuffix(gid, "'") + PREPARED_TRANSACTION_DECISION_SUFFIX + "'"
+	for conn, expected := range map[*scriptedConn][]string{
+		firstConn:  {"BEGIN", update, "PREPARE TRANSACTION " + gid, "COMMIT PREPARED " + gid},
+		secondConn: {"BEGIN", update, "PREPARE TRANSACTION " + decision, "COMMIT PREPARED " + decision},
+	} {
+		queries := conn.queries()
+		queries[1] = strings.TrimSpace(queries[1])
+		if len(queries) < 4 || !slices.Equal(queries[:4], expected) {
+			t.Fatalf("Expected queries %q, got %q", expected, queries)
+		}
+	}
+
+	// A transaction that failed on a shard is rolled back on every shard
+	run("", "", "23505", "")
+	for _, conn := range []*scriptedConn{failedFirstConn, failedSecondConn} {
+		if queries := conn.queries(); len(queries) < 3 || queries[2] != "ROLLBACK" {
+			t.Fatalf("Expected the transaction to be rolled back, got %q", queries)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 30
+	SHUTDOWN_POLL_INTERVAL   = 100 * time.Millisecond
+)
+
+// Coordinates a graceful shutdown of the proxy. New clients stop being
+// accepted, clients are disconnected once they are not in the middle of
+// a transaction, and pooled server connections are closed cleanly.
+// During an upgrade clients are handed to the new process instead
+type ShutdownCoordinator struct {
+	mu            sync.Mutex
+	draining      chan struct{}
+	drainOnce     sync.Once
+	listeners     []net.Listener
+	inherited     []net.Listener
+	clients       map[int]*ClientConnection
+	pidFile       string
+	handoff       *handoffConn
+	nextClientPid int
+	// Held by the accept loops between accepting a client and assigning
+	// its pid. Taken for writing to pause accepting
+	acceptMu sync.RWMutex
+	// Set once a new process took over. The socket and pid files are
+	// its own from then on
+	handedOff bool
+}
+
+func NewShutdownCoordinator(pidFile string) *ShutdownCoordinator {
+	return &ShutdownCoordinator{
+		draining: make(chan struct{}),
+		clients:  make(map[int]*ClientConnection),
+		pidFile:  pidFile,
+	}
+}
+
+func (s *ShutdownCoordinator) IsDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Record the listeners accepting clients so they can be closed on
+// shutdown. Returns false if a shutdown is already in progress
+func (s *ShutdownCoordinator) SetListeners(listeners []net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.IsDraining() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return false
+	}
+	s.listeners = listeners
+	return true
+}
+
+// Take the listeners received from a previous process during an
+// upgrade. Returns nil if the process was not started as an upgrade
+func (s *ShutdownCoordinator) TakeInheritedListeners() []net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listeners := s.inherited
+	s.inherited = nil
+	return listeners
+}
+
+// Hand out the pid identifying a new client. Pids are tracked here so
+// they stay unique across processes during an upgrade
+func (s *ShutdownCoordinator) AssignClientPid() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pid := s.nextClientPid
+	s.nextClientPid++
+	return pid
+}
+
+func (s *ShutdownCoordinator) RegisterClient(client *ClientConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client.Ctx.ClientPid] = client
+}
+
+func (s *ShutdownCoordinator) UnregisterClient(client *ClientConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, client.Ctx.ClientPid)
+}
+
+func (s *ShutdownCoordinator) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Let go of a client once it is not inside a transaction. The client is
+// handed to the new process during an upgrade and disconnected
+// otherwise. Returns false if the client has to be kept for now
+func (s *ShutdownCoordinator) ReleaseClient(client *ClientConnection) bool {
+	s.mu.Lock()
+	handoff := s.handoff
+	s.mu.Unlock()
+	if handoff != nil && client.CanHandOff() {
+		sent, err := client.HandOff(handoff)
+		if err == nil {
+			if sent {
+				slog.Info("Handed client to new process", "clientPid", client.Ctx.ClientPid)
+			}
+			return sent
+		}
+		slog.Error("Error handing off client. Disconnecting clients instead", "error", err)
+		s.mu.Lock()
+		s.handoff = nil
+		s.mu.Unlock()
+	}
+	if client.Terminate(buildAdminShutdownError(), false) {
+		slog.Info("Disconnected client for shutdown", "clientPid", client.Ctx.ClientPid)
+		return true
+	}
+	return false
+}
+
+// Release every idle client. When forced the clients still inside a
+// transaction are disconnected as well and the queries of clients
+// running one are canceled so they get their error soon
+func (s *ShutdownCoordinator) releaseClients(force bool, requester *ConnectionRequester) {
+	s.mu.Lock()
+	clients := make([]*ClientConnection, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	handingOff := s.handoff != nil
+	s.mu.Unlock()
+
+	for _, client := range clients {
+		if force {
+			if client.Terminate(buildAdminShutdownError(), true) && client.IsTerminating() {
+				cancel := protocol.BuildCancelRequestPgMessage(client.Ctx.ClientPid, client.Ctx.ClientSecret)
+				handleCancelRequest(cancel, requester.GetConfig(), requester)
+			}
+		} else if handingOff && client.CanHandOff() {
+			// The client's own goroutine performs the handoff so no
+			// bytes of its next message can be lost in between
+			client.Interrupt()
+		} else {
+			s.ReleaseClient(client)
+		}
+	}
+}
+
+func buildAdminShutdownError() *protocol.ErrorResponsePgMessage {
+	return protocol.BuildErrorResponsePgMessage(map[string]string{
+		protocol.NOTICE_KIND_SEVERITY_NONLOCALIZED: "FATAL",
+		protocol.NOTICE_KIND_SEVERITY_LOCALIZED:    "FATAL",
+		protocol.NOTICE_KIND_CODE:                  "57P01",
+		protocol.NOTICE_KIND_MESSAGE:               "terminating connection due to administrator command",
+		protocol.NOTICE_KIND_DETAIL:                "pgspanner is shutting down",
+	})
+}
+
+// Wait for SIGTERM or SIGINT and shut down. A second signal exits
+// immediately
+func (s *ShutdownCoordinator) WaitForSignal(requester *ConnectionRequester) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	slog.Info("Received signal. Shutting down", "signal", sig.String())
+
+	go func() {
+		sig := <-signals
+		slog.Warn("Received second signal. Exiting immediately", "signal", sig.String())
+		s.removePidFile()
+		os.Exit(1)
+	}()
+
+	s.Shutdown(requester.GetConfig().GetShutdownTimeout(), requester)
+	os.Exit(0)
+}
+
+// Stop accepting new clients
+func (s *ShutdownCoordinator) stopAccepting() {
+	s.drainOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		close(s.draining)
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+	})
+}
+
+func (s *ShutdownCoordinator) Shutdown(timeout time.Duration, requester *ConnectionRequester) {
+	s.stopAccepting()
+	s.removeSocketFiles()
+	s.drainClients(timeout, requester)
+
+	slog.Info("Closing pooled server connections")
+	requester.RequestShutdown()
+	s.removePidFile()
+	slog.Info("Shutdown complete")
+}
+
+func (s *ShutdownCoordinator) drainClients(timeout time.Duration, requester *ConnectionRequester) {
+	slog.Info("Draining client connections", "clients", s.clientCount(), "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	for s.clientCount() > 0 && time.Now().Before(deadline) {
+		s.releaseClients(false, requester)
+		time.Sleep(SHUTDOWN_POLL_INTERVAL)
+	}
+	if remaining := s.clientCount(); remaining > 0 {
+		slog.Warn("Shutdown timeout reached. Disconnecting remaining clients", "clients", remaining)
+		s.releaseClients(true, requester)
+		// Give the connection loops a moment to finish their requests
+		// and return their connections
+		for i := 0; s.clientCount() > 0 && i < 10; i++ {
+			time.Sleep(SHUTDOWN_POLL_INTERVAL)
+		}
+		s.abortClients()
+	}
+}
+
+// Close the clients still running a request without waiting for it
+func (s *ShutdownCoordinator) abortClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, client := range s.clients {
+		if client.Abort() {
+			slog.Warn("Closed client that did not finish its request", "clientPid", client.Ctx.ClientPid)
+		}
+	}
+}
+
+func (s *ShutdownCoordinator) removeSocketFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handedOff {
+		return
+	}
+	for _, listener := range s.listeners {
+		if addr, ok := listener.Addr().(*net.UnixAddr); ok {
+			os.Remove(addr.Name)
+		}
+	}
+}
+
+func (s *ShutdownCoordinator) removePidFile() {
+	s.mu.Lock()
+	handedOff := s.handedOff
+	s.mu.Unlock()
+	if s.pidFile == "" || handedOff {
+		return
+	}
+	if err := os.Remove(s.pidFile); err != nil && !os.IsNotExist(err) {
+		slog.Error("Error removing pid file", "error", err, "pidFile", s.pidFile)
+	}
+}
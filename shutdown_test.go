@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// Start a session for a client on the other end of a pipe. The channel
+// gets everything the client was sent once it is disconnected
+func startTestSession(shutdown *ShutdownCoordinator, clientPid int, inTransaction bool) <-chan []byte {
+	proxyEnd, clientEnd := net.Pipe()
+	client := &ClientConnection{Conn: proxyEnd, Ctx: &ClientConnectionContext{ClientPid: clientPid}}
+	if inTransaction {
+		client.pendingBegin = "BEGIN"
+	}
+	shutdown.RegisterClient(client)
+	go runClientSession(client, nil, shutdown)
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(clientEnd)
+		received <- data
+	}()
+	return received
+}
+
+func TestDrainClients(t *testing.T) {
+	shutdown := NewShutdownCoordinator("")
+	idle := startTestSession(shutdown, 1, false)
+	inTransaction := startTestSession(shutdown, 2, true)
+
+	// A client running a request when the timeout is reached has its
+	// queries canceled and gets the error once the request ends
+	busy := &ClientConnection{Conn: &scriptedConn{}, Ctx: &ClientConnectionContext{ClientPid: 3}}
+	busy.StartRequest()
+	shutdown.RegisterClient(busy)
+	requester := NewConnectionRequester(nil)
+	defer close(requester.channel)
+	canceled := make(chan int, 1)
+	go func() {
+		for request := range requester.ReceiveConnectionRequest() {
+			canceled <- request.FrontendPid
+			busy.FinishRequest()
+			shutdown.UnregisterClient(busy)
+			request.responder <- ConnectionResponse{Result: RESULT_ERROR, Detail: ConnectionMappingNotFound{request.FrontendPid}}
+		}
+	}()
+
+	shutdown.drainClients(2*SHUTDOWN_POLL_INTERVAL, requester)
+	if count := shutdown.clientCount(); count != 0 {
+		t.Fatalf("Expected every client to be disconnected, %d left", count)
+	}
+	if pid := <-canceled; pid != 3 {
+		t.Fatalf("Expected the queries of the busy client to be canceled, got client %d", pid)
+	}
+	for name, received := range map[string][]byte{
+		"idle":           <-idle,
+		"in transaction": <-inTransaction,
+		"busy":           busy.Conn.(*scriptedConn).sent.Bytes(),
+	} {
+		if code := getErrorCode(received); code != "57P01" {
+			t.Fatalf("Expected the %s client to get the shutdown error, got %q", name, code)
+		}
+	}
+}
+
+func TestTerminateBusyClient(t *testing.T) {
+	conn := &scriptedConn{}
+	client := &ClientConnection{Conn: conn, Ctx: &ClientConnectionContext{}}
+	client.StartRequest()
+	if client.Terminate(buildAdminShutdownError(), false) {
+		t.Fatal("Expected a busy client to be kept unless forced")
+	}
+	if !client.Terminate(buildAdminShutdownError(), true) || !client.IsTerminating() {
+		t.Fatal("Expected a forced busy client to be terminated")
+	}
+	// Nothing is written in the middle of the response being relayed
+	if conn.sent.Len() != 0 || conn.closed {
+		t.Fatal("Expected the busy client to be left alone until its request is done")
+	}
+	if client.FinishRequest() || !conn.closed {
+		t.Fatal("Expected the client to be disconnected once its request is done")
+	}
+	if code := sentErrorCode(conn); code != "57P01" {
+		t.Fatalf("Expected the client to get the shutdown error, got %q", code)
+	}
+
+	// A client that never finishes is closed without a word
+	stuck := &ClientConnection{Conn: &scriptedConn{}, Ctx: &ClientConnectionContext{}}
+	stuck.StartRequest()
+	stuck.Terminate(buildAdminShutdownError(), true)
+	if !stuck.Abort() || stuck.Abort() {
+		t.Fatal("Expected a client to be aborted once")
+	}
+}
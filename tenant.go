@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+	"github.com/livinlefevreloca/pgspanner/query"
+)
+
+/// A session that runs as a tenant sends its queries to the cluster of the tenant, apart from
+/// writes to reference tables which still reach every cluster
+
+const (
+	TENANT_SETTING      = "pgspanner.tenant"
+	SEARCH_PATH_SETTING = "search_path"
+	// A tenant being moved to another cluster should stop writing for
+	// this long after its directory row points at the new cluster
+	TENANT_DIRECTORY_TTL = 5 * time.Second
+	// Once the cache is this full expired entries are dropped, and half
+	// of the entries when none have expired
+	TENANT_DIRECTORY_MAX_ENTRIES = 10000
+)
+
+type tenantDirectoryEntry struct {
+	// Address of the tenant's cluster. Empty when the directory does not
+	// list the tenant
+	addr    string
+	fetched time.Time
+}
+
+// Entries of the tenant directories read recently, keyed by database
+// and tenant
+type tenantDirectoryCache struct {
+	mu         sync.Mutex
+	entries    map[[2]string]tenantDirectoryEntry
+	maxEntries int
+}
+
+var tenantDirectory = newTenantDirectoryCache(TENANT_DIRECTORY_MAX_ENTRIES)
+
+func newTenantDirectoryCache(maxEntries int) *tenantDirectoryCache {
+	return &tenantDirectoryCache{entries: make(map[[2]string]tenantDirectoryEntry), maxEntries: maxEntries}
+}
+
+// The cached address of a tenant's cluster unless it has expired
+func (c *tenantDirectoryCache) get(key [2]string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.Sub(entry.fetched) >= TENANT_DIRECTORY_TTL {
+		return "", false
+	}
+	return entry.addr, true
+}
+
+func (c *tenantDirectoryCache) put(key [2]string, addr string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		for cached, entry := range c.entries {
+			if now.Sub(entry.fetched) >= TENANT_DIRECTORY_TTL {
+				delete(c.entries, cached)
+			}
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		// Every tenant was read recently, drop entries at random
+		for cached := range c.entries {
+			if len(c.entries) <= c.maxEntries/2 {
+				break
+			}
+			delete(c.entries, cached)
+		}
+	}
+	c.entries[key] = tenantDirectoryEntry{addr: addr, fetched: now}
+}
+
+// The tenant given in the startup message, either as a parameter of its
+// own or in the options parameter as -c pgspanner.tenant=name
+func getStartupTenant(options map[string]string) string {
+	if tenant, ok := options[TENANT_SETTING]; ok {
+		return tenant
+	}
+	tenant := ""
+	fields := strings.Fields(options["options"])
+	for i, field := range fields {
+		if field == "-c" && i+1 < len(fields) {
+			field = fields[i+1]
+		}
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "-c"), "--")
+		if value, ok := strings.CutPrefix(field, TENANT_SETTING+"="); ok {
+			tenant = value
+		}
+	}
+	return tenant
+}
+
+// The tenant the client's session runs as, if any. It is set with the
+// pgspanner.tenant startup option or SET pgspanner.tenant, or else is
+// the first schema of the session's search_path when the database takes
+// tenants from it
+func getSessionTenant(client *ClientConnection, database *DatabaseConfig) string {
+	if !database.Tenants.Enabled {
+		return ""
+	}
+	if client.Ctx.Tenant != "" || !database.Tenants.FromSearchPath || client.Ctx.SearchPath == "" {
+		return client.Ctx.Tenant
+	}
+	statements, err := query.Parse("SET search_path TO " + client.Ctx.SearchPath)
+	if err != nil || len(statements) != 1 {
+		return ""
+	}
+	set, ok := query.ParseSet(statements[0])
+	if !ok || len(set.Values) == 0 {
+		return ""
+	}
+	return set.Values[0]
+}
+
+// Handle SET, RESET and SHOW of the settings the proxy keeps for the
+// session. Returns whether the query was handled
+func handleSessionSetting(statements []*query.Statement, client *ClientConnection, database *DatabaseConfig) bool {
+	if len(statements) != 1 || !database.Tenants.Enabled {
+		return false
+	}
+	statement := statements[0]
+	if statement.Kind == query.KIND_SHOW {
+		if !strings.EqualFold(strings.TrimSpace(statement.Text[len("SHOW"):]), TENANT_SETTING) {
+			return false
+		}
+		writeSettingValue(client, TENANT_SETTING, getSessionTenant(client, database))
+		return true
+	}
+
+	set, ok := query.ParseSet(statement)
+	if !ok {
+		return false
+	}
+	tenant := client.Ctx.Tenant
+	searchPath := client.Ctx.SearchPath
+	forward := false
+	switch {
+	case set.Name == TENANT_SETTING && set.Local:
+		writeSyntheticError(client, buildQueryError("0A000", TENANT_SETTING+" cannot be set for a single transaction"))
+		return true
+	case set.Name == TENANT_SETTING && set.Text == "":
+		// RESET goes back to the tenant of the startup message
+		tenant = getStartupTenant(client.Ctx.Options)
+	case set.Name == TENANT_SETTING:
+		if len(set.Values) > 1 {
+			writeSyntheticError(client, buildQueryError("22023", TENANT_SETTING+" takes only one value"))
+			return true
+		}
+		tenant = ""
+		if len(set.Values) == 1 {
+			tenant = set.Values[0]
+		}
+	case set.Name == SEARCH_PATH_SETTING && database.Tenants.FromSearchPath && !set.Local:
+		searchPath = ""
+		if len(set.Values) > 0 {
+			searchPath = set.Text
+		}
+		// Inside a transaction the connections already held need it too
+		forward = client.InTransaction()
+	case set.Name == "all":
+		// RESET ALL also resets the settings of the servers
+		tenant = getStartupTenant(client.Ctx.Options)
+		searchPath = ""
+		forward = true
+	default:
+		return false
+	}
+
+	if client.TransactionStatus() == TRANSACTION_STATUS_FAILED {
+		writeSyntheticError(client, buildFailedTransactionError())
+		return true
+	}
+	previous := getSessionTenant(client, database)
+	oldTenant, oldSearchPath := client.Ctx.Tenant, client.Ctx.SearchPath
+	client.Ctx.Tenant, client.Ctx.SearchPath = tenant, searchPath
+	if client.InTransaction() && getSessionTenant(client, database) != previous {
+		client.Ctx.Tenant, client.Ctx.SearchPath = oldTenant, oldSearchPath
+		writeSyntheticError(client, buildQueryError("25001", "the tenant of a session cannot change inside a transaction"))
+		return true
+	}
+	slog.Debug("Set session setting", "clientPid", client.Ctx.ClientPid, "setting", set.Name, "tenant", getSessionTenant(client, database))
+	if forward {
+		return false
+	}
+	tag := "SET"
+	if statement.Kind != query.KIND_SET {
+		tag = "RESET"
+	}
+	writeSyntheticCompletion(client, tag, client.TransactionStatus())
+	return true
+}
+
+// Answer SHOW with the value of a setting kept by the proxy
+func writeSettingValue(client *ClientConnection, name string, value string) {
+	transactionStatus := byte(TRANSACTION_STATUS_IDLE)
+	if client.InTransaction() {
+		transactionStatus = TRANSACTION_STATUS_ACTIVE
+	}
+	packet := protocol.BuildTextRowDescriptionPgMessage([]string{name}).Pack()
+	packet = append(packet, protocol.BuildDataRowPgMessage([][]byte{[]byte(value)}).Pack()...)
+	packet = append(packet, protocol.BuildCommandCompletePgMessage("SHOW").Pack()...)
+	packet = append(packet, protocol.BuildReadyForQueryPgMessage(transactionStatus).Pack()...)
+	client.Write(packet)
+}
+
+// Set the session's search_path on a connection it just got from the pool
+func applySessionSettings(client *ClientConnection, server *ServerConnection) error {
+	if client.Ctx.SearchPath == "" {
+		return nil
+	}
+	return server.Exec("SET search_path TO " + client.Ctx.SearchPath)
+}
+
+// Find the cluster the session's tenant lives on, the one the tenant
+// directory gives or else the one owning the keyspace id of its name.
+// Returns nil when the session has no tenant
+func routeByTenant(
+	client *ClientConnection,
+	write *routedWrite,
+	requester *ConnectionRequester,
+	database *DatabaseConfig,
+) (*ClusterConfig, error) {
+	tenant := getSessionTenant(client, database)
+	if tenant == "" {
+		return nil, nil
+	}
+	addr, err := getTenantAddr(tenant, client.Ctx.ClientPid, requester, database)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		database = routeKeys(write, requester, database, []string{tenant})
+		cluster, ok := database.GetClusterForKeyspaceId(KeyspaceId([]byte(tenant)))
+		if !ok {
+			return nil, fmt.Errorf("no cluster owns the keyspace id of tenant %q", tenant)
+		}
+		return cluster, nil
+	}
+	for i := range database.Clusters {
+		if database.Clusters[i].GetAddr() == addr {
+			return &database.Clusters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("tenant %q lives on %s which is not a cluster of database %q", tenant, addr, database.Name)
+}
+
+// Get the address the tenant directory gives for the tenant. Returns an
+// empty address when the tenant is not listed
+func getTenantAddr(tenant string, clientPid int, requester *ConnectionRequester, database *DatabaseConfig) (string, error) {
+	if database.Tenants.DirectoryTable == "" {
+		return "", nil
+	}
+	key := [2]string{database.Name, tenant}
+	if addr, ok := tenantDirectory.get(key, time.Now()); ok {
+		return addr, nil
+	}
+
+	addr, err := readTenantDirectory(tenant, clientPid, requester, database)
+	if err != nil {
+		return "", err
+	}
+	tenantDirectory.put(key, addr, time.Now())
+	return addr, nil
+}
+
+// Read the address of the tenant's cluster from the directory table on
+// the first cluster
+func readTenantDirectory(tenant string, clientPid int, requester *ConnectionRequester, database *DatabaseConfig) (string, error) {
+	directoryAddr := database.Clusters[0].GetAddr()
+	server, err := getServerConnection(requester, database, directoryAddr, clientPid, false)
+	if err != nil {
+		return "", err
+	}
+	rows, err := server.QueryRows(fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = %s",
+		TENANT_DIRECTORY_CLUSTER_COLUMN, database.Tenants.DirectoryTable, TENANT_DIRECTORY_TENANT_COLUMN, quoteLiteral(tenant),
+	))
+	requester.ReturnConnection(server, database.Name, directoryAddr, clientPid)
+	if err != nil {
+		return "", err
+	}
+	addr := ""
+	if len(rows) > 0 && rows[0].Values[0] != nil {
+		addr = string(rows[0].Values[0])
+	}
+	slog.Debug("Read tenant directory", "database", database.Name, "tenant", tenant, "cluster", addr)
+	return addr, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetStartupTenant(t *testing.T) {
+	cases := []struct {
+		options  map[string]string
+		expected string
+	}{
+		{map[string]string{"pgspanner.tenant": "acme"}, "acme"},
+		{map[string]string{"options": "-c statement_timeout=5s -c pgspanner.tenant=acme"}, "acme"},
+		{map[string]string{"options": "--pgspanner.tenant=acme"}, "acme"},
+		{map[string]string{"options": "-c statement_timeout=5s"}, ""},
+		{map[string]string{}, ""},
+	}
+	for _, c := range cases {
+		if tenant := getStartupTenant(c.options); tenant != c.expected {
+			t.Fatalf("Expected tenant %q from %v, got %q", c.expected, c.options, tenant)
+		}
+	}
+}
+
+func TestRouteByTenant(t *testing.T) {
+	database := lookupTestDatabase()
+	database.Tenants = TenantConfig{Enabled: true, FromSearchPath: true}
+	client := &ClientConnection{Ctx: &ClientConnectionContext{SearchPath: "acme, public"}}
+
+	if tenant := getSessionTenant(client, database); tenant != "acme" {
+		t.Fatalf("Expected tenant acme from search_path, got %q", tenant)
+	}
+	cluster, err := routeByTenant(client, nil, nil, database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := database.GetClusterForKeyspaceId(KeyspaceId([]byte("acme")))
+	if cluster.GetAddr() != expected.GetAddr() {
+		t.Fatalf("Expected tenant acme on %s, got %s", expected.GetAddr(), cluster.GetAddr())
+	}
+
+	// The tenant setting wins over search_path
+	client.Ctx.Tenant = "globex"
+	if tenant := getSessionTenant(client, database); tenant != "globex" {
+		t.Fatalf("Expected tenant globex, got %q", tenant)
+	}
+	database.Tenants.Enabled = false
+	if tenant := getSessionTenant(client, database); tenant != "" {
+		t.Fatalf("Expected no tenant when tenant routing is disabled, got %q", tenant)
+	}
+}
+
+func TestTenantDirectoryCache(t *testing.T) {
+	cache := newTenantDirectoryCache(4)
+	now := time.Now()
+	cache.put([2]string{"test", "old"}, "a:5432", now.Add(-TENANT_DIRECTORY_TTL))
+	if _, ok := cache.get([2]string{"test", "old"}, now); ok {
+		t.Fatal("Expected an expired entry not to be used")
+	}
+	for _, tenant := range []string{"b", "c", "d"} {
+		cache.put([2]string{"test", tenant}, "b:5432", now)
+	}
+
+	// A full cache drops its expired entries first
+	cache.put([2]string{"test", "e"}, "b:5432", now)
+	if _, ok := cache.entries[[2]string{"test", "old"}]; ok || len(cache.entries) != 4 {
+		t.Fatalf("Expected the expired entry to be evicted, got %d entries", len(cache.entries))
+	}
+	if addr, ok := cache.get([2]string{"test", "e"}, now); !ok || addr != "b:5432" {
+		t.Fatalf("Expected the new entry to be cached, got %q", addr)
+	}
+
+	// and half of its entries when none have expired
+	cache.put([2]string{"test", "f"}, "b:5432", now)
+	if len(cache.entries) != 3 {
+		t.Fatalf("Expected the cache to shrink, got %d entries", len(cache.entries))
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HANDOFF_MESSAGE_LISTENER = "listener"
+	HANDOFF_MESSAGE_READY    = "ready"
+	HANDOFF_MESSAGE_CLIENT   = "client"
+	HANDOFF_MESSAGE_DONE     = "done"
+	HANDOFF_MAX_MESSAGE_SIZE = 64 * 1024
+	UPGRADE_CONNECT_TIMEOUT  = 10 * time.Second
+)
+
+// A message passed from the old process to the new one during an
+// upgrade. Listener and client messages carry a file descriptor. The
+// listeners are sent first followed by a ready message, which the new
+// process sends back once it took the listeners over
+type handoffMessage struct {
+	Kind          string
+	NextClientPid int                      `json:",omitempty"`
+	IdGeneration  int                      `json:",omitempty"`
+	Client        *ClientConnectionContext `json:",omitempty"`
+}
+
+// The unix socket file descriptors are passed over with SCM_RIGHTS.
+// A seqpacket socket is used so every message arrives whole
+type handoffConn struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func (h *handoffConn) send(message handoffMessage, file *os.File) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if file != nil {
+		oob = syscall.UnixRights(int(file.Fd()))
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _, err = h.conn.WriteMsgUnix(data, oob, nil)
+	return err
+}
+
+func (h *handoffConn) receive() (*handoffMessage, *os.File, error) {
+	data := make([]byte, HANDOFF_MAX_MESSAGE_SIZE)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := h.conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return nil, nil, io.EOF
+	}
+
+	var file *os.File
+	if oobn > 0 {
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(messages) == 0 {
+			return nil, nil, fmt.Errorf("invalid control message: %w", err)
+		}
+		fds, err := syscall.ParseUnixRights(&messages[0])
+		if err != nil || len(fds) == 0 {
+			return nil, nil, fmt.Errorf("invalid file descriptor: %w", err)
+		}
+		file = os.NewFile(uintptr(fds[0]), "handoff")
+	}
+
+	message := &handoffMessage{}
+	if err := json.Unmarshal(data[:n], message); err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, nil, err
+	}
+	return message, file, nil
+}
+
+// Wait for a new process to connect to the upgrade socket and hand it
+// the listener and our clients. The process exits once every client
+// has been handed off or has disconnected. A failed handoff leaves the
+// process serving clients and waiting for the next upgrade
+func RunUpgradeListener(path string, shutdown *ShutdownCoordinator, requester *ConnectionRequester) {
+	os.Remove(path)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		slog.Error("Error listening on upgrade socket. Upgrades are disabled", "error", err, "path", path)
+		return
+	}
+	// The new process creates its own upgrade socket at the same path
+	listener.SetUnlinkOnClose(false)
+	slog.Info("Listening for upgrades", "path", path)
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			slog.Error("Error accepting on upgrade socket", "error", err)
+			continue
+		}
+		slog.Info("New process connected. Handing off listeners and clients")
+		if err := shutdown.handOff(conn, requester); err != nil {
+			slog.Error("Error handing off listeners. Still accepting clients", "error", err)
+			conn.Close()
+			continue
+		}
+		conn.Close()
+		listener.Close()
+
+		slog.Info("Closing pooled server connections")
+		requester.RequestShutdown()
+		slog.Info("Upgrade handoff complete")
+		os.Exit(0)
+	}
+}
+
+// Hand the listeners and clients to the new process connected on conn.
+// Accepting is paused while the listeners are passed and only stops for
+// good once the new process confirmed it took them over, otherwise it
+// resumes
+func (s *ShutdownCoordinator) handOff(conn *net.UnixConn, requester *ConnectionRequester) error {
+	files, err := s.listenerFiles()
+	if err != nil {
+		return err
+	}
+	handoff := &handoffConn{conn: conn}
+	for _, file := range files {
+		if err == nil {
+			err = handoff.send(handoffMessage{Kind: HANDOFF_MESSAGE_LISTENER}, file)
+		}
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	nextClientPid := s.pauseAccepting()
+	err = handoff.send(handoffMessage{
+		Kind:          HANDOFF_MESSAGE_READY,
+		NextClientPid: nextClientPid,
+		IdGeneration:  idGenerator.GetGeneration(),
+	}, nil)
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(UPGRADE_CONNECT_TIMEOUT))
+		var message *handoffMessage
+		message, _, err = handoff.receive()
+		if err == nil && message.Kind != HANDOFF_MESSAGE_READY {
+			err = fmt.Errorf("expected the new process to be ready, got %q", message.Kind)
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		s.resumeAccepting()
+		return err
+	}
+	s.mu.Lock()
+	s.handedOff = true
+	s.mu.Unlock()
+	s.stopAccepting()
+	s.resumeAccepting()
+
+	s.handOffClients(handoff, requester.GetConfig().GetShutdownTimeout(), requester)
+	if err := handoff.send(handoffMessage{Kind: HANDOFF_MESSAGE_DONE}, nil); err != nil {
+		slog.Error("Error finishing handoff", "error", err)
+	}
+	return nil
+}
+
+// Take over the listener and clients of the process running on the
+// upgrade socket. Clients are resumed in the background as they arrive
+func ReceiveHandoff(path string, shutdown *ShutdownCoordinator, requester *ConnectionRequester) error {
+	conn, err := net.DialTimeout("unixpacket", path, UPGRADE_CONNECT_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	handoff := &handoffConn{conn: conn.(*net.UnixConn)}
+
+	conn.SetReadDeadline(time.Now().Add(UPGRADE_CONNECT_TIMEOUT))
+	listeners := make([]net.Listener, 0)
+	for {
+		message, file, err := handoff.receive()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if message.Kind == HANDOFF_MESSAGE_READY {
+			conn.SetReadDeadline(time.Time{})
+			// The previous process stops accepting once it hears back
+			if err := handoff.send(handoffMessage{Kind: HANDOFF_MESSAGE_READY}, nil); err != nil {
+				closeListeners(listeners)
+				conn.Close()
+				return err
+			}
+			shutdown.inherit(listeners, message.NextClientPid)
+			idGenerator.FollowGeneration(message.IdGeneration)
+			break
+		}
+		if message.Kind != HANDOFF_MESSAGE_LISTENER || file == nil {
+			closeListeners(listeners)
+			conn.Close()
+			return errors.New("expected listeners at the start of the handoff")
+		}
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			conn.Close()
+			return err
+		}
+		slog.Info("Took over listener from previous process", "addr", listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	go handoff.receiveClients(shutdown, requester)
+	return nil
+}
+
+func (h *handoffConn) receiveClients(shutdown *ShutdownCoordinator, requester *ConnectionRequester) {
+	defer h.conn.Close()
+	count := 0
+	for {
+		message, file, err := h.receive()
+		if err != nil {
+			slog.Error("Previous process went away during handoff", "error", err)
+			return
+		}
+		switch message.Kind {
+		case HANDOFF_MESSAGE_CLIENT:
+			conn, err := net.FileConn(file)
+			file.Close()
+			if err != nil || message.Client == nil {
+				slog.Error("Received invalid client from previous process", "error", err)
+				continue
+			}
+			count++
+			go ResumeConnectionLoop(conn, message.Client, requester, shutdown)
+		case HANDOFF_MESSAGE_DONE:
+			slog.Info("Handoff from previous process complete", "clients", count)
+			return
+		default:
+			if file != nil {
+				file.Close()
+			}
+			slog.Warn("Unknown handoff message", "kind", message.Kind)
+		}
+	}
+}
+
+// Duplicate the listeners for the new process. Clients keep being
+// accepted on them until the new process is ready
+func (s *ShutdownCoordinator) listenerFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if len(listeners) == 0 || s.IsDraining() {
+		return nil, errors.New("not accepting clients")
+	}
+	files := make([]*os.File, 0, len(listeners))
+	for _, listener := range listeners {
+		file, err := listener.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Stop accepting clients without closing the listeners. Clients
+// connecting in the meantime wait in the listen backlog. Returns the
+// next free client pid once the accept loops are paused
+func (s *ShutdownCoordinator) pauseAccepting() int {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, listener := range listeners {
+		listener.(interface{ SetDeadline(time.Time) error }).SetDeadline(time.Now())
+	}
+	s.acceptMu.Lock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextClientPid
+}
+
+func (s *ShutdownCoordinator) resumeAccepting() {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, listener := range listeners {
+		listener.(interface{ SetDeadline(time.Time) error }).SetDeadline(time.Time{})
+	}
+	s.acceptMu.Unlock()
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+func (s *ShutdownCoordinator) inherit(listeners []net.Listener, nextClientPid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inherited = listeners
+	s.nextClientPid = nextClientPid
+}
+
+func (s *ShutdownCoordinator) handOffClients(handoff *handoffConn, timeout time.Duration, requester *ConnectionRequester) {
+	s.mu.Lock()
+	s.handoff = handoff
+	s.mu.Unlock()
+	s.drainClients(timeout, requester)
+}
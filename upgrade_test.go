@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/livinlefevreloca/pgspanner/protocol"
+)
+
+// Open the upgrade socket of a process and return the connection the new
+// process makes to it
+func connectUpgradeSocket(t *testing.T) (string, <-chan *net.UnixConn) {
+	path := filepath.Join(t.TempDir(), "upgrade.sock")
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan *net.UnixConn, 1)
+	go func() {
+		conn, err := listener.AcceptUnix()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	return path, accepted
+}
+
+// A client connected to the proxy over a socket that can be handed off
+func newSocketClient(t *testing.T, clientPid int) (*ClientConnection, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "client")
+		conns[i], err = net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { conns[1].Close() })
+	return &ClientConnection{Conn: conns[0], Ctx: &ClientConnectionContext{DatabaseName: "test", ClientPid: clientPid}}, conns[1]
+}
+
+func TestUpgradeHandoff(t *testing.T) {
+	config := &SpannerConfig{ShutdownTimeout: 1, Databases: []DatabaseConfig{{Name: "test"}}}
+	requester := NewConnectionRequester(config)
+	old := NewShutdownCoordinator("")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.SetListeners([]net.Listener{listener})
+	old.nextClientPid = 5
+	client, clientEnd := newSocketClient(t, 3)
+	go runClientSession(client, requester, old)
+
+	path, accepted := connectUpgradeSocket(t)
+	handedOff := make(chan error, 1)
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		handedOff <- old.handOff(conn, requester)
+	}()
+
+	// The new process gets the listener, the next client pid and then
+	// the idle client
+	upgraded := NewShutdownCoordinator("")
+	if err := ReceiveHandoff(path, upgraded, requester); err != nil {
+		t.Fatal(err)
+	}
+	inherited := upgraded.TakeInheritedListeners()
+	if len(inherited) != 1 || inherited[0].Addr().String() != listener.Addr().String() {
+		t.Fatalf("Expected the listener to be handed off, got %v", inherited)
+	}
+	defer inherited[0].Close()
+	if pid := upgraded.AssignClientPid(); pid != 5 {
+		t.Fatalf("Expected client pids to continue at 5, got %d", pid)
+	}
+	if err := <-handedOff; err != nil {
+		t.Fatal(err)
+	}
+	if !old.IsDraining() || old.clientCount() != 0 {
+		t.Fatal("Expected the old process to stop accepting and let go of its clients")
+	}
+	for deadline := time.Now().Add(time.Second); upgraded.clientCount() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be resumed by the new process")
+		}
+	}
+
+	// The handed off client and the inherited listener keep working
+	clientEnd.Write(protocol.BuildTerminateMessage().Pack())
+	for deadline := time.Now().Add(time.Second); upgraded.clientCount() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the resumed client to be served by the new process")
+		}
+	}
+	go net.Dial("tcp", listener.Addr().String())
+	conn, err := inherited[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestUpgradeHandoffFailure(t *testing.T) {
+	requester := NewConnectionRequester(&SpannerConfig{})
+	old := NewShutdownCoordinator("")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	old.SetListeners([]net.Listener{listener})
+
+	// The new process goes away without taking over
+	path, accepted := connectUpgradeSocket(t)
+	handedOff := make(chan error, 1)
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		handedOff <- old.handOff(conn, requester)
+	}()
+	conn, err := net.Dial("unixpacket", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProcess := &handoffConn{conn: conn.(*net.UnixConn)}
+	for {
+		message, file, err := newProcess.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != nil {
+			file.Close()
+		}
+		if message.Kind == HANDOFF_MESSAGE_READY {
+			break
+		}
+	}
+	conn.Close()
+
+	if err := <-handedOff; err == nil {
+		t.Fatal("Expected the handoff to fail")
+	}
+	if old.IsDraining() {
+		t.Fatal("Expected the old process to keep serving")
+	}
+	go net.Dial("tcp", listener.Addr().String())
+	client, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Expected the listener to accept clients again, got %s", err)
+	}
+	client.Close()
+}